@@ -0,0 +1,189 @@
+package chapter3
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Array operators edit an array in place instead of reading the document, changing the slice and writing it back.
+$push appends, optionally inserting at $position, then applying $sort and keeping only $slice elements, so an array can be
+kept bounded ("the 10 latest comments"). $addToSet only adds values that are not present yet, $pop removes from either end,
+$pull removes the elements matching a condition and $pullAll the elements equal to any of the given values.
+Elements are addressed with the positional operators: "$" is the first element matched by the query filter, "$[]" is
+every element and "$[<identifier>]" is every element matching the array filter bound to identifier.
+*/
+
+// AddToSet adds values to the array field, skipping those already present
+func AddToSet(field string, values ...any) bson.D {
+	return bson.D{{Key: "$addToSet", Value: bson.D{{Key: field, Value: bson.D{{Key: "$each", Value: append(bson.A{}, values...)}}}}}}
+}
+
+// PopFirst removes the first element of the array field
+func PopFirst(field string) bson.D {
+	return bson.D{{Key: "$pop", Value: bson.D{{Key: field, Value: -1}}}}
+}
+
+// PopLast removes the last element of the array field
+func PopLast(field string) bson.D {
+	return bson.D{{Key: "$pop", Value: bson.D{{Key: field, Value: 1}}}}
+}
+
+// Pull removes the elements of the array field matching condition.
+// condition is either a value, a query operator document like {"$gte": 6} or, for arrays of documents, a query on their fields.
+func Pull(field string, condition any) bson.D {
+	return bson.D{{Key: "$pull", Value: bson.D{{Key: field, Value: condition}}}}
+}
+
+// PullAll removes every element of the array field equal to one of values
+func PullAll(field string, values ...any) bson.D {
+	return bson.D{{Key: "$pullAll", Value: bson.D{{Key: field, Value: append(bson.A{}, values...)}}}}
+}
+
+// PushOptions are the $push modifiers, they are applied in the order position, sort, slice
+type PushOptions struct {
+	// Position inserts the values at this index instead of appending them, negative values count from the end
+	Position *int
+	// Sort orders the array after the insert: 1 or -1 for arrays of values, a sort document for arrays of documents
+	Sort any
+	// Slice keeps the first Slice elements, or the last -Slice elements when negative
+	Slice *int
+}
+
+// Push adds values to the array field with the given modifiers
+func Push(field string, opts PushOptions, values ...any) bson.D {
+	modifiers := bson.D{{Key: "$each", Value: append(bson.A{}, values...)}}
+	if opts.Position != nil {
+		modifiers = append(modifiers, bson.E{Key: "$position", Value: *opts.Position})
+	}
+	if opts.Sort != nil {
+		modifiers = append(modifiers, bson.E{Key: "$sort", Value: opts.Sort})
+	}
+	if opts.Slice != nil {
+		modifiers = append(modifiers, bson.E{Key: "$slice", Value: *opts.Slice})
+	}
+
+	return bson.D{{Key: "$push", Value: bson.D{{Key: field, Value: modifiers}}}}
+}
+
+// PositionalPath addresses field of the first element of array matched by the query filter: "array.$.field".
+// The filter must contain a condition on array.
+func PositionalPath(array, field string) string {
+	return elementPath(array, "$", field)
+}
+
+// AllElementsPath addresses field of every element of array: "array.$[].field"
+func AllElementsPath(array, field string) string {
+	return elementPath(array, "$[]", field)
+}
+
+// FilteredPath addresses field of every element of array matching the array filter bound to identifier: "array.$[identifier].field"
+func FilteredPath(array, identifier, field string) string {
+	return elementPath(array, "$["+identifier+"]", field)
+}
+
+func elementPath(array, operator, field string) string {
+	parts := []string{array, operator}
+	if field != "" {
+		parts = append(parts, field)
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// UpdateArray applies update to the first document matching filter. arrayFilters bind the identifiers used by
+// FilteredPath, e.g. bson.D{{Key: "c.author", Value: "joe"}} for "comments.$[c].body".
+// It returns ErrNotFound when nothing matched.
+func UpdateArray(ctx context.Context, store DocumentStore, filter, update any, arrayFilters ...any) (*mongo.UpdateResult, error) {
+	o := options.Update()
+	if len(arrayFilters) > 0 {
+		o.SetArrayFilters(options.ArrayFilters{Filters: arrayFilters})
+	}
+	rs, err := store.UpdateOne(ctx, filter, update, o)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if rs.MatchedCount == 0 {
+		return rs, ErrNotFound
+	}
+
+	return rs, nil
+}
+
+// Comment is an element of the "comments" array of a blog post
+type Comment struct {
+	Author string `bson:"author"`
+	Body   string `bson:"body"`
+	Votes  int    `bson:"votes"`
+}
+
+// AddTags adds tags to the post, the "tags" array never holds the same tag twice
+func (d Document) AddTags(ctx context.Context, store DocumentStore, id string, tags ...string) (*mongo.UpdateResult, error) {
+	values := make([]any, len(tags))
+	for i, tag := range tags {
+		values[i] = tag
+	}
+
+	return updateByID(ctx, store, id, AddToSet("tags", values...))
+}
+
+// RemoveTags removes tags from the post
+func (d Document) RemoveTags(ctx context.Context, store DocumentStore, id string, tags ...string) (*mongo.UpdateResult, error) {
+	values := make([]any, len(tags))
+	for i, tag := range tags {
+		values[i] = tag
+	}
+
+	return updateByID(ctx, store, id, PullAll("tags", values...))
+}
+
+// AddComment appends c to the post and keeps only the latest limit comments, the array can't grow without bound.
+// limit must be positive: $slice 0 would empty the array and a positive $slice would keep the oldest comments.
+func (d Document) AddComment(ctx context.Context, store DocumentStore, id string, c Comment, limit int) (*mongo.UpdateResult, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("chapter3: comment limit must be positive, got %d", limit)
+	}
+	slice := -limit
+
+	return updateByID(ctx, store, id, Push("comments", PushOptions{Slice: &slice}, c))
+}
+
+// EditComment replaces the body of the first comment written by author, the positional operator finds it from the filter
+func (d Document) EditComment(ctx context.Context, store DocumentStore, id, author, body string) (*mongo.UpdateResult, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.D{{Key: "_id", Value: objID}, {Key: "comments.author", Value: author}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: PositionalPath("comments", "body"), Value: body}}}}
+
+	return UpdateArray(ctx, store, filter, update)
+}
+
+// VoteComments adds one vote to every comment written by author
+func (d Document) VoteComments(ctx context.Context, store DocumentStore, id, author string) (*mongo.UpdateResult, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: FilteredPath("comments", "c", "votes"), Value: 1}}}}
+
+	return UpdateArray(ctx, store, bson.D{{Key: "_id", Value: objID}}, update, bson.D{{Key: "c.author", Value: author}})
+}
+
+// ResetVotes sets the votes of every comment back to zero
+func (d Document) ResetVotes(ctx context.Context, store DocumentStore, id string) (*mongo.UpdateResult, error) {
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: AllElementsPath("comments", "votes"), Value: 0}}}}
+
+	return updateByID(ctx, store, id, update)
+}
+
+// RemoveComments removes every comment with fewer than minVotes votes
+func (d Document) RemoveComments(ctx context.Context, store DocumentStore, id string, minVotes int) (*mongo.UpdateResult, error) {
+	return updateByID(ctx, store, id, Pull("comments", bson.D{{Key: "votes", Value: bson.D{{Key: "$lt", Value: minVotes}}}}))
+}
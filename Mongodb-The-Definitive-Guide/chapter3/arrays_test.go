@@ -0,0 +1,171 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func arrayField(t *testing.T, store DocumentStore, id primitive.ObjectID, field string) bson.A {
+	t.Helper()
+	docs := findAll(t, store, bson.D{{Key: "_id", Value: id}})
+	if len(docs) != 1 {
+		t.Fatalf("got %d documents, want 1", len(docs))
+	}
+	arr, _ := docs[0][field].(bson.A)
+
+	return arr
+}
+
+func TestArrayOperators(t *testing.T) {
+	ctx := context.Background()
+	lastTwo, three := -2, 3
+	cases := []struct {
+		name   string
+		start  bson.A
+		update bson.D
+		want   bson.A
+	}{
+		{"add to set skips duplicates", bson.A{"a", "b"}, AddToSet("v", "b", "c", "c"), bson.A{"a", "b", "c"}},
+		{"pop first", bson.A{int32(1), int32(2), int32(3)}, PopFirst("v"), bson.A{int32(2), int32(3)}},
+		{"pop last", bson.A{int32(1), int32(2), int32(3)}, PopLast("v"), bson.A{int32(1), int32(2)}},
+		{"pull value", bson.A{"a", "b", "a"}, Pull("v", "a"), bson.A{"b"}},
+		{"pull condition", bson.A{int32(1), int32(5), int32(9)}, Pull("v", bson.D{{Key: "$gte", Value: 5}}), bson.A{int32(1)}},
+		{"pull all", bson.A{"a", "b", "c", "a"}, PullAll("v", "a", "c"), bson.A{"b"}},
+		{"push position", bson.A{"a", "b"}, Push("v", PushOptions{Position: new(int)}, "x", "y"), bson.A{"x", "y", "a", "b"}},
+		{
+			"push sort slice",
+			bson.A{int32(5), int32(1)},
+			Push("v", PushOptions{Sort: -1, Slice: &three}, 3, 9),
+			bson.A{int32(9), int32(5), int32(3)},
+		},
+		{
+			"push keeps the last elements",
+			bson.A{int32(1), int32(2), int32(3)},
+			Push("v", PushOptions{Slice: &lastTwo}, 4),
+			bson.A{int32(3), int32(4)},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := NewMemoryStore()
+			id := seed(t, store, bson.D{{Key: "v", Value: tc.start}})
+			if _, err := UpdateArray(ctx, store, bson.D{{Key: "_id", Value: id}}, tc.update); err != nil {
+				t.Fatal(err)
+			}
+			if got := arrayField(t, store, id, "v"); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPushSortDocuments(t *testing.T) {
+	store := NewMemoryStore()
+	id := seed(t, store, bson.D{{Key: "v", Value: bson.A{bson.D{{Key: "n", Value: 2}}}}})
+	one := 1
+	update := Push("v", PushOptions{Sort: bson.D{{Key: "n", Value: 1}}, Slice: &one}, bson.D{{Key: "n", Value: 1}}, bson.D{{Key: "n", Value: 3}})
+	if _, err := UpdateArray(context.Background(), store, bson.D{{Key: "_id", Value: id}}, update); err != nil {
+		t.Fatal(err)
+	}
+	got := arrayField(t, store, id, "v")
+	if len(got) != 1 || got[0].(bson.M)["n"] != int32(1) {
+		t.Fatalf("got %v, want [{n 1}]", got)
+	}
+}
+
+func TestTagsAndComments(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	var d Document
+	id := seed(t, store, bson.D{{Key: "title", Value: "post"}})
+	hex := id.Hex()
+
+	if _, err := d.AddTags(ctx, store, hex, "go", "mongo", "go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.AddTags(ctx, store, hex, "mongo", "db"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RemoveTags(ctx, store, hex, "db"); err != nil {
+		t.Fatal(err)
+	}
+	// no tags is a no-op, not {$each: null}
+	if _, err := d.AddTags(ctx, store, hex); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RemoveTags(ctx, store, hex); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := arrayField(t, store, id, "tags"), (bson.A{"go", "mongo"}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("tags = %v, want %v", got, want)
+	}
+
+	for _, c := range []Comment{{Author: "joe", Body: "first"}, {Author: "bob", Body: "second"}, {Author: "joe", Body: "third"}} {
+		if _, err := d.AddComment(ctx, store, hex, c, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, limit := range []int{0, -1} {
+		if _, err := d.AddComment(ctx, store, hex, Comment{Author: "bob", Body: "lost"}, limit); err == nil {
+			t.Fatalf("limit %d: expected an error", limit)
+		}
+	}
+	if _, err := d.EditComment(ctx, store, hex, "bob", "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.VoteComments(ctx, store, hex, "joe"); err != nil {
+		t.Fatal(err)
+	}
+
+	var post struct {
+		Comments []Comment `bson:"comments"`
+	}
+	if err := store.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&post); err != nil {
+		t.Fatal(err)
+	}
+	want := []Comment{{Author: "bob", Body: "edited"}, {Author: "joe", Body: "third", Votes: 1}}
+	if !reflect.DeepEqual(post.Comments, want) {
+		t.Fatalf("comments = %+v, want %+v", post.Comments, want)
+	}
+
+	if _, err := d.RemoveComments(ctx, store, hex, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.ResetVotes(ctx, store, hex); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&post); err != nil {
+		t.Fatal(err)
+	}
+	if want := []Comment{{Author: "joe", Body: "third"}}; !reflect.DeepEqual(post.Comments, want) {
+		t.Fatalf("comments = %+v, want %+v", post.Comments, want)
+	}
+
+	if _, err := d.EditComment(ctx, store, hex, "nobody", "x"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestArrayFiltersErrors(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	id := seed(t, store, bson.D{{Key: "v", Value: bson.A{int32(1)}}})
+	filter := bson.D{{Key: "_id", Value: id}}
+
+	missing := bson.D{{Key: "$set", Value: bson.D{{Key: FilteredPath("v", "x", ""), Value: 0}}}}
+	if _, err := UpdateArray(ctx, store, filter, missing); err == nil {
+		t.Fatal("expected an error for an identifier without array filter")
+	}
+	positional := bson.D{{Key: "$set", Value: bson.D{{Key: PositionalPath("v", ""), Value: 0}}}}
+	if _, err := UpdateArray(ctx, store, filter, positional); err == nil {
+		t.Fatal("expected an error for a positional update without a condition on the array")
+	}
+	if _, err := UpdateArray(ctx, store, filter, PopLast("missing")); err != nil {
+		t.Fatalf("$pop on a missing field should be a no-op: %v", err)
+	}
+}
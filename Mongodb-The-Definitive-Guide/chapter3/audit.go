@@ -0,0 +1,472 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Updates change documents in place: after SetOperator or UnSetOperator nothing tells what the document looked like before.
+AuditedStore wraps a DocumentStore and writes one HistoryEntry per changed document to a history collection: the image before
+and after the write, the operator or replacement document, the time and the actor taken from the context. Wrapping is the
+opt-in, every chapter3 function given an AuditedStore is audited without changes. AsOf replays the history to rebuild a
+document as it was at any time.
+The before image is read first, then the write is limited to the documents that were read, then the after image is read.
+Without a transaction a concurrent writer can slip in between, the history is exact only when writers go through the
+same AuditedStore one at a time or inside a transaction.
+*/
+
+// History operations
+const (
+	HistoryInsert  = "insert"
+	HistoryUpdate  = "update"
+	HistoryReplace = "replace"
+	HistoryDelete  = "delete"
+)
+
+// HistoryEntry is the change of one document by one write
+type HistoryEntry struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	DocumentID any                `bson:"documentId"`
+	Operation  string             `bson:"operation"`
+	// Before is nil for inserts and upserts
+	Before bson.D `bson:"before,omitempty"`
+	// After is nil for deletes
+	After bson.D `bson:"after,omitempty"`
+	// Change is the update or replacement document, nil for inserts and deletes
+	Change any       `bson:"change,omitempty"`
+	Actor  string    `bson:"actor,omitempty"`
+	At     time.Time `bson:"at"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a context whose writes are recorded as done by actor
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor set by WithActor, or ""
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// AuditedStore is a DocumentStore recording every change of a document in a history store.
+// Reads go straight to the wrapped store. When the write succeeds but its history can't be written, the error of the history
+// write is returned.
+type AuditedStore struct {
+	DocumentStore
+	history DocumentStore
+	now     func() time.Time
+}
+
+// NewAuditedStore returns a store writing to store and recording the changes in history
+func NewAuditedStore(store, history DocumentStore) *AuditedStore {
+	return &AuditedStore{DocumentStore: store, history: history, now: time.Now}
+}
+
+// History returns the changes of the document with id, oldest first
+func (s *AuditedStore) History(ctx context.Context, id any) ([]HistoryEntry, error) {
+	return NewRepository[HistoryEntry](s.history).List(ctx, bson.D{{Key: "documentId", Value: id}}, ListOptions{
+		Sort: bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}},
+	})
+}
+
+// AsOf returns the document with id as it was at t, ErrNotFound when it did not exist at t
+func (s *AuditedStore) AsOf(ctx context.Context, id any, t time.Time) (bson.D, error) {
+	filter := bson.D{
+		{Key: "documentId", Value: id},
+		{Key: "at", Value: bson.D{{Key: "$lte", Value: primitive.NewDateTimeFromTime(t)}}},
+	}
+	o := options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}, {Key: "_id", Value: -1}})
+	entry, err := decodeResult[HistoryEntry](s.history.FindOne(ctx, filter, o))
+	if err != nil {
+		return nil, err
+	}
+	if entry.After == nil {
+		return nil, ErrNotFound
+	}
+
+	return entry.After, nil
+}
+
+// InsertOne records the inserted document
+func (s *AuditedStore) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	rs, err := s.DocumentStore.InsertOne(ctx, document, opts...)
+	if err != nil {
+		return rs, err
+	}
+
+	return rs, s.recordInserts(ctx, []any{rs.InsertedID})
+}
+
+// InsertMany records the inserted documents. The result holds the id of every document, in the order of documents:
+// those rejected are skipped and, for an ordered insert, those after the first rejected one, which were not tried.
+// Errors recording the history are returned joined with the write error.
+func (s *AuditedStore) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	rs, err := s.DocumentStore.InsertMany(ctx, documents, opts...)
+	if rs == nil {
+		return rs, err
+	}
+	ordered := true
+	if o := options.MergeInsertManyOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+	failed := make(map[int]bool)
+	first := len(rs.InsertedIDs)
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		for _, we := range bwe.WriteErrors {
+			failed[we.Index] = true
+			if we.Index < first {
+				first = we.Index
+			}
+		}
+	}
+	var ids []any
+	for i, id := range rs.InsertedIDs {
+		if failed[i] || (ordered && i > first) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return rs, joinErrors(err, s.recordInserts(ctx, ids))
+}
+
+// UpdateOne records the before and after image of the updated or upserted document
+func (s *AuditedStore) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.auditUpdate(ctx, filter, update, false, HistoryUpdate, func(f any) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.UpdateOne(ctx, f, update, opts...)
+	})
+}
+
+// UpdateMany records the before and after image of every updated or upserted document
+func (s *AuditedStore) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.auditUpdate(ctx, filter, update, true, HistoryUpdate, func(f any) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.UpdateMany(ctx, f, update, opts...)
+	})
+}
+
+// ReplaceOne records the before and after image of the replaced or upserted document
+func (s *AuditedStore) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	return s.auditUpdate(ctx, filter, replacement, false, HistoryReplace, func(f any) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.ReplaceOne(ctx, f, replacement, opts...)
+	})
+}
+
+// DeleteOne records the deleted document
+func (s *AuditedStore) DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return s.auditDelete(ctx, filter, false, func(f any) (*mongo.DeleteResult, error) {
+		return s.DocumentStore.DeleteOne(ctx, f, opts...)
+	})
+}
+
+// DeleteMany records every deleted document
+func (s *AuditedStore) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return s.auditDelete(ctx, filter, true, func(f any) (*mongo.DeleteResult, error) {
+		return s.DocumentStore.DeleteMany(ctx, f, opts...)
+	})
+}
+
+// FindOneAndUpdate records the before and after image of the modified or upserted document
+func (s *AuditedStore) FindOneAndUpdate(ctx context.Context, filter any, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	return s.auditFindAndModify(ctx, filter, update, o.Sort, HistoryUpdate, func(f any) *mongo.SingleResult {
+		return s.DocumentStore.FindOneAndUpdate(ctx, f, update, opts...)
+	})
+}
+
+// FindOneAndReplace records the before and after image of the replaced or upserted document
+func (s *AuditedStore) FindOneAndReplace(ctx context.Context, filter any, replacement any, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndReplaceOptions(opts...)
+	return s.auditFindAndModify(ctx, filter, replacement, o.Sort, HistoryReplace, func(f any) *mongo.SingleResult {
+		return s.DocumentStore.FindOneAndReplace(ctx, f, replacement, opts...)
+	})
+}
+
+// FindOneAndDelete records the deleted document
+func (s *AuditedStore) FindOneAndDelete(ctx context.Context, filter any, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndDeleteOptions(opts...)
+	return s.auditFindAndModify(ctx, filter, nil, o.Sort, HistoryDelete, func(f any) *mongo.SingleResult {
+		return s.DocumentStore.FindOneAndDelete(ctx, f, opts...)
+	})
+}
+
+// BulkWrite runs the models one by one through the audited writes, so it costs one round trip per model or more.
+// Ordered and unordered behave as for a plain bulk write.
+func (s *AuditedStore) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	ordered := true
+	if o := options.MergeBulkWriteOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+	result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]any)}
+	var bwe mongo.BulkWriteException
+	for i, model := range models {
+		err := s.applyModel(ctx, model, int64(i), result)
+		if err == nil {
+			continue
+		}
+		var we mongo.WriteException
+		if !errors.As(err, &we) || len(we.WriteErrors) == 0 {
+			return result, err
+		}
+		writeErr := we.WriteErrors[0]
+		writeErr.Index = i
+		bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: writeErr, Request: model})
+		if ordered {
+			break
+		}
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return result, bwe
+	}
+
+	return result, nil
+}
+
+// Drop records the deletion of every document before dropping the collection
+func (s *AuditedStore) Drop(ctx context.Context) error {
+	befores, err := find(ctx, s.DocumentStore, bson.D{})
+	if err != nil {
+		return err
+	}
+	if err := s.DocumentStore.Drop(ctx); err != nil {
+		return err
+	}
+
+	return s.recordChanges(ctx, HistoryDelete, nil, befores)
+}
+
+func (s *AuditedStore) applyModel(ctx context.Context, model mongo.WriteModel, index int64, result *mongo.BulkWriteResult) error {
+	var (
+		rs  *mongo.UpdateResult
+		err error
+	)
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		if _, err := s.InsertOne(ctx, m.Document); err != nil {
+			return err
+		}
+		result.InsertedCount++
+		return nil
+	case *mongo.DeleteOneModel, *mongo.DeleteManyModel:
+		var drs *mongo.DeleteResult
+		if d, ok := m.(*mongo.DeleteOneModel); ok {
+			drs, err = s.DeleteOne(ctx, d.Filter)
+		} else {
+			drs, err = s.DeleteMany(ctx, m.(*mongo.DeleteManyModel).Filter)
+		}
+		if err != nil {
+			return err
+		}
+		result.DeletedCount += drs.DeletedCount
+		return nil
+	case *mongo.UpdateOneModel:
+		o := options.Update()
+		o.Upsert, o.ArrayFilters = m.Upsert, m.ArrayFilters
+		rs, err = s.UpdateOne(ctx, m.Filter, m.Update, o)
+	case *mongo.UpdateManyModel:
+		o := options.Update()
+		o.Upsert, o.ArrayFilters = m.Upsert, m.ArrayFilters
+		rs, err = s.UpdateMany(ctx, m.Filter, m.Update, o)
+	case *mongo.ReplaceOneModel:
+		o := options.Replace()
+		o.Upsert = m.Upsert
+		rs, err = s.ReplaceOne(ctx, m.Filter, m.Replacement, o)
+	default:
+		return fmt.Errorf("unsupported write model %T", model)
+	}
+	if err != nil {
+		return err
+	}
+	result.MatchedCount += rs.MatchedCount
+	result.ModifiedCount += rs.ModifiedCount
+	if rs.UpsertedID != nil {
+		result.UpsertedCount++
+		result.UpsertedIDs[index] = rs.UpsertedID
+	}
+
+	return nil
+}
+
+// auditUpdate reads the documents write is about to change, runs write limited to them and records the changes
+func (s *AuditedStore) auditUpdate(ctx context.Context, filter, change any, multi bool, op string, write func(filter any) (*mongo.UpdateResult, error)) (*mongo.UpdateResult, error) {
+	befores, err := s.before(ctx, filter, multi, nil)
+	if err != nil {
+		return nil, err
+	}
+	target := filter
+	if len(befores) > 0 {
+		target = limitTo(filter, befores)
+	}
+	rs, err := write(target)
+	if err != nil {
+		return rs, err
+	}
+	if err := s.recordChanges(ctx, op, change, befores); err != nil {
+		return rs, err
+	}
+	if rs.UpsertedID != nil {
+		return rs, s.recordUpsert(ctx, op, change, idFilter(rs.UpsertedID))
+	}
+
+	return rs, nil
+}
+
+func (s *AuditedStore) auditDelete(ctx context.Context, filter any, multi bool, write func(filter any) (*mongo.DeleteResult, error)) (*mongo.DeleteResult, error) {
+	befores, err := s.before(ctx, filter, multi, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(befores) == 0 {
+		return write(filter)
+	}
+	rs, err := write(limitTo(filter, befores))
+	if err != nil {
+		return rs, err
+	}
+
+	return rs, s.recordChanges(ctx, HistoryDelete, nil, befores)
+}
+
+func (s *AuditedStore) auditFindAndModify(ctx context.Context, filter, change, sortSpec any, op string, write func(filter any) *mongo.SingleResult) *mongo.SingleResult {
+	befores, err := s.before(ctx, filter, false, sortSpec)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	if len(befores) == 0 {
+		// nothing matched, the write can only be an upsert
+		result := write(filter)
+		if op != HistoryDelete {
+			if err := s.recordUpsert(ctx, op, change, filter); err != nil && !errors.Is(err, ErrNotFound) {
+				return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+			}
+		}
+		return result
+	}
+	result := write(limitTo(filter, befores))
+	if result.Err() != nil {
+		return result
+	}
+	if err := s.recordChanges(ctx, op, change, befores); err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+
+	return result
+}
+
+// before returns the documents matching filter, only the first one unless multi
+func (s *AuditedStore) before(ctx context.Context, filter any, multi bool, sortSpec any) ([]bson.D, error) {
+	if multi {
+		return find(ctx, s.DocumentStore, filter)
+	}
+	o := options.FindOne()
+	if sortSpec != nil {
+		o.SetSort(sortSpec)
+	}
+	var doc bson.D
+	err := s.DocumentStore.FindOne(ctx, filter, o).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return []bson.D{doc}, nil
+}
+
+// limitTo narrows filter down to the documents of docs
+func limitTo(filter any, docs []bson.D) bson.D {
+	ids := make(bson.A, len(docs))
+	for i, doc := range docs {
+		ids[i] = doc.Map()["_id"]
+	}
+
+	return bson.D{{Key: "$and", Value: bson.A{filter, bson.D{{Key: "_id", Value: bson.D{{Key: "$in", Value: ids}}}}}}}
+}
+
+// recordChanges reads the after image of every document of befores and records the ones that changed
+func (s *AuditedStore) recordChanges(ctx context.Context, op string, change any, befores []bson.D) error {
+	var entries []any
+	for _, before := range befores {
+		id := before.Map()["_id"]
+		var after bson.D
+		if op != HistoryDelete {
+			doc, err := findOne(ctx, s.DocumentStore, idFilter(id))
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			if equalValues(before, doc) {
+				continue
+			}
+			after = doc
+		}
+		entries = append(entries, s.entry(ctx, op, id, before, after, change))
+	}
+
+	return s.write(ctx, entries)
+}
+
+// recordUpsert records the document matching filter as created by op
+func (s *AuditedStore) recordUpsert(ctx context.Context, op string, change any, filter any) error {
+	after, err := findOne(ctx, s.DocumentStore, filter)
+	if err != nil {
+		return err
+	}
+
+	return s.write(ctx, []any{s.entry(ctx, op, after.Map()["_id"], nil, after, change)})
+}
+
+// recordInserts records the documents with ids one by one, a document that can't be read doesn't keep the others
+// from being recorded
+func (s *AuditedStore) recordInserts(ctx context.Context, ids []any) error {
+	var entries []any
+	var errs []error
+	for _, id := range ids {
+		after, err := findOne(ctx, s.DocumentStore, idFilter(id))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chapter3: read inserted document %v: %w", id, err))
+			continue
+		}
+		entries = append(entries, s.entry(ctx, HistoryInsert, id, nil, after, nil))
+	}
+
+	return joinErrors(append(errs, s.write(ctx, entries))...)
+}
+
+func (s *AuditedStore) entry(ctx context.Context, op string, id any, before, after bson.D, change any) HistoryEntry {
+	return HistoryEntry{
+		ID:         primitive.NewObjectID(),
+		DocumentID: id,
+		Operation:  op,
+		Before:     before,
+		After:      after,
+		Change:     change,
+		Actor:      ActorFrom(ctx),
+		At:         s.now(),
+	}
+}
+
+func (s *AuditedStore) write(ctx context.Context, entries []any) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	if _, err := s.history.InsertMany(ctx, entries); err != nil {
+		return fmt.Errorf("chapter3: write history: %w", translateError(err))
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newAuditedStore returns an audited memory store whose clock moves one second per write
+func newAuditedStore() (*AuditedStore, *time.Time) {
+	s := NewAuditedStore(NewMemoryStore(), NewMemoryStore())
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	return s, &now
+}
+
+func TestAuditedStoreHistory(t *testing.T) {
+	ctx := WithActor(context.Background(), "alice")
+	store, _ := newAuditedStore()
+	d := Document{Title: "post", Count: 1}
+
+	one, err := d.InsertOne(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := one.InsertedID.(primitive.ObjectID)
+	if _, err := d.SetOperator(ctx, store, id.Hex(), "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.UnSetOperator(WithActor(ctx, "bob"), store, id.Hex(), "name"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeleteOne(ctx, store, id); err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := store.History(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []string{HistoryInsert, HistoryUpdate, HistoryUpdate, HistoryDelete}
+	if len(history) != len(ops) {
+		t.Fatalf("got %d entries, want %d", len(history), len(ops))
+	}
+	for i, entry := range history {
+		if entry.Operation != ops[i] {
+			t.Errorf("entry %d: operation %s, want %s", i, entry.Operation, ops[i])
+		}
+	}
+	update := history[1]
+	if update.Before.Map()["title"] != "post" || update.After.Map()["title"] != "renamed" || update.Change == nil {
+		t.Errorf("update entry = %+v", update)
+	}
+	if update.Actor != "alice" || history[2].Actor != "bob" {
+		t.Errorf("actors = %q, %q", update.Actor, history[2].Actor)
+	}
+	if history[3].After != nil || history[3].Before.Map()["title"] != "renamed" {
+		t.Errorf("delete entry = %+v", history[3])
+	}
+}
+
+func TestAuditedStoreAsOf(t *testing.T) {
+	ctx := context.Background()
+	store, now := newAuditedStore()
+	start := *now
+
+	id := seed(t, store, bson.D{{Key: "count", Value: 0}})
+	for i := 0; i < 3; i++ {
+		if _, err := (Document{}).UpdateOne(ctx, store, id.Hex()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.DeleteMany(ctx, bson.D{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.AsOf(ctx, id, start); !errors.Is(err, ErrNotFound) {
+		t.Errorf("before the insert: expected ErrNotFound, got %v", err)
+	}
+	for i := 0; i <= 3; i++ {
+		doc, err := store.AsOf(ctx, id, start.Add(time.Duration(i+1)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := doc.Map()["count"]; got != int32(i) {
+			t.Errorf("after %d updates count = %v", i, got)
+		}
+	}
+	if _, err := store.AsOf(ctx, id, *now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("after the delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAuditedStoreOtherWrites(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newAuditedStore()
+	var d Document
+
+	// upserts, find-and-modify, positional updates and bulk writes are audited too
+	if _, err := d.Upsert(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	post := seed(t, store, bson.D{{Key: "title", Value: "post"}})
+	if _, err := d.AddComment(ctx, store, post.Hex(), Comment{Author: "joe", Body: "hi"}, 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.EditComment(ctx, store, post.Hex(), "joe", "edited"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.IncrementCount(ctx, store, post.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	report, err := BulkWrite(ctx, store, []mongo.WriteModel{
+		InsertOp(bson.D{{Key: "_id", Value: post}}),
+		UpdateOp(bson.D{{Key: "_id", Value: post}}, bson.D{{Key: "$set", Value: bson.D{{Key: "bulk", Value: true}}}}),
+	}, false)
+	if !errors.Is(err, ErrDuplicateKey) || len(report.Failed()) != 1 || report.Failed()[0] != 0 {
+		t.Fatalf("report = %+v, err = %v", report, err)
+	}
+
+	history, err := store.History(ctx, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 5 {
+		t.Fatalf("got %d entries, want 5", len(history))
+	}
+	last := history[4].After.Map()
+	if last["bulk"] != true || last["count"] != int32(1) {
+		t.Fatalf("last image = %v", last)
+	}
+	comments := history[3].Before.Map()["comments"].(bson.A)
+	if comments[0].(bson.D).Map()["body"] != "edited" {
+		t.Fatalf("comments = %v", comments)
+	}
+
+	entries := findAll(t, store.history, bson.D{{Key: "after.url", Value: "/blog-1"}})
+	if len(entries) != 1 || entries[0]["before"] != nil {
+		t.Fatalf("upsert entries = %v", entries)
+	}
+}
+
+func TestAuditedStoreInsertManyPartialFailure(t *testing.T) {
+	ctx := context.Background()
+	docs := []any{
+		bson.D{{Key: "_id", Value: 1}},
+		bson.D{{Key: "_id", Value: 1}},
+		bson.D{{Key: "_id", Value: 2}},
+	}
+	for _, tc := range []struct {
+		ordered bool
+		want    map[int32]int
+	}{
+		// ordered stops at the duplicate, _id 2 is never inserted
+		{true, map[int32]int{1: 1, 2: 0}},
+		// unordered inserts _id 2 after the duplicate, it must be recorded too
+		{false, map[int32]int{1: 1, 2: 1}},
+	} {
+		store, _ := newAuditedStore()
+		_, err := store.InsertMany(ctx, docs, options.InsertMany().SetOrdered(tc.ordered))
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || !mongo.IsDuplicateKeyError(err) {
+			t.Fatalf("ordered %v: expected the duplicate key error alone, got %v", tc.ordered, err)
+		}
+		if !errors.Is(translateError(err), ErrDuplicateKey) {
+			t.Fatalf("ordered %v: translated error %v", tc.ordered, translateError(err))
+		}
+		for id, want := range tc.want {
+			history, err := store.History(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(history) != want {
+				t.Errorf("ordered %v: _id %d has %d history entries, want %d", tc.ordered, id, len(history), want)
+			}
+		}
+	}
+}
+
+func TestAuditedStoreInsertManyHistoryError(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newAuditedStore()
+	// recording the inserted document fails, the error is returned with the write error
+	store.history = &failingHistory{DocumentStore: store.history}
+	_, err := store.InsertMany(ctx, []any{bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "_id", Value: 1}}}, options.InsertMany().SetOrdered(false))
+	if !mongo.IsDuplicateKeyError(err) || !errors.Is(err, errHistoryDown) {
+		t.Fatalf("expected the write and the history errors, got %v", err)
+	}
+}
+
+var errHistoryDown = errors.New("history down")
+
+// failingHistory fails every insert
+type failingHistory struct {
+	DocumentStore
+}
+
+func (h *failingHistory) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	return nil, errHistoryDown
+}
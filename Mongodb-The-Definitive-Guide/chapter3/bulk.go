@@ -0,0 +1,172 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+bulkWrite sends a mix of inserts, updates, replaces and deletes in one round trip.
+The same ordered/unordered rules as InsertManyUnOrdered apply: an ordered bulk write stops at the first failing operation,
+an unordered one attempts every operation. The server only reports the operations that failed, BulkWrite turns that into a
+status for every input so a batch job can retry just the failed and skipped items.
+*/
+
+// InsertOp inserts document
+func InsertOp(document any) mongo.WriteModel {
+	return mongo.NewInsertOneModel().SetDocument(document)
+}
+
+// UpdateOp applies update to the first document matching filter
+func UpdateOp(filter, update any) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update)
+}
+
+// UpdateManyOp applies update to every document matching filter
+func UpdateManyOp(filter, update any) mongo.WriteModel {
+	return mongo.NewUpdateManyModel().SetFilter(filter).SetUpdate(update)
+}
+
+// UpsertOp applies update to the first document matching filter, or inserts a new one built from filter and update
+func UpsertOp(filter, update any) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+}
+
+// ReplaceOp replaces the first document matching filter
+func ReplaceOp(filter, replacement any) mongo.WriteModel {
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(replacement)
+}
+
+// DeleteOp deletes the first document matching filter
+func DeleteOp(filter any) mongo.WriteModel {
+	return mongo.NewDeleteOneModel().SetFilter(filter)
+}
+
+// DeleteManyOp deletes every document matching filter
+func DeleteManyOp(filter any) mongo.WriteModel {
+	return mongo.NewDeleteManyModel().SetFilter(filter)
+}
+
+// BulkStatus is the outcome of one operation of a bulk write
+type BulkStatus int
+
+const (
+	// BulkSucceeded the operation was applied
+	BulkSucceeded BulkStatus = iota
+	// BulkFailed the server rejected the operation, see BulkOperationResult.Err
+	BulkFailed
+	// BulkSkipped the operation was not attempted because an earlier operation of an ordered bulk write failed
+	BulkSkipped
+)
+
+func (s BulkStatus) String() string {
+	switch s {
+	case BulkSucceeded:
+		return "succeeded"
+	case BulkFailed:
+		return "failed"
+	case BulkSkipped:
+		return "skipped"
+	}
+
+	return "unknown"
+}
+
+// BulkOperationResult is the status of the operation at Index of the input
+type BulkOperationResult struct {
+	Index  int
+	Status BulkStatus
+	Err    error
+}
+
+// BulkReport is the outcome of BulkWrite
+type BulkReport struct {
+	// Result holds the counters reported by the server
+	Result *mongo.BulkWriteResult
+	// Operations has one entry per input operation, in input order
+	Operations []BulkOperationResult
+	// WriteConcernErr is set when the writes were applied but not acknowledged as requested
+	WriteConcernErr error
+}
+
+func (r *BulkReport) indexes(status BulkStatus) []int {
+	var out []int
+	for _, op := range r.Operations {
+		if op.Status == status {
+			out = append(out, op.Index)
+		}
+	}
+
+	return out
+}
+
+// Failed returns the indexes of the operations the server rejected
+func (r *BulkReport) Failed() []int {
+	return r.indexes(BulkFailed)
+}
+
+// Skipped returns the indexes of the operations that were never attempted
+func (r *BulkReport) Skipped() []int {
+	return r.indexes(BulkSkipped)
+}
+
+// Retry returns the failed and skipped operations of ops, the input of the BulkWrite call that produced r
+func (r *BulkReport) Retry(ops []mongo.WriteModel) []mongo.WriteModel {
+	var out []mongo.WriteModel
+	for _, op := range r.Operations {
+		if op.Status != BulkSucceeded && op.Index < len(ops) {
+			out = append(out, ops[op.Index])
+		}
+	}
+
+	return out
+}
+
+// BulkWrite runs ops ordered or unordered and reports the status of every operation.
+// When some operations failed both the report and an error are returned, the error is a *DuplicateKeyError when
+// duplicate keys caused failures. Errors that prevent the bulk write from running (network, invalid input) return a nil report.
+func BulkWrite(ctx context.Context, store DocumentStore, ops []mongo.WriteModel, ordered bool) (*BulkReport, error) {
+	result, err := store.BulkWrite(ctx, ops, options.BulkWrite().SetOrdered(ordered))
+	if result == nil {
+		result = &mongo.BulkWriteResult{}
+	}
+	report := &BulkReport{Result: result, Operations: make([]BulkOperationResult, len(ops))}
+	for i := range ops {
+		report.Operations[i] = BulkOperationResult{Index: i, Status: BulkSucceeded}
+	}
+	if err == nil {
+		return report, nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) {
+		return nil, translateError(err)
+	}
+	firstFailure := len(ops)
+	for _, we := range bwe.WriteErrors {
+		if we.Index < 0 || we.Index >= len(ops) {
+			continue
+		}
+		var opErr error = we.WriteError
+		if we.Code == duplicateKeyCode {
+			opErr = &DuplicateKeyError{Indexes: []int{we.Index}, Err: we.WriteError}
+		}
+		report.Operations[we.Index] = BulkOperationResult{Index: we.Index, Status: BulkFailed, Err: opErr}
+		if we.Index < firstFailure {
+			firstFailure = we.Index
+		}
+	}
+	if ordered {
+		for i := firstFailure + 1; i < len(ops); i++ {
+			report.Operations[i].Status = BulkSkipped
+		}
+	}
+	if bwe.WriteConcernError != nil {
+		report.WriteConcernErr = bwe.WriteConcernError
+	}
+
+	return report, translateError(err)
+}
@@ -0,0 +1,88 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func bulkOps() []mongo.WriteModel {
+	return []mongo.WriteModel{
+		InsertOp(bson.D{{Key: "_id", Value: 1}, {Key: "title", Value: "a"}}),
+		InsertOp(bson.D{{Key: "_id", Value: 1}, {Key: "title", Value: "duplicate"}}),
+		UpdateOp(bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}),
+		UpsertOp(bson.D{{Key: "_id", Value: 2}}, bson.D{{Key: "$set", Value: bson.D{{Key: "title", Value: "b"}}}}),
+		ReplaceOp(bson.D{{Key: "_id", Value: 2}}, bson.D{{Key: "title", Value: "replaced"}}),
+		DeleteOp(bson.D{{Key: "_id", Value: 1}}),
+	}
+}
+
+func TestBulkWriteOrdered(t *testing.T) {
+	store := NewMemoryStore()
+	report, err := BulkWrite(context.Background(), store, bulkOps(), true)
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("expected a duplicate key error, got %v", err)
+	}
+
+	want := []BulkStatus{BulkSucceeded, BulkFailed, BulkSkipped, BulkSkipped, BulkSkipped, BulkSkipped}
+	for i, op := range report.Operations {
+		if op.Status != want[i] {
+			t.Errorf("operation %d: got %v, want %v", i, op.Status, want[i])
+		}
+	}
+	if !errors.Is(report.Operations[1].Err, ErrDuplicateKey) {
+		t.Errorf("operation 1: unexpected error %v", report.Operations[1].Err)
+	}
+	if retry := report.Retry(bulkOps()); len(retry) != 5 {
+		t.Errorf("got %d operations to retry, want 5", len(retry))
+	}
+	if docs := findAll(t, store, bson.D{}); len(docs) != 1 {
+		t.Errorf("got %d documents, want 1", len(docs))
+	}
+}
+
+func TestBulkWriteUnordered(t *testing.T) {
+	store := NewMemoryStore()
+	report, err := BulkWrite(context.Background(), store, bulkOps(), false)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if failed := report.Failed(); len(failed) != 1 || failed[0] != 1 {
+		t.Errorf("failed = %v, want [1]", failed)
+	}
+	if skipped := report.Skipped(); len(skipped) != 0 {
+		t.Errorf("skipped = %v, want none", skipped)
+	}
+	rs := report.Result
+	if rs.InsertedCount != 1 || rs.MatchedCount != 2 || rs.UpsertedCount != 1 || rs.DeletedCount != 1 {
+		t.Errorf("unexpected counters: %+v", rs)
+	}
+	if rs.UpsertedIDs[3] != int32(2) {
+		t.Errorf("upserted ids = %v", rs.UpsertedIDs)
+	}
+
+	docs := findAll(t, store, bson.D{})
+	if len(docs) != 1 || docs[0]["title"] != "replaced" {
+		t.Errorf("unexpected documents: %v", docs)
+	}
+}
+
+func TestBulkWriteAllSucceeded(t *testing.T) {
+	ops := []mongo.WriteModel{
+		InsertOp(bson.D{{Key: "tag", Value: "x"}}),
+		InsertOp(bson.D{{Key: "tag", Value: "x"}}),
+		UpdateManyOp(bson.D{{Key: "tag", Value: "x"}}, bson.D{{Key: "$set", Value: bson.D{{Key: "seen", Value: true}}}}),
+		DeleteManyOp(bson.D{{Key: "seen", Value: true}}),
+	}
+	report, err := BulkWrite(context.Background(), NewMemoryStore(), ops, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Failed()) != 0 || report.Result.ModifiedCount != 2 || report.Result.DeletedCount != 2 {
+		t.Errorf("unexpected report: %+v", report.Result)
+	}
+}
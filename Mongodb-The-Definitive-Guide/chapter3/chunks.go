@@ -0,0 +1,225 @@
+package chapter3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Payloads over MaxDocumentSize can't be stored in one document. ChunkStore does what GridFS does: the payload is split into
+chunk documents {fileId, n, data, sha256} and described by a manifest document holding its name, length, chunk count and
+checksum. The manifest is written last, so an interrupted upload never shows up as a file. Reading streams the chunks back
+in order through an io.Reader and verifies every chunk checksum and the checksum of the whole payload.
+*/
+
+// DefaultChunkSize is the chunk size of ChunkStore when none is given, the GridFS default of 255kB
+const DefaultChunkSize = 255 * 1024
+
+// ErrChecksumMismatch is returned by ChunkReader.Read when the stored data does not match its checksum
+var ErrChecksumMismatch = errors.New("chapter3: checksum mismatch")
+
+// ChunkManifest describes a payload stored by ChunkStore
+type ChunkManifest struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Name       string             `bson:"name"`
+	Length     int64              `bson:"length"`
+	ChunkSize  int                `bson:"chunkSize"`
+	Chunks     int                `bson:"chunks"`
+	SHA256     string             `bson:"sha256"`
+	UploadedAt time.Time          `bson:"uploadedAt"`
+}
+
+type chunk struct {
+	ID     primitive.ObjectID `bson:"_id"`
+	FileID primitive.ObjectID `bson:"fileId"`
+	N      int                `bson:"n"`
+	Data   []byte             `bson:"data"`
+	SHA256 string             `bson:"sha256"`
+}
+
+// ChunkStore stores large payloads as chunks, files holds the manifests and chunks the chunk documents.
+// On MongoDB create a unique index on {fileId: 1, n: 1} of chunks.
+type ChunkStore struct {
+	files     DocumentStore
+	chunks    DocumentStore
+	chunkSize int
+	now       func() time.Time
+}
+
+// NewChunkStore returns a ChunkStore splitting payloads into chunks of chunkSize bytes, DefaultChunkSize when <= 0
+func NewChunkStore(files, chunks DocumentStore, chunkSize int) *ChunkStore {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	return &ChunkStore{files: files, chunks: chunks, chunkSize: chunkSize, now: time.Now}
+}
+
+// Upload stores the content of r under name and returns its manifest.
+// When it fails the chunks already written are removed.
+func (c *ChunkStore) Upload(ctx context.Context, name string, r io.Reader) (ChunkManifest, error) {
+	m := ChunkManifest{ID: primitive.NewObjectID(), Name: name, ChunkSize: c.chunkSize}
+	total := sha256.New()
+	buf := make([]byte, c.chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			total.Write(data)
+			if werr := c.writeChunk(ctx, m.ID, m.Chunks, data); werr != nil {
+				return ChunkManifest{}, c.abort(ctx, m.ID, werr)
+			}
+			m.Chunks++
+			m.Length += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ChunkManifest{}, c.abort(ctx, m.ID, err)
+		}
+	}
+	m.SHA256 = hex.EncodeToString(total.Sum(nil))
+	m.UploadedAt = c.now()
+	if _, err := c.files.InsertOne(ctx, m); err != nil {
+		return ChunkManifest{}, c.abort(ctx, m.ID, translateError(err))
+	}
+
+	return m, nil
+}
+
+func (c *ChunkStore) writeChunk(ctx context.Context, fileID primitive.ObjectID, n int, data []byte) error {
+	sum := sha256.Sum256(data)
+	_, err := c.chunks.InsertOne(ctx, chunk{
+		ID:     primitive.NewObjectID(),
+		FileID: fileID,
+		N:      n,
+		Data:   data,
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+
+	return translateError(err)
+}
+
+// abort removes the chunks of an upload that failed with err
+func (c *ChunkStore) abort(ctx context.Context, fileID primitive.ObjectID, err error) error {
+	if _, derr := c.chunks.DeleteMany(ctx, bson.D{{Key: "fileId", Value: fileID}}); derr != nil {
+		return fmt.Errorf("%w (removing the chunks also failed: %v)", err, derr)
+	}
+
+	return err
+}
+
+// Manifest returns the manifest of the payload with id, ErrNotFound when there is none
+func (c *ChunkStore) Manifest(ctx context.Context, id primitive.ObjectID) (ChunkManifest, error) {
+	return decodeResult[ChunkManifest](c.files.FindOne(ctx, idFilter(id)))
+}
+
+// Open returns a reader streaming the payload with id. The chunks are fetched as the reader advances.
+// ctx bounds the whole read, the reader must be closed.
+func (c *ChunkStore) Open(ctx context.Context, id primitive.ObjectID) (*ChunkReader, error) {
+	m, err := c.Manifest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := c.chunks.Find(ctx, bson.D{{Key: "fileId", Value: id}}, options.Find().SetSort(bson.D{{Key: "n", Value: 1}}))
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return &ChunkReader{ctx: ctx, manifest: m, cur: cur, total: sha256.New()}, nil
+}
+
+// Delete removes the payload with id, manifest first so a partially deleted payload can't be opened
+func (c *ChunkStore) Delete(ctx context.Context, id primitive.ObjectID) error {
+	rs, err := c.files.DeleteOne(ctx, idFilter(id))
+	if err != nil {
+		return translateError(err)
+	}
+	if rs.DeletedCount == 0 {
+		return ErrNotFound
+	}
+	_, err = c.chunks.DeleteMany(ctx, bson.D{{Key: "fileId", Value: id}})
+
+	return translateError(err)
+}
+
+// ChunkReader streams a payload stored by ChunkStore
+type ChunkReader struct {
+	ctx      context.Context
+	manifest ChunkManifest
+	cur      *mongo.Cursor
+	buf      bytes.Reader
+	next     int
+	read     int64
+	total    hash.Hash
+	err      error
+}
+
+// Manifest returns the manifest of the payload being read
+func (r *ChunkReader) Manifest() ChunkManifest {
+	return r.manifest
+}
+
+// Read implements io.Reader. It returns an error wrapping ErrChecksumMismatch when a chunk or the whole payload does not
+// match its checksum, the data of a corrupt chunk is never returned.
+func (r *ChunkReader) Read(p []byte) (int, error) {
+	for r.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		r.err = r.fetch()
+	}
+
+	return r.buf.Read(p)
+}
+
+// fetch loads the next chunk into buf, it returns io.EOF once the payload was read and verified
+func (r *ChunkReader) fetch() error {
+	if r.next == r.manifest.Chunks {
+		if r.cur.Next(r.ctx) {
+			return fmt.Errorf("%w: more than %d chunks", ErrChecksumMismatch, r.manifest.Chunks)
+		}
+		if r.read != r.manifest.Length || hex.EncodeToString(r.total.Sum(nil)) != r.manifest.SHA256 {
+			return fmt.Errorf("%w: payload %s", ErrChecksumMismatch, r.manifest.ID.Hex())
+		}
+		return io.EOF
+	}
+	if !r.cur.Next(r.ctx) {
+		if err := r.cur.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: chunk %d is missing", ErrChecksumMismatch, r.next)
+	}
+	var ch chunk
+	if err := r.cur.Decode(&ch); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(ch.Data)
+	if ch.N != r.next || hex.EncodeToString(sum[:]) != ch.SHA256 {
+		return fmt.Errorf("%w: chunk %d", ErrChecksumMismatch, r.next)
+	}
+	r.next++
+	r.read += int64(len(ch.Data))
+	r.total.Write(ch.Data)
+	r.buf.Reset(ch.Data)
+
+	return nil
+}
+
+// Close releases the cursor
+func (r *ChunkReader) Close() error {
+	return r.cur.Close(r.ctx)
+}
@@ -0,0 +1,155 @@
+package chapter3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCheckDocumentSize(t *testing.T) {
+	ctx := context.Background()
+	small := bson.D{{Key: "title", Value: "post"}}
+	if _, err := CheckDocumentSize(small, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	big := Document{Title: strings.Repeat("x", MaxDocumentSize)}
+	_, err := big.InsertOne(ctx, NewMemoryStore())
+	var tooLarge *DocumentTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrDocumentTooLarge) || tooLarge.Size <= MaxDocumentSize {
+		t.Fatalf("expected a DocumentTooLargeError, got %v", err)
+	}
+
+	store := SizeGuardStore{DocumentStore: NewMemoryStore(), Limit: 64}
+	if _, err := store.InsertOne(ctx, small); err != nil {
+		t.Fatal(err)
+	}
+	large := bson.D{{Key: "body", Value: strings.Repeat("x", 64)}}
+	if _, err := store.InsertMany(ctx, []any{small, large}); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Fatalf("InsertMany: expected ErrDocumentTooLarge, got %v", err)
+	}
+	if _, err := store.ReplaceOne(ctx, bson.D{}, large); !errors.Is(err, ErrDocumentTooLarge) {
+		t.Fatalf("ReplaceOne: expected ErrDocumentTooLarge, got %v", err)
+	}
+	if n := len(findAll(t, store, bson.D{})); n != 1 {
+		t.Fatalf("%d documents stored, want 1", n)
+	}
+}
+
+func TestChunkStoreRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	chunks := NewMemoryStore()
+	fs := NewChunkStore(NewMemoryStore(), chunks, 1000)
+
+	payload := make([]byte, 4500)
+	rand.New(rand.NewSource(1)).Read(payload)
+	m, err := fs.Upload(ctx, "payload.bin", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Chunks != 5 || m.Length != 4500 || m.SHA256 == "" {
+		t.Fatalf("manifest = %+v", m)
+	}
+
+	r, err := fs.Open(ctx, m.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload changed")
+	}
+
+	empty, err := fs.Upload(ctx, "empty.txt", strings.NewReader(""))
+	if err != nil || empty.Chunks != 0 {
+		t.Fatalf("manifest = %+v, err = %v", empty, err)
+	}
+	r, _ = fs.Open(ctx, empty.ID)
+	if got, err := io.ReadAll(r); err != nil || len(got) != 0 {
+		t.Fatalf("got %q, %v", got, err)
+	}
+
+	if err := fs.Delete(ctx, m.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Open(ctx, m.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if n := len(findAll(t, chunks, bson.D{{Key: "fileId", Value: m.ID}})); n != 0 {
+		t.Fatalf("%d chunks left", n)
+	}
+}
+
+func TestChunkStoreDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	chunks := NewMemoryStore()
+	fs := NewChunkStore(NewMemoryStore(), chunks, 4)
+	upload := func() primitive.ObjectID {
+		m, err := fs.Upload(ctx, "text", strings.NewReader("hello chunked world"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m.ID
+	}
+	read := func(id primitive.ObjectID) error {
+		r, err := fs.Open(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		_, err = io.ReadAll(r)
+		return err
+	}
+
+	flipped := upload()
+	chunks.UpdateOne(ctx, bson.D{{Key: "fileId", Value: flipped}, {Key: "n", Value: 2}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "data", Value: []byte("XXXX")}}}})
+	if err := read(flipped); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("corrupt chunk: expected ErrChecksumMismatch, got %v", err)
+	}
+
+	missing := upload()
+	chunks.DeleteOne(ctx, bson.D{{Key: "fileId", Value: missing}, {Key: "n", Value: 1}})
+	if err := read(missing); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("missing chunk: expected ErrChecksumMismatch, got %v", err)
+	}
+}
+
+// failingReader returns err after n bytes
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, r.err
+	}
+	k := minInt(len(p), r.n)
+	r.n -= k
+	return k, nil
+}
+
+func TestChunkStoreUploadFailure(t *testing.T) {
+	ctx := context.Background()
+	files, chunks := NewMemoryStore(), NewMemoryStore()
+	fs := NewChunkStore(files, chunks, 4)
+	errBroken := errors.New("broken pipe")
+	if _, err := fs.Upload(ctx, "x", &failingReader{n: 10, err: errBroken}); !errors.Is(err, errBroken) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if len(findAll(t, chunks, bson.D{})) != 0 || len(findAll(t, files, bson.D{})) != 0 {
+		t.Fatal("a failed upload must not leave chunks or a manifest")
+	}
+}
@@ -0,0 +1,196 @@
+package chapter3
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrNotFound is returned when no document matches the filter of an operation that targets one document
+	ErrNotFound = errors.New("chapter3: document not found")
+	// ErrDuplicateKey matches every *DuplicateKeyError with errors.Is
+	ErrDuplicateKey = errors.New("chapter3: duplicate key")
+	// ErrInvalidID is returned when an id is not a valid ObjectID hex string
+	ErrInvalidID = errors.New("chapter3: invalid id")
+	// ErrConflict matches every *ConflictError with errors.Is
+	ErrConflict = errors.New("chapter3: version conflict")
+	// ErrDocumentTooLarge matches every *DocumentTooLargeError with errors.Is
+	ErrDocumentTooLarge = errors.New("chapter3: document too large")
+	// ErrInvalidDocument matches every *SchemaError with errors.Is, and the server rejecting a document with its validator
+	ErrInvalidDocument = errors.New("chapter3: document failed validation")
+)
+
+// DuplicateKeyError reports a write rejected by a unique index.
+// Indexes holds the positions of the offending documents for InsertMany, it is nil for single document writes.
+type DuplicateKeyError struct {
+	Indexes []int
+	Err     error
+}
+
+func (e *DuplicateKeyError) Error() string {
+	if len(e.Indexes) == 0 {
+		return fmt.Sprintf("%v: %v", ErrDuplicateKey, e.Err)
+	}
+	return fmt.Sprintf("%v at indexes %v: %v", ErrDuplicateKey, e.Indexes, e.Err)
+}
+
+// Unwrap returns the driver error
+func (e *DuplicateKeyError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrDuplicateKey) true
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// ConflictError reports a write guarded by a version that lost against a concurrent write.
+// Expected is the version the caller read, Actual the version currently stored.
+type ConflictError struct {
+	Expected int64
+	Actual   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: expected version %d, found %d", ErrConflict, e.Expected, e.Actual)
+}
+
+// Is makes errors.Is(err, ErrConflict) true
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// DocumentTooLargeError reports a document whose BSON encoding is over the size limit
+type DocumentTooLargeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *DocumentTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %d bytes, the limit is %d bytes", ErrDocumentTooLarge, e.Size, e.Limit)
+}
+
+// Is makes errors.Is(err, ErrDocumentTooLarge) true
+func (e *DocumentTooLargeError) Is(target error) bool {
+	return target == ErrDocumentTooLarge
+}
+
+// SchemaError reports the first value of a document that does not satisfy a Schema.
+// Path is the dotted path of the value, empty for the document itself.
+type SchemaError struct {
+	Path   string
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%v: %s", ErrInvalidDocument, e.Reason)
+	}
+	return fmt.Sprintf("%v: %s: %s", ErrInvalidDocument, e.Path, e.Reason)
+}
+
+// Is makes errors.Is(err, ErrInvalidDocument) true
+func (e *SchemaError) Is(target error) bool {
+	return target == ErrInvalidDocument
+}
+
+// joinedError holds several errors, errors.Is and errors.As look into each of them
+type joinedError []error
+
+// joinErrors returns the errors that are not nil joined, nil when all of them are
+func joinErrors(errs ...error) error {
+	var out joinedError
+	for _, err := range errs {
+		if err != nil {
+			out = append(out, err)
+		}
+	}
+	switch len(out) {
+	case 0:
+		return nil
+	case 1:
+		return out[0]
+	}
+
+	return out
+}
+
+func (e joinedError) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+
+	return strings.Join(s, "; ")
+}
+
+// Unwrap returns the first error, so the driver helpers like mongo.IsDuplicateKeyError, which only follow Unwrap,
+// look at the write error a history error was joined with
+func (e joinedError) Unwrap() error { return e[0] }
+
+// Is reports whether one of the errors is target
+func (e joinedError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As finds the first of the errors matching target
+func (e joinedError) As(target any) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseID converts a hex string into an ObjectID
+func parseID(id string) (primitive.ObjectID, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("%w %q: %v", ErrInvalidID, id, err)
+	}
+
+	return objID, nil
+}
+
+// translateError maps driver errors onto the chapter3 error taxonomy, other errors are returned unchanged
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) {
+		var indexes []int
+		for _, we := range bwe.WriteErrors {
+			if we.Code == duplicateKeyCode {
+				indexes = append(indexes, we.Index)
+			}
+		}
+		if len(indexes) > 0 {
+			return &DuplicateKeyError{Indexes: indexes, Err: err}
+		}
+	} else if mongo.IsDuplicateKeyError(err) {
+		return &DuplicateKeyError{Err: err}
+	}
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(documentValidationFailureCode) {
+		return fmt.Errorf("%w: %v", ErrInvalidDocument, err)
+	}
+
+	return err
+}
@@ -0,0 +1,99 @@
+package chapter3
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+UpdateOne only reports how many documents matched and changed. findAndModify (FindOneAndUpdate, FindOneAndReplace and
+FindOneAndDelete in the driver) modifies one document and returns it in the same atomic operation, so there is no window
+between the write and a follow-up find where another client could change the document.
+This is what counters and job queues need: increment-and-get, or claim the oldest pending job.
+*/
+
+// ReturnDocument selects which version of the document a find-and-modify returns
+type ReturnDocument int
+
+const (
+	// Before returns the document as it was before the modification, this is the server default
+	Before ReturnDocument = iota
+	// After returns the modified document (or the inserted one for an upsert)
+	After
+)
+
+// FindAndModifyOptions configures FindOneAndUpdate, FindOneAndReplace and FindOneAndDelete.
+// Return and Upsert are ignored by FindOneAndDelete.
+type FindAndModifyOptions struct {
+	Return ReturnDocument
+	// Projection limits the fields of the returned document
+	Projection any
+	// Sort picks which document is modified when several match
+	Sort any
+	// Upsert inserts a document when nothing matches. With Return: Before the result is then ErrNotFound.
+	Upsert bool
+}
+
+func (o FindAndModifyOptions) returnDocument() options.ReturnDocument {
+	if o.Return == After {
+		return options.After
+	}
+
+	return options.Before
+}
+
+// FindOneAndUpdate applies update to one document matching filter and decodes the chosen version into a T.
+// It returns ErrNotFound when nothing matched (and nothing was upserted).
+func FindOneAndUpdate[T any](ctx context.Context, store DocumentStore, filter, update any, opts FindAndModifyOptions) (T, error) {
+	o := options.FindOneAndUpdate().
+		SetReturnDocument(opts.returnDocument()).
+		SetUpsert(opts.Upsert)
+	if opts.Projection != nil {
+		o.SetProjection(opts.Projection)
+	}
+	if opts.Sort != nil {
+		o.SetSort(opts.Sort)
+	}
+
+	return decodeResult[T](store.FindOneAndUpdate(ctx, filter, update, o))
+}
+
+// FindOneAndReplace replaces one document matching filter and decodes the chosen version into a T
+func FindOneAndReplace[T any](ctx context.Context, store DocumentStore, filter, replacement any, opts FindAndModifyOptions) (T, error) {
+	o := options.FindOneAndReplace().
+		SetReturnDocument(opts.returnDocument()).
+		SetUpsert(opts.Upsert)
+	if opts.Projection != nil {
+		o.SetProjection(opts.Projection)
+	}
+	if opts.Sort != nil {
+		o.SetSort(opts.Sort)
+	}
+
+	return decodeResult[T](store.FindOneAndReplace(ctx, filter, replacement, o))
+}
+
+// FindOneAndDelete deletes one document matching filter and decodes it into a T
+func FindOneAndDelete[T any](ctx context.Context, store DocumentStore, filter any, opts FindAndModifyOptions) (T, error) {
+	o := options.FindOneAndDelete()
+	if opts.Projection != nil {
+		o.SetProjection(opts.Projection)
+	}
+	if opts.Sort != nil {
+		o.SetSort(opts.Sort)
+	}
+
+	return decodeResult[T](store.FindOneAndDelete(ctx, filter, o))
+}
+
+func decodeResult[T any](result *mongo.SingleResult) (T, error) {
+	var v T
+	if err := result.Decode(&v); err != nil {
+		var zero T
+		return zero, translateError(err)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,127 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type job struct {
+	ID       int    `bson:"_id"`
+	State    string `bson:"state"`
+	Priority int    `bson:"priority"`
+	Owner    string `bson:"owner,omitempty"`
+}
+
+func seedJobs(t *testing.T) *MemoryStore {
+	t.Helper()
+	store := NewMemoryStore()
+	_, err := store.InsertMany(context.Background(), []any{
+		job{ID: 1, State: "pending", Priority: 1},
+		job{ID: 2, State: "pending", Priority: 5},
+		job{ID: 3, State: "done", Priority: 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+func TestFindOneAndUpdateClaimsJob(t *testing.T) {
+	ctx := context.Background()
+	store := seedJobs(t)
+	filter := bson.D{{Key: "state", Value: "pending"}}
+	claim := bson.D{{Key: "$set", Value: bson.D{{Key: "state", Value: "running"}, {Key: "owner", Value: "worker-1"}}}}
+	opts := FindAndModifyOptions{Return: After, Sort: bson.D{{Key: "priority", Value: -1}}}
+
+	got, err := FindOneAndUpdate[job](ctx, store, filter, claim, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 2 || got.State != "running" || got.Owner != "worker-1" {
+		t.Fatalf("claimed %+v, want job 2 after the update", got)
+	}
+
+	opts.Return = Before
+	got, err = FindOneAndUpdate[job](ctx, store, filter, claim, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 1 || got.State != "pending" {
+		t.Fatalf("claimed %+v, want job 1 before the update", got)
+	}
+
+	if _, err := FindOneAndUpdate[job](ctx, store, filter, claim, opts); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound once every job is claimed, got %v", err)
+	}
+}
+
+func TestFindOneAndUpdateUpsertCounter(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	filter := bson.D{{Key: "_id", Value: "orders"}}
+	inc := bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: 1}}}}
+
+	_, err := FindOneAndUpdate[bson.M](ctx, store, filter, inc, FindAndModifyOptions{Upsert: true})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("an upsert returning the document before should be ErrNotFound, got %v", err)
+	}
+	counter, err := FindOneAndUpdate[bson.M](ctx, store, filter, inc, FindAndModifyOptions{
+		Return:     After,
+		Upsert:     true,
+		Projection: bson.D{{Key: "seq", Value: 1}, {Key: "_id", Value: 0}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counter) != 1 || counter["seq"] != int32(2) {
+		t.Fatalf("counter = %v, want {seq: 2}", counter)
+	}
+}
+
+func TestFindOneAndReplaceAndDelete(t *testing.T) {
+	ctx := context.Background()
+	store := seedJobs(t)
+
+	before, err := FindOneAndReplace[job](ctx, store, bson.D{{Key: "_id", Value: 3}}, bson.D{{Key: "state", Value: "archived"}}, FindAndModifyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.State != "done" {
+		t.Fatalf("got %+v, want the document before the replacement", before)
+	}
+	after, err := FindOneAndReplace[job](ctx, store, bson.D{{Key: "_id", Value: 4}}, job{ID: 4, State: "new"}, FindAndModifyOptions{Return: After, Upsert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.ID != 4 || after.State != "new" {
+		t.Fatalf("got %+v, want the upserted document", after)
+	}
+
+	deleted, err := FindOneAndDelete[job](ctx, store, bson.D{}, FindAndModifyOptions{Sort: bson.D{{Key: "priority", Value: 1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != 3 {
+		t.Fatalf("deleted %+v, want the archived job without priority", deleted)
+	}
+	if _, err := FindOneAndDelete[job](ctx, store, bson.D{{Key: "_id", Value: 3}}, FindAndModifyOptions{}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestIncrementCount(t *testing.T) {
+	store := NewMemoryStore()
+	id := seed(t, store, bson.D{{Key: "count", Value: 1}})
+
+	doc, err := Document{}.IncrementCount(context.Background(), store, id.Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Map()["count"] != int32(2) {
+		t.Fatalf("got %v, want count 2", doc)
+	}
+}
@@ -1,24 +0,0 @@
-package chapter3
-
-import (
-	"context"
-	"log"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
-)
-
-func mongoDBConnection(ctx context.Context) *mongo.Collection {
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		log.Fatal("connect mongodb error:", err)
-	}
-	err = client.Ping(ctx, readpref.Primary())
-	if err != nil {
-		log.Fatal("ping mongodb error:", err)
-	}
-
-	return client.Database("testing").Collection("numbers")
-
-}
@@ -0,0 +1,300 @@
+package chapter3
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Without an _id the driver generates an ObjectID: 12 bytes, roughly sorted by creation time, unique without coordination.
+Other ids fit other needs:
+	UUIDv4    random, reveals nothing, not sortable
+	UUIDv7    a millisecond timestamp then random bits, sortable, stored as BSON binary subtype 4 like any UUID
+	ULID      the same layout as UUIDv7 written as 26 characters of Crockford base32, sortable as strings
+	Sequence  1, 2, 3... from a counters collection, short and human friendly
+The time based generators are monotonic: ids generated in the same millisecond by one generator still increase.
+A Repository picks its generator with IDs.
+*/
+
+// IDGenerator generates document ids
+type IDGenerator interface {
+	NewID(ctx context.Context) (any, error)
+}
+
+// ObjectIDGenerator generates ObjectIDs, the ids the driver generates
+type ObjectIDGenerator struct{}
+
+// NewID ...
+func (ObjectIDGenerator) NewID(context.Context) (any, error) {
+	return primitive.NewObjectID(), nil
+}
+
+// UUID is a RFC 4122 UUID, stored as BSON binary subtype 4
+type UUID [16]byte
+
+// String returns the canonical xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx form
+func (u UUID) String() string {
+	h := hex.EncodeToString(u[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// Version returns the version number of u, 4 or 7 for the generated ones
+func (u UUID) Version() int {
+	return int(u[6] >> 4)
+}
+
+// MarshalBSONValue implements bson.ValueMarshaler
+func (u UUID) MarshalBSONValue() (bsontype.Type, []byte, error) {
+	return bson.MarshalValue(primitive.Binary{Subtype: bsontype.BinaryUUID, Data: u[:]})
+}
+
+// UnmarshalBSONValue implements bson.ValueUnmarshaler
+func (u *UUID) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	var b primitive.Binary
+	if err := (bson.RawValue{Type: t, Value: data}).Unmarshal(&b); err != nil {
+		return err
+	}
+	if b.Subtype != bsontype.BinaryUUID || len(b.Data) != len(u) {
+		return fmt.Errorf("chapter3: not a UUID: subtype %d, %d bytes", b.Subtype, len(b.Data))
+	}
+	copy(u[:], b.Data)
+
+	return nil
+}
+
+// UUIDv4Generator generates random UUIDs
+type UUIDv4Generator struct{}
+
+// NewID returns a UUID
+func (UUIDv4Generator) NewID(context.Context) (any, error) {
+	var u UUID
+	if _, err := rand.Read(u[:]); err != nil {
+		return nil, err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+
+	return u, nil
+}
+
+// timeOrdered holds the state shared by UUIDv7Generator and ULIDGenerator: the 48 bits timestamp in milliseconds and the
+// 80 bits after it of the last id. Within a millisecond the 80 bits are incremented instead of drawn again.
+type timeOrdered struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	ms   int64
+	last [16]byte
+}
+
+func (g *timeOrdered) next() ([16]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now
+	if g.now != nil {
+		now = g.now
+	}
+	ms := now().UnixMilli()
+	var id [16]byte
+	if ms > g.ms {
+		g.ms = ms
+		if _, err := rand.Read(id[6:]); err != nil {
+			return id, err
+		}
+		// keep the top bit clear so increments have room before overflowing
+		id[6] &= 0x7f
+	} else {
+		id = g.last
+		if increment(id[6:]) {
+			// the 80 bits overflowed, borrow the next millisecond
+			g.ms++
+		}
+	}
+	binary.BigEndian.PutUint16(id[0:2], uint16(g.ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(g.ms))
+	g.last = id
+
+	return id, nil
+}
+
+// increment adds 1 to the big endian number b and reports whether it overflowed
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// UUIDv7Generator generates time ordered UUIDs, the zero value is ready to use
+type UUIDv7Generator struct {
+	timeOrdered
+}
+
+// NewID returns a UUID
+func (g *UUIDv7Generator) NewID(context.Context) (any, error) {
+	id, err := g.next()
+	if err != nil {
+		return nil, err
+	}
+	// the version and variant bits replace 6 of the 80 bits, increments only carry into them after about 2^61 ids in
+	// the same millisecond so the ids stay ordered
+	u := UUID(id)
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+
+	return u, nil
+}
+
+// ULIDGenerator generates ULIDs, the zero value is ready to use
+type ULIDGenerator struct {
+	timeOrdered
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewID returns a ULID string
+func (g *ULIDGenerator) NewID(context.Context) (any, error) {
+	id, err := g.next()
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeULID(id), nil
+}
+
+// encodeULID writes the 128 bits of id as 26 base32 characters, the first one holding 3 bits
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	for i := range out {
+		c := 0
+		for k := 0; k < 5; k++ {
+			pos := i*5 + k - 2
+			c <<= 1
+			if pos >= 0 {
+				c |= int(id[pos/8]>>(7-pos%8)) & 1
+			}
+		}
+		out[i] = crockford[c]
+	}
+
+	return string(out)
+}
+
+// Sequence generates 1, 2, 3... from a counter document {_id: name, seq: last} of counters. Every findAndModify
+// reserves a block of ids, the following ones are served from memory. Several Sequences with the same name, in one
+// process or many, never return the same id but ids are not in insertion order across Sequences, and the unused part
+// of a block is lost when the process stops.
+type Sequence struct {
+	counters DocumentStore
+	name     string
+	block    int64
+
+	mu   sync.Mutex
+	next int64
+	last int64
+}
+
+// NewSequence returns the sequence name of counters reserving block ids at a time, 1 when block <= 0
+func NewSequence(counters DocumentStore, name string, block int64) *Sequence {
+	if block <= 0 {
+		block = 1
+	}
+
+	return &Sequence{counters: counters, name: name, block: block}
+}
+
+// Next returns the next id
+func (s *Sequence) Next(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.next == 0 || s.next > s.last {
+		last, err := s.reserve(ctx)
+		if err != nil {
+			return 0, err
+		}
+		s.next, s.last = last-s.block+1, last
+	}
+	id := s.next
+	s.next++
+
+	return id, nil
+}
+
+// NewID returns Next as an int64
+func (s *Sequence) NewID(ctx context.Context) (any, error) {
+	return s.Next(ctx)
+}
+
+// reserve increments the counter by block and returns the last id of the reserved block
+func (s *Sequence) reserve(ctx context.Context) (int64, error) {
+	type counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	inc := bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: s.block}}}}
+	opts := FindAndModifyOptions{Return: After, Upsert: true}
+	c, err := FindOneAndUpdate[counter](ctx, s.counters, idFilter(s.name), inc, opts)
+	if errors.Is(err, ErrDuplicateKey) {
+		// two upserts created the counter at the same time, the document exists now
+		c, err = FindOneAndUpdate[counter](ctx, s.counters, idFilter(s.name), inc, opts)
+	}
+
+	return c.Seq, err
+}
+
+// assignID returns v as a document with an _id from ids when v has none
+func assignID(ctx context.Context, v any, ids IDGenerator) (bson.D, error) {
+	doc, err := toDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range doc {
+		if e.Key != "_id" {
+			continue
+		}
+		if !zeroID(e.Value) {
+			return doc, nil
+		}
+		doc = append(doc[:i], doc[i+1:]...)
+		break
+	}
+	id, err := ids.NewID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(bson.D{{Key: "_id", Value: id}}, doc...), nil
+}
+
+func zeroID(id any) bool {
+	switch v := id.(type) {
+	case nil:
+		return true
+	case primitive.ObjectID:
+		return v.IsZero()
+	case string:
+		return v == ""
+	case int32:
+		return v == 0
+	case int64:
+		return v == 0
+	case primitive.Binary:
+		return len(v.Data) == 0
+	}
+
+	return false
+}
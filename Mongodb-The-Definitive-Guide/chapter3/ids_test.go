@@ -0,0 +1,156 @@
+package chapter3
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestUUIDs(t *testing.T) {
+	ctx := context.Background()
+	v4, err := UUIDv4Generator{}.NewID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := v4.(UUID)
+	if u.Version() != 4 || u[8]>>6 != 2 {
+		t.Fatalf("%s is not a version 4 UUID", u)
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(u.String()) {
+		t.Fatalf("String() = %s", u)
+	}
+
+	// UUIDs round trip as binary subtype 4
+	data, err := bson.Marshal(bson.D{{Key: "_id", Value: u}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _, _ := bson.Raw(data).Lookup("_id").BinaryOK(); st != 4 {
+		t.Fatalf("subtype %d, want 4", st)
+	}
+	var decoded struct {
+		ID UUID `bson:"_id"`
+	}
+	if err := bson.Unmarshal(data, &decoded); err != nil || decoded.ID != u {
+		t.Fatalf("decoded %s, %v", decoded.ID, err)
+	}
+}
+
+func TestTimeOrderedIDs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	v7 := &UUIDv7Generator{}
+	v7.now = clock
+	var prev UUID
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			// a clock going backwards must not break the order
+			now = now.Add(-time.Second)
+		}
+		id, err := v7.NewID(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := id.(UUID)
+		if u.Version() != 7 || bytes.Compare(u[:], prev[:]) <= 0 {
+			t.Fatalf("id %d: %s after %s", i, u, prev)
+		}
+		prev = u
+	}
+
+	ulids := &ULIDGenerator{}
+	ulids.now = clock
+	last := ""
+	for i := 0; i < 1000; i++ {
+		id, err := ulids.NewID(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := id.(string)
+		if len(s) != 26 || s <= last {
+			t.Fatalf("id %d: %s after %s", i, s, last)
+		}
+		last = s
+	}
+	if got := encodeULID([16]byte{0x01, 0x8c, 0xc2, 0x51, 0xf4, 0x00}); got[:10] != "01HK153X00" {
+		t.Fatalf("timestamp encoded as %s", got[:10])
+	}
+}
+
+func TestSequence(t *testing.T) {
+	ctx := context.Background()
+	counters := NewMemoryStore()
+
+	// two processes sharing the counter
+	a, b := NewSequence(counters, "orders", 10), NewSequence(counters, "orders", 10)
+	var mu sync.Mutex
+	seen := map[int64]bool{}
+	var wg sync.WaitGroup
+	for _, s := range []*Sequence{a, b, a, b} {
+		wg.Add(1)
+		go func(s *Sequence) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				id, err := s.Next(ctx)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				if seen[id] {
+					t.Errorf("id %d returned twice", id)
+				}
+				seen[id] = true
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	if len(seen) != 100 {
+		t.Fatalf("got %d ids, want 100", len(seen))
+	}
+
+	// 100 ids in blocks of 10 reserved exactly 100
+	counter := findAll(t, counters, idFilter("orders"))
+	if len(counter) != 1 || counter[0]["seq"] != int64(100) {
+		t.Fatalf("counter = %v", counter)
+	}
+	for id := int64(1); id <= 100; id++ {
+		if !seen[id] {
+			t.Fatalf("id %d is missing", id)
+		}
+	}
+}
+
+func TestRepositoryIDs(t *testing.T) {
+	ctx := context.Background()
+	type ticket struct {
+		ID    int64  `bson:"_id,omitempty"`
+		Title string `bson:"title"`
+	}
+	repo := NewRepository[ticket](NewMemoryStore()).IDs(NewSequence(NewMemoryStore(), "tickets", 5))
+	for i := int64(1); i <= 3; i++ {
+		id, err := repo.Insert(ctx, ticket{Title: "bug"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != i {
+			t.Fatalf("id = %v, want %d", id, i)
+		}
+	}
+	// an explicit id is kept
+	if id, err := repo.Insert(ctx, ticket{ID: 42, Title: "feature"}); err != nil || id != int64(42) {
+		t.Fatalf("id = %v, err = %v", id, err)
+	}
+	got, err := repo.Get(ctx, int64(2))
+	if err != nil || got.Title != "bug" {
+		t.Fatalf("got %+v, %v", got, err)
+	}
+}
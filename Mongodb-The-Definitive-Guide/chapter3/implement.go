@@ -3,50 +3,54 @@ package chapter3
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Document ...
 type Document struct {
-	Title string
-	Count int
+	Title string `bson:"title"`
+	Count int    `bson:"count"`
 }
 
 // InsertOne will add an "_id" key to the document (if you don't supply one) and store the document in MongoDB
 // MongoDB does minimal checks on data being inserted: it checks the document's basic structure and adds an "_id" field if one doesn't exist.
-// All documents must be smaller than 16MB.
-func (d Document) InsertOne(ctx context.Context) {
-	// get collection
-	collection := mongoDBConnection(ctx)
-	result, err := collection.InsertOne(ctx, bson.D{{Key: "title", Value: d.Title}, {Key: "count", Value: d.Count}})
+// A collection validator adds rules (see ApplySchema), SchemaStore checks the same rules before sending a document.
+// All documents must be smaller than 16MB, a larger one fails with a *DocumentTooLargeError before being sent.
+// Store larger payloads with a ChunkStore.
+func (d Document) InsertOne(ctx context.Context, store DocumentStore) (*mongo.InsertOneResult, error) {
+	doc := bson.D{{Key: "title", Value: d.Title}, {Key: "count", Value: d.Count}}
+	if _, err := CheckDocumentSize(doc, MaxDocumentSize); err != nil {
+		return nil, err
+	}
+	result, err := store.InsertOne(ctx, doc)
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
 	}
-	log.Println("insert result:", result)
+
+	return result, nil
 }
 
 // InsertMany enables you to pass an array of documents to the database
 // Make more efficient to reduce the db round trip
-func (d Document) InsertMany(ctx context.Context) {
-	// get collection
-	collection := mongoDBConnection(ctx)
+func (d Document) InsertMany(ctx context.Context, store DocumentStore) (*mongo.InsertManyResult, error) {
 	n := 10
 	data := make([]any, 0, n)
 	for i := 0; i < n; i++ {
 		data = append(data, bson.D{{Key: "title", Value: fmt.Sprintf("%s-%d", d.Title, i)}, {Key: "count", Value: d.Count}})
 	}
-	result, err := collection.InsertMany(ctx, data, &options.InsertManyOptions{
+	result, err := store.InsertMany(ctx, data, &options.InsertManyOptions{
 		Ordered: new(bool),
 	})
 	if err != nil {
-		log.Fatal(err)
+		return result, translateError(err)
 	}
-	log.Println("insert result:", result)
+
+	return result, nil
 }
 
 // InsertManyUnOrdered when performing a bulk insert using insertMany, if a document halfway through the array produces an error
@@ -55,222 +59,220 @@ func (d Document) InsertMany(ctx context.Context) {
 // Specify false and MongoDB may reorder the inserts to increase performance
 // Ordered inserts is the default. If a document produces an insertion error, no documents beyond that point in the array will be inserted.
 // For unordered inserts, MongoDB will attempt to insert all documents, regardless of whether some insertions produce errors.
-func (d Document) InsertManyUnOrdered(ctx context.Context, ordered bool) {
-	conn := mongoDBConnection(ctx)
+// result.InsertedIDs holds the id of every document in order, the rejected and, when ordered, the skipped ones
+// included: the *DuplicateKeyError lists the indexes that were rejected, an ordered insert skips every document after
+// the first of them.
+func (d Document) InsertManyUnOrdered(ctx context.Context, store DocumentStore, ordered bool) (*mongo.InsertManyResult, error) {
 	n := 10
 	data := make([]any, 0, n)
 	for i := 0; i < n; i++ {
 		data = append(data, bson.D{{Key: "title", Value: fmt.Sprintf("%s-%d", d.Title, i)}, {Key: "_id", Value: "0"}}) // duplicate key
 	}
-	result, err := conn.InsertMany(ctx, data, &options.InsertManyOptions{
+	result, err := store.InsertMany(ctx, data, &options.InsertManyOptions{
 		Ordered: &ordered, // default true
 	})
 	if err != nil {
-		log.Fatal(err)
+		return result, translateError(err)
 	}
-	log.Println("insert results:", result)
 
+	return result, nil
 }
 
 // Find ...
-func (d Document) Find(ctx context.Context) {
-	conn := mongoDBConnection(ctx)
-	cur, err := conn.Find(ctx, bson.D{})
-	if err != nil {
-		log.Fatal(err)
-	}
-	for cur.Next(ctx) {
-		log.Println("results:", cur.Current)
-	}
+func (d Document) Find(ctx context.Context, store DocumentStore) ([]bson.D, error) {
+	return find(ctx, store, bson.D{})
 }
 
-// FindByID ...
-func (d Document) FindByID(ctx context.Context, id string) {
-	conn := mongoDBConnection(ctx)
-	objID, _ := primitive.ObjectIDFromHex(id)
-	cur, err := conn.Find(ctx, bson.D{{Key: "_id", Value: objID}})
+// FindByID returns ErrInvalidID when id is not an ObjectID hex string and ErrNotFound when no document has this id
+func (d Document) FindByID(ctx context.Context, store DocumentStore, id string) (bson.D, error) {
+	objID, err := parseID(id)
 	if err != nil {
-		log.Fatal(err)
-	}
-	for cur.Next(ctx) {
-		log.Println("results:", cur.Current)
+		return nil, err
 	}
+
+	return findOne(ctx, store, bson.D{{Key: "_id", Value: objID}})
 }
 
 // DeleteOne will delete the first document found that matches the filter.
 // Which document is found first depends on several factors, including the order in which the documents were inserted
 // what updates were made to the documents, and what indexes are specified.
-func (d Document) DeleteOne(ctx context.Context, id any) {
-	conn := mongoDBConnection(ctx)
-	rs, err := conn.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+func (d Document) DeleteOne(ctx context.Context, store DocumentStore, id any) (*mongo.DeleteResult, error) {
+	rs, err := store.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
+	}
+	if rs.DeletedCount == 0 {
+		return rs, ErrNotFound
 	}
-	log.Println("delete one result:", rs.DeletedCount)
 
+	return rs, nil
 }
 
 // DeleteMany delete all the documents that match a filter
-func (d Document) DeleteMany(ctx context.Context, title any) {
-	conn := mongoDBConnection(ctx)
-
+// A DeleteMany with the wrong title can't be undone, SoftDeleteMany moves the documents to a Trash instead
+func (d Document) DeleteMany(ctx context.Context, store DocumentStore, title any) (*mongo.DeleteResult, error) {
 	filter := bson.D{}
 	filter = append(filter, primitive.E{
 		Key:   "title",
 		Value: title,
 	})
 
-	rs, err := conn.DeleteMany(ctx, filter)
+	rs, err := store.DeleteMany(ctx, filter)
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
 	}
-	log.Println("delete many result:", rs.DeletedCount)
+
+	return rs, nil
 }
 
 // Drop it is possible to use deleteMany to remove all documents in a collection
 // However, if you want to clear an entire collection, it is faster to drop it
 // Once data has been removed, it is gone forever. There is no way to undo a delete or drop operation or recover deleted documents (except backup)
-func (d Document) Drop(ctx context.Context) {
-	conn := mongoDBConnection(ctx)
-
-	err := conn.Drop(ctx)
-	if err != nil {
-		log.Fatal(err)
-	}
+// or unless it was deleted through a Trash
+func (d Document) Drop(ctx context.Context, store DocumentStore) error {
+	return translateError(store.Drop(ctx))
 }
 
 // UpdateOne take a filter document as their first parameter and a modifier document
 // When to use: only certain portions of a document need to be updated. You can update specific fields in a documents using atomic update operations.
 // Updating a document is atomic: if two updates happen at the same time, whichever one reaches the server first will be applied, and then the next will be applied
-// The last update will "win"
-func (d Document) UpdateOne(ctx context.Context, id string) {
-	conn := mongoDBConnection(ctx)
+// The last update will "win", ReplaceOne guards edit-heavy documents with a version instead
+func (d Document) UpdateOne(ctx context.Context, store DocumentStore, id string) (*mongo.UpdateResult, error) {
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
+
+	return updateByID(ctx, store, id, update)
+}
 
-	objID, _ := primitive.ObjectIDFromHex(id)
+// UpdateMany take a filter document as their first parameter and a modifier document
+func (d Document) UpdateMany(ctx context.Context, store DocumentStore, id string) (*mongo.UpdateResult, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
 	filter := bson.D{{Key: "_id", Value: objID}}
-	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
-	rs, err := conn.UpdateOne(ctx, filter, update)
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}, {Key: "$set", Value: bson.D{{Key: "title", Value: "updated"}}}}
+	rs, err := store.UpdateMany(ctx, filter, update)
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
 	}
-	log.Println("update result:", rs)
+
+	return rs, nil
 }
 
-// UpdateMany take a filter document as their first parameter and a modifier document
-func (d Document) UpdateMany(ctx context.Context, id string) {
-	conn := mongoDBConnection(ctx)
+// ReplaceOne replaces the whole document with d. Unlike UpdateOne the last write does not silently win:
+// version is the "version" field read together with the document (documents written without one count as version 0),
+// the replacement only applies while the stored version is still the same and is saved with version+1, which is returned.
+// When another writer got there first a *ConflictError holding the current version is returned and nothing is written,
+// the caller should read the document again and redo its edit.
+func (d Document) ReplaceOne(ctx context.Context, store DocumentStore, id string, version int64) (int64, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return 0, err
+	}
+	filter := bson.D{{Key: "_id", Value: objID}, versionCondition(version)}
+	replacement := bson.D{{Key: "title", Value: d.Title}, {Key: "count", Value: d.Count}, {Key: "version", Value: version + 1}}
+	rs, err := store.ReplaceOne(ctx, filter, replacement)
+	if err != nil {
+		return 0, translateError(err)
+	}
+	if rs.MatchedCount > 0 {
+		return version + 1, nil
+	}
 
-	objID, _ := primitive.ObjectIDFromHex(id)
-	filter := bson.D{{Key: "_id", Value: objID}}
-	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}, {Key: "$set", Value: bson.D{{Key: "title", Value: "updated"}}}}
-	rs, err := conn.UpdateMany(ctx, filter, update)
+	// nothing matched: either the document is gone or its version moved on
+	current, err := findOne(ctx, store, bson.D{{Key: "_id", Value: objID}})
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
-	log.Println("update result:", rs)
+
+	return 0, &ConflictError{Expected: version, Actual: int64Value(current.Map()["version"])}
 }
 
-// func (d Document) ReplaceOne(ctx context.Context) {}
+// versionCondition matches documents at version, version 0 also matches documents without a "version" field
+func versionCondition(version int64) bson.E {
+	if version != 0 {
+		return bson.E{Key: "version", Value: version}
+	}
 
-// SetOperator sets the value of a field. If the field does not yet exist, it will be created. This can be handy for updating schemas or adding user-defined keys.
-func (d Document) SetOperator(ctx context.Context, id, newTitle string) {
-	conn := mongoDBConnection(ctx)
+	return bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: "version", Value: 0}},
+		bson.D{{Key: "version", Value: bson.D{{Key: "$exists", Value: false}}}},
+	}}
+}
 
-	objID, _ := primitive.ObjectIDFromHex(id)
-	filter := bson.D{{Key: "_id", Value: objID}}
-	update := bson.D{}
+// int64Value converts a stored number to an int64, anything else is 0
+func int64Value(v any) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+
+	return 0
+}
+
+// SetOperator sets the value of a field. If the field does not yet exist, it will be created. This can be handy for updating schemas or adding user-defined keys.
+func (d Document) SetOperator(ctx context.Context, store DocumentStore, id, newTitle string) (*mongo.UpdateResult, error) {
 	// $inc is similar to $set, but it is designed for incrementing (and decrementing) numbers.
 	// $inc can be used only on values of type integer, long double, or decimal
 	// Also, the value of the $inc key must be a number
-	update = append(update, primitive.E{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}})
-	update = append(update, primitive.E{Key: "$set", Value: bson.D{{Key: "title", Value: newTitle}}})
-	update = append(update, primitive.E{Key: "$set", Value: bson.D{{Key: "name", Value: bson.D{{Key: "email", Value: "ngoctd@gmail.com"}, {Key: "address", Value: "Thanh Xuan, Ha Noi"}}}}})
-
-	rs, err := conn.UpdateOne(ctx, filter, update)
+	// Both fields end up in a single $set entry, a second "$set" key in the same update document is a mistake
+	update, err := NewUpdate().
+		Inc("count", 1).
+		Set("title", newTitle).
+		Set("name", bson.D{{Key: "email", Value: "ngoctd@gmail.com"}, {Key: "address", Value: "Thanh Xuan, Ha Noi"}}).
+		Build()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	log.Println("update result:", rs)
+
+	return updateByID(ctx, store, id, update)
 }
 
 // UnSetOperator $unset delete matching field
-func (d Document) UnSetOperator(ctx context.Context, id string, field string) {
-	conn := mongoDBConnection(ctx)
-
-	objID, _ := primitive.ObjectIDFromHex(id)
-	filter := bson.D{{Key: "_id", Value: objID}}
+func (d Document) UnSetOperator(ctx context.Context, store DocumentStore, id string, field string) (*mongo.UpdateResult, error) {
 	update := bson.D{{Key: "$unset", Value: bson.D{{Key: field}}}}
-	rs, err := conn.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("update result:", rs)
+
+	return updateByID(ctx, store, id, update)
 }
 
 // SetEmbeddedDocument you can also use $set to reach in and change embedded documents
-func (d Document) SetEmbeddedDocument(ctx context.Context, id string) {
-	conn := mongoDBConnection(ctx)
-
-	objID, _ := primitive.ObjectIDFromHex(id)
-	filter := bson.D{{Key: "_id", Value: objID}}
+func (d Document) SetEmbeddedDocument(ctx context.Context, store DocumentStore, id string) (*mongo.UpdateResult, error) {
 	update := bson.D{{Key: "$set", Value: bson.D{{Key: "name.email", Value: "ngoc@gmail.com"}}}}
-	rs, err := conn.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Println("update result:", rs)
+
+	return updateByID(ctx, store, id, update)
 }
 
 // PushOperator $push adds elements to the end of an array if the array exists and creates a new array if it does not.
-func (d Document) PushOperator(ctx context.Context) {
-	conn := mongoDBConnection(ctx)
-
+// It returns the blog post after both pushes.
+func (d Document) PushOperator(ctx context.Context, store DocumentStore) (bson.D, error) {
 	data := bson.D{}
 	data = append(data, primitive.E{Key: "title", Value: "A blog post"})
 	data = append(data, primitive.E{Key: "content", Value: "Learn mongodb array"})
 
 	// insert
-	rs, err := conn.InsertOne(ctx, data)
-	if err != nil {
-		log.Println("insert one error:", err)
-	}
-
-	// find
-	post, err := conn.Find(ctx, bson.D{{Key: "_id", Value: rs.InsertedID}})
+	rs, err := store.InsertOne(ctx, data)
 	if err != nil {
-		log.Println("insert one error:", err)
-	}
-	for post.Next(ctx) {
-		log.Println(post.Current)
+		return nil, translateError(err)
 	}
 
 	filter := bson.D{{Key: "_id", Value: rs.InsertedID}}
 	update := bson.D{{Key: "$push", Value: bson.D{{Key: "comments", Value: bson.D{{Key: "name", Value: "ngoctd"}, {Key: "email", Value: "ngoctd@gmail.com"}, {Key: "content", Value: "nice post."}}}}}}
-	_, err = conn.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Println("insert one error:", err)
-	}
-
-	post, err = conn.Find(ctx, bson.D{{Key: "_id", Value: rs.InsertedID}})
+	_, err = store.UpdateOne(ctx, filter, update)
 	if err != nil {
-		log.Println("insert one error:", err)
-	}
-	for post.Next(ctx) {
-		log.Println(post.Current)
+		return nil, translateError(err)
 	}
 
 	update = bson.D{{Key: "$push", Value: bson.D{{Key: "hourly", Value: bson.D{{Key: "$each", Value: bson.A{1, 2, 3, 4}}}}}}}
-	_, err = conn.UpdateOne(ctx, filter, update)
-	if err != nil {
-		log.Println("insert one error:", err)
-	}
-	post, err = conn.Find(ctx, bson.D{{Key: "_id", Value: rs.InsertedID}})
+	_, err = store.UpdateOne(ctx, filter, update)
 	if err != nil {
-		log.Println("insert one error:", err)
-	}
-	for post.Next(ctx) {
-		log.Println(post.Current)
+		return nil, translateError(err)
 	}
+
+	return findOne(ctx, store, filter)
 }
 
 // Upsert is a special type of update.
@@ -280,8 +282,7 @@ func (d Document) PushOperator(ctx context.Context) {
 // Without Upserts, we need making a round trip to the database, plus sending an update or insert. If we are running this code in multiple processes
 // we are also subject to a race condition where more than one document can be inserted for a given URL.
 // Upsert is atomic.
-func (d Document) Upsert(ctx context.Context) {
-	conn := mongoDBConnection(ctx)
+func (d Document) Upsert(ctx context.Context, store DocumentStore) (bson.D, error) {
 	filter := bson.D{{Key: "url", Value: "/blog-1"}}
 	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "pageviews", Value: 1}}}}
 	update = append(update, primitive.E{
@@ -295,57 +296,87 @@ func (d Document) Upsert(ctx context.Context) {
 	})
 
 	upsert := true
-	rs, err := conn.UpdateOne(ctx, filter, update, &options.UpdateOptions{
+	_, err := store.UpdateOne(ctx, filter, update, &options.UpdateOptions{
 		Upsert: &upsert,
 	})
 	if err != nil {
-		log.Println("insert one error:", err)
+		return nil, translateError(err)
 	}
-	log.Println("upsert result:", rs)
 
-	find, err := conn.Find(ctx, filter)
-	if err != nil {
-		log.Println("insert one error:", err)
-	}
-	for find.Next(ctx) {
-		log.Println(find.Current)
-	}
+	return findOne(ctx, store, filter)
 }
 
 // UpdateMany ...
-func UpdateMany(ctx context.Context) {
-	conn := mongoDBConnection(ctx)
-
-	find := func(ctx context.Context) {
-		rs, err := conn.Find(ctx, bson.D{{Key: "birthday", Value: "10/13/1978"}})
-		if err != nil {
-			log.Fatal(err)
-		}
-		for rs.Next(ctx) {
-			log.Println(rs.Current)
-		}
-	}
-
+func UpdateMany(ctx context.Context, store DocumentStore) ([]bson.D, error) {
 	n := 5
 	data := make([]any, 0, n)
 	for i := 0; i < n; i++ {
 		data = append(data, bson.D{{Key: "birthday", Value: "10/13/1978"}})
 	}
 
-	_, err := conn.InsertMany(ctx, data)
+	_, err := store.InsertMany(ctx, data)
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
 	}
-	find(ctx)
 
 	filter := bson.D{{Key: "birthday", Value: "10/13/1978"}}
 	update := bson.D{{Key: "$set", Value: bson.D{{Key: "gift", Value: "Happy BirthDay"}}}}
-	_, err = conn.UpdateMany(ctx, filter, update)
+	_, err = store.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return find(ctx, store, filter)
+}
+
+// updateByID applies update to the document with the given hex id, ErrNotFound is returned when nothing matched
+func updateByID(ctx context.Context, store DocumentStore, id string, update bson.D) (*mongo.UpdateResult, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := store.UpdateOne(ctx, bson.D{{Key: "_id", Value: objID}}, update)
+	if err != nil {
+		return nil, translateError(err)
+	}
+	if rs.MatchedCount == 0 {
+		return rs, ErrNotFound
+	}
+
+	return rs, nil
+}
+
+func find(ctx context.Context, store DocumentStore, filter any) ([]bson.D, error) {
+	cur, err := store.Find(ctx, filter)
 	if err != nil {
-		log.Fatal(err)
+		return nil, translateError(err)
 	}
-	find(ctx)
+	var docs []bson.D
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, translateError(err)
+	}
+
+	return docs, nil
+}
+
+func findOne(ctx context.Context, store DocumentStore, filter any) (bson.D, error) {
+	var doc bson.D
+	if err := store.FindOne(ctx, filter).Decode(&doc); err != nil {
+		return nil, translateError(err)
+	}
+
+	return doc, nil
 }
 
-// Return updated documents
-// Array operation
+// IncrementCount increments count and returns the updated document in one atomic operation.
+// Unlike UpdateOne, no other update can slip in between the write and reading the new value.
+func (d Document) IncrementCount(ctx context.Context, store DocumentStore, id string) (bson.D, error) {
+	objID, err := parseID(id)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.D{{Key: "_id", Value: objID}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}
+
+	return FindOneAndUpdate[bson.D](ctx, store, filter, update, FindAndModifyOptions{Return: After})
+}
@@ -0,0 +1,292 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func findAll(t *testing.T, store DocumentStore, filter any) []bson.M {
+	t.Helper()
+	cur, err := store.Find(context.Background(), filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.M
+	if err := cur.All(context.Background(), &docs); err != nil {
+		t.Fatal(err)
+	}
+
+	return docs
+}
+
+func seed(t *testing.T, store DocumentStore, doc bson.D) primitive.ObjectID {
+	t.Helper()
+	id := primitive.NewObjectID()
+	if _, err := store.InsertOne(context.Background(), append(bson.D{{Key: "_id", Value: id}}, doc...)); err != nil {
+		t.Fatal(err)
+	}
+
+	return id
+}
+
+func TestInsertAndFind(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := Document{Title: "post", Count: 1}
+
+	one, err := d.InsertOne(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	many, err := d.InsertMany(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(many.InsertedIDs) != 10 {
+		t.Fatalf("inserted %d documents, want 10", len(many.InsertedIDs))
+	}
+
+	docs, err := d.Find(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 11 {
+		t.Fatalf("got %d documents, want 11", len(docs))
+	}
+	if docs[10].Map()["title"] != "post-9" {
+		t.Fatalf("unexpected last document: %v", docs[10])
+	}
+
+	doc, err := d.FindByID(ctx, store, one.InsertedID.(primitive.ObjectID).Hex())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Map()["title"] != "post" {
+		t.Fatalf("unexpected document: %v", doc)
+	}
+}
+
+func TestUpdateOperators(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := Document{}
+	id := seed(t, store, bson.D{{Key: "title", Value: "post"}, {Key: "count", Value: 1}})
+
+	if _, err := d.UpdateOne(ctx, store, id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SetOperator(ctx, store, id.Hex(), "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.SetEmbeddedDocument(ctx, store, id.Hex()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.UnSetOperator(ctx, store, id.Hex(), "title"); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := findAll(t, store, bson.D{{Key: "_id", Value: id}})
+	if len(docs) != 1 {
+		t.Fatalf("got %d documents, want 1", len(docs))
+	}
+	doc := docs[0]
+	if doc["count"] != int32(3) {
+		t.Errorf("count = %v, want 3", doc["count"])
+	}
+	if _, ok := doc["title"]; ok {
+		t.Errorf("title should have been unset: %v", doc)
+	}
+	if name := doc["name"].(bson.M); name["email"] != "ngoc@gmail.com" || name["address"] != "Thanh Xuan, Ha Noi" {
+		t.Errorf("unexpected name: %v", name)
+	}
+}
+
+func TestPushOperator(t *testing.T) {
+	post, err := Document{}.PushOperator(context.Background(), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := post.Map()
+	if comments := doc["comments"].(bson.A); len(comments) != 1 {
+		t.Errorf("comments = %v", comments)
+	}
+	if hourly := doc["hourly"].(bson.A); len(hourly) != 4 {
+		t.Errorf("hourly = %v", hourly)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := Document{}
+
+	if _, err := d.Upsert(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	page, err := d.Upsert(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := page.Map()
+	if doc["pageviews"] != int32(2) {
+		t.Errorf("pageviews = %v, want 2", doc["pageviews"])
+	}
+	if _, ok := doc["createAt"]; !ok {
+		t.Errorf("createAt was not set on insert: %v", doc)
+	}
+	if docs := findAll(t, store, bson.D{{Key: "url", Value: "/blog-1"}}); len(docs) != 1 {
+		t.Fatalf("got %d documents, want 1", len(docs))
+	}
+}
+
+func TestUpdateMany(t *testing.T) {
+	docs, err := UpdateMany(context.Background(), NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 5 {
+		t.Fatalf("got %d documents, want 5", len(docs))
+	}
+	for _, doc := range docs {
+		if doc.Map()["gift"] != "Happy BirthDay" {
+			t.Errorf("document was not updated: %v", doc)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := Document{}
+	id := seed(t, store, bson.D{{Key: "title", Value: "a"}})
+	seed(t, store, bson.D{{Key: "title", Value: "b"}})
+	seed(t, store, bson.D{{Key: "title", Value: "b"}})
+
+	if _, err := d.DeleteOne(ctx, store, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DeleteOne(ctx, store, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	rs, err := d.DeleteMany(ctx, store, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.DeletedCount != 2 {
+		t.Fatalf("deleted %d documents, want 2", rs.DeletedCount)
+	}
+	if err := d.Drop(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertManyUnOrdered(t *testing.T) {
+	ctx := context.Background()
+	d := Document{Title: "dup"}
+
+	for _, tc := range []struct {
+		ordered  bool
+		rejected int
+	}{
+		// ordered stops at the second document, unordered tries and rejects every duplicate
+		{true, 1},
+		{false, 9},
+	} {
+		store := NewMemoryStore()
+		result, err := d.InsertManyUnOrdered(ctx, store, tc.ordered)
+		var dup *DuplicateKeyError
+		if !errors.As(err, &dup) || !errors.Is(err, ErrDuplicateKey) {
+			t.Fatalf("ordered %v: expected a duplicate key error, got %v", tc.ordered, err)
+		}
+		if len(dup.Indexes) != tc.rejected || dup.Indexes[0] != 1 {
+			t.Fatalf("ordered %v: rejected %v", tc.ordered, dup.Indexes)
+		}
+		// the result lists the id of every document, like the driver, only the first one is stored
+		if len(result.InsertedIDs) != 10 {
+			t.Fatalf("ordered %v: inserted ids %v", tc.ordered, result.InsertedIDs)
+		}
+		for _, id := range result.InsertedIDs {
+			if id != "0" {
+				t.Fatalf("ordered %v: inserted ids %v", tc.ordered, result.InsertedIDs)
+			}
+		}
+		if n, err := store.CountDocuments(ctx, bson.D{}); err != nil || n != 1 {
+			t.Fatalf("ordered %v: stored %d documents, %v", tc.ordered, n, err)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	d := Document{}
+
+	if _, err := d.FindByID(ctx, store, "not-an-id"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("FindByID: expected ErrInvalidID, got %v", err)
+	}
+	if _, err := d.UpdateOne(ctx, store, "xyz"); !errors.Is(err, ErrInvalidID) {
+		t.Errorf("UpdateOne: expected ErrInvalidID, got %v", err)
+	}
+	missing := primitive.NewObjectID().Hex()
+	if _, err := d.FindByID(ctx, store, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FindByID: expected ErrNotFound, got %v", err)
+	}
+	if _, err := d.SetOperator(ctx, store, missing, "title"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetOperator: expected ErrNotFound, got %v", err)
+	}
+
+	one, _ := d.InsertOne(ctx, store)
+	_, err := store.InsertOne(ctx, bson.D{{Key: "_id", Value: one.InsertedID}})
+	if err := translateError(err); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	invalid := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: documentValidationFailureCode, Message: "Document failed validation"}}}
+	if err := translateError(invalid); !errors.Is(err, ErrInvalidDocument) {
+		t.Errorf("expected ErrInvalidDocument, got %v", err)
+	}
+}
+
+func TestReplaceOneVersion(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	one, err := Document{Title: "draft", Count: 1}.InsertOne(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := one.InsertedID.(primitive.ObjectID).Hex()
+
+	// documents inserted without a version field are at version 0
+	version, err := Document{Title: "first edit", Count: 2}.ReplaceOne(ctx, store, id, 0)
+	if err != nil || version != 1 {
+		t.Fatalf("version = %d, err = %v", version, err)
+	}
+
+	// a second writer still holding version 0 must not overwrite the first edit
+	_, err = Document{Title: "stale edit"}.ReplaceOne(ctx, store, id, 0)
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || !errors.Is(err, ErrConflict) {
+		t.Fatalf("expected a conflict, got %v", err)
+	}
+	if conflict.Expected != 0 || conflict.Actual != 1 {
+		t.Fatalf("conflict = %+v", conflict)
+	}
+
+	if version, err = (Document{Title: "second edit", Count: 3}).ReplaceOne(ctx, store, id, conflict.Actual); err != nil || version != 2 {
+		t.Fatalf("version = %d, err = %v", version, err)
+	}
+	docs := findAll(t, store, bson.D{})
+	if len(docs) != 1 || docs[0]["title"] != "second edit" || docs[0]["version"] != int64(2) {
+		t.Fatalf("got %v", docs)
+	}
+
+	if _, err := (Document{}).ReplaceOne(ctx, store, primitive.NewObjectID().Hex(), 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
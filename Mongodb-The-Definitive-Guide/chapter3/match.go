@@ -0,0 +1,588 @@
+package chapter3
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Match evaluates a filter the way the server does, so MemoryStore and tests give the answers a collection would give.
+The rules that surprise people most:
+
+  - A path reaches into embedded documents, and into every document of an array on the way: {"comments.author": "Joe"}
+    matches {comments: [{author: "Mary"}, {author: "Joe"}]}.
+  - A condition on an array field matches when the whole array or any one element satisfies it: {fruit: "apple"}
+    matches {fruit: ["apple", "banana"]}. Different elements may satisfy different conditions of the same field,
+    {x: {$gt: 10, $lt: 20}} matches {x: [5, 25]}; $elemMatch asks for a single element satisfying all of them.
+  - null matches a null value and a missing field alike, $exists tells them apart.
+  - $gt, $gte, $lt and $lte only compare values of the same type, numbers of any type with each other: {age: {$gt: 18}}
+    never matches {age: "20"}. Equality follows the same rule. Only MinKey and MaxKey compare with every type.
+  - Equality on an embedded document compares the whole document, field order included.
+*/
+
+// Match reports whether doc matches filter with the semantics of a MongoDB query. filter and doc can be bson.D, bson.M
+// or anything marshalling to a document. Supported operators: $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $type,
+// $regex with $options, $all, $size, $elemMatch, $not, $and, $or and $nor. Other operators are an error.
+func Match(filter, doc any) (bool, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return false, err
+	}
+	d, err := toDocument(doc)
+	if err != nil {
+		return false, err
+	}
+
+	return match(f, d)
+}
+
+// field is the result of resolving a path: the values found and whether some branch of the path was missing
+type field struct {
+	values  []any
+	missing bool
+}
+
+// exists reports whether the path led to at least one value
+func (f field) exists() bool {
+	return len(f.values) > 0
+}
+
+// resolve follows a dotted path. Arrays on the way are traversed element by element, a numeric part also selects
+// the element at that index.
+func resolve(v any, path []string) field {
+	if len(path) == 0 {
+		return field{values: []any{v}}
+	}
+	switch t := v.(type) {
+	case bson.D:
+		for _, e := range t {
+			if e.Key == path[0] {
+				return resolve(e.Value, path[1:])
+			}
+		}
+	case bson.A:
+		var out field
+		idx, err := strconv.Atoi(path[0])
+		isIndex := err == nil && idx >= 0
+		if isIndex && idx < len(t) {
+			sub := resolve(t[idx], path[1:])
+			out.values = append(out.values, sub.values...)
+			out.missing = sub.missing
+		}
+		for _, el := range t {
+			if d, ok := el.(bson.D); ok {
+				sub := resolve(d, path)
+				out.values = append(out.values, sub.values...)
+				// documents without a field named like the index don't make the path missing
+				out.missing = out.missing || (sub.missing && !isIndex)
+			}
+		}
+		if !out.exists() {
+			out.missing = true
+		}
+		return out
+	}
+
+	return field{missing: true}
+}
+
+// match reports whether doc satisfies filter
+func match(filter bson.D, doc bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(e, doc)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func matchElement(e bson.E, doc bson.D) (bool, error) {
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(bson.A)
+		if !ok || len(clauses) == 0 {
+			return false, fmt.Errorf("%s must be a nonempty array", e.Key)
+		}
+		for _, c := range clauses {
+			sub, ok := c.(bson.D)
+			if !ok {
+				return false, fmt.Errorf("%s entries must be documents", e.Key)
+			}
+			matched, err := match(sub, doc)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case e.Key == "$and" && !matched:
+				return false, nil
+			case e.Key == "$or" && matched:
+				return true, nil
+			case e.Key == "$nor" && matched:
+				return false, nil
+			}
+		}
+		return e.Key != "$or", nil
+	case "$comment":
+		return true, nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, fmt.Errorf("unknown top level operator: %s", e.Key)
+	}
+
+	f := resolve(doc, splitPath(e.Key))
+	if isOperatorDocument(e.Value) {
+		return matchOperators(e.Value.(bson.D), f)
+	}
+	if re, ok := e.Value.(primitive.Regex); ok {
+		return matchRegex(f, re.Pattern, re.Options)
+	}
+
+	return matchEqual(f, e.Value), nil
+}
+
+// matchEqual implements {field: value}, an array field matches when the whole array or any element is equal.
+// null also matches a missing field.
+func matchEqual(f field, want any) bool {
+	if isNull(want) && f.missing {
+		return true
+	}
+
+	return anyValue(f, func(v any) bool { return equalValues(v, want) })
+}
+
+// anyValue reports whether a value of f, or an element of an array value, satisfies check
+func anyValue(f field, check func(v any) bool) bool {
+	for _, v := range f.values {
+		if check(v) {
+			return true
+		}
+		if arr, ok := v.(bson.A); ok {
+			for _, el := range arr {
+				if check(el) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func isNull(v any) bool {
+	switch v.(type) {
+	case nil, primitive.Null, primitive.Undefined:
+		return true
+	}
+
+	return false
+}
+
+// matchCompare implements $gt, $gte, $lt and $lte, which only compare values of the same type
+func matchCompare(f field, want any, accept func(int) bool) bool {
+	if isNull(want) && f.missing && accept(0) {
+		return true
+	}
+	bound := typeOrder(want)
+	_, minKey := want.(primitive.MinKey)
+	_, maxKey := want.(primitive.MaxKey)
+
+	return anyValue(f, func(v any) bool {
+		return (minKey || maxKey || typeOrder(v) == bound) && accept(compareValues(v, want))
+	})
+}
+
+// matchOperators reports whether f satisfies every operator of ops
+func matchOperators(ops bson.D, f field) (bool, error) {
+	for _, op := range ops {
+		var ok bool
+		var err error
+		switch op.Key {
+		case "$regex":
+			ok, err = matchRegexOperator(ops, op.Value, f)
+		case "$options":
+			if _, found := lookupKey(ops, "$regex"); !found {
+				return false, fmt.Errorf("$options needs a $regex")
+			}
+			continue
+		default:
+			ok, err = matchOperator(op, f)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func lookupKey(d bson.D, key string) (any, bool) {
+	for _, e := range d {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func matchOperator(op bson.E, f field) (bool, error) {
+	switch op.Key {
+	case "$eq":
+		return matchEqual(f, op.Value), nil
+	case "$ne":
+		return !matchEqual(f, op.Value), nil
+	case "$gt":
+		return matchCompare(f, op.Value, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return matchCompare(f, op.Value, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return matchCompare(f, op.Value, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return matchCompare(f, op.Value, func(c int) bool { return c <= 0 }), nil
+	case "$in", "$nin":
+		candidates, ok := op.Value.(bson.A)
+		if !ok {
+			return false, fmt.Errorf("%s needs an array", op.Key)
+		}
+		found, err := matchIn(f, candidates)
+		if err != nil {
+			return false, err
+		}
+		return found == (op.Key == "$in"), nil
+	case "$exists":
+		return f.exists() == truthy(op.Value), nil
+	case "$type":
+		return matchType(f, op.Value)
+	case "$all":
+		return matchAll(f, op.Value)
+	case "$size":
+		n, ok := toFloat(op.Value)
+		if !ok || n != float64(int(n)) || n < 0 {
+			return false, fmt.Errorf("$size needs a non negative integer, got %v", op.Value)
+		}
+		for _, v := range f.values {
+			if arr, ok := v.(bson.A); ok && len(arr) == int(n) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		return matchElemMatch(f, op.Value)
+	case "$not":
+		var ok bool
+		var err error
+		switch cond := op.Value.(type) {
+		case bson.D:
+			if !isOperatorDocument(cond) {
+				return false, fmt.Errorf("$not needs a regex or a document of operators")
+			}
+			ok, err = matchOperators(cond, f)
+		case primitive.Regex:
+			ok, err = matchRegex(f, cond.Pattern, cond.Options)
+		default:
+			return false, fmt.Errorf("$not needs a regex or a document of operators")
+		}
+		return !ok && err == nil, err
+	}
+
+	return false, fmt.Errorf("unknown operator: %s", op.Key)
+}
+
+// matchIn implements $in, regular expressions among the candidates match strings
+func matchIn(f field, candidates bson.A) (bool, error) {
+	for _, c := range candidates {
+		if re, ok := c.(primitive.Regex); ok {
+			matched, err := matchRegex(f, re.Pattern, re.Options)
+			if err != nil || matched {
+				return matched, err
+			}
+			continue
+		}
+		if isOperatorDocument(c) {
+			return false, fmt.Errorf("cannot nest operators in $in")
+		}
+		if matchEqual(f, c) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// matchAll implements $all: every value is in the array, or is an $elemMatch matched by one of its elements
+func matchAll(f field, value any) (bool, error) {
+	candidates, ok := value.(bson.A)
+	if !ok {
+		return false, fmt.Errorf("$all needs an array")
+	}
+	if len(candidates) == 0 {
+		return false, nil
+	}
+	for _, c := range candidates {
+		var ok bool
+		var err error
+		if d, isDoc := c.(bson.D); isDoc && isOperatorDocument(d) {
+			if d[0].Key != "$elemMatch" || len(d) != 1 {
+				return false, fmt.Errorf("$all only accepts $elemMatch documents")
+			}
+			ok, err = matchElemMatch(f, d[0].Value)
+		} else {
+			ok, err = matchIn(f, bson.A{c})
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchElemMatch implements $elemMatch: one element of an array satisfies every condition.
+// A document of operators applies to the element itself, any other document, or one starting with $and, $or or
+// $nor, is a query on embedded documents.
+func matchElemMatch(f field, value any) (bool, error) {
+	cond, ok := value.(bson.D)
+	if !ok {
+		return false, fmt.Errorf("$elemMatch needs a document")
+	}
+	for _, v := range f.values {
+		arr, ok := v.(bson.A)
+		if !ok {
+			continue
+		}
+		i, err := firstElemMatch(cond, arr)
+		if err != nil || i >= 0 {
+			return i >= 0, err
+		}
+	}
+
+	return false, nil
+}
+
+// queryOperators start a query on documents, not a condition on a value: {$elemMatch: {$or: [{a: 1}, {b: 2}]}} queries
+// the embedded documents of the array
+var queryOperators = map[string]bool{
+	"$and": true, "$or": true, "$nor": true, "$expr": true, "$where": true, "$text": true, "$comment": true,
+}
+
+// firstElemMatch returns the index of the first element of arr satisfying the $elemMatch condition cond, -1 if none
+func firstElemMatch(cond bson.D, arr bson.A) (int, error) {
+	valueOperators := isOperatorDocument(cond) && !queryOperators[cond[0].Key]
+	for i, el := range arr {
+		var matched bool
+		var err error
+		if valueOperators {
+			matched, err = matchOperators(cond, field{values: []any{el}})
+		} else if doc, ok := el.(bson.D); ok {
+			matched, err = match(cond, doc)
+		}
+		if err != nil {
+			return -1, err
+		}
+		if matched {
+			return i, nil
+		}
+	}
+
+	return -1, nil
+}
+
+func matchRegexOperator(ops bson.D, pattern any, f field) (bool, error) {
+	var options string
+	if o, ok := lookupKey(ops, "$options"); ok {
+		s, ok := o.(string)
+		if !ok {
+			return false, fmt.Errorf("$options needs a string")
+		}
+		options = s
+	}
+	switch p := pattern.(type) {
+	case string:
+		return matchRegex(f, p, options)
+	case primitive.Regex:
+		if options == "" {
+			options = p.Options
+		}
+		return matchRegex(f, p.Pattern, options)
+	}
+
+	return false, fmt.Errorf("$regex needs a string or a regular expression")
+}
+
+// matchRegex reports whether a string of f, or of an array of f, matches the regular expression
+func matchRegex(f field, pattern, options string) (bool, error) {
+	re, err := compileRegex(pattern, options)
+	if err != nil {
+		return false, err
+	}
+
+	return anyValue(f, func(v any) bool {
+		s, ok := v.(string)
+		return ok && re.MatchString(s)
+	}), nil
+}
+
+// compileRegex compiles a regular expression with the MongoDB options i, m, s, x and u.
+// Go regular expressions have no lookaround or backreferences, patterns using them are an error.
+func compileRegex(pattern, options string) (*regexp.Regexp, error) {
+	var flags string
+	for _, o := range options {
+		switch o {
+		case 'i', 'm', 's':
+			flags += string(o)
+		case 'x':
+			pattern = stripExtended(pattern)
+		case 'u':
+		default:
+			return nil, fmt.Errorf("invalid regex option %q", o)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported regular expression: %w", err)
+	}
+
+	return re, nil
+}
+
+// stripExtended removes the whitespace and # comments the x option ignores, outside character classes
+func stripExtended(pattern string) string {
+	var b strings.Builder
+	inClass, inComment := false, false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case inComment:
+			inComment = c != '\n'
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			b.WriteByte(pattern[i+1])
+			i++
+		case inClass:
+			inClass = c != ']'
+			b.WriteByte(c)
+		case c == '[':
+			inClass = true
+			b.WriteByte(c)
+		case c == '#':
+			inComment = true
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// bsonTypes maps the $type aliases to BSON type numbers, "number" is any numeric type
+var bsonTypes = map[string]int{
+	"double": 1, "string": 2, "object": 3, "array": 4, "binData": 5, "undefined": 6, "objectId": 7, "bool": 8,
+	"date": 9, "null": 10, "regex": 11, "dbPointer": 12, "javascript": 13, "symbol": 14, "javascriptWithScope": 15,
+	"int": 16, "timestamp": 17, "long": 18, "decimal": 19, "minKey": -1, "maxKey": 127,
+}
+
+// bsonType returns the BSON type number of a decoded value
+func bsonType(v any) int {
+	switch v.(type) {
+	case float64:
+		return 1
+	case string:
+		return 2
+	case bson.D:
+		return 3
+	case bson.A:
+		return 4
+	case primitive.Binary:
+		return 5
+	case primitive.Undefined:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	case nil, primitive.Null:
+		return 10
+	case primitive.Regex:
+		return 11
+	case primitive.DBPointer:
+		return 12
+	case primitive.JavaScript:
+		return 13
+	case primitive.Symbol:
+		return 14
+	case primitive.CodeWithScope:
+		return 15
+	case int32:
+		return 16
+	case primitive.Timestamp:
+		return 17
+	case int64:
+		return 18
+	case primitive.Decimal128:
+		return 19
+	case primitive.MinKey:
+		return -1
+	case primitive.MaxKey:
+		return 127
+	}
+
+	return 0
+}
+
+// matchType implements $type with aliases or type numbers. "array" matches array fields, other types match the
+// field or an element of an array field.
+func matchType(f field, value any) (bool, error) {
+	list, ok := value.(bson.A)
+	if !ok {
+		list = bson.A{value}
+	}
+	var codes []int
+	number := false
+	for _, t := range list {
+		switch v := t.(type) {
+		case string:
+			if v == "number" {
+				number = true
+				continue
+			}
+			code, ok := bsonTypes[v]
+			if !ok {
+				return false, fmt.Errorf("unknown type name alias: %s", v)
+			}
+			codes = append(codes, code)
+		default:
+			n, ok := toFloat(v)
+			if !ok {
+				return false, fmt.Errorf("$type needs type names or numbers, got %v", t)
+			}
+			codes = append(codes, int(n))
+		}
+	}
+	is := func(v any) bool {
+		code := bsonType(v)
+		if number && (code == 1 || code == 16 || code == 18 || code == 19) {
+			return true
+		}
+		for _, c := range codes {
+			if c == code {
+				return true
+			}
+		}
+		return false
+	}
+
+	return anyValue(f, is), nil
+}
@@ -0,0 +1,150 @@
+package chapter3
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestMatch(t *testing.T) {
+	doc := bson.D{
+		{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}, {Key: "last", Value: "Schmoe"}}},
+		{Key: "age", Value: 23},
+		{Key: "nick", Value: nil},
+		{Key: "tags", Value: bson.A{"go", "mongo"}},
+		{Key: "scores", Value: bson.A{5, 25}},
+		{Key: "comments", Value: bson.A{
+			bson.D{{Key: "author", Value: "Joe"}, {Key: "score", Value: 3}},
+			bson.D{{Key: "author", Value: "Mary"}, {Key: "score", Value: 6}, {Key: "edited", Value: true}},
+		}},
+	}
+	for _, tc := range []struct {
+		name   string
+		filter bson.D
+		want   bool
+	}{
+		{"embedded path", bson.D{{Key: "name.first", Value: "Joe"}}, true},
+		{"embedded document", bson.D{{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}, {Key: "last", Value: "Schmoe"}}}}, true},
+		{"embedded document field order", bson.D{{Key: "name", Value: bson.D{{Key: "last", Value: "Schmoe"}, {Key: "first", Value: "Joe"}}}}, false},
+		{"array element", bson.D{{Key: "tags", Value: "go"}}, true},
+		{"whole array", bson.D{{Key: "tags", Value: bson.A{"go", "mongo"}}}, true},
+		{"array order", bson.D{{Key: "tags", Value: bson.A{"mongo", "go"}}}, false},
+		{"path through array", bson.D{{Key: "comments.author", Value: "Mary"}}, true},
+		{"array index", bson.D{{Key: "comments.0.author", Value: "Mary"}}, false},
+		{"null matches null", bson.D{{Key: "nick", Value: nil}}, true},
+		{"null matches missing", bson.D{{Key: "email", Value: nil}}, true},
+		{"null matches missing in an element", bson.D{{Key: "comments.edited", Value: nil}}, true},
+		{"exists null", bson.D{{Key: "nick", Value: bson.D{{Key: "$exists", Value: true}}}}, true},
+		{"exists missing", bson.D{{Key: "email", Value: bson.D{{Key: "$exists", Value: true}}}}, false},
+		{"ne null", bson.D{{Key: "email", Value: bson.D{{Key: "$ne", Value: nil}}}}, false},
+		{"gte null", bson.D{{Key: "email", Value: bson.D{{Key: "$gte", Value: nil}}}}, true},
+		{"numbers of different types", bson.D{{Key: "age", Value: 23.0}}, true},
+		{"type bracketing", bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: "a"}}}}, false},
+		{"max key", bson.D{{Key: "age", Value: bson.D{{Key: "$lt", Value: primitive.MaxKey{}}}}}, true},
+		{"range across elements", bson.D{{Key: "scores", Value: bson.D{{Key: "$gt", Value: 10}, {Key: "$lt", Value: 20}}}}, true},
+		{"range in one element", bson.D{{Key: "scores", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: 10}, {Key: "$lt", Value: 20}}}}}}, false},
+		{"elem match documents", bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "author", Value: "Joe"}, {Key: "score", Value: bson.D{{Key: "$gte", Value: 5}}}}}}}}, false},
+		{"elem match or", bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "author", Value: "Bob"}}, bson.D{{Key: "edited", Value: true}}}}}}}}}, true},
+		{"elem match and", bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "author", Value: "Joe"}}, bson.D{{Key: "edited", Value: true}}}}}}}}}, false},
+		{"documents across elements", bson.D{{Key: "comments.author", Value: "Joe"}, {Key: "comments.score", Value: bson.D{{Key: "$gte", Value: 5}}}}, true},
+		{"in", bson.D{{Key: "age", Value: bson.D{{Key: "$in", Value: bson.A{18, 23}}}}}, true},
+		{"in regex", bson.D{{Key: "tags", Value: bson.D{{Key: "$in", Value: bson.A{primitive.Regex{Pattern: "^mon"}}}}}}, true},
+		{"nin missing", bson.D{{Key: "email", Value: bson.D{{Key: "$nin", Value: bson.A{"a"}}}}}, true},
+		{"all", bson.D{{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{"mongo", "go"}}}}}, true},
+		{"all missing one", bson.D{{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{"go", "sql"}}}}}, false},
+		{"all empty", bson.D{{Key: "tags", Value: bson.D{{Key: "$all", Value: bson.A{}}}}}, false},
+		{"size", bson.D{{Key: "tags", Value: bson.D{{Key: "$size", Value: 2}}}}, true},
+		{"size of a scalar", bson.D{{Key: "age", Value: bson.D{{Key: "$size", Value: 1}}}}, false},
+		{"not", bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: 23}}}}}}, false},
+		{"not missing", bson.D{{Key: "email", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: 23}}}}}}, true},
+		{"not regex", bson.D{{Key: "name.first", Value: bson.D{{Key: "$not", Value: primitive.Regex{Pattern: "^j"}}}}}, true},
+		{"regex", bson.D{{Key: "name.first", Value: bson.D{{Key: "$regex", Value: "^j"}, {Key: "$options", Value: "i"}}}}, true},
+		{"regex value", bson.D{{Key: "name.last", Value: primitive.Regex{Pattern: "moe$"}}}, true},
+		{"regex extended", bson.D{{Key: "name.first", Value: bson.D{{Key: "$regex", Value: "^ J o e  # the name"}, {Key: "$options", Value: "x"}}}}, true},
+		{"type", bson.D{{Key: "age", Value: bson.D{{Key: "$type", Value: "int"}}}}, true},
+		{"type number", bson.D{{Key: "age", Value: bson.D{{Key: "$type", Value: bson.A{"string", "number"}}}}}, true},
+		{"type array", bson.D{{Key: "tags", Value: bson.D{{Key: "$type", Value: "array"}}}}, true},
+		{"type of elements", bson.D{{Key: "tags", Value: bson.D{{Key: "$type", Value: 2}}}}, true},
+		{"type null", bson.D{{Key: "email", Value: bson.D{{Key: "$type", Value: "null"}}}}, false},
+		{"or", bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "age", Value: 1}}, bson.D{{Key: "tags", Value: "go"}}}}}, true},
+		{"nor", bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "age", Value: 1}}, bson.D{{Key: "tags", Value: "go"}}}}}, false},
+	} {
+		got, err := Match(tc.filter, doc)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: Match(%v) = %v, want %v", tc.name, tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestMatchComparisons(t *testing.T) {
+	decimal := func(s string) primitive.Decimal128 {
+		d, err := primitive.ParseDecimal128(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	cond := func(op string, v any) bson.D { return bson.D{{Key: "v", Value: bson.D{{Key: op, Value: v}}}} }
+	code := primitive.CodeWithScope{Code: "f()", Scope: bson.D{{Key: "x", Value: int32(1)}}}
+	for _, tc := range []struct {
+		name   string
+		value  any
+		filter bson.D
+		want   bool
+	}{
+		{"symbol and string", "b", cond("$gt", primitive.Symbol("a")), true},
+		{"string and symbol", primitive.Symbol("a"), cond("$lt", "b"), true},
+		{"symbol equals string", primitive.Symbol("a"), cond("$eq", "a"), true},
+		{"decimals by value", decimal("10"), cond("$gt", decimal("9")), true},
+		{"decimal and int", decimal("2.5"), cond("$lt", 3), true},
+		{"decimal equals double", decimal("0.50"), cond("$eq", 0.5), true},
+		{"decimal NaN", decimal("NaN"), cond("$lt", -1e300), true},
+		{"decimal infinity", decimal("Infinity"), cond("$gt", int64(1)<<62), true},
+		{"int64 beyond 2^53", int64(1)<<53 + 1, cond("$gt", int64(1)<<53), true},
+		{"int64 and double beyond 2^53", int64(1)<<53 + 1, cond("$gt", float64(int64(1)<<53)), true},
+		{"code with scope", code, cond("$eq", code), true},
+		{"code with another scope", code, cond("$eq", primitive.CodeWithScope{Code: "f()", Scope: bson.D{}}), false},
+		{"javascript and code with scope", primitive.JavaScript("f()"), cond("$eq", code), false},
+	} {
+		got, err := Match(tc.filter, bson.D{{Key: "v", Value: tc.value}})
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: Match(%v) = %v, want %v", tc.name, tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	for _, filter := range []bson.D{
+		{{Key: "$where", Value: "true"}},
+		{{Key: "a", Value: bson.D{{Key: "$near", Value: 1}}}},
+		{{Key: "a", Value: bson.D{{Key: "$size", Value: -1}}}},
+		{{Key: "a", Value: bson.D{{Key: "$type", Value: "text"}}}},
+		{{Key: "a", Value: bson.D{{Key: "$not", Value: 1}}}},
+		{{Key: "a", Value: bson.D{{Key: "$regex", Value: "(?=a)"}}}},
+		{{Key: "a", Value: bson.D{{Key: "$options", Value: "i"}}}},
+		{{Key: "$or", Value: bson.A{}}},
+	} {
+		if _, err := Match(filter, bson.D{{Key: "a", Value: "x"}}); err == nil {
+			t.Errorf("%v: expected an error", filter)
+		}
+	}
+
+	// bson.M and structs are accepted
+	ok, err := Match(bson.M{"title": "post"}, struct {
+		Title string `bson:"title"`
+	}{"post"})
+	if err != nil || !ok {
+		t.Fatalf("Match = %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,153 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type memoryOpKind int
+
+const (
+	memoryInsert memoryOpKind = iota
+	memoryUpdate
+	memoryReplace
+	memoryDelete
+)
+
+// memoryOp is a normalized mongo.WriteModel
+type memoryOp struct {
+	kind   memoryOpKind
+	filter bson.D
+	doc    bson.D
+	multi  bool
+	upsert bool
+	// arrayFilters of an update
+	arrayFilters []bson.D
+}
+
+func newMemoryOp(model mongo.WriteModel) (memoryOp, error) {
+	var (
+		op  memoryOp
+		err error
+	)
+	switch m := model.(type) {
+	case *mongo.InsertOneModel:
+		op.kind = memoryInsert
+		op.doc, err = toDocument(m.Document)
+	case *mongo.UpdateOneModel:
+		op.kind = memoryUpdate
+		op.upsert = m.Upsert != nil && *m.Upsert
+		if op.filter, op.doc, err = updateDocuments(m.Filter, m.Update); err == nil {
+			op.arrayFilters, err = arrayFilterDocuments(m.ArrayFilters)
+		}
+	case *mongo.UpdateManyModel:
+		op.kind, op.multi = memoryUpdate, true
+		op.upsert = m.Upsert != nil && *m.Upsert
+		if op.filter, op.doc, err = updateDocuments(m.Filter, m.Update); err == nil {
+			op.arrayFilters, err = arrayFilterDocuments(m.ArrayFilters)
+		}
+	case *mongo.ReplaceOneModel:
+		op.kind = memoryReplace
+		op.upsert = m.Upsert != nil && *m.Upsert
+		if op.filter, err = toDocument(m.Filter); err == nil {
+			op.doc, err = toDocument(m.Replacement)
+		}
+	case *mongo.DeleteOneModel:
+		op.kind = memoryDelete
+		op.filter, err = toDocument(m.Filter)
+	case *mongo.DeleteManyModel:
+		op.kind, op.multi = memoryDelete, true
+		op.filter, err = toDocument(m.Filter)
+	default:
+		err = fmt.Errorf("unsupported write model %T", model)
+	}
+
+	return op, err
+}
+
+// BulkWrite runs the models one after another while holding the store lock.
+// Like the server, an ordered bulk write stops at the first failure and an unordered one attempts every model.
+func (s *MemoryStore) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	ordered := true
+	if o := options.MergeBulkWriteOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+	ops := make([]memoryOp, len(models))
+	for i, model := range models {
+		op, err := newMemoryOp(model)
+		if err != nil {
+			return nil, err
+		}
+		ops[i] = op
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]any{}}
+	var bwe mongo.BulkWriteException
+	for i, op := range ops {
+		err := s.applyLocked(op, int64(i), result)
+		if err == nil {
+			continue
+		}
+		var we mongo.WriteError
+		if !errors.As(err, &we) {
+			we = mongo.WriteError{Message: err.Error()}
+		}
+		we.Index = i
+		bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: we, Request: models[i]})
+		if ordered {
+			break
+		}
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return result, bwe
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) applyLocked(op memoryOp, index int64, result *mongo.BulkWriteResult) error {
+	switch op.kind {
+	case memoryInsert:
+		if _, err := s.insert(op.doc); err != nil {
+			return err
+		}
+		result.InsertedCount++
+	case memoryDelete:
+		deleted, err := s.deleteLocked(op.filter, op.multi)
+		if err != nil {
+			return err
+		}
+		result.DeletedCount += deleted
+	default:
+		var (
+			rs  *mongo.UpdateResult
+			err error
+		)
+		if op.kind == memoryReplace {
+			rs, err = s.replaceLocked(op.filter, op.doc, op.upsert)
+		} else {
+			rs, err = s.updateLocked(op.filter, op.doc, op.arrayFilters, op.multi, op.upsert)
+		}
+		if err != nil {
+			return err
+		}
+		result.MatchedCount += rs.MatchedCount
+		result.ModifiedCount += rs.ModifiedCount
+		if rs.UpsertedCount > 0 {
+			result.UpsertedCount++
+			result.UpsertedIDs[index] = rs.UpsertedID
+		}
+	}
+
+	return nil
+}
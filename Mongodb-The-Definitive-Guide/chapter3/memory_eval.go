@@ -0,0 +1,430 @@
+package chapter3
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+The helpers below give MemoryStore just enough of MongoDB's update semantics to run the chapter3 examples, queries are
+matched by Match (see match.go) and projections applied by Project (see project.go).
+Documents are normalized through a bson round trip, so every value is one of the types the driver decodes into
+a bson.D: bson.D, bson.A, string, int32, int64, float64, bool, nil, primitive.ObjectID, primitive.DateTime ...
+*/
+
+// toDocument marshals v and decodes it back into a bson.D
+func toDocument(v any) (bson.D, error) {
+	if d, ok := v.(bson.D); v == nil || (ok && d == nil) {
+		return bson.D{}, nil
+	}
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = bson.D{}
+	}
+
+	return doc, nil
+}
+
+// copyValue returns a deep copy of documents and arrays, other values are immutable
+func copyValue(v any) any {
+	switch t := v.(type) {
+	case bson.D:
+		out := make(bson.D, len(t))
+		for i, e := range t {
+			out[i] = bson.E{Key: e.Key, Value: copyValue(e.Value)}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(t))
+		for i, e := range t {
+			out[i] = copyValue(e)
+		}
+		return out
+	}
+
+	return v
+}
+
+func isOperatorDocument(v any) bool {
+	d, ok := v.(bson.D)
+	return ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+// getPath returns the value stored at a dotted path without traversing arrays implicitly
+func getPath(v any, path []string) (any, bool) {
+	if len(path) == 0 {
+		return v, true
+	}
+	switch t := v.(type) {
+	case bson.D:
+		for _, e := range t {
+			if e.Key == path[0] {
+				return getPath(e.Value, path[1:])
+			}
+		}
+	case bson.A:
+		if idx, err := strconv.Atoi(path[0]); err == nil && idx >= 0 && idx < len(t) {
+			return getPath(t[idx], path[1:])
+		}
+	}
+
+	return nil, false
+}
+
+// setPath stores value at a dotted path, creating embedded documents as needed
+func setPath(v any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch t := v.(type) {
+	case bson.D:
+		for i, e := range t {
+			if e.Key == path[0] {
+				child, err := setPath(e.Value, path[1:], value)
+				if err != nil {
+					return nil, err
+				}
+				t[i].Value = child
+				return t, nil
+			}
+		}
+		child, err := setPath(bson.D{}, path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		return append(t, bson.E{Key: path[0], Value: child}), nil
+	case bson.A:
+		idx, err := strconv.Atoi(path[0])
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("cannot create field %q in array", path[0])
+		}
+		for len(t) <= idx {
+			t = append(t, nil)
+		}
+		child, err := setPath(t[idx], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[idx] = child
+		return t, nil
+	}
+
+	return nil, fmt.Errorf("cannot create field %q in element %v", path[0], v)
+}
+
+// unsetPath removes the field at a dotted path, array elements are set to null like $unset does
+func unsetPath(v any, path []string) any {
+	switch t := v.(type) {
+	case bson.D:
+		for i, e := range t {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				return append(t[:i:i], t[i+1:]...)
+			}
+			t[i].Value = unsetPath(e.Value, path[1:])
+			return t
+		}
+	case bson.A:
+		idx, err := strconv.Atoi(path[0])
+		if err != nil || idx < 0 || idx >= len(t) {
+			return t
+		}
+		if len(path) == 1 {
+			t[idx] = nil
+			return t
+		}
+		t[idx] = unsetPath(t[idx], path[1:])
+	}
+
+	return v
+}
+
+func splitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+
+	return 0, false
+}
+
+// typeOrder follows the BSON comparison order used by sort
+func typeOrder(v any) int {
+	switch v.(type) {
+	case primitive.MinKey:
+		return 1
+	case nil, primitive.Null, primitive.Undefined:
+		return 2
+	case int32, int64, float64, int, primitive.Decimal128:
+		return 3
+	case string, primitive.Symbol:
+		return 4
+	case bson.D:
+		return 5
+	case bson.A:
+		return 6
+	case primitive.Binary:
+		return 7
+	case primitive.ObjectID:
+		return 8
+	case bool:
+		return 9
+	case primitive.DateTime:
+		return 10
+	case primitive.Timestamp:
+		return 11
+	case primitive.Regex:
+		return 12
+	case primitive.DBPointer:
+		return 13
+	case primitive.JavaScript:
+		return 14
+	case primitive.CodeWithScope:
+		return 15
+	case primitive.MaxKey:
+		return 17
+	}
+
+	return 16
+}
+
+// compareValues orders two values, values of different types are ordered by typeOrder
+func compareValues(a, b any) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return compareInts(ta, tb)
+	}
+	switch x := a.(type) {
+	case string, primitive.Symbol:
+		return strings.Compare(stringValue(a), stringValue(b))
+	case int32, int64, float64, int, primitive.Decimal128:
+		return compareNumbers(a, b)
+	case nil, primitive.Null, primitive.Undefined, primitive.MinKey, primitive.MaxKey:
+		return 0
+	case bool:
+		y := b.(bool)
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case primitive.ObjectID:
+		y := b.(primitive.ObjectID)
+		return bytes.Compare(x[:], y[:])
+	case primitive.Binary:
+		// binary data sorts by length, then subtype, then bytes
+		y := b.(primitive.Binary)
+		if len(x.Data) != len(y.Data) {
+			return compareInts(len(x.Data), len(y.Data))
+		}
+		if x.Subtype != y.Subtype {
+			return compareInts(int(x.Subtype), int(y.Subtype))
+		}
+		return bytes.Compare(x.Data, y.Data)
+	case primitive.DateTime:
+		return compareInts(int(x), int(b.(primitive.DateTime)))
+	case primitive.Timestamp:
+		y := b.(primitive.Timestamp)
+		if x.T != y.T {
+			return compareInts(int(x.T), int(y.T))
+		}
+		return compareInts(int(x.I), int(y.I))
+	case bson.D:
+		y := b.(bson.D)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := strings.Compare(x[i].Key, y[i].Key); c != 0 {
+				return c
+			}
+			if c := compareValues(x[i].Value, y[i].Value); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(x), len(y))
+	case bson.A:
+		y := b.(bson.A)
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInts(len(x), len(y))
+	case primitive.Regex:
+		y := b.(primitive.Regex)
+		if c := strings.Compare(x.Pattern, y.Pattern); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Options, y.Options)
+	case primitive.DBPointer:
+		y := b.(primitive.DBPointer)
+		if c := strings.Compare(x.DB, y.DB); c != 0 {
+			return c
+		}
+		return bytes.Compare(x.Pointer[:], y.Pointer[:])
+	case primitive.JavaScript:
+		return strings.Compare(string(x), string(b.(primitive.JavaScript)))
+	case primitive.CodeWithScope:
+		y := b.(primitive.CodeWithScope)
+		if c := strings.Compare(string(x.Code), string(y.Code)); c != 0 {
+			return c
+		}
+		return compareValues(x.Scope, y.Scope)
+	}
+
+	// types the driver does not decode into, ordered by type then printed value
+	if c := strings.Compare(fmt.Sprintf("%T", a), fmt.Sprintf("%T", b)); c != 0 {
+		return c
+	}
+
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+// stringValue returns the text of a string or a symbol, they compare as strings
+func stringValue(v any) string {
+	if s, ok := v.(primitive.Symbol); ok {
+		return string(s)
+	}
+
+	return v.(string)
+}
+
+// number is a numeric value of any BSON type, exact: NaN, an infinity of sign inf or the rational r
+type number struct {
+	nan bool
+	inf int
+	r   *big.Rat
+}
+
+func toNumber(v any) number {
+	switch n := v.(type) {
+	case int32:
+		return number{r: new(big.Rat).SetInt64(int64(n))}
+	case int64:
+		return number{r: new(big.Rat).SetInt64(n)}
+	case int:
+		return number{r: new(big.Rat).SetInt64(int64(n))}
+	case float64:
+		switch {
+		case math.IsNaN(n):
+			return number{nan: true}
+		case math.IsInf(n, 0):
+			return number{inf: int(math.Copysign(1, n))}
+		}
+		return number{r: new(big.Rat).SetFloat64(n)}
+	case primitive.Decimal128:
+		if n.IsNaN() {
+			return number{nan: true}
+		}
+		if inf := n.IsInf(); inf != 0 {
+			return number{inf: inf}
+		}
+		coefficient, exp, err := n.BigInt()
+		if err != nil {
+			return number{nan: true}
+		}
+		r := new(big.Rat).SetInt(coefficient)
+		scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(absInt(exp))), nil))
+		if exp < 0 {
+			return number{r: r.Quo(r, scale)}
+		}
+		return number{r: r.Mul(r, scale)}
+	}
+
+	return number{nan: true}
+}
+
+// compareNumbers orders numbers of any BSON type by value, exactly: int64 values above 2^53 are not rounded to float64
+// and decimals are not compared as text. NaN is less than every other number, as in MongoDB.
+func compareNumbers(a, b any) int {
+	if x, ok := toInt64(a); ok {
+		if y, ok := toInt64(b); ok {
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		}
+	}
+	x, y := toNumber(a), toNumber(b)
+	switch {
+	case x.nan || y.nan:
+		return compareInts(boolInt(!x.nan), boolInt(!y.nan))
+	case x.inf != 0 || y.inf != 0:
+		return compareInts(x.inf, y.inf)
+	}
+
+	return x.r.Cmp(y.r)
+}
+
+func toInt64(v any) (int64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+
+	return n
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+func equalValues(a, b any) bool {
+	return typeOrder(a) == typeOrder(b) && compareValues(a, b) == 0
+}
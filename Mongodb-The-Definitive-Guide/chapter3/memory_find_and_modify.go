@@ -0,0 +1,151 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// firstMatchLocked returns the position of the first document matching f in sortSpec order, or -1.
+// Callers must hold s.mu.
+func (s *MemoryStore) firstMatchLocked(f bson.D, sortSpec any) (int, error) {
+	keys, err := toDocument(sortSpec)
+	if err != nil {
+		return -1, err
+	}
+	first := -1
+	for i, doc := range s.docs {
+		ok, err := match(f, doc)
+		if err != nil {
+			return -1, err
+		}
+		if !ok {
+			continue
+		}
+		if first == -1 || lessBy(keys, doc, s.docs[first]) {
+			first = i
+		}
+		if len(keys) == 0 {
+			break
+		}
+	}
+
+	return first, nil
+}
+
+func returnAfter(rd *options.ReturnDocument) bool {
+	return rd != nil && *rd == options.After
+}
+
+// FindOneAndUpdate supports the Sort, Projection, ReturnDocument, Upsert and ArrayFilters options
+func (s *MemoryStore) FindOneAndUpdate(ctx context.Context, filter any, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndUpdateOptions(opts...)
+	f, u, err := updateDocuments(filter, update)
+	if err != nil {
+		return errorResult(err)
+	}
+	arrayFilters, err := arrayFilterDocuments(o.ArrayFilters)
+	if err != nil {
+		return errorResult(err)
+	}
+	uc := updateContext{filter: f, arrayFilters: arrayFilters}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.firstMatchLocked(f, o.Sort)
+	if err != nil {
+		return errorResult(err)
+	}
+	var before, after bson.D
+	switch {
+	case i >= 0:
+		before = s.docs[i]
+		if err := s.updateAt(i, u, uc, &mongo.UpdateResult{}); err != nil {
+			return errorResult(writeException(err))
+		}
+		after = s.docs[i]
+	case o.Upsert != nil && *o.Upsert:
+		uc.inserting = true
+		doc, err := applyUpdate(seedFromFilter(f), u, uc)
+		if err != nil {
+			return errorResult(writeException(mongo.WriteError{Message: err.Error()}))
+		}
+		if _, err := s.insert(doc); err != nil {
+			return errorResult(writeException(err))
+		}
+		after = s.docs[len(s.docs)-1]
+	}
+	if returnAfter(o.ReturnDocument) {
+		return projectedResult(after, o.Projection, f)
+	}
+
+	return projectedResult(before, o.Projection, f)
+}
+
+// FindOneAndReplace supports the Sort, Projection, ReturnDocument and Upsert options
+func (s *MemoryStore) FindOneAndReplace(ctx context.Context, filter any, replacement any, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndReplaceOptions(opts...)
+	f, err := toDocument(filter)
+	if err != nil {
+		return errorResult(err)
+	}
+	r, err := toDocument(replacement)
+	if err != nil {
+		return errorResult(err)
+	}
+	if isOperatorDocument(r) {
+		return errorResult(errors.New("replacement document cannot contain keys beginning with '$'"))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.firstMatchLocked(f, o.Sort)
+	if err != nil {
+		return errorResult(err)
+	}
+	var before, after bson.D
+	switch {
+	case i >= 0:
+		before = s.docs[i]
+		if err := s.replaceAt(i, withID(r, fieldValue(before, "_id")), &mongo.UpdateResult{}); err != nil {
+			return errorResult(writeException(err))
+		}
+		after = s.docs[i]
+	case o.Upsert != nil && *o.Upsert:
+		if _, err := s.replaceLocked(f, r, true); err != nil {
+			return errorResult(writeException(err))
+		}
+		after = s.docs[len(s.docs)-1]
+	}
+	if returnAfter(o.ReturnDocument) {
+		return projectedResult(after, o.Projection, f)
+	}
+
+	return projectedResult(before, o.Projection, f)
+}
+
+// FindOneAndDelete supports the Sort and Projection options
+func (s *MemoryStore) FindOneAndDelete(ctx context.Context, filter any, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	o := options.MergeFindOneAndDeleteOptions(opts...)
+	f, err := toDocument(filter)
+	if err != nil {
+		return errorResult(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.firstMatchLocked(f, o.Sort)
+	if err != nil {
+		return errorResult(err)
+	}
+	if i < 0 {
+		return errorResult(mongo.ErrNoDocuments)
+	}
+	doc := s.docs[i]
+	s.docs = append(s.docs[:i:i], s.docs[i+1:]...)
+
+	return projectedResult(doc, o.Projection, f)
+}
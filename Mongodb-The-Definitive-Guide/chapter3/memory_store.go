@@ -0,0 +1,627 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const duplicateKeyCode = 11000
+
+// MemoryStore is a DocumentStore that keeps documents in memory, in insertion order.
+// It understands the query and update operators used by the chapter3 examples, enforces a unique "_id"
+// and reports errors with the same types as the driver, so code written against a *mongo.Collection behaves the same.
+type MemoryStore struct {
+	mu   sync.Mutex
+	docs []bson.D
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// insert appends doc, generating an ObjectID when "_id" is missing. Callers must hold s.mu.
+func (s *MemoryStore) insert(doc bson.D) (any, error) {
+	id, ok := getPath(doc, []string{"_id"})
+	if !ok {
+		id = primitive.NewObjectID()
+		doc = withID(doc, id)
+	}
+	for _, d := range s.docs {
+		if existing, _ := getPath(d, []string{"_id"}); equalValues(existing, id) {
+			return nil, mongo.WriteError{
+				Code:    duplicateKeyCode,
+				Message: fmt.Sprintf("E11000 duplicate key error collection: memory index: _id_ dup key: { _id: %v }", id),
+			}
+		}
+	}
+	s.docs = append(s.docs, doc)
+
+	return id, nil
+}
+
+// InsertOne ...
+func (s *MemoryStore) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, err := toDocument(document)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, err := s.insert(doc)
+	if err != nil {
+		var we mongo.WriteError
+		if errors.As(err, &we) {
+			return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{we}}
+		}
+		return nil, err
+	}
+
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+// InsertMany stops at the first failure when ordered (the default), otherwise it tries every document
+func (s *MemoryStore) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	if len(documents) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	ordered := true
+	if o := options.MergeInsertManyOptions(opts...); o.Ordered != nil {
+		ordered = *o.Ordered
+	}
+	// like the driver, ids are given to the documents before the write and all of them are returned, failures included
+	docs := make([]bson.D, 0, len(documents))
+	result := &mongo.InsertManyResult{}
+	for _, document := range documents {
+		doc, err := toDocument(document)
+		if err != nil {
+			return nil, err
+		}
+		id, ok := getPath(doc, []string{"_id"})
+		if !ok {
+			id = primitive.NewObjectID()
+			doc = withID(doc, id)
+		}
+		docs = append(docs, doc)
+		result.InsertedIDs = append(result.InsertedIDs, id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bwe mongo.BulkWriteException
+	for i, doc := range docs {
+		if _, err := s.insert(doc); err != nil {
+			var we mongo.WriteError
+			if !errors.As(err, &we) {
+				return result, err
+			}
+			we.Index = i
+			bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: we, Request: mongo.NewInsertOneModel().SetDocument(doc)})
+			if ordered {
+				break
+			}
+		}
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return result, bwe
+	}
+
+	return result, nil
+}
+
+// matching returns copies of the documents that match filter. Callers must hold s.mu.
+func (s *MemoryStore) matching(filter any) ([]bson.D, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	var out []bson.D
+	for _, doc := range s.docs {
+		ok, err := match(f, doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			out = append(out, copyValue(doc).(bson.D))
+		}
+	}
+
+	return out, nil
+}
+
+// Find supports the Sort, Skip, Limit and Projection options
+func (s *MemoryStore) Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	o := options.MergeFindOptions(opts...)
+	if err := checkSkip(o.Skip); err != nil {
+		return nil, err
+	}
+	projection, err := toDocument(o.Projection)
+	if err != nil {
+		return nil, err
+	}
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	docs, err := s.matching(f)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := sortDocuments(docs, o.Sort); err != nil {
+		return nil, err
+	}
+	if o.Skip != nil {
+		docs = docs[minInt(int(*o.Skip), len(docs)):]
+	}
+	if o.Limit != nil && *o.Limit != 0 {
+		limit := int(*o.Limit)
+		if limit < 0 {
+			limit = -limit
+		}
+		docs = docs[:minInt(limit, len(docs))]
+	}
+	results := make([]any, len(docs))
+	for i, doc := range docs {
+		if results[i], err = applyProjection(doc, projection, f); err != nil {
+			return nil, err
+		}
+	}
+
+	return mongo.NewCursorFromDocuments(results, nil, nil)
+}
+
+// FindOne supports the Sort, Skip and Projection options
+func (s *MemoryStore) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	o := options.MergeFindOneOptions(opts...)
+	if err := checkSkip(o.Skip); err != nil {
+		return errorResult(err)
+	}
+
+	s.mu.Lock()
+	docs, err := s.matching(filter)
+	s.mu.Unlock()
+	if err == nil {
+		err = sortDocuments(docs, o.Sort)
+	}
+	if err != nil {
+		return errorResult(err)
+	}
+	if o.Skip != nil {
+		docs = docs[minInt(int(*o.Skip), len(docs)):]
+	}
+	if len(docs) == 0 {
+		return errorResult(mongo.ErrNoDocuments)
+	}
+
+	return projectedResult(docs[0], o.Projection, filter)
+}
+
+// CountDocuments supports the Skip and Limit options
+func (s *MemoryStore) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+	o := options.MergeCountOptions(opts...)
+	if err := checkSkip(o.Skip); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	docs, err := s.matching(filter)
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	n := int64(len(docs))
+	if o.Skip != nil {
+		n -= *o.Skip
+		if n < 0 {
+			n = 0
+		}
+	}
+	if o.Limit != nil && *o.Limit > 0 && n > *o.Limit {
+		n = *o.Limit
+	}
+
+	return n, nil
+}
+
+// checkSkip rejects a negative skip like the server does
+func checkSkip(skip *int64) error {
+	if skip != nil && *skip < 0 {
+		return fmt.Errorf("skip value must be non-negative, but received: %d", *skip)
+	}
+
+	return nil
+}
+
+func errorResult(err error) *mongo.SingleResult {
+	return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+}
+
+// projectedResult returns doc, or mongo.ErrNoDocuments when doc is nil, as a SingleResult. filter is the query doc
+// was found with, for positional projections.
+func projectedResult(doc bson.D, projection, filter any) *mongo.SingleResult {
+	if doc == nil {
+		return errorResult(mongo.ErrNoDocuments)
+	}
+	p, err := toDocument(projection)
+	var f bson.D
+	if err == nil {
+		f, err = toDocument(filter)
+	}
+	if err == nil {
+		doc, err = applyProjection(doc, p, f)
+	}
+	if err != nil {
+		return errorResult(err)
+	}
+
+	return mongo.NewSingleResultFromDocument(doc, nil, nil)
+}
+
+func sortDocuments(docs []bson.D, sortSpec any) error {
+	if sortSpec == nil {
+		return nil
+	}
+	keys, err := toDocument(sortSpec)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return lessBy(keys, docs[i], docs[j])
+	})
+
+	return nil
+}
+
+// lessBy reports whether a sorts before b for the sort specification keys
+func lessBy(keys bson.D, a, b bson.D) bool {
+	for _, k := range keys {
+		va, _ := getPath(a, splitPath(k.Key))
+		vb, _ := getPath(b, splitPath(k.Key))
+		c := compareValues(va, vb)
+		if dir, _ := toFloat(k.Value); dir < 0 {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+
+	return false
+}
+
+// UpdateOne ...
+func (s *MemoryStore) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.update(filter, update, false, options.MergeUpdateOptions(opts...))
+}
+
+// UpdateMany ...
+func (s *MemoryStore) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return s.update(filter, update, true, options.MergeUpdateOptions(opts...))
+}
+
+func (s *MemoryStore) update(filter, update any, multi bool, o *options.UpdateOptions) (*mongo.UpdateResult, error) {
+	f, u, err := updateDocuments(filter, update)
+	if err != nil {
+		return nil, err
+	}
+	arrayFilters, err := arrayFilterDocuments(o.ArrayFilters)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.updateLocked(f, u, arrayFilters, multi, o.Upsert != nil && *o.Upsert)
+
+	return result, writeException(err)
+}
+
+// ReplaceOne supports the Upsert option
+func (s *MemoryStore) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	o := options.MergeReplaceOptions(opts...)
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+	r, err := toDocument(replacement)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.replaceLocked(f, r, o.Upsert != nil && *o.Upsert)
+
+	return result, writeException(err)
+}
+
+// updateDocuments normalizes the filter and update of an update operation
+func updateDocuments(filter, update any) (bson.D, bson.D, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := toDocument(update)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(u) == 0 || !isOperatorDocument(u) {
+		return nil, nil, errors.New("update document must contain key beginning with '$'")
+	}
+
+	return f, u, nil
+}
+
+// arrayFilterDocuments normalizes the filters bound to the $[<identifier>] operator
+func arrayFilterDocuments(af *options.ArrayFilters) ([]bson.D, error) {
+	if af == nil {
+		return nil, nil
+	}
+	out := make([]bson.D, len(af.Filters))
+	for i, filter := range af.Filters {
+		d, err := toDocument(filter)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = d
+	}
+
+	return out, nil
+}
+
+// writeException wraps a mongo.WriteError the way the driver reports single document write failures
+func writeException(err error) error {
+	var we mongo.WriteError
+	if errors.As(err, &we) {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{we}}
+	}
+
+	return err
+}
+
+// updateLocked applies u to the documents matching f. Failures of the write itself are returned as a mongo.WriteError.
+// Callers must hold s.mu.
+func (s *MemoryStore) updateLocked(f, u bson.D, arrayFilters []bson.D, multi, upsert bool) (*mongo.UpdateResult, error) {
+	result := &mongo.UpdateResult{}
+	uc := updateContext{filter: f, arrayFilters: arrayFilters}
+	for i, doc := range s.docs {
+		ok, err := match(f, doc)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		result.MatchedCount++
+		if err := s.updateAt(i, u, uc, result); err != nil {
+			return nil, err
+		}
+		if !multi {
+			break
+		}
+	}
+	if result.MatchedCount > 0 || !upsert {
+		return result, nil
+	}
+
+	uc.inserting = true
+	doc, err := applyUpdate(seedFromFilter(f), u, uc)
+	if err != nil {
+		return nil, mongo.WriteError{Message: err.Error()}
+	}
+
+	return s.upsertLocked(doc, result)
+}
+
+// updateAt applies u to the document at position i. Callers must hold s.mu.
+func (s *MemoryStore) updateAt(i int, u bson.D, uc updateContext, result *mongo.UpdateResult) error {
+	updated, err := applyUpdate(s.docs[i], u, uc)
+	if err != nil {
+		return mongo.WriteError{Message: err.Error()}
+	}
+
+	return s.replaceAt(i, updated, result)
+}
+
+// replaceLocked replaces the first document matching f with replacement, keeping its "_id".
+// Callers must hold s.mu.
+func (s *MemoryStore) replaceLocked(f, replacement bson.D, upsert bool) (*mongo.UpdateResult, error) {
+	if isOperatorDocument(replacement) {
+		return nil, errors.New("replacement document cannot contain keys beginning with '$'")
+	}
+	result := &mongo.UpdateResult{}
+	for i, doc := range s.docs {
+		ok, err := match(f, doc)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		result.MatchedCount++
+		updated := copyValue(replacement).(bson.D)
+		return result, s.replaceAt(i, withID(updated, fieldValue(doc, "_id")), result)
+	}
+	if !upsert {
+		return result, nil
+	}
+
+	doc := copyValue(replacement).(bson.D)
+	if id, ok := getPath(seedFromFilter(f), []string{"_id"}); ok {
+		doc = withID(doc, id)
+	}
+
+	return s.upsertLocked(doc, result)
+}
+
+// replaceAt stores updated at position i, it refuses to change "_id". Callers must hold s.mu.
+func (s *MemoryStore) replaceAt(i int, updated bson.D, result *mongo.UpdateResult) error {
+	doc := s.docs[i]
+	if !equalValues(fieldValue(doc, "_id"), fieldValue(updated, "_id")) {
+		return mongo.WriteError{Code: 66, Message: "Performing an update on the path '_id' would modify the immutable field '_id'"}
+	}
+	if !equalValues(doc, updated) {
+		result.ModifiedCount++
+		s.docs[i] = updated
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) upsertLocked(doc bson.D, result *mongo.UpdateResult) (*mongo.UpdateResult, error) {
+	id, err := s.insert(doc)
+	if err != nil {
+		return nil, err
+	}
+	result.UpsertedCount = 1
+	result.UpsertedID = id
+
+	return result, nil
+}
+
+// withID puts id in front of doc unless doc already has an "_id"
+func withID(doc bson.D, id any) bson.D {
+	if _, ok := getPath(doc, []string{"_id"}); ok {
+		return doc
+	}
+
+	return append(bson.D{{Key: "_id", Value: id}}, doc...)
+}
+
+func fieldValue(doc bson.D, key string) any {
+	v, _ := getPath(doc, []string{key})
+	return v
+}
+
+// seedFromFilter builds the document an upsert starts from: the equality conditions of the filter
+func seedFromFilter(filter bson.D) bson.D {
+	var node any = bson.D{}
+	for _, e := range filter {
+		if e.Key == "$and" {
+			if clauses, ok := e.Value.(bson.A); ok {
+				for _, c := range clauses {
+					if sub, ok := c.(bson.D); ok {
+						for _, se := range seedFromFilter(sub) {
+							node, _ = setPath(node, splitPath(se.Key), se.Value)
+						}
+					}
+				}
+			}
+			continue
+		}
+		if len(e.Key) == 0 || e.Key[0] == '$' {
+			continue
+		}
+		value := e.Value
+		if isOperatorDocument(value) {
+			ops := value.(bson.D)
+			if ops[0].Key != "$eq" {
+				continue
+			}
+			value = ops[0].Value
+		}
+		node, _ = setPath(node, splitPath(e.Key), copyValue(value))
+	}
+
+	return node.(bson.D)
+}
+
+// DeleteOne ...
+func (s *MemoryStore) DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return s.delete(filter, false)
+}
+
+// DeleteMany ...
+func (s *MemoryStore) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return s.delete(filter, true)
+}
+
+func (s *MemoryStore) delete(filter any, multi bool) (*mongo.DeleteResult, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted, err := s.deleteLocked(f, multi)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mongo.DeleteResult{DeletedCount: deleted}, nil
+}
+
+// deleteLocked removes the documents matching f. Callers must hold s.mu.
+func (s *MemoryStore) deleteLocked(f bson.D, multi bool) (int64, error) {
+	kept := s.docs[:0:0]
+	var deleted int64
+	for _, doc := range s.docs {
+		if multi || deleted == 0 {
+			ok, err := match(f, doc)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				deleted++
+				continue
+			}
+		}
+		kept = append(kept, doc)
+	}
+	s.docs = kept
+
+	return deleted, nil
+}
+
+// Drop removes every document
+func (s *MemoryStore) Drop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs = nil
+
+	return nil
+}
+
+// Snapshot returns a copy of the documents, which Restore can put back later
+func (s *MemoryStore) Snapshot() []bson.D {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	docs := make([]bson.D, len(s.docs))
+	for i, d := range s.docs {
+		docs[i] = copyValue(d).(bson.D)
+	}
+
+	return docs
+}
+
+// Restore replaces the documents with a Snapshot, rolling back the writes made since
+func (s *MemoryStore) Restore(snapshot []bson.D) {
+	docs := make([]bson.D, len(snapshot))
+	for i, d := range snapshot {
+		docs[i] = copyValue(d).(bson.D)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs = docs
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,119 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestMemoryStoreDuplicateKey(t *testing.T) {
+	ctx := context.Background()
+	docs := []any{
+		bson.D{{Key: "_id", Value: "0"}},
+		bson.D{{Key: "_id", Value: "0"}},
+		bson.D{{Key: "_id", Value: "1"}},
+	}
+
+	for _, ordered := range []bool{true, false} {
+		store := NewMemoryStore()
+		result, err := store.InsertMany(ctx, docs, options.InsertMany().SetOrdered(ordered))
+		if !mongo.IsDuplicateKeyError(err) {
+			t.Fatalf("ordered=%v: expected duplicate key error, got %v", ordered, err)
+		}
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) || len(bwe.WriteErrors) != 1 || bwe.WriteErrors[0].Index != 1 {
+			t.Fatalf("ordered=%v: unexpected write errors: %v", ordered, err)
+		}
+		want := 1
+		if !ordered {
+			want = 2
+		}
+		if n, _ := store.CountDocuments(ctx, bson.D{}); n != int64(want) {
+			t.Errorf("ordered=%v: inserted %d documents, want %d", ordered, n, want)
+		}
+		// like the driver, the result holds the id of every document, the failed and skipped ones included
+		if len(result.InsertedIDs) != len(docs) {
+			t.Errorf("ordered=%v: result has %d ids, want %d", ordered, len(result.InsertedIDs), len(docs))
+		}
+	}
+
+	store := NewMemoryStore()
+	store.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+	if _, err := store.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}}); !mongo.IsDuplicateKeyError(err) {
+		t.Fatalf("expected duplicate key error, got %v", err)
+	}
+}
+
+func TestMemoryStoreQuery(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.InsertMany(ctx, []any{
+		bson.M{"no": 1, "tags": bson.A{"a", "b"}, "name": bson.M{"first": "Joe"}},
+		bson.M{"no": 2, "tags": bson.A{"b"}},
+		bson.M{"no": 3},
+		bson.M{"no": 4.5},
+	})
+
+	tests := []struct {
+		name   string
+		filter bson.D
+		want   int
+	}{
+		{"equal", bson.D{{Key: "no", Value: 2}}, 1},
+		{"array element", bson.D{{Key: "tags", Value: "b"}}, 2},
+		{"dotted path", bson.D{{Key: "name.first", Value: "Joe"}}, 1},
+		{"range", bson.D{{Key: "no", Value: bson.D{{Key: "$gt", Value: 1}, {Key: "$lte", Value: 4}}}}, 2},
+		{"mixed numbers", bson.D{{Key: "no", Value: bson.D{{Key: "$gt", Value: 4}}}}, 1},
+		{"in", bson.D{{Key: "no", Value: bson.D{{Key: "$in", Value: bson.A{1, 3}}}}}, 2},
+		{"missing is null", bson.D{{Key: "tags", Value: nil}}, 2},
+		{"exists", bson.D{{Key: "tags", Value: bson.D{{Key: "$exists", Value: true}}}}, 2},
+		{"or", bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "no", Value: 1}}, bson.D{{Key: "no", Value: 3}}}}}, 2},
+	}
+	for _, tt := range tests {
+		if got := findAll(t, store, tt.filter); len(got) != tt.want {
+			t.Errorf("%s: got %d documents, want %d", tt.name, len(got), tt.want)
+		}
+	}
+
+	cur, err := store.Find(ctx, bson.D{}, options.Find().SetSort(bson.M{"no": -1}).SetSkip(1).SetLimit(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.M
+	cur.All(ctx, &docs)
+	if len(docs) != 2 || docs[0]["no"] != int32(3) || docs[1]["no"] != int32(2) {
+		t.Errorf("sort/skip/limit returned %v", docs)
+	}
+
+	if err := store.FindOne(ctx, bson.D{{Key: "no", Value: 9}}).Err(); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("expected ErrNoDocuments, got %v", err)
+	}
+
+	if _, err := store.Find(ctx, bson.D{}, options.Find().SetSkip(-1)); err == nil {
+		t.Error("Find: expected an error for a negative skip")
+	}
+	if err := store.FindOne(ctx, bson.D{}, options.FindOne().SetSkip(-1)).Err(); err == nil {
+		t.Error("FindOne: expected an error for a negative skip")
+	}
+	if _, err := store.CountDocuments(ctx, bson.D{}, options.Count().SetSkip(-1)); err == nil {
+		t.Error("CountDocuments: expected an error for a negative skip")
+	}
+}
+
+func TestMemoryStoreUpdateImmutableID(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	store.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}})
+
+	_, err := store.UpdateOne(ctx, bson.D{{Key: "_id", Value: 1}}, bson.D{{Key: "$set", Value: bson.D{{Key: "_id", Value: 2}}}})
+	if err == nil {
+		t.Fatal("expected an error when modifying _id")
+	}
+	if _, err := store.UpdateOne(ctx, bson.D{}, bson.D{{Key: "title", Value: "x"}}); err == nil {
+		t.Fatal("expected an error for an update without operators")
+	}
+}
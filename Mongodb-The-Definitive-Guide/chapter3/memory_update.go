@@ -0,0 +1,512 @@
+package chapter3
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// updateContext carries what the update operators need besides the document itself
+type updateContext struct {
+	// filter of the update, it locates the element addressed by the positional $ operator
+	filter bson.D
+	// arrayFilters bind the identifiers of the $[<identifier>] operator
+	arrayFilters []bson.D
+	// inserting is true when an upsert creates the document, $setOnInsert only applies then
+	inserting bool
+	// original is the document before the update, positional matches are resolved against it
+	original bson.D
+}
+
+// applyUpdate returns a copy of doc with the update operators applied
+func applyUpdate(doc bson.D, update bson.D, uc updateContext) (bson.D, error) {
+	if err := checkUpdatePaths(update); err != nil {
+		return nil, err
+	}
+	uc.original = doc
+	var node any = copyValue(doc)
+	for _, op := range update {
+		fields, ok := op.Value.(bson.D)
+		if !ok {
+			return nil, fmt.Errorf("modifier %s expects a document", op.Key)
+		}
+		for _, f := range fields {
+			paths, err := expandPath(node, splitPath(f.Key), uc)
+			if err != nil {
+				return nil, err
+			}
+			for _, path := range paths {
+				if node, err = applyOperator(op.Key, node, path, f.Value, uc); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return node.(bson.D), nil
+}
+
+func applyOperator(op string, node any, path []string, arg any, uc updateContext) (any, error) {
+	switch op {
+	case "$set":
+		return setPath(node, path, copyValue(arg))
+	case "$setOnInsert":
+		if !uc.inserting {
+			return node, nil
+		}
+		return setPath(node, path, copyValue(arg))
+	case "$unset":
+		return unsetPath(node, path), nil
+	case "$inc":
+		return incPath(node, path, arg)
+	case "$push":
+		return pushPath(node, path, arg)
+	case "$addToSet":
+		return addToSetPath(node, path, arg)
+	case "$pop":
+		return popPath(node, path, arg)
+	case "$rename":
+		return renamePath(node, path, arg)
+	case "$min":
+		return boundPath(node, path, arg, -1)
+	case "$max":
+		return boundPath(node, path, arg, 1)
+	case "$currentDate":
+		return currentDatePath(node, path, arg)
+	case "$pull":
+		return pullPath(node, path, func(el any) (bool, error) { return pullMatches(arg, el) })
+	case "$pullAll":
+		values, ok := arg.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("$pullAll requires an array argument but was given %v", arg)
+		}
+		return pullPath(node, path, func(el any) (bool, error) { return containsValue(values, el), nil })
+	}
+
+	return nil, fmt.Errorf("unsupported update operator: %s", op)
+}
+
+// checkUpdatePaths rejects updates touching the same field twice, like the server does
+func checkUpdatePaths(update bson.D) error {
+	var seen []string
+	for _, op := range update {
+		fields, _ := op.Value.(bson.D)
+		for _, f := range fields {
+			paths := []string{f.Key}
+			if to, ok := f.Value.(string); ok && op.Key == "$rename" {
+				paths = append(paths, to)
+			}
+			for _, p := range paths {
+				for _, s := range seen {
+					if pathsConflict(s, p) {
+						return fmt.Errorf("updating the path %q would create a conflict at %q", p, s)
+					}
+				}
+				seen = append(seen, p)
+			}
+		}
+	}
+
+	return nil
+}
+
+// expandPath replaces the array update operators $, $[] and $[<identifier>] in path with concrete indexes
+func expandPath(node any, path []string, uc updateContext) ([][]string, error) {
+	for i, seg := range path {
+		if !strings.HasPrefix(seg, "$") {
+			continue
+		}
+		prefix := path[:i]
+		value, _ := getPath(node, prefix)
+		elems, ok := value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("the path %q must exist in the document in order to apply array updates", strings.Join(prefix, "."))
+		}
+
+		var indexes []int
+		switch {
+		case seg == "$":
+			idx, err := positionalIndex(uc.original, prefix, uc.filter)
+			if err != nil {
+				return nil, err
+			}
+			indexes = []int{idx}
+		case seg == "$[]":
+			for j := range elems {
+				indexes = append(indexes, j)
+			}
+		case strings.HasPrefix(seg, "$[") && strings.HasSuffix(seg, "]"):
+			id := seg[2 : len(seg)-1]
+			filter, ok := arrayFilterFor(uc.arrayFilters, id)
+			if !ok {
+				return nil, fmt.Errorf("no array filter found for identifier %q in path %q", id, strings.Join(path, "."))
+			}
+			for j, el := range elems {
+				matched, err := match(filter, bson.D{{Key: id, Value: el}})
+				if err != nil {
+					return nil, err
+				}
+				if matched {
+					indexes = append(indexes, j)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid path segment %q", seg)
+		}
+
+		var out [][]string
+		for _, idx := range indexes {
+			concrete := append(append(append([]string{}, prefix...), strconv.Itoa(idx)), path[i+1:]...)
+			expanded, err := expandPath(node, concrete, uc)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded...)
+		}
+		return out, nil
+	}
+
+	return [][]string{path}, nil
+}
+
+// arrayFilterFor returns the array filter whose fields start with identifier
+func arrayFilterFor(filters []bson.D, identifier string) (bson.D, bool) {
+	for _, f := range filters {
+		for _, e := range f {
+			if e.Key == identifier || strings.HasPrefix(e.Key, identifier+".") {
+				return f, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// positionalIndex finds the first element of the array at prefix that satisfies the conditions the filter puts on it
+func positionalIndex(doc bson.D, prefix []string, filter bson.D) (int, error) {
+	notFound := fmt.Errorf("the positional operator did not find the match needed from the query")
+	value, _ := getPath(doc, prefix)
+	elems, _ := value.(bson.A)
+	field := strings.Join(prefix, ".")
+	conditions := arrayConditions(filter, field)
+	if len(conditions) == 0 {
+		return 0, notFound
+	}
+	for i, el := range elems {
+		single, err := setPath(copyValue(doc), prefix, bson.A{el})
+		if err != nil {
+			return 0, err
+		}
+		matched, err := match(conditions, single.(bson.D))
+		if err != nil {
+			return 0, err
+		}
+		if matched {
+			return i, nil
+		}
+	}
+
+	return 0, notFound
+}
+
+// arrayConditions returns the conditions of filter on field or its subfields, including those nested in $and
+func arrayConditions(filter bson.D, field string) bson.D {
+	var out bson.D
+	for _, e := range filter {
+		switch {
+		case e.Key == field || strings.HasPrefix(e.Key, field+"."):
+			out = append(out, e)
+		case e.Key == "$and":
+			clauses, _ := e.Value.(bson.A)
+			for _, c := range clauses {
+				if d, ok := c.(bson.D); ok {
+					out = append(out, arrayConditions(d, field)...)
+				}
+			}
+		}
+	}
+
+	return out
+}
+
+func incPath(node any, path []string, delta any) (any, error) {
+	d, ok := toFloat(delta)
+	if !ok {
+		return nil, fmt.Errorf("cannot increment with non-numeric argument: %v", delta)
+	}
+	cur, found := getPath(node, path)
+	if !found {
+		return setPath(node, path, delta)
+	}
+	switch n := cur.(type) {
+	case int32:
+		if i, ok := delta.(int32); ok {
+			return setPath(node, path, n+i)
+		}
+		if i, ok := delta.(int64); ok {
+			return setPath(node, path, int64(n)+i)
+		}
+	case int64:
+		if i, ok := delta.(int32); ok {
+			return setPath(node, path, n+int64(i))
+		}
+		if i, ok := delta.(int64); ok {
+			return setPath(node, path, n+i)
+		}
+	case float64:
+		return setPath(node, path, n+d)
+	default:
+		return nil, fmt.Errorf("cannot apply $inc to a value of non-numeric type: %v", cur)
+	}
+	f, _ := toFloat(cur)
+
+	return setPath(node, path, f+d)
+}
+
+func renamePath(node any, path []string, arg any) (any, error) {
+	to, ok := arg.(string)
+	if !ok || to == "" {
+		return nil, fmt.Errorf("the 'to' field for $rename must be a string: %v", arg)
+	}
+	value, found := getPath(node, path)
+	if !found {
+		return node, nil
+	}
+
+	return setPath(unsetPath(node, path), splitPath(to), value)
+}
+
+// boundPath implements $min (sign -1) and $max (sign 1): path is set to value when the field is missing or value
+// compares on the sign side of the current value
+func boundPath(node any, path []string, value any, sign int) (any, error) {
+	cur, found := getPath(node, path)
+	if found && compareValues(value, cur)*sign <= 0 {
+		return node, nil
+	}
+
+	return setPath(node, path, copyValue(value))
+}
+
+func currentDatePath(node any, path []string, arg any) (any, error) {
+	now := time.Now()
+	switch v := arg.(type) {
+	case bool:
+		return setPath(node, path, primitive.NewDateTimeFromTime(now))
+	case bson.D:
+		switch v.Map()["$type"] {
+		case "date":
+			return setPath(node, path, primitive.NewDateTimeFromTime(now))
+		case "timestamp":
+			return setPath(node, path, primitive.Timestamp{T: uint32(now.Unix())})
+		}
+	}
+
+	return nil, fmt.Errorf("$currentDate expects true or {$type: \"date\"|\"timestamp\"}, found: %v", arg)
+}
+
+// arrayAt returns a copy of the array stored at path, or an empty array when the field is missing
+func arrayAt(node any, path []string, op string) (bson.A, bool, error) {
+	cur, found := getPath(node, path)
+	if !found {
+		return bson.A{}, false, nil
+	}
+	arr, ok := cur.(bson.A)
+	if !ok {
+		return nil, true, fmt.Errorf("cannot apply %s to non-array field %q", op, strings.Join(path, "."))
+	}
+
+	return copyValue(arr).(bson.A), true, nil
+}
+
+// pushModifiers is the parsed argument of $push, modifiers other than $each need $each
+type pushModifiers struct {
+	each     bson.A
+	position *int
+	slice    *int
+	sort     any
+}
+
+func parsePush(value any) (pushModifiers, error) {
+	mods, ok := value.(bson.D)
+	if !ok || !isOperatorDocument(mods) {
+		return pushModifiers{each: bson.A{value}}, nil
+	}
+	var p pushModifiers
+	hasEach := false
+	for _, m := range mods {
+		switch m.Key {
+		case "$each":
+			each, ok := m.Value.(bson.A)
+			if !ok {
+				return p, fmt.Errorf("$each requires an array value")
+			}
+			p.each, hasEach = each, true
+		case "$position", "$slice":
+			n, ok := toFloat(m.Value)
+			if !ok {
+				return p, fmt.Errorf("%s requires a number", m.Key)
+			}
+			v := int(n)
+			if m.Key == "$position" {
+				p.position = &v
+			} else {
+				p.slice = &v
+			}
+		case "$sort":
+			p.sort = m.Value
+		default:
+			return p, fmt.Errorf("unrecognized clause in $push: %s", m.Key)
+		}
+	}
+	if !hasEach {
+		return p, fmt.Errorf("$push modifiers require $each")
+	}
+
+	return p, nil
+}
+
+func pushPath(node any, path []string, value any) (any, error) {
+	p, err := parsePush(value)
+	if err != nil {
+		return nil, err
+	}
+	arr, _, err := arrayAt(node, path, "$push")
+	if err != nil {
+		return nil, err
+	}
+
+	pos := len(arr)
+	if p.position != nil {
+		pos = *p.position
+		if pos < 0 {
+			pos += len(arr)
+		}
+		if pos < 0 {
+			pos = 0
+		}
+		if pos > len(arr) {
+			pos = len(arr)
+		}
+	}
+	items := copyValue(p.each).(bson.A)
+	arr = append(arr[:pos], append(items, arr[pos:]...)...)
+
+	if p.sort != nil {
+		if keys, ok := p.sort.(bson.D); ok {
+			sort.SliceStable(arr, func(i, j int) bool {
+				a, _ := arr[i].(bson.D)
+				b, _ := arr[j].(bson.D)
+				return lessBy(keys, a, b)
+			})
+		} else {
+			dir, _ := toFloat(p.sort)
+			sort.SliceStable(arr, func(i, j int) bool {
+				c := compareValues(arr[i], arr[j])
+				if dir < 0 {
+					c = -c
+				}
+				return c < 0
+			})
+		}
+	}
+
+	if p.slice != nil {
+		n := *p.slice
+		switch {
+		case n >= 0 && n < len(arr):
+			arr = arr[:n]
+		case n < 0 && -n < len(arr):
+			arr = arr[len(arr)+n:]
+		}
+	}
+
+	return setPath(node, path, arr)
+}
+
+func addToSetPath(node any, path []string, value any) (any, error) {
+	items := bson.A{value}
+	if mods, ok := value.(bson.D); ok && len(mods) == 1 && mods[0].Key == "$each" {
+		each, ok := mods[0].Value.(bson.A)
+		if !ok {
+			return nil, fmt.Errorf("$each requires an array value")
+		}
+		items = each
+	}
+	arr, _, err := arrayAt(node, path, "$addToSet")
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if !containsValue(arr, item) {
+			arr = append(arr, copyValue(item))
+		}
+	}
+
+	return setPath(node, path, arr)
+}
+
+func popPath(node any, path []string, arg any) (any, error) {
+	dir, ok := toFloat(arg)
+	if !ok || (dir != 1 && dir != -1) {
+		return nil, fmt.Errorf("$pop expects 1 or -1, found: %v", arg)
+	}
+	arr, found, err := arrayAt(node, path, "$pop")
+	if err != nil || !found || len(arr) == 0 {
+		return node, err
+	}
+	if dir == 1 {
+		arr = arr[:len(arr)-1]
+	} else {
+		arr = arr[1:]
+	}
+
+	return setPath(node, path, arr)
+}
+
+func pullPath(node any, path []string, remove func(any) (bool, error)) (any, error) {
+	arr, found, err := arrayAt(node, path, "$pull")
+	if err != nil || !found {
+		return node, err
+	}
+	kept := bson.A{}
+	for _, el := range arr {
+		matched, err := remove(el)
+		if err != nil {
+			return nil, err
+		}
+		if !matched {
+			kept = append(kept, el)
+		}
+	}
+
+	return setPath(node, path, kept)
+}
+
+// pullMatches reports whether $pull removes el. A plain document condition is a query on the fields of embedded documents,
+// anything else is matched against the element itself.
+func pullMatches(cond, el any) (bool, error) {
+	if c, ok := cond.(bson.D); ok && !isOperatorDocument(c) {
+		doc, ok := el.(bson.D)
+		if !ok {
+			return false, nil
+		}
+		return match(c, doc)
+	}
+
+	return match(bson.D{{Key: "v", Value: cond}}, bson.D{{Key: "v", Value: el}})
+}
+
+func containsValue(arr bson.A, v any) bool {
+	for _, el := range arr {
+		if equalValues(el, v) {
+			return true
+		}
+	}
+
+	return false
+}
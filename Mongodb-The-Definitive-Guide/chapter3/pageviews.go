@@ -0,0 +1,209 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+Document.Upsert costs one round trip per page view. PageViewCounter keeps the increments in memory, adds up the hits of
+the same URL, and periodically writes them as one unordered bulk write of upserts, one per URL. Unordered because the URLs
+are independent: one failing upsert must not hold back the others.
+Counts that are still in memory are lost if the process dies before a flush, that is the price of batching.
+Flushes are at least once: when the bulk write fails without saying which upserts were applied, a network error after
+the server applied some of them for instance, the whole batch is kept for the next flush and those views can be counted
+twice. Only the upserts a BulkWriteException reports as failed are kept otherwise.
+Concurrent upserts of a new URL can insert it twice, create a unique index on "url" so the losing upsert fails and is retried.
+*/
+
+// ErrCounterClosed is returned by PageViewCounter.Add after Close
+var ErrCounterClosed = errors.New("chapter3: counter closed")
+
+// CounterConfig configures a PageViewCounter, zero values take the defaults
+type CounterConfig struct {
+	// FlushInterval is how often pending increments are written, 1s by default
+	FlushInterval time.Duration
+	// FlushSize triggers a flush as soon as that many URLs have pending increments, 1000 by default
+	FlushSize int
+	// FlushTimeout bounds each background flush, 10s by default
+	FlushTimeout time.Duration
+	// OnError receives the errors of background flushes, the increments that may not have been written are kept for the
+	// next flush
+	OnError func(error)
+}
+
+func (c CounterConfig) withDefaults() CounterConfig {
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.FlushSize <= 0 {
+		c.FlushSize = 1000
+	}
+	if c.FlushTimeout <= 0 {
+		c.FlushTimeout = 10 * time.Second
+	}
+
+	return c
+}
+
+// PageViewCounter counts page views per URL in documents {url, pageviews, createAt}
+type PageViewCounter struct {
+	store DocumentStore
+	cfg   CounterConfig
+
+	// flushMu is held for writing by a flush and for reading by Get, so Get never sees a delta both pending and persisted
+	flushMu sync.RWMutex
+	mu      sync.Mutex
+	pending map[string]int64
+	closed  bool
+
+	kick    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewPageViewCounter starts a counter writing to store, Close must be called to stop it and write the last increments
+func NewPageViewCounter(store DocumentStore, cfg CounterConfig) *PageViewCounter {
+	c := &PageViewCounter{
+		store:   store,
+		cfg:     cfg.withDefaults(),
+		pending: make(map[string]int64),
+		kick:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go c.run()
+
+	return c
+}
+
+// Add records n views of url
+func (c *PageViewCounter) Add(url string, n int64) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrCounterClosed
+	}
+	c.pending[url] += n
+	full := len(c.pending) >= c.cfg.FlushSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.kick <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Get returns the views of url: the persisted count plus the increments not flushed yet
+func (c *PageViewCounter) Get(ctx context.Context, url string) (int64, error) {
+	c.flushMu.RLock()
+	defer c.flushMu.RUnlock()
+
+	c.mu.Lock()
+	pending := c.pending[url]
+	c.mu.Unlock()
+
+	doc, err := findOne(ctx, c.store, bson.D{{Key: "url", Value: url}})
+	if errors.Is(err, ErrNotFound) {
+		return pending, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return int64Value(doc.Map()["pageviews"]) + pending, nil
+}
+
+// Flush writes the pending increments now. Increments that may not have been written are pending again when it returns an
+// error: the failed upserts of a BulkWriteException, or the whole batch for other errors, some of which may have been
+// applied already and will then be counted twice.
+func (c *PageViewCounter) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.pending
+	c.pending = make(map[string]int64)
+	c.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+
+	urls := make([]string, 0, len(batch))
+	ops := make([]mongo.WriteModel, 0, len(batch))
+	now := primitive.NewDateTimeFromTime(time.Now())
+	for url, n := range batch {
+		update, err := NewUpdate().Inc("pageviews", n).SetOnInsert("createAt", now).Build()
+		if err != nil {
+			return err
+		}
+		urls = append(urls, url)
+		ops = append(ops, UpsertOp(bson.D{{Key: "url", Value: url}}, update))
+	}
+
+	report, err := BulkWrite(ctx, c.store, ops, false)
+	if err == nil {
+		return nil
+	}
+	var failed []string
+	if report == nil {
+		// which upserts were applied is unknown, keep them all rather than lose views
+		failed = urls
+	} else {
+		for _, op := range report.Operations {
+			if op.Status != BulkSucceeded {
+				failed = append(failed, urls[op.Index])
+			}
+		}
+	}
+	c.mu.Lock()
+	for _, url := range failed {
+		c.pending[url] += batch[url]
+	}
+	c.mu.Unlock()
+
+	return err
+}
+
+// Close stops the background flushes and writes the pending increments
+func (c *PageViewCounter) Close(ctx context.Context) error {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.done)
+	})
+	<-c.stopped
+
+	return c.Flush(ctx)
+}
+
+func (c *PageViewCounter) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.kick:
+		case <-c.done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.FlushTimeout)
+		if err := c.Flush(ctx); err != nil && c.cfg.OnError != nil {
+			c.cfg.OnError(err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,128 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// countingStore counts bulk writes and fails them while failing is set
+type countingStore struct {
+	DocumentStore
+	mu      sync.Mutex
+	bulks   int
+	failing bool
+}
+
+func (s *countingStore) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+	s.mu.Lock()
+	s.bulks++
+	failing := s.failing
+	s.mu.Unlock()
+	if failing {
+		return nil, errors.New("network down")
+	}
+
+	return s.DocumentStore.BulkWrite(ctx, models, opts...)
+}
+
+func (s *countingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bulks
+}
+
+func TestPageViewCounterBatches(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{DocumentStore: NewMemoryStore()}
+	c := NewPageViewCounter(store, CounterConfig{FlushInterval: time.Hour})
+
+	for i := 0; i < 100; i++ {
+		if err := c.Add("/blog-1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Add("/blog-2", 5); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.Get(ctx, "/blog-1"); err != nil || n != 100 {
+		t.Fatalf("pending read = %d, %v", n, err)
+	}
+	if err := c.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if store.count() != 1 {
+		t.Fatalf("%d bulk writes, want 1", store.count())
+	}
+
+	c.Add("/blog-1", 2)
+	if n, _ := c.Get(ctx, "/blog-1"); n != 102 {
+		t.Fatalf("merged read = %d, want 102", n)
+	}
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Add("/blog-1", 1); !errors.Is(err, ErrCounterClosed) {
+		t.Fatalf("expected ErrCounterClosed, got %v", err)
+	}
+
+	docs := findAll(t, store, bson.D{{Key: "url", Value: "/blog-1"}})
+	if len(docs) != 1 || docs[0]["pageviews"] != int64(102) || docs[0]["createAt"] == nil {
+		t.Fatalf("got %v", docs)
+	}
+}
+
+func TestPageViewCounterFlushSize(t *testing.T) {
+	store := &countingStore{DocumentStore: NewMemoryStore()}
+	c := NewPageViewCounter(store, CounterConfig{FlushInterval: time.Hour, FlushSize: 2})
+	defer c.Close(context.Background())
+
+	c.Add("/a", 1)
+	c.Add("/b", 1)
+	deadline := time.Now().Add(time.Second)
+	for store.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("reaching FlushSize did not flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPageViewCounterKeepsFailedIncrements(t *testing.T) {
+	ctx := context.Background()
+	store := &countingStore{DocumentStore: NewMemoryStore(), failing: true}
+	errs := make(chan error, 1)
+	onError := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	c := NewPageViewCounter(store, CounterConfig{FlushInterval: time.Millisecond, OnError: onError})
+
+	c.Add("/a", 3)
+	select {
+	case <-errs:
+	case <-time.After(time.Second):
+		t.Fatal("background flush did not report the failure")
+	}
+	if n, _ := c.Get(ctx, "/a"); n != 3 {
+		t.Fatalf("failed increments lost: %d", n)
+	}
+
+	store.mu.Lock()
+	store.failing = false
+	store.mu.Unlock()
+	if err := c.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if docs := findAll(t, store, bson.D{}); len(docs) != 1 || docs[0]["pageviews"] != int64(3) {
+		t.Fatalf("got %v", docs)
+	}
+}
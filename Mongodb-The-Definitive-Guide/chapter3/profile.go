@@ -0,0 +1,85 @@
+package chapter3
+
+import (
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+)
+
+/*
+A consistency profile (see connection.Profile) picks the write concern, read concern and read preference of a call.
+The client default comes from Config.Profile, a repository or a single call can choose another one:
+
+	reports := NewRepository[Order](store).With(connection.Analytics())  // reads from secondaries
+	orders.With(connection.Durable()).Insert(ctx, order)                // majority acknowledged and journaled
+
+Stores without a server behind them, like MemoryStore, ignore profiles.
+*/
+
+// Profiled is implemented by stores able to run their operations with a consistency profile
+type Profiled interface {
+	// WithProfile returns a copy of the store using p, the receiver is unchanged
+	WithProfile(p connection.Profile) DocumentStore
+}
+
+// WithProfile returns store using p when it is Profiled, store itself otherwise
+func WithProfile(store DocumentStore, p connection.Profile) DocumentStore {
+	if ps, ok := store.(Profiled); ok {
+		return ps.WithProfile(p)
+	}
+
+	return store
+}
+
+// WithProfile returns a store over a clone of the collection with the settings of p
+func (s MongoStore) WithProfile(p connection.Profile) DocumentStore {
+	// Clone only fails on invalid options, CollectionOptions never builds any
+	coll, err := s.Collection.Clone(p.CollectionOptions())
+	if err != nil {
+		return s
+	}
+
+	return MongoStore{Collection: coll}
+}
+
+// WithProfile ...
+func (s *AuditedStore) WithProfile(p connection.Profile) DocumentStore {
+	c := *s
+	c.DocumentStore = WithProfile(s.DocumentStore, p)
+
+	return &c
+}
+
+// WithProfile ...
+func (s SizeGuardStore) WithProfile(p connection.Profile) DocumentStore {
+	s.DocumentStore = WithProfile(s.DocumentStore, p)
+
+	return s
+}
+
+// WithProfile ...
+func (s SchemaStore) WithProfile(p connection.Profile) DocumentStore {
+	s.DocumentStore = WithProfile(s.DocumentStore, p)
+
+	return s
+}
+
+// WithProfile ...
+func (s RetryStore) WithProfile(p connection.Profile) DocumentStore {
+	s.DocumentStore = WithProfile(s.DocumentStore, p)
+
+	return s
+}
+
+// With returns a copy of the repository running its operations with p, sharing the hooks and ID generator of r
+func (r *Repository[T]) With(p connection.Profile) *Repository[T] {
+	c := *r
+	c.hooks = r.hooks[:len(r.hooks):len(r.hooks)]
+	c.store = WithProfile(r.store, p)
+
+	return &c
+}
+
+var _ Profiled = MongoStore{}
+var _ Profiled = (*AuditedStore)(nil)
+var _ Profiled = SizeGuardStore{}
+var _ Profiled = SchemaStore{}
+var _ Profiled = RetryStore{}
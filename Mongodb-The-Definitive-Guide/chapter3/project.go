@@ -0,0 +1,403 @@
+package chapter3
+
+import (
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Project applies a projection the way the server does (MongoDB 4.4 and later), so MemoryStore and tests return the
+fields a collection would return:
+
+  - A projection either includes fields, {name: 1, age: 1}, or excludes them, {comments: 0}. Mixing both is an error,
+    except for _id: it is returned unless it is excluded, in both kinds of projection.
+  - {path: {$slice: n}} returns the first n elements of an array, -n the last n, [skip, n] n elements after skipping
+    skip, a negative skip counting from the end. $slice does not make a projection an inclusion: alone, it returns
+    every field with the array sliced.
+  - {path: {$elemMatch: query}} returns only the first element of the array matching query, and removes the field when
+    none does. It only applies to top level fields, and is returned after the other fields.
+  - {"path.$": 1} returns only the first element of the array matching the conditions the query filter puts on it.
+    There is at most one in a projection, and the query must have a condition on the array.
+  - $elemMatch and positional projections are inclusions.
+  - Two paths where one is a prefix of the other, like "comments" and "comments.author", are a path collision.
+*/
+
+// Project returns the fields of doc selected by projection. filter is the query filter the document was found with,
+// it is only used by positional projections. projection, filter and doc can be bson.D, bson.M or anything marshalling
+// to a document.
+func Project(doc, projection, filter any) (bson.D, error) {
+	d, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	p, err := toDocument(projection)
+	if err != nil {
+		return nil, err
+	}
+	f, err := toDocument(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return applyProjection(d, p, f)
+}
+
+// projectionTree is a parsed projection, a nil subtree selects the whole value
+type projectionTree map[string]projectionTree
+
+func (t projectionTree) add(path []string) {
+	if len(path) == 1 {
+		t[path[0]] = nil
+		return
+	}
+	sub, ok := t[path[0]]
+	if ok && sub == nil {
+		return
+	}
+	if !ok {
+		sub = projectionTree{}
+		t[path[0]] = sub
+	}
+	sub.add(path[1:])
+}
+
+// projectionSpec is a validated projection
+type projectionSpec struct {
+	// inclusion is 1 for an inclusion projection, 0 for an exclusion, -1 while unknown
+	inclusion  int
+	includeID  bool
+	explicitID bool
+	// fields holds the paths included or excluded
+	fields     []string
+	slices     []bson.E
+	elemMatch  []bson.E
+	positional string
+	// paths holds every path of the projection, to detect collisions
+	paths []string
+}
+
+// parseProjection validates a projection document
+func parseProjection(projection bson.D) (*projectionSpec, error) {
+	spec := &projectionSpec{inclusion: -1, includeID: true}
+	for _, e := range projection {
+		path := e.Key
+		if path == "" || strings.HasPrefix(path, "$") {
+			return nil, fmt.Errorf("projection cannot have an empty path or start with $: %q", path)
+		}
+		positional := strings.HasSuffix(path, ".$")
+		if positional {
+			path = strings.TrimSuffix(path, ".$")
+		}
+		for _, part := range splitPath(path) {
+			if part == "" || strings.HasPrefix(part, "$") {
+				return nil, fmt.Errorf("invalid projection path %q, the positional $ must end the path", e.Key)
+			}
+		}
+		if err := spec.addPath(path); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case positional:
+			if spec.positional != "" {
+				return nil, fmt.Errorf("cannot specify more than one positional projection per query")
+			}
+			if isOperatorDocument(e.Value) || !truthy(e.Value) {
+				return nil, fmt.Errorf("positional projection on %s must be an inclusion", path)
+			}
+			if err := spec.setMode(true, e.Key); err != nil {
+				return nil, err
+			}
+			spec.positional = path
+		case isOperatorDocument(e.Value):
+			ops := e.Value.(bson.D)
+			if len(ops) != 1 {
+				return nil, fmt.Errorf("projection of %s must have a single operator", path)
+			}
+			if err := spec.addOperator(path, ops[0]); err != nil {
+				return nil, err
+			}
+		case path == "_id":
+			spec.includeID = truthy(e.Value)
+			spec.explicitID = true
+		default:
+			if err := spec.setMode(truthy(e.Value), path); err != nil {
+				return nil, err
+			}
+			spec.fields = append(spec.fields, path)
+		}
+	}
+	if spec.inclusion == -1 && spec.explicitID && spec.includeID {
+		// {_id: 1} returns _id only
+		spec.inclusion = 1
+	}
+
+	return spec, nil
+}
+
+func (s *projectionSpec) addPath(path string) error {
+	for _, p := range s.paths {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") {
+			return fmt.Errorf("path collision at %s", path)
+		}
+	}
+	s.paths = append(s.paths, path)
+
+	return nil
+}
+
+func (s *projectionSpec) setMode(include bool, path string) error {
+	mode := 0
+	if include {
+		mode = 1
+	}
+	switch {
+	case s.inclusion == 1 && mode == 0:
+		return fmt.Errorf("cannot do exclusion on field %s in inclusion projection", path)
+	case s.inclusion == 0 && mode == 1:
+		return fmt.Errorf("cannot do inclusion on field %s in exclusion projection", path)
+	}
+	s.inclusion = mode
+
+	return nil
+}
+
+func (s *projectionSpec) addOperator(path string, op bson.E) error {
+	switch op.Key {
+	case "$slice":
+		if _, _, err := sliceBounds(op.Value, 0); err != nil {
+			return fmt.Errorf("projection of %s: %w", path, err)
+		}
+		s.slices = append(s.slices, bson.E{Key: path, Value: op.Value})
+	case "$elemMatch":
+		if strings.Contains(path, ".") {
+			return fmt.Errorf("cannot use $elemMatch projection on a nested field: %s", path)
+		}
+		if _, ok := op.Value.(bson.D); !ok {
+			return fmt.Errorf("$elemMatch projection of %s needs a document", path)
+		}
+		if err := s.setMode(true, path); err != nil {
+			return err
+		}
+		s.elemMatch = append(s.elemMatch, bson.E{Key: path, Value: op.Value})
+	default:
+		return fmt.Errorf("projection operator %s is not supported", op.Key)
+	}
+
+	return nil
+}
+
+// sliceBounds returns the bounds of the elements $slice keeps in an array of n elements
+func sliceBounds(value any, n int) (int, int, error) {
+	if count, ok := toFloat(value); ok {
+		c := int(count)
+		if c < 0 {
+			return maxInt(n+c, 0), n, nil
+		}
+		return 0, minInt(c, n), nil
+	}
+	args, ok := value.(bson.A)
+	if !ok || len(args) != 2 {
+		return 0, 0, fmt.Errorf("$slice takes a number or an array of 2 numbers")
+	}
+	skip, ok1 := toFloat(args[0])
+	limit, ok2 := toFloat(args[1])
+	if !ok1 || !ok2 {
+		return 0, 0, fmt.Errorf("$slice takes a number or an array of 2 numbers")
+	}
+	if limit <= 0 {
+		return 0, 0, fmt.Errorf("$slice limit must be positive")
+	}
+	start := minInt(int(skip), n)
+	if skip < 0 {
+		start = maxInt(n+int(skip), 0)
+	}
+
+	return start, minInt(start+int(limit), n), nil
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// applyProjection implements Project on normalized documents
+func applyProjection(doc bson.D, projection bson.D, filter bson.D) (bson.D, error) {
+	if len(projection) == 0 {
+		return doc, nil
+	}
+	spec, err := parseProjection(projection)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bson.D
+	if spec.inclusion == 1 {
+		tree := projectionTree{}
+		for _, p := range spec.fields {
+			tree.add(splitPath(p))
+		}
+		for _, s := range spec.slices {
+			tree.add(splitPath(s.Key))
+		}
+		if spec.positional != "" {
+			tree.add(splitPath(spec.positional))
+		}
+		out, _ = includeTree(doc, tree).(bson.D)
+		if out == nil {
+			out = bson.D{}
+		}
+		if id, ok := getPath(doc, []string{"_id"}); ok && spec.includeID {
+			out = append(bson.D{{Key: "_id", Value: id}}, out...)
+		}
+	} else {
+		tree := projectionTree{}
+		for _, p := range spec.fields {
+			tree.add(splitPath(p))
+		}
+		out = excludeTree(copyValue(doc), tree).(bson.D)
+		if !spec.includeID {
+			out = unsetPath(out, []string{"_id"}).(bson.D)
+		}
+	}
+
+	for _, s := range spec.slices {
+		s := s
+		out = transformPath(out, splitPath(s.Key), func(v any) any {
+			arr, ok := v.(bson.A)
+			if !ok {
+				return v
+			}
+			start, end, _ := sliceBounds(s.Value, len(arr))
+			return arr[start:end]
+		}).(bson.D)
+	}
+
+	if spec.positional != "" {
+		// the first element satisfying the conditions of the query on the array, like the $ of an update
+		prefix := splitPath(spec.positional)
+		if arr, ok := getPath(doc, prefix); ok {
+			if arr, ok := arr.(bson.A); ok {
+				i, err := positionalIndex(doc, prefix, filter)
+				if err != nil {
+					return nil, err
+				}
+				out = transformPath(out, prefix, func(any) any {
+					return bson.A{copyValue(arr[i])}
+				}).(bson.D)
+			}
+		}
+	}
+
+	for _, em := range spec.elemMatch {
+		out = unsetPath(out, []string{em.Key}).(bson.D)
+		arr, ok := fieldValue(doc, em.Key).(bson.A)
+		if !ok {
+			continue
+		}
+		i, err := firstElemMatch(em.Value.(bson.D), arr)
+		if err != nil {
+			return nil, err
+		}
+		if i >= 0 {
+			out = append(out, bson.E{Key: em.Key, Value: bson.A{copyValue(arr[i])}})
+		}
+	}
+
+	return out, nil
+}
+
+// transformPath replaces the values at a dotted path with fn of them, traversing the documents of arrays on the way
+func transformPath(v any, path []string, fn func(any) any) any {
+	switch t := v.(type) {
+	case bson.D:
+		for i, e := range t {
+			if e.Key != path[0] {
+				continue
+			}
+			if len(path) == 1 {
+				t[i].Value = fn(e.Value)
+			} else {
+				t[i].Value = transformPath(e.Value, path[1:], fn)
+			}
+		}
+	case bson.A:
+		for i, el := range t {
+			if _, ok := el.(bson.D); ok {
+				t[i] = transformPath(el, path, fn)
+			}
+		}
+	}
+
+	return v
+}
+
+func truthy(v any) bool {
+	if b, ok := v.(bool); ok {
+		return b
+	}
+	f, ok := toFloat(v)
+	return !ok || f != 0
+}
+
+func includeTree(v any, tree projectionTree) any {
+	switch t := v.(type) {
+	case bson.D:
+		out := bson.D{}
+		for _, e := range t {
+			sub, ok := tree[e.Key]
+			if !ok {
+				continue
+			}
+			if sub == nil {
+				out = append(out, bson.E{Key: e.Key, Value: copyValue(e.Value)})
+				continue
+			}
+			if child := includeTree(e.Value, sub); child != nil {
+				out = append(out, bson.E{Key: e.Key, Value: child})
+			}
+		}
+		return out
+	case bson.A:
+		out := bson.A{}
+		for _, el := range t {
+			switch el.(type) {
+			case bson.D, bson.A:
+				out = append(out, includeTree(el, tree))
+			}
+		}
+		return out
+	}
+
+	return nil
+}
+
+func excludeTree(v any, tree projectionTree) any {
+	switch t := v.(type) {
+	case bson.D:
+		out := bson.D{}
+		for _, e := range t {
+			sub, ok := tree[e.Key]
+			switch {
+			case !ok:
+				out = append(out, e)
+			case sub != nil:
+				out = append(out, bson.E{Key: e.Key, Value: excludeTree(e.Value, sub)})
+			}
+		}
+		return out
+	case bson.A:
+		out := make(bson.A, len(t))
+		for i, el := range t {
+			out[i] = excludeTree(el, tree)
+		}
+		return out
+	}
+
+	return v
+}
@@ -0,0 +1,116 @@
+package chapter3
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestProject(t *testing.T) {
+	doc := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "name", Value: "Joe"},
+		{Key: "fruit", Value: bson.A{"apple", "banana", "peach", "cherry"}},
+		{Key: "comments", Value: bson.A{
+			bson.D{{Key: "author", Value: "Joe"}, {Key: "score", Value: 3}},
+			bson.D{{Key: "author", Value: "Mary"}, {Key: "score", Value: 6}},
+		}},
+	}
+	fruit := func(v ...any) bson.E { return bson.E{Key: "fruit", Value: append(bson.A{}, v...)} }
+	comment := func(author string, score int) bson.D {
+		return bson.D{{Key: "author", Value: author}, {Key: "score", Value: score}}
+	}
+	for _, tc := range []struct {
+		name       string
+		projection bson.D
+		filter     bson.D
+		want       bson.D
+	}{
+		{"inclusion", bson.D{{Key: "name", Value: 1}}, nil, bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "Joe"}}},
+		{"inclusion without _id", bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 0}}, nil, bson.D{{Key: "name", Value: "Joe"}}},
+		{"only _id", bson.D{{Key: "_id", Value: 1}}, nil, bson.D{{Key: "_id", Value: 1}}},
+		{"exclusion", bson.D{{Key: "fruit", Value: 0}, {Key: "comments", Value: 0}}, nil, bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "Joe"}}},
+		{"embedded inclusion", bson.D{{Key: "comments.author", Value: 1}, {Key: "_id", Value: 0}}, nil,
+			bson.D{{Key: "comments", Value: bson.A{bson.D{{Key: "author", Value: "Joe"}}, bson.D{{Key: "author", Value: "Mary"}}}}}},
+		{"slice first", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: 2}}}, {Key: "_id", Value: 0}, {Key: "name", Value: 0}, {Key: "comments", Value: 0}}, nil,
+			bson.D{fruit("apple", "banana")}},
+		{"slice last", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: -2}}}, {Key: "name", Value: 1}}, nil,
+			bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "Joe"}, fruit("peach", "cherry")}},
+		{"slice skip", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: bson.A{1, 2}}}}, {Key: "_id", Value: 0}, {Key: "name", Value: 1}}, nil,
+			bson.D{{Key: "name", Value: "Joe"}, fruit("banana", "peach")}},
+		{"slice negative skip", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: bson.A{-3, 5}}}}, {Key: "_id", Value: 0}, {Key: "name", Value: 1}}, nil,
+			bson.D{{Key: "name", Value: "Joe"}, fruit("banana", "peach", "cherry")}},
+		{"slice past the end", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: bson.A{10, 2}}}}, {Key: "_id", Value: 0}, {Key: "name", Value: 1}}, nil,
+			bson.D{{Key: "name", Value: "Joe"}, fruit()}},
+		{"slice alone keeps every field", bson.D{{Key: "fruit", Value: bson.D{{Key: "$slice", Value: 1}}}}, nil,
+			bson.D{doc[0], doc[1], fruit("apple"), doc[3]}},
+		{"elemMatch", bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "score", Value: bson.D{{Key: "$gte", Value: 5}}}}}}}, {Key: "name", Value: 1}}, nil,
+			bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "Joe"}, {Key: "comments", Value: bson.A{comment("Mary", 6)}}}},
+		{"elemMatch without match", bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "author", Value: "Bob"}}}}}}, nil,
+			bson.D{{Key: "_id", Value: 1}}},
+		{"elemMatch on scalars", bson.D{{Key: "fruit", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: "c"}}}}}, {Key: "_id", Value: 0}}, nil,
+			bson.D{fruit("peach")}},
+		{"positional", bson.D{{Key: "comments.$", Value: 1}, {Key: "_id", Value: 0}}, bson.D{{Key: "comments.author", Value: "Mary"}},
+			bson.D{{Key: "comments", Value: bson.A{comment("Mary", 6)}}}},
+		{"positional in $and", bson.D{{Key: "fruit.$", Value: 1}}, bson.D{{Key: "$and", Value: bson.A{bson.D{{Key: "fruit", Value: bson.D{{Key: "$gte", Value: "c"}}}}}}},
+			bson.D{{Key: "_id", Value: 1}, fruit("peach")}},
+	} {
+		got, err := Project(doc, tc.projection, tc.filter)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		// ints are decoded as int32
+		want, _ := toDocument(tc.want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestProjectErrors(t *testing.T) {
+	doc := bson.D{{Key: "a", Value: bson.A{1, 2}}, {Key: "b", Value: bson.D{{Key: "c", Value: 1}}}}
+	for _, tc := range []struct {
+		name       string
+		projection bson.D
+		filter     bson.D
+	}{
+		{"inclusion then exclusion", bson.D{{Key: "a", Value: 1}, {Key: "b", Value: 0}}, nil},
+		{"exclusion then inclusion", bson.D{{Key: "a", Value: 0}, {Key: "b", Value: 1}}, nil},
+		{"elemMatch in exclusion", bson.D{{Key: "b", Value: 0}, {Key: "a", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: 1}}}}}}, nil},
+		{"nested elemMatch", bson.D{{Key: "b.c", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: 1}}}}}}, nil},
+		{"path collision", bson.D{{Key: "b", Value: 1}, {Key: "b.c", Value: 1}}, nil},
+		{"slice limit", bson.D{{Key: "a", Value: bson.D{{Key: "$slice", Value: bson.A{1, 0}}}}}, nil},
+		{"slice argument", bson.D{{Key: "a", Value: bson.D{{Key: "$slice", Value: "2"}}}}, nil},
+		{"unknown operator", bson.D{{Key: "a", Value: bson.D{{Key: "$meta", Value: "textScore"}}}}, nil},
+		{"two positional", bson.D{{Key: "a.$", Value: 1}, {Key: "b.$", Value: 1}}, bson.D{{Key: "a", Value: 1}}},
+		{"positional inside the path", bson.D{{Key: "a.$.c", Value: 1}}, bson.D{{Key: "a", Value: 1}}},
+		{"positional without condition", bson.D{{Key: "a.$", Value: 1}}, nil},
+		{"positional without match", bson.D{{Key: "a.$", Value: 1}}, bson.D{{Key: "a", Value: 3}}},
+	} {
+		if _, err := Project(doc, tc.projection, tc.filter); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
+
+func TestMemoryStoreFindPositional(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	if _, err := store.InsertOne(ctx, bson.D{{Key: "_id", Value: 1}, {Key: "grades", Value: bson.A{80, 92, 95}}}); err != nil {
+		t.Fatal(err)
+	}
+	var got bson.D
+	err := store.FindOne(ctx, bson.D{{Key: "grades", Value: bson.D{{Key: "$gte", Value: 90}}}},
+		options.FindOne().SetProjection(bson.D{{Key: "grades.$", Value: 1}})).Decode(&got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "_id", Value: int32(1)}, {Key: "grades", Value: bson.A{int32(92)}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,212 @@
+package chapter3
+
+import (
+	"context"
+
+	"books-note/Mongodb-The-Definitive-Guide/iterator"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Repository[T] is the CRUD code every entity needs, written once. T is any struct the driver can marshal: the bson tags
+decide the field names and a field tagged `bson:"_id,omitempty"` holds the id. Behaviour that differs between entities
+(defaults, validation, timestamps, logging) is plugged in with Hooks instead of copying the repository.
+*/
+
+// Hooks run around the operations of a Repository. Every field is optional, an error returned by a hook aborts the operation
+// and is returned to the caller unchanged.
+type Hooks[T any] struct {
+	// BeforeInsert runs before v is inserted and may modify it
+	BeforeInsert func(ctx context.Context, v *T) error
+	// BeforeUpdate runs before update is applied to the document with id
+	BeforeUpdate func(ctx context.Context, id any, update any) error
+	// BeforeDelete runs before the document with id is deleted
+	BeforeDelete func(ctx context.Context, id any) error
+	// AfterFind runs on every document decoded by Get and List and may modify it
+	AfterFind func(ctx context.Context, v *T) error
+}
+
+// ListOptions configures Repository.List, zero values mean no sort, skip or limit
+type ListOptions struct {
+	Sort  any
+	Skip  int64
+	Limit int64
+}
+
+// Repository is a typed view over a collection whose documents decode into T
+type Repository[T any] struct {
+	store DocumentStore
+	hooks []Hooks[T]
+	ids   IDGenerator
+}
+
+// NewRepository returns a repository over store
+func NewRepository[T any](store DocumentStore) *Repository[T] {
+	return &Repository[T]{store: store}
+}
+
+// Use registers hooks, hooks run in the order they were registered
+func (r *Repository[T]) Use(hooks Hooks[T]) *Repository[T] {
+	r.hooks = append(r.hooks, hooks)
+
+	return r
+}
+
+// IDs makes Insert generate the _id of documents without one with ids, instead of letting the driver generate an ObjectID.
+// The _id field of T must be able to hold the generated ids.
+func (r *Repository[T]) IDs(ids IDGenerator) *Repository[T] {
+	r.ids = ids
+
+	return r
+}
+
+// Store returns the store the repository works on
+func (r *Repository[T]) Store() DocumentStore {
+	return r.store
+}
+
+// Get returns the document with id, ErrNotFound when there is none
+func (r *Repository[T]) Get(ctx context.Context, id any) (T, error) {
+	v, err := decodeResult[T](r.store.FindOne(ctx, idFilter(id)))
+	if err != nil {
+		return v, err
+	}
+	if err := r.afterFind(ctx, &v); err != nil {
+		var zero T
+		return zero, err
+	}
+
+	return v, nil
+}
+
+// List returns the documents matching filter, a nil filter matches every document
+func (r *Repository[T]) List(ctx context.Context, filter any, opts ListOptions) ([]T, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	o := options.Find()
+	if opts.Sort != nil {
+		o.SetSort(opts.Sort)
+	}
+	if opts.Skip > 0 {
+		o.SetSkip(opts.Skip)
+	}
+	if opts.Limit > 0 {
+		o.SetLimit(opts.Limit)
+	}
+	it, err := iterator.Find[T](ctx, r.store, filter, o)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	var out []T
+	err = it.ForEach(func(v T) error {
+		if err := r.afterFind(ctx, &v); err != nil {
+			return err
+		}
+		out = append(out, v)
+		return nil
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return out, nil
+}
+
+// Insert stores v and returns its id, the one of v or the one generated by the driver
+func (r *Repository[T]) Insert(ctx context.Context, v T) (any, error) {
+	for _, h := range r.hooks {
+		if h.BeforeInsert == nil {
+			continue
+		}
+		if err := h.BeforeInsert(ctx, &v); err != nil {
+			return nil, err
+		}
+	}
+	var doc any = v
+	if r.ids != nil {
+		withID, err := assignID(ctx, v, r.ids)
+		if err != nil {
+			return nil, err
+		}
+		doc = withID
+	}
+	rs, err := r.store.InsertOne(ctx, doc)
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	return rs.InsertedID, nil
+}
+
+// Update applies the update operators of update to the document with id, ErrNotFound when there is none
+func (r *Repository[T]) Update(ctx context.Context, id any, update any) error {
+	for _, h := range r.hooks {
+		if h.BeforeUpdate == nil {
+			continue
+		}
+		if err := h.BeforeUpdate(ctx, id, update); err != nil {
+			return err
+		}
+	}
+	rs, err := r.store.UpdateOne(ctx, idFilter(id), update)
+	if err != nil {
+		return translateError(err)
+	}
+	if rs.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Delete removes the document with id, ErrNotFound when there is none
+func (r *Repository[T]) Delete(ctx context.Context, id any) error {
+	for _, h := range r.hooks {
+		if h.BeforeDelete == nil {
+			continue
+		}
+		if err := h.BeforeDelete(ctx, id); err != nil {
+			return err
+		}
+	}
+	rs, err := r.store.DeleteOne(ctx, idFilter(id))
+	if err != nil {
+		return translateError(err)
+	}
+	if rs.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Count returns the number of documents matching filter, a nil filter counts every document
+func (r *Repository[T]) Count(ctx context.Context, filter any) (int64, error) {
+	if filter == nil {
+		filter = bson.D{}
+	}
+	n, err := r.store.CountDocuments(ctx, filter)
+
+	return n, translateError(err)
+}
+
+func (r *Repository[T]) afterFind(ctx context.Context, v *T) error {
+	for _, h := range r.hooks {
+		if h.AfterFind == nil {
+			continue
+		}
+		if err := h.AfterFind(ctx, v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func idFilter(id any) bson.D {
+	return bson.D{{Key: "_id", Value: id}}
+}
@@ -0,0 +1,164 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type article struct {
+	ID    primitive.ObjectID `bson:"_id,omitempty"`
+	Title string             `bson:"title"`
+	Views int                `bson:"views"`
+}
+
+func TestRepositoryCRUD(t *testing.T) {
+	ctx := context.Background()
+	repo := NewRepository[article](NewMemoryStore())
+
+	var ids []any
+	for i, title := range []string{"a", "b", "c"} {
+		id, err := repo.Insert(ctx, article{Title: title, Views: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+
+	got, err := repo.Get(ctx, ids[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != ids[1] || got.Title != "b" {
+		t.Fatalf("got %+v", got)
+	}
+
+	list, err := repo.List(ctx, bson.D{{Key: "views", Value: bson.D{{Key: "$gte", Value: 1}}}}, ListOptions{Sort: bson.D{{Key: "views", Value: -1}}, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Title != "c" {
+		t.Fatalf("list = %+v", list)
+	}
+
+	if err := repo.Update(ctx, ids[0], bson.D{{Key: "$inc", Value: bson.D{{Key: "views", Value: 10}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := repo.Get(ctx, ids[0]); got.Views != 10 {
+		t.Fatalf("views = %d, want 10", got.Views)
+	}
+
+	if err := repo.Delete(ctx, ids[2]); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.Count(ctx, nil); err != nil || n != 2 {
+		t.Fatalf("count = %d, err = %v", n, err)
+	}
+
+	missing := primitive.NewObjectID()
+	if _, err := repo.Get(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.Update(ctx, missing, bson.D{{Key: "$set", Value: bson.D{{Key: "views", Value: 1}}}}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update: expected ErrNotFound, got %v", err)
+	}
+	if err := repo.Delete(ctx, missing); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestRepositoryHooks(t *testing.T) {
+	ctx := context.Background()
+	errReadOnly := errors.New("read only")
+	var calls []string
+	repo := NewRepository[Document](NewMemoryStore()).
+		Use(Hooks[Document]{
+			BeforeInsert: func(ctx context.Context, d *Document) error {
+				calls = append(calls, "insert")
+				d.Title = strings.TrimSpace(d.Title)
+				return nil
+			},
+			AfterFind: func(ctx context.Context, d *Document) error {
+				d.Title = strings.ToUpper(d.Title)
+				return nil
+			},
+		}).
+		Use(Hooks[Document]{
+			BeforeInsert: func(ctx context.Context, d *Document) error {
+				calls = append(calls, "validate")
+				if d.Title == "" {
+					return errors.New("title is required")
+				}
+				return nil
+			},
+			BeforeDelete: func(ctx context.Context, id any) error { return errReadOnly },
+		})
+
+	id, err := repo.Insert(ctx, Document{Title: "  post ", Count: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ",") != "insert,validate" {
+		t.Fatalf("hooks ran as %v", calls)
+	}
+	if _, err := repo.Insert(ctx, Document{Title: "   "}); err == nil {
+		t.Fatal("expected the validation hook to reject an empty title")
+	}
+
+	docs, err := repo.List(ctx, nil, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || docs[0].Title != "POST" {
+		t.Fatalf("docs = %+v", docs)
+	}
+	if err := repo.Delete(ctx, id); !errors.Is(err, errReadOnly) {
+		t.Fatalf("expected the hook error, got %v", err)
+	}
+	if n, _ := repo.Count(ctx, nil); n != 1 {
+		t.Fatalf("count = %d, want 1", n)
+	}
+}
+
+// profiledStore records the profile it was given
+type profiledStore struct {
+	DocumentStore
+	profile string
+}
+
+func (s profiledStore) WithProfile(p connection.Profile) DocumentStore {
+	s.profile = p.Name
+	return s
+}
+
+func TestRepositoryWith(t *testing.T) {
+	ctx := context.Background()
+	inserts := 0
+	repo := NewRepository[article](RetryStore{DocumentStore: profiledStore{DocumentStore: NewMemoryStore()}}).
+		Use(Hooks[article]{BeforeInsert: func(ctx context.Context, a *article) error { inserts++; return nil }})
+
+	reports := repo.With(connection.Analytics())
+	if got := reports.Store().(RetryStore).DocumentStore.(profiledStore).profile; got != connection.ProfileAnalytics {
+		t.Fatalf("profile = %q, want %q", got, connection.ProfileAnalytics)
+	}
+	if got := repo.Store().(RetryStore).DocumentStore.(profiledStore).profile; got != "" {
+		t.Fatalf("With changed the original repository, profile = %q", got)
+	}
+
+	if _, err := reports.Insert(ctx, article{Title: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := repo.Count(ctx, nil); err != nil || n != 1 || inserts != 1 {
+		t.Fatalf("count = %d, inserts = %d, err = %v", n, inserts, err)
+	}
+
+	if store := NewMemoryStore(); WithProfile(store, connection.Durable()) != DocumentStore(store) {
+		t.Fatal("stores that are not Profiled should be returned as is")
+	}
+}
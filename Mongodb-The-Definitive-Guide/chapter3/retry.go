@@ -0,0 +1,252 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Some errors only say the server could not be reached right now: the connection dropped, the primary stepped down during
+an election, the operation timed out. Retrying a little later usually succeeds, as long as running the operation twice
+does the same as running it once. Reads are always safe. $inc and $push are not: when the first attempt was applied
+but its acknowledgement was lost, a retry applies it again. Writes that set values ($set, $unset, $min, $max,
+$addToSet, $pull...) and replacements are safe only when the filter still matches after the write: a job claimed with
+{status: "new"} and {$set: {status: "taken"}}, or a replacement guarded by a version, matches nothing on the retry and
+looks like it lost against another writer. RetryStore only retries them when the filter is on _id alone, which no
+write changes. The driver already retries a write once with retryable writes, Retry covers the longer outages.
+
+Retry waits with capped exponential backoff and full jitter, a random delay in [0, min(MaxDelay, BaseDelay*2^n)), so
+clients failing together don't retry together. It never waits past the context deadline.
+*/
+
+// Server error codes worth a retry, from the retryable reads and writes specifications
+var retryableCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsRetryable reports whether err is transient: a network error, a timeout, a server error carrying the
+// RetryableWriteError label or a code telling the node is not the primary or is shutting down.
+// A cancelled context is not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	for _, code := range retryableCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RetryPolicy configures Retry, zero values use the defaults
+type RetryPolicy struct {
+	// MaxAttempts counts the first attempt, 5 when <= 0
+	MaxAttempts int
+	// BaseDelay is the cap of the first backoff, 50ms when <= 0
+	BaseDelay time.Duration
+	// MaxDelay caps every backoff, 2s when <= 0
+	MaxDelay time.Duration
+	// Retryable classifies errors, IsRetryable when nil
+	Retryable func(error) bool
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = 50 * time.Millisecond
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 2 * time.Second
+	}
+	if p.Retryable == nil {
+		p.Retryable = IsRetryable
+	}
+
+	return p
+}
+
+// backoff returns the delay before the attempt following attempt n, starting at 1
+func (p RetryPolicy) backoff(n int) time.Duration {
+	ceiling := p.MaxDelay
+	if shift := n - 1; shift < 32 && p.BaseDelay<<shift < p.MaxDelay && p.BaseDelay<<shift > 0 {
+		ceiling = p.BaseDelay << shift
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling)))
+}
+
+// Retry calls fn until it succeeds, fails with an error that is not retryable or runs out of attempts, and returns
+// the last error. It gives up early when the context is done or its deadline would pass during the backoff.
+func Retry(ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) error) error {
+	p := policy.withDefaults()
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || attempt >= p.MaxAttempts || !p.Retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := p.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryValue is Retry for functions returning a value
+func RetryValue[T any](ctx context.Context, policy RetryPolicy, fn func(ctx context.Context) (T, error)) (T, error) {
+	var v T
+	err := Retry(ctx, policy, func(ctx context.Context) error {
+		var err error
+		v, err = fn(ctx)
+		return err
+	})
+
+	return v, err
+}
+
+// idempotentOperators are the update operators giving the same document when applied twice
+var idempotentOperators = map[string]bool{
+	"$set": true, "$unset": true, "$setOnInsert": true, "$min": true, "$max": true,
+	"$addToSet": true, "$pull": true, "$pullAll": true, "$currentDate": true,
+}
+
+// IsIdempotentUpdate reports whether applying update twice gives the same document as applying it once
+func IsIdempotentUpdate(update any) bool {
+	doc, err := toDocument(update)
+	if err != nil || len(doc) == 0 {
+		return false
+	}
+	for _, e := range doc {
+		if !idempotentOperators[e.Key] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isIDFilter reports whether filter selects documents by _id alone, {_id: v} or {_id: {$eq: v}}
+func isIDFilter(filter any) bool {
+	doc, err := toDocument(filter)
+	if err != nil || len(doc) != 1 || doc[0].Key != "_id" {
+		return false
+	}
+	if ops, ok := doc[0].Value.(bson.D); ok && isOperatorDocument(ops) {
+		return len(ops) == 1 && ops[0].Key == "$eq"
+	}
+
+	return true
+}
+
+// RetryStore is a DocumentStore retrying reads and idempotent writes with Policy: Find, FindOne, CountDocuments,
+// UpdateOne and UpdateMany with idempotent operators (see IsIdempotentUpdate) and ReplaceOne when the filter is on _id
+// alone, and DeleteMany.
+// Inserts, DeleteOne (a retry could delete a second document), find-and-modify and bulk writes go through once, the
+// driver's retryable writes cover them.
+// Find retries the query, not the later batches of the cursor.
+type RetryStore struct {
+	DocumentStore
+	Policy RetryPolicy
+}
+
+// Find ...
+func (s RetryStore) Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (*mongo.Cursor, error) {
+		return s.DocumentStore.Find(ctx, filter, opts...)
+	})
+}
+
+// FindOne ...
+func (s RetryStore) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	var result *mongo.SingleResult
+	Retry(ctx, s.Policy, func(ctx context.Context) error {
+		result = s.DocumentStore.FindOne(ctx, filter, opts...)
+		return result.Err()
+	})
+
+	return result
+}
+
+// CountDocuments ...
+func (s RetryStore) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (int64, error) {
+		return s.DocumentStore.CountDocuments(ctx, filter, opts...)
+	})
+}
+
+// UpdateOne retries only idempotent updates of a filter on _id
+func (s RetryStore) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if !IsIdempotentUpdate(update) || !isIDFilter(filter) {
+		return s.DocumentStore.UpdateOne(ctx, filter, update, opts...)
+	}
+
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.UpdateOne(ctx, filter, update, opts...)
+	})
+}
+
+// UpdateMany retries only idempotent updates of a filter on _id
+func (s RetryStore) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if !IsIdempotentUpdate(update) || !isIDFilter(filter) {
+		return s.DocumentStore.UpdateMany(ctx, filter, update, opts...)
+	}
+
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.UpdateMany(ctx, filter, update, opts...)
+	})
+}
+
+// ReplaceOne retries only replacements of a filter on _id
+func (s RetryStore) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if !isIDFilter(filter) {
+		return s.DocumentStore.ReplaceOne(ctx, filter, replacement, opts...)
+	}
+
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (*mongo.UpdateResult, error) {
+		return s.DocumentStore.ReplaceOne(ctx, filter, replacement, opts...)
+	})
+}
+
+// DeleteMany ...
+func (s RetryStore) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	return RetryValue(ctx, s.Policy, func(ctx context.Context) (*mongo.DeleteResult, error) {
+		return s.DocumentStore.DeleteMany(ctx, filter, opts...)
+	})
+}
@@ -0,0 +1,190 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// flakyStore fails the next calls with the queued errors, then lets them through
+type flakyStore struct {
+	DocumentStore
+	mu       sync.Mutex
+	failures []error
+	calls    int
+}
+
+func (s *flakyStore) fail(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, errs...)
+}
+
+func (s *flakyStore) next() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if len(s.failures) == 0 {
+		return nil
+	}
+	err := s.failures[0]
+	s.failures = s.failures[1:]
+	return err
+}
+
+func (s *flakyStore) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	if err := s.next(); err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	return s.DocumentStore.FindOne(ctx, filter, opts...)
+}
+
+func (s *flakyStore) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	if err := s.next(); err != nil {
+		return nil, err
+	}
+	return s.DocumentStore.UpdateOne(ctx, filter, update, opts...)
+}
+
+func (s *flakyStore) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+	if err := s.next(); err != nil {
+		return 0, err
+	}
+	return s.DocumentStore.CountDocuments(ctx, filter, opts...)
+}
+
+// timeoutError is a net.Error timing out, like a socket read deadline
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+var (
+	errNotWritablePrimary = mongo.CommandError{Code: 10107, Name: "NotWritablePrimary", Message: "not primary"}
+	errNetwork            = mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+	errRetryableWrite     = mongo.WriteException{
+		WriteConcernError: &mongo.WriteConcernError{Code: 64, Message: "waiting for replication timed out"},
+		Labels:            []string{"RetryableWriteError"},
+	}
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errNotWritablePrimary, true},
+		{errNetwork, true},
+		{errRetryableWrite, true},
+		{mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired"}, true},
+		{fmt.Errorf("find: %w", timeoutError{}), true},
+		{fmt.Errorf("find: %w", errNotWritablePrimary), true},
+		{mongo.CommandError{Code: 11000, Message: "duplicate key"}, false},
+		{mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121}}}, false},
+		{context.Canceled, false},
+		{ErrNotFound, false},
+		{errors.New("boom"), false},
+	} {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+var fastRetries = RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func TestRetryStore(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyStore{DocumentStore: NewMemoryStore()}
+	store := RetryStore{DocumentStore: flaky, Policy: fastRetries}
+	id := seed(t, flaky.DocumentStore, bson.D{{Key: "title", Value: "post"}, {Key: "count", Value: 0}})
+
+	// transient failures are retried
+	flaky.fail(errNetwork, errNotWritablePrimary, errRetryableWrite)
+	if _, err := findOne(ctx, store, idFilter(id)); err != nil {
+		t.Fatal(err)
+	}
+	if flaky.calls != 4 {
+		t.Fatalf("%d calls, want 4", flaky.calls)
+	}
+
+	// up to MaxAttempts
+	flaky.calls = 0
+	flaky.fail(errNetwork, errNetwork, errNetwork, errNetwork, errNetwork)
+	if _, err := store.CountDocuments(ctx, bson.D{}); !mongo.IsNetworkError(err) || flaky.calls != 4 {
+		t.Fatalf("err = %v after %d calls", err, flaky.calls)
+	}
+	flaky.failures = nil
+
+	// other errors are returned at once
+	flaky.calls = 0
+	flaky.fail(mongo.CommandError{Code: 11000, Message: "duplicate key"})
+	if _, err := store.UpdateOne(ctx, idFilter(id), bson.D{{Key: "$set", Value: bson.D{{Key: "title", Value: "x"}}}}); !mongo.IsDuplicateKeyError(err) || flaky.calls != 1 {
+		t.Fatalf("err = %v after %d calls", err, flaky.calls)
+	}
+
+	// updates that are not idempotent go through once
+	flaky.calls = 0
+	flaky.fail(errNetwork)
+	if _, err := store.UpdateOne(ctx, idFilter(id), bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}}}); !mongo.IsNetworkError(err) || flaky.calls != 1 {
+		t.Fatalf("$inc: err = %v after %d calls", err, flaky.calls)
+	}
+	flaky.fail(errNetwork)
+	if _, err := store.UpdateOne(ctx, idFilter(id), bson.D{{Key: "$set", Value: bson.D{{Key: "count", Value: 5}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := findOne(ctx, flaky.DocumentStore, idFilter(id)); doc.Map()["count"] != int32(5) {
+		t.Fatalf("doc = %v", doc)
+	}
+
+	// a filter the write may stop matching goes through once: a lost acknowledgement would make the retry miss
+	flaky.calls = 0
+	flaky.fail(errNetwork)
+	claim := bson.D{{Key: "_id", Value: id}, {Key: "status", Value: "new"}}
+	if _, err := store.UpdateOne(ctx, claim, bson.D{{Key: "$set", Value: bson.D{{Key: "status", Value: "taken"}}}}); !mongo.IsNetworkError(err) || flaky.calls != 1 {
+		t.Fatalf("claim: err = %v after %d calls", err, flaky.calls)
+	}
+	flaky.fail(errNetwork)
+	eq := bson.D{{Key: "_id", Value: bson.D{{Key: "$eq", Value: id}}}}
+	if _, err := store.UpdateOne(ctx, eq, bson.D{{Key: "$set", Value: bson.D{{Key: "count", Value: 6}}}}); err != nil {
+		t.Fatalf("$eq on _id: %v", err)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := Retry(ctx, RetryPolicy{MaxAttempts: 100, BaseDelay: time.Second, MaxDelay: time.Second}, func(context.Context) error {
+		return errNetwork
+	})
+	if !mongo.IsNetworkError(err) {
+		t.Fatalf("expected the last error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Retry waited %s past a 20ms deadline", elapsed)
+	}
+
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 40 * time.Millisecond}.withDefaults()
+	for n := 1; n <= 40; n++ {
+		ceiling := 40 * time.Millisecond
+		if n < 3 {
+			ceiling = 10 * time.Millisecond << (n - 1)
+		}
+		if d := p.backoff(n); d < 0 || d >= ceiling {
+			t.Fatalf("backoff(%d) = %s, want below %s", n, d, ceiling)
+		}
+	}
+}
@@ -0,0 +1,592 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+MongoDB only checks the structure of the documents it stores. A collection validator adds rules, {$jsonSchema: ...}
+describes the expected fields and their types. The validation level decides which writes are checked: strict checks
+every insert and update, moderate skips updates of documents that were already invalid. The validation action decides
+what happens to an invalid document: error rejects the write with code 121, warn stores it and logs a warning.
+
+SchemaOf derives the schema from the bson tags of a struct. A field without omitempty is always written, so it is
+required. The schema tag adds constraints:
+	Title string `bson:"title,omitempty" schema:"required,minLength=1"`
+The keys are required, minLength, maxLength, minimum, maximum, pattern and enum (values separated by |).
+
+The same Schema validates documents on the client, SchemaStore rejects an invalid document before sending it.
+*/
+
+const (
+	documentValidationFailureCode = 121
+	namespaceNotFoundCode         = 26
+)
+
+// ValidationLevel selects the writes checked by a collection validator
+type ValidationLevel string
+
+// ValidationAction selects what happens to a document failing validation
+type ValidationAction string
+
+const (
+	// LevelStrict checks every insert and update
+	LevelStrict ValidationLevel = "strict"
+	// LevelModerate checks inserts and updates of valid documents only
+	LevelModerate ValidationLevel = "moderate"
+
+	// ActionError rejects invalid documents
+	ActionError ValidationAction = "error"
+	// ActionWarn accepts invalid documents and logs a warning on the server
+	ActionWarn ValidationAction = "warn"
+)
+
+// Schema is the subset of $jsonSchema generated by SchemaOf and checked by Validate
+type Schema struct {
+	// BSONType lists the accepted types, any type when empty
+	BSONType   []string
+	Required   []string
+	Properties map[string]*Schema
+	// AdditionalProperties is the schema of the fields not in Properties, they are not checked when nil
+	AdditionalProperties *Schema
+	Items                *Schema
+	MinLength            *int64
+	MaxLength            *int64
+	Minimum              *float64
+	Maximum              *float64
+	Enum                 []any
+	Pattern              string
+}
+
+// Document returns the $jsonSchema document of s, with the properties sorted by name
+func (s *Schema) Document() bson.D {
+	doc := bson.D{}
+	switch len(s.BSONType) {
+	case 0:
+	case 1:
+		doc = append(doc, bson.E{Key: "bsonType", Value: s.BSONType[0]})
+	default:
+		doc = append(doc, bson.E{Key: "bsonType", Value: s.BSONType})
+	}
+	if len(s.Required) > 0 {
+		doc = append(doc, bson.E{Key: "required", Value: s.Required})
+	}
+	if len(s.Properties) > 0 {
+		names := make([]string, 0, len(s.Properties))
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		props := bson.D{}
+		for _, name := range names {
+			props = append(props, bson.E{Key: name, Value: s.Properties[name].Document()})
+		}
+		doc = append(doc, bson.E{Key: "properties", Value: props})
+	}
+	if s.AdditionalProperties != nil {
+		doc = append(doc, bson.E{Key: "additionalProperties", Value: s.AdditionalProperties.Document()})
+	}
+	if s.Items != nil {
+		doc = append(doc, bson.E{Key: "items", Value: s.Items.Document()})
+	}
+	if s.MinLength != nil {
+		doc = append(doc, bson.E{Key: "minLength", Value: *s.MinLength})
+	}
+	if s.MaxLength != nil {
+		doc = append(doc, bson.E{Key: "maxLength", Value: *s.MaxLength})
+	}
+	if s.Minimum != nil {
+		doc = append(doc, bson.E{Key: "minimum", Value: *s.Minimum})
+	}
+	if s.Maximum != nil {
+		doc = append(doc, bson.E{Key: "maximum", Value: *s.Maximum})
+	}
+	if len(s.Enum) > 0 {
+		doc = append(doc, bson.E{Key: "enum", Value: s.Enum})
+	}
+	if s.Pattern != "" {
+		doc = append(doc, bson.E{Key: "pattern", Value: s.Pattern})
+	}
+
+	return doc
+}
+
+// MarshalBSON encodes s as its $jsonSchema document
+func (s *Schema) MarshalBSON() ([]byte, error) {
+	return bson.Marshal(s.Document())
+}
+
+// Validate returns a *SchemaError for the first value of doc that does not satisfy s
+func (s *Schema) Validate(doc any) error {
+	d, err := toDocument(doc)
+	if err != nil {
+		return err
+	}
+
+	return s.validate("", d)
+}
+
+func (s *Schema) validate(path string, v any) error {
+	if len(s.BSONType) > 0 {
+		t := bsonTypeOf(v)
+		if !containsString(s.BSONType, t) {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("bsonType %s, want %s", t, strings.Join(s.BSONType, " or "))}
+		}
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equalValues(v, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("%v is not one of %v", v, s.Enum)}
+		}
+	}
+
+	switch t := v.(type) {
+	case bson.D:
+		for _, name := range s.Required {
+			if _, ok := fieldOf(t, name); !ok {
+				return &SchemaError{Path: joinPath(path, name), Reason: "required"}
+			}
+		}
+		for _, e := range t {
+			sub := s.Properties[e.Key]
+			if sub == nil {
+				sub = s.AdditionalProperties
+			}
+			if sub == nil {
+				continue
+			}
+			if err := sub.validate(joinPath(path, e.Key), e.Value); err != nil {
+				return err
+			}
+		}
+	case bson.A:
+		if s.Items == nil {
+			break
+		}
+		for i, el := range t {
+			if err := s.Items.validate(joinPath(path, strconv.Itoa(i)), el); err != nil {
+				return err
+			}
+		}
+	case string:
+		n := int64(utf8.RuneCountInString(t))
+		if s.MinLength != nil && n < *s.MinLength {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("length %d, want at least %d", n, *s.MinLength)}
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("length %d, want at most %d", n, *s.MaxLength)}
+		}
+		if s.Pattern != "" {
+			ok, err := regexp.MatchString(s.Pattern, t)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return &SchemaError{Path: path, Reason: fmt.Sprintf("%q does not match %s", t, s.Pattern)}
+			}
+		}
+	default:
+		f, ok := toFloat(v)
+		if !ok {
+			break
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("%v, want at least %v", v, *s.Minimum)}
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return &SchemaError{Path: path, Reason: fmt.Sprintf("%v, want at most %v", v, *s.Maximum)}
+		}
+	}
+
+	return nil
+}
+
+func fieldOf(doc bson.D, key string) (any, bool) {
+	for _, e := range doc {
+		if e.Key == key {
+			return e.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bsonTypeOf returns the $jsonSchema bsonType alias of a decoded value
+func bsonTypeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int32:
+		return "int"
+	case int64:
+		return "long"
+	case float64:
+		return "double"
+	case primitive.Decimal128:
+		return "decimal"
+	case primitive.DateTime:
+		return "date"
+	case primitive.ObjectID:
+		return "objectId"
+	case primitive.Binary:
+		return "binData"
+	case primitive.Timestamp:
+		return "timestamp"
+	case primitive.Regex:
+		return "regex"
+	case bson.D:
+		return "object"
+	case bson.A:
+		return "array"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	dateTimeType   = reflect.TypeOf(primitive.DateTime(0))
+	objectIDType   = reflect.TypeOf(primitive.ObjectID{})
+	decimalType    = reflect.TypeOf(primitive.Decimal128{})
+	binaryType     = reflect.TypeOf(primitive.Binary{})
+	uuidType       = reflect.TypeOf(UUID{})
+	timestampType  = reflect.TypeOf(primitive.Timestamp{})
+	regexType      = reflect.TypeOf(primitive.Regex{})
+	documentType   = reflect.TypeOf(bson.D{})
+	arrayType      = reflect.TypeOf(bson.A{})
+	byteSliceType  = reflect.TypeOf([]byte(nil))
+	emptyInterface = reflect.TypeOf((*any)(nil)).Elem()
+)
+
+// SchemaOf returns the schema of the documents encoded from a T, T must be a struct
+func SchemaOf[T any]() (*Schema, error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("chapter3: SchemaOf needs a struct, got %s", t)
+	}
+
+	return schemaOfType(t, map[reflect.Type]bool{})
+}
+
+// schemaOfType returns the schema of t, parents holds the structs being generated to stop on recursive types
+func schemaOfType(t reflect.Type, parents map[reflect.Type]bool) (*Schema, error) {
+	switch t {
+	case timeType, dateTimeType:
+		return &Schema{BSONType: []string{"date"}}, nil
+	case objectIDType:
+		return &Schema{BSONType: []string{"objectId"}}, nil
+	case decimalType:
+		return &Schema{BSONType: []string{"decimal"}}, nil
+	case binaryType, uuidType, byteSliceType:
+		return &Schema{BSONType: []string{"binData"}}, nil
+	case timestampType:
+		return &Schema{BSONType: []string{"timestamp"}}, nil
+	case regexType:
+		return &Schema{BSONType: []string{"regex"}}, nil
+	case documentType:
+		return &Schema{BSONType: []string{"object"}}, nil
+	case arrayType:
+		return &Schema{BSONType: []string{"array"}}, nil
+	case emptyInterface:
+		return &Schema{}, nil
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s, err := schemaOfType(t.Elem(), parents)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.BSONType) > 0 {
+			s.BSONType = append(s.BSONType, "null")
+		}
+		return s, nil
+	case reflect.String:
+		return &Schema{BSONType: []string{"string"}}, nil
+	case reflect.Bool:
+		return &Schema{BSONType: []string{"bool"}}, nil
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return &Schema{BSONType: []string{"int"}}, nil
+	case reflect.Int64:
+		return &Schema{BSONType: []string{"long"}}, nil
+	case reflect.Int, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		// the driver writes these as an int when the value fits in 32 bits
+		return &Schema{BSONType: []string{"int", "long"}}, nil
+	case reflect.Float32, reflect.Float64:
+		return &Schema{BSONType: []string{"double"}}, nil
+	case reflect.Slice, reflect.Array:
+		items, err := schemaOfType(t.Elem(), parents)
+		if err != nil {
+			return nil, err
+		}
+		// a nil slice is written as null
+		return &Schema{BSONType: []string{"array", "null"}, Items: items}, nil
+	case reflect.Map:
+		if t.Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("chapter3: unsupported map key type %s", t.Key())
+		}
+		values, err := schemaOfType(t.Elem(), parents)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{BSONType: []string{"object", "null"}, AdditionalProperties: values}, nil
+	case reflect.Interface:
+		return &Schema{}, nil
+	case reflect.Struct:
+		if parents[t] {
+			return &Schema{BSONType: []string{"object"}}, nil
+		}
+		parents[t] = true
+		defer delete(parents, t)
+		s := &Schema{BSONType: []string{"object"}, Properties: map[string]*Schema{}}
+		if err := addFields(s, t, parents); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("chapter3: unsupported type %s", t)
+}
+
+// addFields adds the fields of the struct t to s, inline structs add their own fields
+func addFields(s *Schema, t reflect.Type, parents map[reflect.Type]bool) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("bson")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		omitempty, inline := false, false
+		for _, o := range strings.Split(opts, ",") {
+			switch o {
+			case "omitempty":
+				omitempty = true
+			case "inline":
+				inline = true
+			}
+		}
+		if inline && f.Type.Kind() == reflect.Struct {
+			if err := addFields(s, f.Type, parents); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fs, err := schemaOfType(f.Type, parents)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		required, err := applySchemaTag(fs, f)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", t.Name(), f.Name, err)
+		}
+		s.Properties[name] = fs
+		if required || !omitempty {
+			s.Required = append(s.Required, name)
+		}
+	}
+
+	return nil
+}
+
+// applySchemaTag adds the constraints of the schema tag of f to s and reports whether the field is required
+func applySchemaTag(s *Schema, f reflect.StructField) (bool, error) {
+	tag, ok := f.Tag.Lookup("schema")
+	if !ok {
+		return false, nil
+	}
+	required := false
+	for _, item := range strings.Split(tag, ",") {
+		key, value, _ := strings.Cut(item, "=")
+		var err error
+		switch key {
+		case "required":
+			required = true
+		case "minLength":
+			s.MinLength, err = parseInt(value)
+		case "maxLength":
+			s.MaxLength, err = parseInt(value)
+		case "minimum":
+			s.Minimum, err = parseFloat(value)
+		case "maximum":
+			s.Maximum, err = parseFloat(value)
+		case "pattern":
+			_, err = regexp.Compile(value)
+			s.Pattern = value
+		case "enum":
+			for _, v := range strings.Split(value, "|") {
+				e, perr := enumValue(f.Type, v)
+				if perr != nil {
+					return false, perr
+				}
+				s.Enum = append(s.Enum, e)
+			}
+		default:
+			err = fmt.Errorf("unknown schema tag key %q", key)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return required, nil
+}
+
+func parseInt(s string) (*int64, error) {
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+func parseFloat(s string) (*float64, error) {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+// enumValue parses an enum value of the schema tag for a field of type t
+func enumValue(t reflect.Type, s string) (any, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseInt(s, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(s, 64)
+	case reflect.Bool:
+		return strconv.ParseBool(s)
+	}
+
+	return s, nil
+}
+
+// ValidationOptions configures ApplySchema, the zero value is strict with the error action
+type ValidationOptions struct {
+	Level  ValidationLevel
+	Action ValidationAction
+}
+
+// ApplySchema sets schema as the validator of collection with collMod, creating the collection when it does not exist
+func ApplySchema(ctx context.Context, db *mongo.Database, collection string, schema *Schema, opts ValidationOptions) error {
+	if opts.Level == "" {
+		opts.Level = LevelStrict
+	}
+	if opts.Action == "" {
+		opts.Action = ActionError
+	}
+	validator := bson.D{{Key: "$jsonSchema", Value: schema.Document()}}
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: collection},
+		{Key: "validator", Value: validator},
+		{Key: "validationLevel", Value: string(opts.Level)},
+		{Key: "validationAction", Value: string(opts.Action)},
+	}).Err()
+	var ce mongo.CommandError
+	if errors.As(err, &ce) && ce.Code == namespaceNotFoundCode {
+		return db.CreateCollection(ctx, collection, options.CreateCollection().
+			SetValidator(validator).
+			SetValidationLevel(string(opts.Level)).
+			SetValidationAction(string(opts.Action)))
+	}
+
+	return err
+}
+
+// SchemaStore is a DocumentStore validating inserted and replacement documents against Schema before sending them.
+// Updates are not checked: only the server sees the updated document.
+type SchemaStore struct {
+	DocumentStore
+	Schema *Schema
+}
+
+// InsertOne ...
+func (s SchemaStore) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if err := s.Schema.Validate(document); err != nil {
+		return nil, err
+	}
+
+	return s.DocumentStore.InsertOne(ctx, document, opts...)
+}
+
+// InsertMany rejects the whole batch when one document is invalid
+func (s SchemaStore) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	for i, doc := range documents {
+		if err := s.Schema.Validate(doc); err != nil {
+			return nil, fmt.Errorf("document %d: %w", i, err)
+		}
+	}
+
+	return s.DocumentStore.InsertMany(ctx, documents, opts...)
+}
+
+// ReplaceOne ...
+func (s SchemaStore) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if err := s.Schema.Validate(replacement); err != nil {
+		return nil, err
+	}
+
+	return s.DocumentStore.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+// FindOneAndReplace ...
+func (s SchemaStore) FindOneAndReplace(ctx context.Context, filter any, replacement any, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	if err := s.Schema.Validate(replacement); err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+
+	return s.DocumentStore.FindOneAndReplace(ctx, filter, replacement, opts...)
+}
@@ -0,0 +1,129 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type address struct {
+	City string `bson:"city" schema:"enum=HN|HCM"`
+	Zip  string `bson:"zip,omitempty" schema:"pattern=^[0-9]{5}$"`
+}
+
+// Timestamps is exported, the driver skips embedded structs of unexported types
+type Timestamps struct {
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+type customer struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Name       string             `bson:"name,omitempty" schema:"required,minLength=2,maxLength=20"`
+	Age        int32              `bson:"age" schema:"minimum=0,maximum=150"`
+	Tags       []string           `bson:"tags,omitempty"`
+	Address    *address           `bson:"address,omitempty"`
+	Attributes map[string]int64   `bson:"attributes,omitempty"`
+	Notes      any                `bson:"notes,omitempty"`
+	Internal   string             `bson:"-"`
+	Referrer   *customer          `bson:"referrer,omitempty"`
+	Timestamps `bson:",inline"`
+}
+
+func TestSchemaOf(t *testing.T) {
+	s, err := SchemaOf[customer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"name", "age", "createdAt"}; !reflect.DeepEqual(s.Required, want) {
+		t.Fatalf("required = %v, want %v", s.Required, want)
+	}
+	if _, ok := s.Properties["internal"]; ok {
+		t.Fatal("a field tagged - must not be in the schema")
+	}
+
+	doc := s.Document()
+	props := doc.Map()["properties"].(bson.D).Map()
+	if got := props["address"].(bson.D); !reflect.DeepEqual(got.Map()["bsonType"], []string{"object", "null"}) {
+		t.Fatalf("address = %v", got)
+	}
+	if got := props["createdAt"].(bson.D).Map()["bsonType"]; got != "date" {
+		t.Fatalf("createdAt bsonType = %v", got)
+	}
+	if got := props["tags"].(bson.D).Map()["items"].(bson.D).Map()["bsonType"]; got != "string" {
+		t.Fatalf("tags items = %v", got)
+	}
+	if got := props["referrer"].(bson.D).Map()["properties"]; got != nil {
+		t.Fatalf("a recursive type must stop, got %v", got)
+	}
+	if _, err := bson.Marshal(bson.D{{Key: "$jsonSchema", Value: s}}); err != nil {
+		t.Fatal(err)
+	}
+
+	type bad struct {
+		N int `bson:"n" schema:"minimum=low"`
+	}
+	if _, err := SchemaOf[bad](); err == nil {
+		t.Fatal("expected an error for an invalid schema tag")
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	s, err := SchemaOf[customer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := customer{Name: "Joe", Age: 30, Tags: []string{"vip"}, Address: &address{City: "HN", Zip: "10000"}}
+	if err := s.Validate(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		doc  any
+		path string
+	}{
+		{customer{Age: 30}, "name"},
+		{customer{Name: "J", Age: 30}, "name"},
+		{customer{Name: "Joe", Age: -1}, "age"},
+		{customer{Name: "Joe", Address: &address{City: "DN"}}, "address.city"},
+		{customer{Name: "Joe", Address: &address{City: "HN", Zip: "1"}}, "address.zip"},
+		{bson.D{{Key: "name", Value: "Joe"}, {Key: "age", Value: "old"}, {Key: "createdAt", Value: time.Now()}}, "age"},
+		{bson.D{{Key: "name", Value: "Joe"}, {Key: "age", Value: 1}, {Key: "createdAt", Value: time.Now()}, {Key: "tags", Value: bson.A{"a", 2}}}, "tags.1"},
+		{bson.D{{Key: "name", Value: "Joe"}, {Key: "age", Value: 1}, {Key: "createdAt", Value: time.Now()}, {Key: "attributes", Value: bson.D{{Key: "x", Value: "y"}}}}, "attributes.x"},
+	} {
+		err := s.Validate(tc.doc)
+		var se *SchemaError
+		if !errors.As(err, &se) || !errors.Is(err, ErrInvalidDocument) || se.Path != tc.path {
+			t.Errorf("%v: expected a SchemaError at %s, got %v", tc.doc, tc.path, err)
+		}
+	}
+}
+
+func TestSchemaStore(t *testing.T) {
+	ctx := context.Background()
+	s, err := SchemaOf[customer]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := SchemaStore{DocumentStore: NewMemoryStore(), Schema: s}
+
+	if _, err := store.InsertOne(ctx, customer{Name: "Joe"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.InsertMany(ctx, []any{customer{Name: "Ann"}, customer{}}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("InsertMany: expected ErrInvalidDocument, got %v", err)
+	}
+	if _, err := store.ReplaceOne(ctx, bson.D{}, customer{Name: "Joe", Age: 200}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("ReplaceOne: expected ErrInvalidDocument, got %v", err)
+	}
+	if _, err := FindOneAndReplace[customer](ctx, store, bson.D{}, bson.D{}, FindAndModifyOptions{}); !errors.Is(err, ErrInvalidDocument) {
+		t.Fatalf("FindOneAndReplace: expected ErrInvalidDocument, got %v", err)
+	}
+	if n := len(findAll(t, store, bson.D{})); n != 1 {
+		t.Fatalf("%d documents stored, want 1", n)
+	}
+}
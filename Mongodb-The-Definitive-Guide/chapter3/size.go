@@ -0,0 +1,76 @@
+package chapter3
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxDocumentSize is the largest BSON document MongoDB stores, 16MB
+const MaxDocumentSize = 16 * 1024 * 1024
+
+// CheckDocumentSize returns the size of the BSON encoding of doc, and a *DocumentTooLargeError when it is over limit.
+// A limit <= 0 means MaxDocumentSize.
+func CheckDocumentSize(doc any, limit int) (int, error) {
+	if limit <= 0 {
+		limit = MaxDocumentSize
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > limit {
+		return len(b), &DocumentTooLargeError{Size: len(b), Limit: limit}
+	}
+
+	return len(b), nil
+}
+
+// SizeGuardStore is a DocumentStore that measures inserted and replacement documents before sending them, so an oversized
+// document fails with a *DocumentTooLargeError instead of a server error after the whole payload was transferred.
+// Updates are not checked: their size does not tell the size of the updated document.
+type SizeGuardStore struct {
+	DocumentStore
+	// Limit is the largest accepted document, MaxDocumentSize when <= 0
+	Limit int
+}
+
+// InsertOne ...
+func (s SizeGuardStore) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	if _, err := CheckDocumentSize(document, s.Limit); err != nil {
+		return nil, err
+	}
+
+	return s.DocumentStore.InsertOne(ctx, document, opts...)
+}
+
+// InsertMany rejects the whole batch when one document is too large
+func (s SizeGuardStore) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	for _, doc := range documents {
+		if _, err := CheckDocumentSize(doc, s.Limit); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.DocumentStore.InsertMany(ctx, documents, opts...)
+}
+
+// ReplaceOne ...
+func (s SizeGuardStore) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	if _, err := CheckDocumentSize(replacement, s.Limit); err != nil {
+		return nil, err
+	}
+
+	return s.DocumentStore.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+// FindOneAndReplace ...
+func (s SizeGuardStore) FindOneAndReplace(ctx context.Context, filter any, replacement any, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult {
+	if _, err := CheckDocumentSize(replacement, s.Limit); err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+
+	return s.DocumentStore.FindOneAndReplace(ctx, filter, replacement, opts...)
+}
@@ -0,0 +1,54 @@
+package chapter3
+
+import (
+	"context"
+
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DocumentStore is the subset of *mongo.Collection used by the chapter3 examples.
+// The method set mirrors the driver so a *mongo.Collection can be used directly,
+// while MemoryStore lets the examples run without a live server.
+type DocumentStore interface {
+	InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error)
+	InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult
+	CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error)
+	UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error)
+	DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	FindOneAndUpdate(ctx context.Context, filter any, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult
+	FindOneAndReplace(ctx context.Context, filter any, replacement any, opts ...*options.FindOneAndReplaceOptions) *mongo.SingleResult
+	FindOneAndDelete(ctx context.Context, filter any, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult
+	BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error)
+	Drop(ctx context.Context) error
+}
+
+// MongoStore is a DocumentStore backed by a MongoDB collection.
+// Every MongoStore shares the process wide client of the connection package, so creating a store does not dial a new connection.
+type MongoStore struct {
+	*mongo.Collection
+}
+
+// NewMongoStore returns a store for the given database and collection
+func NewMongoStore(ctx context.Context, database, collection string) (MongoStore, error) {
+	db, err := connection.Database(ctx, database)
+	if err != nil {
+		return MongoStore{}, err
+	}
+
+	return MongoStore{Collection: db.Collection(collection)}, nil
+}
+
+var _ DocumentStore = MongoStore{}
+var _ DocumentStore = (*MemoryStore)(nil)
+var _ DocumentStore = (*AuditedStore)(nil)
+var _ DocumentStore = SizeGuardStore{}
+var _ DocumentStore = SchemaStore{}
+var _ DocumentStore = RetryStore{}
@@ -0,0 +1,186 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+A delete can't be undone. Trash turns deletes into moves: each deleted document is copied into a trash collection
+("<collection>_trash") with the time and reason of the delete, then removed from the live collection. It can be restored
+until it is purged. On MongoDB a TTL index on "deletedAt" can do the purging, Purge and PurgeEvery do it from the application.
+The copy happens before the delete and the two are separate writes: a failure in between leaves the document in both
+collections, never in neither. The delete only removes the document if it is still the one copied, a concurrent update
+is moved to the trash with it instead of being lost.
+*/
+
+// TrashEntry is a deleted document waiting in the trash
+type TrashEntry struct {
+	// ID is the "_id" of the deleted document
+	ID        any       `bson:"_id"`
+	DeletedAt time.Time `bson:"deletedAt"`
+	Reason    string    `bson:"reason"`
+	Document  bson.D    `bson:"document"`
+}
+
+// Trash soft deletes the documents of a collection
+type Trash struct {
+	store DocumentStore
+	trash DocumentStore
+	now   func() time.Time
+}
+
+// NewTrash returns a Trash moving deleted documents of store into trash
+func NewTrash(store, trash DocumentStore) *Trash {
+	return &Trash{store: store, trash: trash, now: time.Now}
+}
+
+// NewMongoTrash returns a Trash for collection, the trash collection is named collection + "_trash"
+func NewMongoTrash(ctx context.Context, database, collection string) (*Trash, error) {
+	store, err := NewMongoStore(ctx, database, collection)
+	if err != nil {
+		return nil, err
+	}
+	trash, err := NewMongoStore(ctx, database, collection+"_trash")
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTrash(store, trash), nil
+}
+
+// Delete moves every document matching filter to the trash and returns how many were moved
+func (t *Trash) Delete(ctx context.Context, filter any, reason string) (int64, error) {
+	f, err := toDocument(filter)
+	if err != nil {
+		return 0, err
+	}
+	docs, err := find(ctx, t.store, f)
+	if err != nil {
+		return 0, err
+	}
+	deletedAt := primitive.NewDateTimeFromTime(t.now())
+	var moved int64
+	for _, doc := range docs {
+		ok, err := t.move(ctx, f, doc, deletedAt, reason)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	return moved, nil
+}
+
+// maxMoveAttempts bounds the attempts to move a document that keeps changing
+const maxMoveAttempts = 10
+
+// move copies doc into the trash, then deletes it with the copy as filter: a write landing in between makes the
+// delete miss instead of being lost, and the document is read and copied again. A write adding a field still matches,
+// the copy is then replaced by the document that was deleted. It reports false when the document was deleted by
+// someone else or stopped matching filter.
+func (t *Trash) move(ctx context.Context, filter, doc bson.D, deletedAt primitive.DateTime, reason string) (bool, error) {
+	id := fieldValue(doc, "_id")
+	entry := func(doc bson.D) bson.D {
+		return bson.D{
+			{Key: "_id", Value: id},
+			{Key: "deletedAt", Value: deletedAt},
+			{Key: "reason", Value: reason},
+			{Key: "document", Value: doc},
+		}
+	}
+	for attempt := 0; attempt < maxMoveAttempts; attempt++ {
+		copied := entry(doc)
+		if _, err := t.trash.ReplaceOne(ctx, idFilter(id), copied, options.Replace().SetUpsert(true)); err != nil {
+			return false, translateError(err)
+		}
+		deleted, err := decodeResult[bson.D](t.store.FindOneAndDelete(ctx, doc))
+		if err == nil {
+			if equalValues(deleted, doc) {
+				return true, nil
+			}
+			_, err := t.trash.ReplaceOne(ctx, idFilter(id), entry(deleted))
+			return err == nil, translateError(err)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return false, err
+		}
+
+		// the document changed since it was read
+		current := idFilter(id)
+		if len(filter) > 0 {
+			current = bson.D{{Key: "$and", Value: bson.A{filter, current}}}
+		}
+		doc, err = findOne(ctx, t.store, current)
+		if errors.Is(err, ErrNotFound) {
+			// gone or no longer matching: take back the copy, unless another delete replaced it
+			_, err = t.trash.DeleteOne(ctx, copied)
+			return false, translateError(err)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return false, fmt.Errorf("%w: document %v kept changing while being moved to the trash", ErrConflict, id)
+}
+
+// Restore moves the document with id back from the trash. It returns ErrNotFound when the document is not in the trash
+// and a *DuplicateKeyError when a document with the same id was inserted since.
+func (t *Trash) Restore(ctx context.Context, id any) error {
+	entry, err := decodeResult[TrashEntry](t.trash.FindOne(ctx, idFilter(id)))
+	if err != nil {
+		return err
+	}
+	if _, err := t.store.InsertOne(ctx, entry.Document); err != nil {
+		return translateError(err)
+	}
+	_, err = t.trash.DeleteOne(ctx, idFilter(id))
+
+	return translateError(err)
+}
+
+// ListTrash returns the documents in the trash, the most recently deleted first
+func (t *Trash) ListTrash(ctx context.Context) ([]TrashEntry, error) {
+	return NewRepository[TrashEntry](t.trash).List(ctx, nil, ListOptions{Sort: bson.D{{Key: "deletedAt", Value: -1}}})
+}
+
+// Purge removes for good the documents deleted more than retention ago and returns how many were removed
+func (t *Trash) Purge(ctx context.Context, retention time.Duration) (int64, error) {
+	cutoff := primitive.NewDateTimeFromTime(t.now().Add(-retention))
+	rs, err := t.trash.DeleteMany(ctx, bson.D{{Key: "deletedAt", Value: bson.D{{Key: "$lt", Value: cutoff}}}})
+	if err != nil {
+		return 0, translateError(err)
+	}
+
+	return rs.DeletedCount, nil
+}
+
+// PurgeEvery runs Purge every interval until ctx is done. Errors are passed to onError when it is not nil.
+func (t *Trash) PurgeEvery(ctx context.Context, interval, retention time.Duration, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := t.Purge(ctx, retention); err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}
+}
+
+// SoftDeleteMany is DeleteMany through the trash: the documents with title can be restored until they are purged
+func (d Document) SoftDeleteMany(ctx context.Context, trash *Trash, title any, reason string) (int64, error) {
+	return trash.Delete(ctx, bson.D{{Key: "title", Value: title}}, reason)
+}
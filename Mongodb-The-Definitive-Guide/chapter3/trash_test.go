@@ -0,0 +1,162 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestTrashDeleteAndRestore(t *testing.T) {
+	ctx := context.Background()
+	store, trashStore := NewMemoryStore(), NewMemoryStore()
+	trash := NewTrash(store, trashStore)
+	d := Document{Title: "post"}
+	if _, err := d.InsertMany(ctx, store); err != nil {
+		t.Fatal(err)
+	}
+	keep := seed(t, store, bson.D{{Key: "title", Value: "other"}})
+	gone := seed(t, store, bson.D{{Key: "title", Value: "post-3"}})
+
+	// the accidental DeleteMany: every "post-3" document goes to the trash
+	moved, err := d.SoftDeleteMany(ctx, trash, "post-3", "cleanup")
+	if err != nil || moved != 2 {
+		t.Fatalf("moved = %d, err = %v", moved, err)
+	}
+	if n := len(findAll(t, store, bson.D{})); n != 10 {
+		t.Fatalf("%d live documents, want 10", n)
+	}
+
+	entries, err := trash.ListTrash(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Reason != "cleanup" || entries[0].DeletedAt.IsZero() {
+		t.Fatalf("trash = %+v", entries)
+	}
+
+	if err := trash.Restore(ctx, gone); err != nil {
+		t.Fatal(err)
+	}
+	docs := findAll(t, store, bson.D{{Key: "_id", Value: gone}})
+	if len(docs) != 1 || docs[0]["title"] != "post-3" {
+		t.Fatalf("restored %v", docs)
+	}
+	if err := trash.Restore(ctx, gone); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("second restore: expected ErrNotFound, got %v", err)
+	}
+	if err := trash.Restore(ctx, keep); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("restore of a live document: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTrashRestoreConflict(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	trash := NewTrash(store, NewMemoryStore())
+	id := seed(t, store, bson.D{{Key: "title", Value: "a"}})
+	if _, err := trash.Delete(ctx, bson.D{{Key: "_id", Value: id}}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	newer := bson.D{{Key: "_id", Value: id}, {Key: "title", Value: "b"}}
+	if _, err := store.InsertOne(ctx, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := trash.Restore(ctx, id); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("expected ErrDuplicateKey, got %v", err)
+	}
+	if entries, _ := trash.ListTrash(ctx); len(entries) != 1 {
+		t.Fatal("a failed restore must keep the document in the trash")
+	}
+}
+
+func TestTrashPurge(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	trash := NewTrash(store, NewMemoryStore())
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	trash.now = func() time.Time { return now }
+
+	old := seed(t, store, bson.D{{Key: "title", Value: "old"}})
+	seed(t, store, bson.D{{Key: "title", Value: "recent"}})
+	trash.Delete(ctx, bson.D{{Key: "_id", Value: old}}, "")
+	now = now.Add(5 * 24 * time.Hour)
+	trash.Delete(ctx, bson.D{}, "")
+
+	now = now.Add(24 * time.Hour)
+	purged, err := trash.Purge(ctx, 3*24*time.Hour)
+	if err != nil || purged != 1 {
+		t.Fatalf("purged = %d, err = %v", purged, err)
+	}
+	entries, _ := trash.ListTrash(ctx)
+	if len(entries) != 1 || entries[0].Document.Map()["title"] != "recent" {
+		t.Fatalf("trash = %+v", entries)
+	}
+}
+
+// racingStore runs race once, just before the first FindOneAndDelete, like a writer slipping in after the read
+type racingStore struct {
+	DocumentStore
+	race func()
+}
+
+func (s *racingStore) FindOneAndDelete(ctx context.Context, filter any, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+	if s.race != nil {
+		s.race()
+		s.race = nil
+	}
+	return s.DocumentStore.FindOneAndDelete(ctx, filter, opts...)
+}
+
+func TestTrashDeleteConcurrentUpdate(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		update bson.D
+		moved  int64
+		want   bson.M
+	}{
+		{"changed field", bson.D{{Key: "$set", Value: bson.D{{Key: "body", Value: "edited"}}}}, 1, bson.M{"body": "edited"}},
+		{"added field", bson.D{{Key: "$set", Value: bson.D{{Key: "tag", Value: "new"}}}}, 1, bson.M{"body": "draft", "tag": "new"}},
+		{"no longer matching", bson.D{{Key: "$set", Value: bson.D{{Key: "title", Value: "kept"}}}}, 0, nil},
+	} {
+		memory := NewMemoryStore()
+		id := seed(t, memory, bson.D{{Key: "title", Value: "post"}, {Key: "body", Value: "draft"}})
+		store := &racingStore{DocumentStore: memory}
+		store.race = func() {
+			if _, err := memory.UpdateOne(ctx, idFilter(id), tc.update); err != nil {
+				t.Fatal(err)
+			}
+		}
+		trash := NewTrash(store, NewMemoryStore())
+
+		moved, err := trash.Delete(ctx, bson.D{{Key: "title", Value: "post"}}, "test")
+		if err != nil || moved != tc.moved {
+			t.Fatalf("%s: moved = %d, err = %v", tc.name, moved, err)
+		}
+		entries, err := trash.ListTrash(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want == nil {
+			if len(entries) != 0 || len(findAll(t, memory, idFilter(id))) != 1 {
+				t.Fatalf("%s: trash = %v, the document must stay live", tc.name, entries)
+			}
+			continue
+		}
+		if len(entries) != 1 {
+			t.Fatalf("%s: trash = %v", tc.name, entries)
+		}
+		// the trash holds the document as it was when deleted, the update included
+		doc := entries[0].Document.Map()
+		for k, v := range tc.want {
+			if doc[k] != v {
+				t.Errorf("%s: trashed %v, want %s = %v", tc.name, doc, k, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package chapter3
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+An update document is a bson.D of operators, each holding a document of paths. Writing it by hand makes two mistakes easy:
+appending a second {"$set": ...} entry instead of adding to the first one, and touching the same field twice, e.g. setting
+"name" and "name.email" in one update, which the server rejects with "would create a conflict".
+UpdateBuilder merges the fields of each operator into one entry and reports conflicting paths before anything is sent.
+*/
+
+// ErrUpdateConflict is returned by UpdateBuilder.Build when two fields of the update overlap
+var ErrUpdateConflict = errors.New("chapter3: conflicting update paths")
+
+// UpdateBuilder builds an update document, the zero value is ready to use
+type UpdateBuilder struct {
+	update bson.D
+	// paths holds every path touched so far with the operator touching it
+	paths []bson.E
+	err   error
+}
+
+// NewUpdate returns an empty UpdateBuilder
+func NewUpdate() *UpdateBuilder {
+	return &UpdateBuilder{}
+}
+
+// Set sets path to value, creating the field if needed
+func (b *UpdateBuilder) Set(path string, value any) *UpdateBuilder {
+	return b.add("$set", path, value)
+}
+
+// SetOnInsert sets path to value only when an upsert inserts the document
+func (b *UpdateBuilder) SetOnInsert(path string, value any) *UpdateBuilder {
+	return b.add("$setOnInsert", path, value)
+}
+
+// Unset removes the fields
+func (b *UpdateBuilder) Unset(paths ...string) *UpdateBuilder {
+	for _, path := range paths {
+		b.add("$unset", path, "")
+	}
+
+	return b
+}
+
+// Inc adds delta to the number at path, a missing field is set to delta
+func (b *UpdateBuilder) Inc(path string, delta any) *UpdateBuilder {
+	return b.add("$inc", path, delta)
+}
+
+// Push appends values to the array at path
+func (b *UpdateBuilder) Push(path string, values ...any) *UpdateBuilder {
+	if len(values) == 1 {
+		return b.add("$push", path, values[0])
+	}
+
+	return b.add("$push", path, bson.D{{Key: "$each", Value: bson.A(values)}})
+}
+
+// Rename moves the value of from to to
+func (b *UpdateBuilder) Rename(from, to string) *UpdateBuilder {
+	if err := b.claim("$rename", to); err != nil {
+		b.err = err
+		return b
+	}
+
+	return b.add("$rename", from, to)
+}
+
+// Min sets path to value when value is lower than the current one or the field is missing
+func (b *UpdateBuilder) Min(path string, value any) *UpdateBuilder {
+	return b.add("$min", path, value)
+}
+
+// Max sets path to value when value is greater than the current one or the field is missing
+func (b *UpdateBuilder) Max(path string, value any) *UpdateBuilder {
+	return b.add("$max", path, value)
+}
+
+// CurrentDate sets path to the current date of the server
+func (b *UpdateBuilder) CurrentDate(path string) *UpdateBuilder {
+	return b.add("$currentDate", path, true)
+}
+
+// Build returns the update document, operators and fields keep the order they were added in.
+// The error wraps ErrUpdateConflict when two paths overlap, an update without any field is an error too.
+func (b *UpdateBuilder) Build() (bson.D, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.update) == 0 {
+		return nil, errors.New("chapter3: empty update")
+	}
+
+	return b.update, nil
+}
+
+func (b *UpdateBuilder) add(operator, path string, value any) *UpdateBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := b.claim(operator, path); err != nil {
+		b.err = err
+		return b
+	}
+	for i, op := range b.update {
+		if op.Key == operator {
+			b.update[i].Value = append(op.Value.(bson.D), bson.E{Key: path, Value: value})
+			return b
+		}
+	}
+	b.update = append(b.update, bson.E{Key: operator, Value: bson.D{{Key: path, Value: value}}})
+
+	return b
+}
+
+// claim records path for operator, unless an earlier field overlaps it
+func (b *UpdateBuilder) claim(operator, path string) error {
+	if path == "" {
+		return fmt.Errorf("chapter3: empty path for %s", operator)
+	}
+	for _, p := range b.paths {
+		if pathsConflict(p.Key, path) {
+			return fmt.Errorf("%w: %s %q and %s %q", ErrUpdateConflict, p.Value, p.Key, operator, path)
+		}
+	}
+	b.paths = append(b.paths, bson.E{Key: path, Value: operator})
+
+	return nil
+}
+
+// pathsConflict reports whether a and b are the same field or one is inside the other
+func pathsConflict(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
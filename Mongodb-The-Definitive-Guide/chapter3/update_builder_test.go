@@ -0,0 +1,85 @@
+package chapter3
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUpdateBuilderMergesOperators(t *testing.T) {
+	update, err := NewUpdate().
+		Set("title", "a").
+		Inc("count", 1).
+		Set("name.email", "x@y.z").
+		Unset("draft", "tmp").
+		Push("tags", "go", "mongo").
+		Rename("old", "new").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "title", Value: "a"}, {Key: "name.email", Value: "x@y.z"}}},
+		{Key: "$inc", Value: bson.D{{Key: "count", Value: 1}}},
+		{Key: "$unset", Value: bson.D{{Key: "draft", Value: ""}, {Key: "tmp", Value: ""}}},
+		{Key: "$push", Value: bson.D{{Key: "tags", Value: bson.D{{Key: "$each", Value: bson.A{"go", "mongo"}}}}}},
+		{Key: "$rename", Value: bson.D{{Key: "old", Value: "new"}}},
+	}
+	if !reflect.DeepEqual(update, want) {
+		t.Fatalf("got %v\nwant %v", update, want)
+	}
+}
+
+func TestUpdateBuilderConflicts(t *testing.T) {
+	cases := map[string]*UpdateBuilder{
+		"parent and child":      NewUpdate().Set("name", bson.D{}).Set("name.email", "x"),
+		"child and parent":      NewUpdate().Inc("stats.views", 1).Unset("stats"),
+		"same path":             NewUpdate().Set("count", 1).Inc("count", 1),
+		"rename target":         NewUpdate().Set("b", 1).Rename("a", "b"),
+		"rename source":         NewUpdate().Rename("a", "b").Max("a.x", 1),
+		"set on insert and set": NewUpdate().SetOnInsert("createdAt", 1).Set("createdAt", 2),
+	}
+	for name, b := range cases {
+		if _, err := b.Build(); !errors.Is(err, ErrUpdateConflict) {
+			t.Errorf("%s: expected ErrUpdateConflict, got %v", name, err)
+		}
+	}
+
+	if _, err := NewUpdate().Set("name", 1).Set("names", 2).Build(); err != nil {
+		t.Errorf("name and names do not overlap: %v", err)
+	}
+	if _, err := NewUpdate().Build(); err == nil {
+		t.Error("expected an error for an empty update")
+	}
+}
+
+func TestUpdateBuilderApplied(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+	id := seed(t, store, bson.D{{Key: "low", Value: 5}, {Key: "high", Value: 5}, {Key: "old", Value: "v"}})
+
+	update, err := NewUpdate().Min("low", 3).Max("high", 4).Rename("old", "new").CurrentDate("modified").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, update); err != nil {
+		t.Fatal(err)
+	}
+	doc := findAll(t, store, bson.D{})[0]
+	if doc["low"] != int32(3) || doc["high"] != int32(5) || doc["new"] != "v" || doc["old"] != nil {
+		t.Fatalf("got %v", doc)
+	}
+	if _, ok := doc["modified"].(primitive.DateTime); !ok {
+		t.Fatalf("modified = %T, want a date", doc["modified"])
+	}
+
+	// the memory store rejects raw updates with overlapping paths like the server
+	conflict := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: 1}, {Key: "name.email", Value: "x"}}}}
+	if _, err := store.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, conflict); err == nil {
+		t.Fatal("expected a conflict error")
+	}
+}
@@ -0,0 +1,102 @@
+package chapter4
+
+import (
+	"reflect"
+	"testing"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// conformance pins the documents each chapter4 example finds, evaluated offline with chapter3.Match.
+// Seeds and filters are copied from the examples, want lists the indexes of the seeds the server returns.
+var conformance = []struct {
+	example string
+	seed    []any
+	filter  any
+	want    []int
+}{
+	{"Find", []any{bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}}, bson.D{}, []int{0}},
+	{"Find", []any{bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}}, bson.D{{Key: "username", Value: "admin1"}}, nil},
+	{"Find", []any{bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}}, bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}, []int{0}},
+	{"QueryCondition", []any{bson.D{{Key: "age", Value: 20}}}, Gte("age", 18), []int{0}},
+	{"QueryCondition", []any{bson.D{{Key: "age", Value: 20}}}, Gte("age", 22), nil},
+	{"OrQuery", ages(20, 25, 30), In("age", 18, 19, 20), []int{0}},
+	{"NotQuery", []any{bson.M{"age": 23, "name": "ngoctd"}}, Eq("age", 23), []int{0}},
+	{"NotQuery", []any{bson.M{"age": 23, "name": "ngoctd"}}, Gte("age", 23), []int{0}},
+	{"NotQuery", []any{bson.M{"age": 23, "name": "ngoctd"}}, Not(Gte("age", 23)), nil},
+	{"QueryingArrays", []any{bson.M{"fruit": []any{"apple", "banana", "peach"}}}, bson.M{"fruit": "apple"}, []int{0}},
+	{"QueryingArraysAllOperation", fruits(), bson.M{"fruit": bson.M{"$all": []any{"apple", "banana"}}}, []int{0, 2}},
+	// an exact array match needs the same elements in the same order
+	{"QueryingArraysAllOperation", fruits(), bson.M{"fruit": []any{"apple", "banana"}}, nil},
+	{"QueryingArraysAllOperation", fruits(), bson.M{"fruit": []any{"apple", "banana", "peach"}}, []int{0}},
+	{"QueryingArraysSizeOperator", fruits(), bson.M{"fruit": bson.M{"$size": 3}}, []int{0, 1, 2}},
+	{"QueryingArraysSizeOperator", fruits(), bson.M{"fruit": bson.M{"$size": 1}}, nil},
+	{"QueryingArraysSliceOperator", fruits(), bson.D{{Key: "fruit", Value: "apple"}}, []int{0, 1, 2}},
+	// the example uses bson.M for the embedded document, whose field order is random: bson.D keeps the result stable
+	{"QueryingOnEmbedded", []any{bson.D{{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}, {Key: "last", Value: "Schmoe"}}}, {Key: "age", Value: 23}}},
+		bson.D{{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}, {Key: "last", Value: "Schmoe"}}}}, []int{0}},
+	{"QueryingOnEmbedded", []any{bson.D{{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}, {Key: "last", Value: "Schmoe"}}}, {Key: "age", Value: 23}}},
+		bson.D{{Key: "name", Value: bson.D{{Key: "last", Value: "Schmoe"}, {Key: "first", Value: "Joe"}}}}, nil},
+	{"QueryingOnEmbedded", []any{bson.M{"name": bson.M{"first": "Joe", "last": "Schmoe"}, "age": 23}}, bson.M{"name.first": "Joe"}, []int{0}},
+	{"QueryingArraysEmbedded", []any{bson.M{"comments": []any{bson.M{"author": "Joe", "score": 3}, bson.M{"author": "Mary", "score": 6}}, "content": "content 1"}},
+		bson.M{"comments": bson.M{"$elemMatch": bson.M{"score": bson.M{"$gte": 6}}}}, []int{0}},
+	// $or inside $elemMatch queries the embedded documents, as documented for the server
+	{"QueryingArraysEmbedded", []any{
+		bson.M{"results": []any{bson.M{"product": "abc", "score": 10}, bson.M{"product": "xyz", "score": 5}}},
+		bson.M{"results": []any{bson.M{"product": "abc", "score": 8}, bson.M{"product": "xyz", "score": 7}}},
+		bson.M{"results": []any{bson.M{"product": "abc", "score": 7}, bson.M{"product": "xyz", "score": 8}}},
+	}, bson.D{{Key: "results", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "product", Value: "x"}}, bson.D{{Key: "score", Value: 8}},
+	}}}}}}}, []int{1, 2}},
+	{"TextQuery", []any{
+		bson.D{{Key: "name", Value: "admin"}, {Key: "age", Value: 30}, {Key: "city", Value: "HN"}},
+		bson.D{{Key: "name", Value: "ngoctd"}, {Key: "age", Value: 23}, {Key: "city", Value: "HCM"}},
+		bson.D{{Key: "name", Value: "joe"}, {Key: "age", Value: 17}, {Key: "city", Value: "DN"}},
+	}, mustParse(`age >= 18 and (city in ["HN", "HCM"] or not name ~ /^adm/)`), []int{0, 1}},
+}
+
+func ages(values ...int) []any {
+	docs := make([]any, len(values))
+	for i, v := range values {
+		docs[i] = bson.D{{Key: "age", Value: v}}
+	}
+
+	return docs
+}
+
+func fruits() []any {
+	return []any{
+		bson.M{"fruit": []any{"apple", "banana", "peach"}},
+		bson.M{"fruit": []any{"apple", "kumquat", "orange"}},
+		bson.M{"fruit": []any{"cherry", "banana", "apple"}},
+	}
+}
+
+func mustParse(s string) Filter {
+	f, err := ParseFilter(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return f
+}
+
+func TestConformance(t *testing.T) {
+	for _, tc := range conformance {
+		var got []int
+		for i, doc := range tc.seed {
+			ok, err := chapter3.Match(tc.filter, doc)
+			if err != nil {
+				t.Fatalf("%s %v: %v", tc.example, tc.filter, err)
+			}
+			if ok {
+				got = append(got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %v: matched %v, want %v", tc.example, tc.filter, got, tc.want)
+		}
+	}
+}
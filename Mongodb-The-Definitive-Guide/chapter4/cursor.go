@@ -28,9 +28,7 @@ func LimitSkipSort(ctx context.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 /*
@@ -38,4 +36,37 @@ Using skip for a small number of documents is fine. But for a large number of re
 since it has to find and then discard all the skipped results.
 MongDB does not yet support index with skips.
 So large skip should be avoided. Often you can calculate the results of the next query based on the previous one.
+Paginator does this, see KeysetPagination.
 */
+
+// KeysetPagination ...
+// pages through the collection sorted by no descending, 3 documents per page
+func KeysetPagination(ctx context.Context) {
+	collection := getCollection(ctx)
+
+	docs := make([]any, 10)
+	for i := range docs {
+		docs[i] = bson.M{"no": i % 4}
+	}
+	collection.InsertMany(ctx, docs)
+
+	pages, err := NewPaginator[bson.M](collection, nil, bson.D{{Key: "no", Value: -1}}, PageOptions{Size: 3, Secret: []byte("secret")})
+	if err != nil {
+		log.Fatal(err)
+	}
+	token := ""
+	for {
+		page, err := pages.Page(ctx, token)
+		if err != nil {
+			log.Fatal(err)
+		}
+		breakLine()
+		for _, doc := range page.Items {
+			log.Println(doc)
+		}
+		if page.Next == "" {
+			break
+		}
+		token = page.Next
+	}
+}
@@ -0,0 +1,359 @@
+package chapter4
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Filters written as nested bson.D literals are hard to read and easy to get wrong:
+
+	bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: 23}}}}}}
+
+is Not(Gte("age", 23)). The functions below build a Filter, D renders it, and a Filter can be passed to Find as it is.
+Rendering is deterministic: fields and operators keep the order they were given in, so the same Filter always gives
+the same document, which keeps query shapes, logs and tests stable.
+
+And merges its filters into one document when it can, conditions on the same field included:
+
+	And(Gte("age", 18), Lt("age", 30), Eq("city", "HN"))  // {age: {$gte: 18, $lt: 30}, city: "HN"}
+
+and falls back to {$and: [...]} when two of them use the same operator on the same field, or the same logical operator.
+
+Not negates the operators of one field with $not. Negating anything else, like an Or, renders as {$nor: [filter]}.
+*/
+
+// Filter is a query filter
+type Filter interface {
+	// D renders the filter document
+	D() bson.D
+	// MarshalBSON lets the driver use a Filter as a filter
+	MarshalBSON() ([]byte, error)
+	// String prints the filter in the language of ParseFilter
+	String() string
+}
+
+// op is an operator of a field condition, $not holds []op, $elemMatch holds a Filter
+type op struct {
+	name  string
+	value any
+}
+
+// fieldFilter holds the conditions on one field
+type fieldFilter struct {
+	path string
+	ops  []op
+}
+
+// logicalFilter combines filters with $and, $or or $nor
+type logicalFilter struct {
+	name    string
+	filters []Filter
+}
+
+func field(path, name string, value any) Filter {
+	return fieldFilter{path: path, ops: []op{{name: name, value: value}}}
+}
+
+// Eq matches documents whose field at path equals v, or holds an array containing v
+func Eq(path string, v any) Filter { return field(path, "$eq", v) }
+
+// Ne matches documents whose field at path does not equal v, missing fields included
+func Ne(path string, v any) Filter { return field(path, "$ne", v) }
+
+// Gt matches documents whose field at path is greater than v
+func Gt(path string, v any) Filter { return field(path, "$gt", v) }
+
+// Gte matches documents whose field at path is greater than or equal to v
+func Gte(path string, v any) Filter { return field(path, "$gte", v) }
+
+// Lt matches documents whose field at path is lower than v
+func Lt(path string, v any) Filter { return field(path, "$lt", v) }
+
+// Lte matches documents whose field at path is lower than or equal to v
+func Lte(path string, v any) Filter { return field(path, "$lte", v) }
+
+// In matches documents whose field at path equals one of values
+func In(path string, values ...any) Filter { return field(path, "$in", bson.A(values)) }
+
+// Nin matches documents whose field at path equals none of values, missing fields included
+func Nin(path string, values ...any) Filter { return field(path, "$nin", bson.A(values)) }
+
+// Exists matches documents having a field at path, or not having one when exists is false
+func Exists(path string, exists bool) Filter { return field(path, "$exists", exists) }
+
+// Type matches documents whose field at path has one of the BSON types, named by their alias: "string", "int",
+// "number", "array", "null"...
+func Type(path string, aliases ...string) Filter {
+	if len(aliases) == 1 {
+		return field(path, "$type", aliases[0])
+	}
+	types := make(bson.A, len(aliases))
+	for i, a := range aliases {
+		types[i] = a
+	}
+
+	return field(path, "$type", types)
+}
+
+// Regex matches documents whose string at path matches pattern, options are the $options flags like "i"
+func Regex(path, pattern, options string) Filter {
+	f := fieldFilter{path: path, ops: []op{{name: "$regex", value: pattern}}}
+	if options != "" {
+		f.ops = append(f.ops, op{name: "$options", value: options})
+	}
+
+	return f
+}
+
+// All matches documents whose array at path contains every one of values
+func All(path string, values ...any) Filter { return field(path, "$all", bson.A(values)) }
+
+// Size matches documents whose array at path has n elements
+func Size(path string, n int) Filter { return field(path, "$size", n) }
+
+// ElemMatch matches documents whose array at path has an element matching every filter.
+// Filters on the empty path apply to the element itself, for arrays of scalars:
+//
+//	ElemMatch("scores", Gte("", 80), Lt("", 85))  // {scores: {$elemMatch: {$gte: 80, $lt: 85}}}
+func ElemMatch(path string, filters ...Filter) Filter {
+	return field(path, "$elemMatch", And(filters...))
+}
+
+// Not matches documents not matching f
+func Not(f Filter) Filter {
+	if ff, ok := f.(fieldFilter); ok && !ff.has("$not") {
+		return fieldFilter{path: ff.path, ops: []op{{name: "$not", value: ff.ops}}}
+	}
+
+	return logicalFilter{name: "$nor", filters: []Filter{f}}
+}
+
+// And matches documents matching every filter, And() matches every document.
+// Conditions on a single field give a single field condition, so Not(And(Gte("age", 18), Lt("age", 30))) negates
+// them with $not.
+func And(filters ...Filter) Filter {
+	if len(filters) > 0 {
+		if f, ok := sameField(filters); ok {
+			return f
+		}
+	}
+
+	return logicalFilter{name: "$and", filters: filters}
+}
+
+// sameField merges filters on one field with distinct operators into one condition
+func sameField(filters []Filter) (fieldFilter, bool) {
+	var merged fieldFilter
+	for i, f := range filters {
+		ff, ok := f.(fieldFilter)
+		if !ok || (i > 0 && ff.path != merged.path) {
+			return fieldFilter{}, false
+		}
+		for _, o := range ff.ops {
+			if merged.has(o.name) {
+				return fieldFilter{}, false
+			}
+		}
+		merged.path = ff.path
+		merged.ops = append(merged.ops, ff.ops...)
+	}
+
+	return merged, true
+}
+
+// Or matches documents matching at least one filter
+func Or(filters ...Filter) Filter { return logicalFilter{name: "$or", filters: filters} }
+
+// Nor matches documents matching none of the filters
+func Nor(filters ...Filter) Filter { return logicalFilter{name: "$nor", filters: filters} }
+
+// Path joins field names and array indexes into a dotted path: Path("comments", 0, "author") is "comments.0.author"
+func Path(parts ...any) string {
+	s := make([]string, 0, len(parts))
+	for _, p := range parts {
+		switch v := p.(type) {
+		case string:
+			if v != "" {
+				s = append(s, v)
+			}
+		case int:
+			s = append(s, strconv.Itoa(v))
+		default:
+			s = append(s, fmt.Sprint(v))
+		}
+	}
+
+	return strings.Join(s, ".")
+}
+
+// Sub moves f into the embedded document at prefix: Sub("name", Eq("first", "Joe")) is Eq("name.first", "Joe").
+// Filters inside ElemMatch keep their paths, they are relative to the array elements.
+func Sub(prefix string, f Filter) Filter {
+	switch t := f.(type) {
+	case fieldFilter:
+		t.path = Path(prefix, t.path)
+		return t
+	case logicalFilter:
+		filters := make([]Filter, len(t.filters))
+		for i, c := range t.filters {
+			filters[i] = Sub(prefix, c)
+		}
+		return logicalFilter{name: t.name, filters: filters}
+	}
+
+	return f
+}
+
+func (f fieldFilter) has(name string) bool {
+	for _, o := range f.ops {
+		if o.name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// implicitEq reports whether f is a single $eq rendering as {path: value}. A document of operators can't, it would
+// be read as operators.
+func (f fieldFilter) implicitEq() bool {
+	if len(f.ops) != 1 || f.ops[0].name != "$eq" {
+		return false
+	}
+	switch v := f.ops[0].value.(type) {
+	case bson.D:
+		return len(v) == 0 || !strings.HasPrefix(v[0].Key, "$")
+	case bson.M:
+		for k := range v {
+			if strings.HasPrefix(k, "$") {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// condition renders the value of the field
+func (f fieldFilter) condition() any {
+	if f.implicitEq() {
+		return f.ops[0].value
+	}
+
+	return renderOps(f.ops)
+}
+
+func renderOps(ops []op) bson.D {
+	d := make(bson.D, 0, len(ops))
+	for _, o := range ops {
+		switch v := o.value.(type) {
+		case []op:
+			d = append(d, bson.E{Key: o.name, Value: renderOps(v)})
+		case Filter:
+			d = append(d, bson.E{Key: o.name, Value: v.D()})
+		default:
+			d = append(d, bson.E{Key: o.name, Value: v})
+		}
+	}
+
+	return d
+}
+
+// D ...
+func (f fieldFilter) D() bson.D {
+	if f.path == "" {
+		// an element condition of ElemMatch
+		return renderOps(f.ops)
+	}
+
+	return bson.D{{Key: f.path, Value: f.condition()}}
+}
+
+// MarshalBSON ...
+func (f fieldFilter) MarshalBSON() ([]byte, error) { return bson.Marshal(f.D()) }
+
+// D ...
+func (f logicalFilter) D() bson.D {
+	if f.name == "$and" {
+		if d, ok := merge(f.filters); ok {
+			return d
+		}
+	}
+	list := make(bson.A, len(f.filters))
+	for i, c := range f.filters {
+		list[i] = c.D()
+	}
+
+	return bson.D{{Key: f.name, Value: list}}
+}
+
+// MarshalBSON ...
+func (f logicalFilter) MarshalBSON() ([]byte, error) { return bson.Marshal(f.D()) }
+
+// merge renders filters as one document, false when two of them clash. Each field and logical operator is rendered
+// where it first appears.
+func merge(filters []Filter) (bson.D, bool) {
+	// parts holds the fields and the logical operators in order, logical operators use their name as path
+	var parts []fieldFilter
+	var flatten func(filters []Filter) bool
+	flatten = func(filters []Filter) bool {
+		for _, f := range filters {
+			switch t := f.(type) {
+			case logicalFilter:
+				if t.name == "$and" {
+					if !flatten(t.filters) {
+						return false
+					}
+					continue
+				}
+				if indexOfPath(parts, t.name) >= 0 {
+					return false
+				}
+				parts = append(parts, fieldFilter{path: t.name, ops: []op{{value: t}}})
+			case fieldFilter:
+				i := indexOfPath(parts, t.path)
+				if i < 0 {
+					parts = append(parts, fieldFilter{path: t.path, ops: append([]op(nil), t.ops...)})
+					continue
+				}
+				for _, o := range t.ops {
+					if parts[i].has(o.name) {
+						return false
+					}
+				}
+				parts[i].ops = append(parts[i].ops, t.ops...)
+			default:
+				return false
+			}
+		}
+		return true
+	}
+	if !flatten(filters) {
+		return nil, false
+	}
+
+	d := bson.D{}
+	for _, p := range parts {
+		if l, ok := p.ops[0].value.(logicalFilter); ok && p.ops[0].name == "" {
+			d = append(d, l.D()...)
+			continue
+		}
+		d = append(d, p.D()...)
+	}
+
+	return d, true
+}
+
+func indexOfPath(parts []fieldFilter, path string) int {
+	for i, p := range parts {
+		if p.path == path {
+			return i
+		}
+	}
+
+	return -1
+}
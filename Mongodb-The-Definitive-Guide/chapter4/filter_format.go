@@ -0,0 +1,267 @@
+package chapter4
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Precedence of the text forms, an operand binding less tightly than its operator is parenthesized
+const (
+	precOr = iota + 1
+	precAnd
+	precUnary
+	precAtom
+)
+
+// String prints the condition in the language of ParseFilter
+func (f fieldFilter) String() string {
+	path := formatPath(f.path)
+	clauses := make([]string, 0, len(f.ops))
+	for i := 0; i < len(f.ops); i++ {
+		o := f.ops[i]
+		switch o.name {
+		case "$eq", "$ne", "$gt", "$gte", "$lt", "$lte":
+			clauses = append(clauses, path+" "+comparisonSymbols[o.name]+" "+formatValue(o.value))
+		case "$in", "$nin", "$all":
+			clauses = append(clauses, path+" "+o.name[1:]+" "+formatValue(o.value))
+		case "$size":
+			clauses = append(clauses, fmt.Sprintf("%s size %v", path, o.value))
+		case "$type":
+			clauses = append(clauses, path+" type "+formatValue(o.value))
+		case "$exists":
+			if o.value == true {
+				clauses = append(clauses, path+" exists")
+			} else {
+				clauses = append(clauses, path+" exists false")
+			}
+		case "$regex":
+			options := ""
+			if i+1 < len(f.ops) && f.ops[i+1].name == "$options" {
+				options = fmt.Sprint(f.ops[i+1].value)
+				i++
+			}
+			clauses = append(clauses, path+" ~ /"+strings.ReplaceAll(fmt.Sprint(o.value), "/", `\/`)+"/"+options)
+		case "$elemMatch":
+			inner := o.value.(Filter)
+			if lf, ok := inner.(logicalFilter); ok && lf.name == "$and" && len(lf.filters) == 1 {
+				// ElemMatch of a single and or or filter, the parentheses of match already group it
+				inner = lf.filters[0]
+			}
+			clauses = append(clauses, path+" match ("+parenthesize(inner, 0)+")")
+		case "$not":
+			negated := fieldFilter{path: f.path, ops: o.value.([]op)}
+			clauses = append(clauses, "not "+parenthesize(negated, precUnary))
+		default:
+			clauses = append(clauses, fmt.Sprintf("%s %s %s", path, o.name, formatValue(o.value)))
+		}
+	}
+
+	return strings.Join(clauses, " and ")
+}
+
+// String prints the filter in the language of ParseFilter. And() prints as the empty string. Nor prints as not when
+// Not gives it back, as nor(...) otherwise. Or() and Nor(), which the server rejects, print as or() and nor(), which
+// ParseFilter rejects too.
+func (f logicalFilter) String() string {
+	if len(f.filters) == 0 && f.name != "$and" {
+		return f.name[1:] + "()"
+	}
+	switch f.name {
+	case "$and":
+		return joinFilters(f.filters, " and ", precAnd)
+	case "$or":
+		return joinFilters(f.filters, " or ", precOr)
+	}
+	if f.notForm() {
+		return "not " + parenthesize(f.filters[0], precUnary)
+	}
+	s := make([]string, len(f.filters))
+	for i, c := range f.filters {
+		s[i] = parenthesize(c, 0)
+	}
+
+	return "nor(" + strings.Join(s, ", ") + ")"
+}
+
+// notForm reports whether the $nor is what Not gives for its single filter: Not of a field condition without $not
+// negates its operators instead
+func (f logicalFilter) notForm() bool {
+	if f.name != "$nor" || len(f.filters) != 1 {
+		return false
+	}
+	ff, ok := f.filters[0].(fieldFilter)
+
+	return !ok || ff.has("$not")
+}
+
+func joinFilters(filters []Filter, sep string, prec int) string {
+	s := make([]string, len(filters))
+	for i, f := range filters {
+		s[i] = parenthesize(f, prec)
+	}
+
+	return strings.Join(s, sep)
+}
+
+// parenthesize prints f, in parentheses unless it binds more tightly than an operator of precedence prec.
+// Operands of the same precedence get them too, which keeps the nesting of the filter.
+// A nested And() has no text form, it prints as and(), which ParseFilter rejects.
+func parenthesize(f Filter, prec int) string {
+	if lf, ok := f.(logicalFilter); ok && len(lf.filters) == 0 {
+		return lf.name[1:] + "()"
+	}
+	if precedence(f) <= prec {
+		return "(" + f.String() + ")"
+	}
+
+	return f.String()
+}
+
+func precedence(f Filter) int {
+	switch t := f.(type) {
+	case fieldFilter:
+		clauses := len(t.ops)
+		if t.has("$regex") && t.has("$options") {
+			clauses--
+		}
+		if clauses > 1 {
+			return precAnd
+		}
+		if t.ops[0].name == "$not" {
+			return precUnary
+		}
+	case logicalFilter:
+		if len(t.filters) == 0 {
+			return precAtom
+		}
+		switch t.name {
+		case "$and":
+			return precAnd
+		case "$or":
+			return precOr
+		}
+		if t.notForm() {
+			return precUnary
+		}
+	}
+
+	return precAtom
+}
+
+var comparisonSymbols = map[string]string{
+	"$eq": "=", "$ne": "!=", "$gt": ">", "$gte": ">=", "$lt": "<", "$lte": "<=",
+}
+
+// formatPath quotes paths that would not be read back as a path, a backquote inside the quotes is doubled
+func formatPath(path string) string {
+	if path == "" {
+		return "@"
+	}
+	quoted := "`" + strings.ReplaceAll(path, "`", "``") + "`"
+	if keywords[path] {
+		return quoted
+	}
+	for i, r := range path {
+		if (i == 0 && !isIdentStart(r)) || !isIdentPart(r) {
+			return quoted
+		}
+	}
+
+	return path
+}
+
+// formatValue prints a literal. Values the language has no literal for, like binary data, are printed with %v and
+// can't be parsed back.
+func formatValue(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return strconv.Quote(t)
+	case bool:
+		return strconv.FormatBool(t)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(t)
+	case float32:
+		return formatFloat(float64(t))
+	case float64:
+		return formatFloat(t)
+	case primitive.ObjectID:
+		return `ObjectId("` + t.Hex() + `")`
+	case time.Time:
+		return `ISODate("` + t.UTC().Format(time.RFC3339Nano) + `")`
+	case primitive.DateTime:
+		return formatValue(t.Time())
+	case bson.A:
+		return formatArray(t)
+	case []any:
+		return formatArray(t)
+	case []string:
+		a := make(bson.A, len(t))
+		for i, s := range t {
+			a[i] = s
+		}
+		return formatArray(a)
+	case bson.D:
+		s := make([]string, len(t))
+		for i, e := range t {
+			s[i] = formatKey(e.Key) + ": " + formatValue(e.Value)
+		}
+		return "{" + strings.Join(s, ", ") + "}"
+	case bson.M:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		d := make(bson.D, len(keys))
+		for i, k := range keys {
+			d[i] = bson.E{Key: k, Value: t[k]}
+		}
+		return formatValue(d)
+	}
+
+	return fmt.Sprint(v)
+}
+
+func formatArray(a []any) string {
+	s := make([]string, len(a))
+	for i, v := range a {
+		s[i] = formatValue(v)
+	}
+
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// formatFloat keeps a fraction or an exponent, so the number is read back as a float
+func formatFloat(f float64) string {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Sprint(f)
+	}
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+
+	return s
+}
+
+func formatKey(key string) string {
+	for i, r := range key {
+		if (i == 0 && !isIdentStart(r)) || !isIdentPart(r) {
+			return strconv.Quote(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+
+	return key
+}
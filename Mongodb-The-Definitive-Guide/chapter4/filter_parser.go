@@ -0,0 +1,780 @@
+package chapter4
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+ParseFilter reads filters written as text, so nobody has to nest bson by hand to ask a question:
+
+	age >= 18 and (city in ["HN", "HCM"] or not name ~ /^adm/)
+
+compiles to the same document as And(Gte("age", 18), Or(In("city", "HN", "HCM"), Not(Regex("name", "^adm", "")))).
+
+	expr       = or
+	or         = and { "or" and }
+	and        = unary { "and" unary }
+	unary      = "not" unary | "nor" "(" expr { "," expr } ")" | "(" expr ")" | condition
+	condition  = path ( ("=" | "==" | "!=" | ">" | ">=" | "<" | "<=") value
+	                  | ("in" | "nin" | "all") array
+	                  | "~" regex
+	                  | "size" integer
+	                  | "type" (string | array)
+	                  | "exists" [ "true" | "false" ]
+	                  | "match" "(" expr ")" )
+	path       = name { "." name }, or any text between backquotes, a backquote in it is written "``";
+	             "@" is the array element, only inside match
+	value      = string | number | "true" | "false" | "null" | array | document
+	           | "ObjectId(" string ")" | "ISODate(" string ")"
+	array      = "[" [ value { "," value } ] "]"
+	document   = "{" [ key ":" value { "," key ":" value } ] "}"
+	regex      = "/" pattern "/" [ flags ], a "/" inside the pattern is written "\/", the pattern may span lines
+
+Strings are double quoted with Go escapes. Integers are int, numbers with a fraction or an exponent float64. Keywords
+are case sensitive and can't be used as paths unless quoted: `size` > 3.
+
+not negates like Not, nor(a, b) is Nor(a, b), matching neither a nor b.
+
+Inside match, conditions on the element @ can only be combined with and, and not mixed with conditions on field paths:
+x match (@ > 1 and @ < 5) matches the values of an array, comments match (author = "Joe" or score > 5) its embedded
+documents.
+
+Errors are *SyntaxError values telling the line and column of the offending token. Filter.String prints a filter back
+in this language, parsing the text gives the same filter again.
+*/
+
+// SyntaxError is returned by ParseFilter for invalid input
+type SyntaxError struct {
+	// Offset is the byte offset of the error in the input, Line and Column start at 1, Column counts runes
+	Offset       int
+	Line, Column int
+	Msg          string
+}
+
+// Error ...
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("chapter4: syntax error at line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokRegex
+	tokOperator
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string // the source text, the unquoted value of strings and quoted paths
+	// flags of a regex
+	flags string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of input"
+	case tokString:
+		return strconv.Quote(t.text)
+	case tokRegex:
+		return "/" + t.text + "/" + t.flags
+	}
+
+	return strconv.Quote(t.text)
+}
+
+// keywords can't be used as paths without backquotes
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "nin": true, "all": true, "size": true, "type": true,
+	"exists": true, "match": true, "true": true, "false": true, "null": true, "nor": true,
+}
+
+// regexFlags are the $options accepted by the server
+const regexFlags = "imsux"
+
+type lexer struct {
+	input string
+	pos   int
+}
+
+func (l *lexer) errorf(pos int, format string, args ...any) *SyntaxError {
+	line, col := 1, 1
+	for _, r := range l.input[:pos] {
+		if r == '\n' {
+			line++
+			col = 1
+			continue
+		}
+		col++
+	}
+
+	return &SyntaxError{Offset: pos, Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+func isIdentPart(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// next returns the following token, a *SyntaxError for invalid input
+func (l *lexer) next() (token, error) {
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.pos += size
+	}
+	start := l.pos
+	if start >= len(l.input) {
+		return token{kind: tokEOF, pos: start}, nil
+	}
+
+	r, size := utf8.DecodeRuneInString(l.input[start:])
+	switch {
+	case isIdentStart(r):
+		l.pos += size
+		for l.pos < len(l.input) {
+			r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+			if !isIdentPart(r) {
+				break
+			}
+			l.pos += size
+		}
+		return token{kind: tokIdent, text: l.input[start:l.pos], pos: start}, nil
+	case r == '`':
+		return l.quotedPath(start)
+	case r == '"':
+		return l.string(start)
+	case r == '/':
+		return l.regex(start)
+	case r == '-' || (r >= '0' && r <= '9'):
+		return l.number(start)
+	}
+
+	for _, o := range []string{"==", "!=", ">=", "<=", "=", ">", "<", "~"} {
+		if strings.HasPrefix(l.input[start:], o) {
+			l.pos += len(o)
+			return token{kind: tokOperator, text: o, pos: start}, nil
+		}
+	}
+	if strings.ContainsRune("()[]{},:@", r) {
+		l.pos += size
+		return token{kind: tokPunct, text: string(r), pos: start}, nil
+	}
+
+	return token{}, l.errorf(start, "unexpected character %q", r)
+}
+
+// quotedPath reads a path between backquotes, a doubled backquote is a backquote of the path
+func (l *lexer) quotedPath(start int) (token, error) {
+	var path strings.Builder
+	for i := start + 1; i < len(l.input); i++ {
+		if l.input[i] != '`' {
+			path.WriteByte(l.input[i])
+			continue
+		}
+		if i+1 < len(l.input) && l.input[i+1] == '`' {
+			path.WriteByte('`')
+			i++
+			continue
+		}
+		l.pos = i + 1
+		if path.Len() == 0 {
+			return token{}, l.errorf(start, "empty quoted path")
+		}
+		return token{kind: tokIdent, text: path.String(), pos: start, flags: "`"}, nil
+	}
+
+	return token{}, l.errorf(start, "unterminated quoted path")
+}
+
+func (l *lexer) string(start int) (token, error) {
+	for i := start + 1; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '\\':
+			i++
+		case '\n':
+			return token{}, l.errorf(start, "unterminated string")
+		case '"':
+			s, err := strconv.Unquote(l.input[start : i+1])
+			if err != nil {
+				return token{}, l.errorf(start, "invalid string %s", l.input[start:i+1])
+			}
+			l.pos = i + 1
+			return token{kind: tokString, text: s, pos: start}, nil
+		}
+	}
+
+	return token{}, l.errorf(start, "unterminated string")
+}
+
+func (l *lexer) regex(start int) (token, error) {
+	var pattern strings.Builder
+	for i := start + 1; i < len(l.input); i++ {
+		switch c := l.input[i]; c {
+		case '\\':
+			if i+1 < len(l.input) && l.input[i+1] == '/' {
+				pattern.WriteByte('/')
+				i++
+				continue
+			}
+			pattern.WriteByte(c)
+			if i+1 < len(l.input) {
+				pattern.WriteByte(l.input[i+1])
+				i++
+			}
+		case '/':
+			l.pos = i + 1
+			for l.pos < len(l.input) && unicode.IsLetter(rune(l.input[l.pos])) {
+				if !strings.ContainsRune(regexFlags, rune(l.input[l.pos])) {
+					return token{}, l.errorf(l.pos, "unknown regular expression flag %q, want one of %q", l.input[l.pos], regexFlags)
+				}
+				l.pos++
+			}
+			return token{kind: tokRegex, text: pattern.String(), flags: l.input[i+1 : l.pos], pos: start}, nil
+		default:
+			pattern.WriteByte(c)
+		}
+	}
+
+	return token{}, l.errorf(start, "unterminated regular expression")
+}
+
+func (l *lexer) number(start int) (token, error) {
+	i := start
+	if l.input[i] == '-' {
+		i++
+	}
+	digits := i
+	for i < len(l.input) && strings.ContainsRune("0123456789.eE+-", rune(l.input[i])) {
+		// a sign only follows an exponent
+		if (l.input[i] == '+' || l.input[i] == '-') && i > digits && l.input[i-1] != 'e' && l.input[i-1] != 'E' {
+			break
+		}
+		i++
+	}
+	if i == digits {
+		return token{}, l.errorf(start, "unexpected character '-'")
+	}
+	l.pos = i
+
+	return token{kind: tokNumber, text: l.input[start:i], pos: start}, nil
+}
+
+type parser struct {
+	lex *lexer
+	tok token
+	// scopes holds a scope per match expression being parsed, @ is only valid inside one
+	scopes []*matchScope
+}
+
+// matchScope records what the expression of a match uses. $elemMatch holds either conditions on the element itself,
+// combined with and only, or a query on the fields of embedded documents, never both.
+type matchScope struct {
+	// element, field and logical are the offsets of the first @, field path and or, nor or not, -1 when there is none
+	element, field, logical int
+	keyword                 string
+}
+
+// ParseFilter compiles a filter written in the text language described above. An empty input matches every document.
+func ParseFilter(input string) (Filter, error) {
+	p := &parser{lex: &lexer{input: input}}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokEOF {
+		return And(), nil
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.unexpected("\"and\", \"or\" or the end of input")
+	}
+
+	return f, nil
+}
+
+func (p *parser) advance() error {
+	t, err := p.lex.next()
+	if err != nil {
+		return err
+	}
+	p.tok = t
+
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	return p.lex.errorf(p.tok.pos, "expected %s, found %s", want, p.tok)
+}
+
+// is reports whether the current token is the keyword, operator or punctuation s
+func (p *parser) is(s string) bool {
+	switch p.tok.kind {
+	case tokIdent:
+		return p.tok.flags == "" && p.tok.text == s
+	case tokOperator, tokPunct:
+		return p.tok.text == s
+	}
+
+	return false
+}
+
+func (p *parser) expect(s string) error {
+	if !p.is(s) {
+		return p.unexpected(strconv.Quote(s))
+	}
+
+	return p.advance()
+}
+
+func (p *parser) or() (Filter, error) {
+	return p.list("or", p.and, Or)
+}
+
+func (p *parser) and() (Filter, error) {
+	return p.list("and", p.unary, And)
+}
+
+// list parses operands separated by the keyword sep and combines two or more with combine
+func (p *parser) list(sep string, operand func() (Filter, error), combine func(...Filter) Filter) (Filter, error) {
+	f, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	filters := []Filter{f}
+	for p.is(sep) {
+		if sep == "or" {
+			if err := p.useLogical(); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		f, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+
+	return combine(filters...), nil
+}
+
+func (p *parser) unary() (Filter, error) {
+	switch {
+	case p.is("not"):
+		if err := p.useLogical(); err != nil {
+			return nil, err
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		f, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return Not(f), nil
+	case p.is("nor"):
+		if err := p.useLogical(); err != nil {
+			return nil, err
+		}
+		return p.nor()
+	case p.is("("):
+		return p.group()
+	}
+
+	return p.condition()
+}
+
+// group parses a parenthesized expression
+func (p *parser) group() (Filter, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// nor parses nor(expr, ...)
+func (p *parser) nor() (Filter, error) {
+	if err := p.expect("nor"); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var filters []Filter
+	for {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+		if !p.is(",") {
+			break
+		}
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	return Nor(filters...), nil
+}
+
+var comparisons = map[string]func(string, any) Filter{
+	"=": Eq, "==": Eq, "!=": Ne, ">": Gt, ">=": Gte, "<": Lt, "<=": Lte,
+}
+
+func (p *parser) condition() (Filter, error) {
+	var path string
+	switch {
+	case p.is("@"):
+		scope := p.scope()
+		if scope == nil {
+			return nil, p.lex.errorf(p.tok.pos, "@ is the array element, it is only valid inside match")
+		}
+		if scope.element < 0 {
+			scope.element = p.tok.pos
+		}
+		if err := p.checkScope(); err != nil {
+			return nil, err
+		}
+	case p.tok.kind == tokIdent && (p.tok.flags != "" || !keywords[p.tok.text]):
+		path = p.tok.text
+		if i := emptySegment(path); i >= 0 {
+			if p.tok.flags != "" {
+				// the opening backquote and the doubled backquotes before the empty name
+				i += 1 + strings.Count(path[:i], "`")
+			}
+			return nil, p.lex.errorf(p.tok.pos+i, "empty field name in path %q", path)
+		}
+		if scope := p.scope(); scope != nil && scope.field < 0 {
+			scope.field = p.tok.pos
+			if err := p.checkScope(); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, p.unexpected("a path")
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	operator := p.tok
+	if operator.kind == tokOperator && operator.text != "~" {
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		return comparisons[operator.text](path, v), nil
+	}
+	switch {
+	case p.is("~"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRegex {
+			return nil, p.unexpected("a regular expression")
+		}
+		re := p.tok
+		return Regex(path, re.text, re.flags), p.advance()
+	case p.is("in"), p.is("nin"), p.is("all"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if !p.is("[") {
+			return nil, p.unexpected("an array")
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values := v.(bson.A)
+		switch operator.text {
+		case "in":
+			return In(path, values...), nil
+		case "nin":
+			return Nin(path, values...), nil
+		}
+		return All(path, values...), nil
+	case p.is("size"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(p.tok.text)
+		if p.tok.kind != tokNumber || err != nil || n < 0 {
+			return nil, p.unexpected("a size")
+		}
+		return Size(path, n), p.advance()
+	case p.is("type"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		return p.typeCondition(path)
+	case p.is("exists"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		exists := true
+		if p.is("true") || p.is("false") {
+			exists = p.is("true")
+			if err := p.advance(); err != nil {
+				return nil, err
+			}
+		}
+		return Exists(path, exists), nil
+	case p.is("match"):
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		p.scopes = append(p.scopes, &matchScope{element: -1, field: -1, logical: -1})
+		f, err := p.group()
+		p.scopes = p.scopes[:len(p.scopes)-1]
+		if err != nil {
+			return nil, err
+		}
+		return ElemMatch(path, f), nil
+	}
+
+	return nil, p.unexpected("an operator")
+}
+
+// scope returns the innermost match being parsed, nil outside match
+func (p *parser) scope() *matchScope {
+	if len(p.scopes) == 0 {
+		return nil
+	}
+
+	return p.scopes[len(p.scopes)-1]
+}
+
+// useLogical records the or, nor or not keyword of the current token in the innermost match
+func (p *parser) useLogical() error {
+	scope := p.scope()
+	if scope == nil || scope.logical >= 0 {
+		return nil
+	}
+	scope.logical, scope.keyword = p.tok.pos, p.tok.text
+
+	return p.checkScope()
+}
+
+// checkScope rejects a match the server can't run: conditions on @ combined with or, nor or not, or mixed with
+// conditions on field paths
+func (p *parser) checkScope() error {
+	scope := p.scope()
+	if scope.element < 0 {
+		return nil
+	}
+	if scope.field >= 0 {
+		pos := scope.field
+		if scope.element > pos {
+			pos = scope.element
+		}
+		return p.lex.errorf(pos, "match can't mix conditions on @ with conditions on field paths")
+	}
+	if scope.logical >= 0 {
+		return p.lex.errorf(scope.logical, "%s can't combine conditions on @ inside match, only and can", scope.keyword)
+	}
+
+	return nil
+}
+
+// emptySegment returns the offset of the first empty field name of a dotted path, -1 when there is none
+func emptySegment(path string) int {
+	start := 0
+	for i := 0; i <= len(path); i++ {
+		if i == len(path) || path[i] == '.' {
+			if i == start {
+				return i
+			}
+			start = i + 1
+		}
+	}
+
+	return -1
+}
+
+func (p *parser) typeCondition(path string) (Filter, error) {
+	if p.tok.kind == tokString {
+		alias := p.tok.text
+		return Type(path, alias), p.advance()
+	}
+	if !p.is("[") {
+		return nil, p.unexpected("a type name or an array of type names")
+	}
+	pos := p.tok.pos
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	var aliases []string
+	for _, a := range v.(bson.A) {
+		s, ok := a.(string)
+		if !ok {
+			return nil, p.lex.errorf(pos, "type names must be strings")
+		}
+		aliases = append(aliases, s)
+	}
+
+	return Type(path, aliases...), nil
+}
+
+// value parses a literal
+func (p *parser) value() (any, error) {
+	t := p.tok
+	switch {
+	case t.kind == tokString:
+		return t.text, p.advance()
+	case t.kind == tokNumber:
+		return p.number()
+	case p.is("true"), p.is("false"):
+		return t.text == "true", p.advance()
+	case p.is("null"):
+		return nil, p.advance()
+	case p.is("["):
+		return p.array()
+	case p.is("{"):
+		return p.document()
+	case t.kind == tokIdent && (t.text == "ObjectId" || t.text == "ISODate"):
+		return p.call()
+	}
+
+	return nil, p.unexpected("a value")
+}
+
+func (p *parser) number() (any, error) {
+	t := p.tok
+	if !strings.ContainsAny(t.text, ".eE") {
+		if n, err := strconv.Atoi(t.text); err == nil {
+			return n, p.advance()
+		}
+	}
+	f, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, p.lex.errorf(t.pos, "invalid number %s", t.text)
+	}
+
+	return f, p.advance()
+}
+
+func (p *parser) array() (any, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	values := bson.A{}
+	for !p.is("]") {
+		if len(values) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+
+	return values, p.advance()
+}
+
+func (p *parser) document() (any, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	doc := bson.D{}
+	for !p.is("}") {
+		if len(doc) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		if p.tok.kind != tokIdent && p.tok.kind != tokString {
+			return nil, p.unexpected("a key")
+		}
+		key := p.tok.text
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, bson.E{Key: key, Value: v})
+	}
+
+	return doc, p.advance()
+}
+
+// call parses ObjectId("...") and ISODate("...")
+func (p *parser) call() (any, error) {
+	name := p.tok.text
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	arg := p.tok
+	if arg.kind != tokString {
+		return nil, p.unexpected("a string")
+	}
+	var v any
+	var err error
+	if name == "ObjectId" {
+		v, err = primitive.ObjectIDFromHex(arg.text)
+	} else {
+		v, err = time.Parse(time.RFC3339Nano, arg.text)
+	}
+	if err != nil {
+		return nil, p.lex.errorf(arg.pos, "invalid %s: %v", name, err)
+	}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+
+	return v, p.expect(")")
+}
@@ -0,0 +1,176 @@
+package chapter4
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseFilter(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("5f1d7f3c9d1e8a6b2c3d4e5f")
+	for _, tc := range []struct {
+		input string
+		want  Filter
+	}{
+		{``, And()},
+		{`username = "admin"`, Eq("username", "admin")},
+		{`age >= 18`, Gte("age", 18)},
+		{`age in [18, 19, 20]`, In("age", 18, 19, 20)},
+		{`not age >= 23`, Not(Gte("age", 23))},
+		{`age >= 18 and (city in ["HN","HCM"] or not name ~ /^adm/)`,
+			And(Gte("age", 18), Or(In("city", "HN", "HCM"), Not(Regex("name", "^adm", ""))))},
+		{`a = 1 or b = 2 and c = 3`, Or(Eq("a", 1), And(Eq("b", 2), Eq("c", 3)))},
+		{`age > 18 and age < 30`, And(Gt("age", 18), Lt("age", 30))},
+		{`name.first == "Joe"`, Eq("name.first", "Joe")},
+		{`name = {first: "Joe", "last name": "Schmoe"}`, Eq("name", bson.D{{Key: "first", Value: "Joe"}, {Key: "last name", Value: "Schmoe"}})},
+		{`fruit all ["apple", "banana"] and fruit size 3`, And(All("fruit", "apple", "banana"), Size("fruit", 3))},
+		{`comments match (author = "Joe" and score >= 5)`, ElemMatch("comments", Eq("author", "Joe"), Gte("score", 5))},
+		{`x match (@ > 10 and @ < 20)`, ElemMatch("x", Gt("", 10), Lt("", 20))},
+		{`x match (a = 1 or not b = 2)`, ElemMatch("x", Or(Eq("a", 1), Not(Eq("b", 2))))},
+		{"`a``b` = 1", Eq("a`b", 1)},
+		{"p ~ /a\nb/", Regex("p", "a\nb", "")},
+		{`email exists false or email = null`, Or(Exists("email", false), Eq("email", nil))},
+		{`age type ["int", "double"] and tag type "string"`, And(Type("age", "int", "double"), Type("tag", "string"))},
+		{`path ~ /a\/b/im`, Regex("path", "a/b", "im")},
+		{"`size` != -1.5e3", Ne("size", -1500.0)},
+		{`_id = ObjectId("5f1d7f3c9d1e8a6b2c3d4e5f") and at < ISODate("2023-01-02T03:04:05Z")`,
+			And(Eq("_id", oid), Lt("at", time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)))},
+	} {
+		got, err := ParseFilter(tc.input)
+		if err != nil {
+			t.Errorf("%s: %v", tc.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(got.D(), tc.want.D()) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.input, got.D(), tc.want.D())
+		}
+	}
+}
+
+func TestFilterRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		`age >= 18 and (city in ["HN", "HCM"] or not name ~ /^adm/)`,
+		`(a = 1 or b = 2) or c = 3`,
+		`a = 1 and (b = 2 and c = 3)`,
+		`not (age > 18 and age < 30)`,
+		`not not a = 1`,
+		`not (a = 1 or b = 2)`,
+		`not a > 1 and a < 5`,
+		`name = {first: "Joe", "$weird": [1, 2.5, true, null]}`,
+		`comments match (author = "Joe" and score >= 5) and tags size 2`,
+		`x match (@ >= 80 and @ < 85)`,
+		"`and` exists and `a b` nin [] and t type [\"int\", \"long\"]",
+		`p ~ /a\/b/i and q = "quote \" and \\ backslash"`,
+	} {
+		f, err := ParseFilter(input)
+		if err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		text := f.String()
+		again, err := ParseFilter(text)
+		if err != nil {
+			t.Fatalf("%s printed as %s: %v", input, text, err)
+		}
+		if !reflect.DeepEqual(again.D(), f.D()) || again.String() != text {
+			t.Errorf("%s printed as %s, read back as %v", input, text, again.D())
+		}
+	}
+
+	// filters built in Go print as text too, and read back as the same filter
+	for _, tc := range []struct {
+		f    Filter
+		want string
+	}{
+		{Nor(Eq("a", 1), Eq("b", 2)), `nor(a = 1, b = 2)`},
+		{Nor(Eq("a", 1)), `nor(a = 1)`},
+		{Not(Eq("a", 1)), `not a = 1`},
+		{Not(Or(Eq("a", 1), Eq("b", 2))), `not (a = 1 or b = 2)`},
+		{Nor(Or(Eq("a", 1), Eq("b", 2)), Gt("c", 3)), `nor(a = 1 or b = 2, c > 3)`},
+		{And(Nor(Eq("a", 1), Eq("b", 2)), Eq("nor", 1)), "nor(a = 1, b = 2) and `nor` = 1"},
+		{Regex("p", "a\nb/c", "i"), "p ~ /a\nb\\/c/i"},
+		{Eq("a`b", 1), "`a``b` = 1"},
+		{Eq("``", 1), "`````` = 1"},
+		{ElemMatch("x", Or(Eq("a", 1), Eq("b", 2))), `x match (a = 1 or b = 2)`},
+		{ElemMatch("x", And(Eq("a", 1), Eq("b", 2))), `x match (a = 1 and b = 2)`},
+		{ElemMatch("x", Gte("", 80), Lt("", 85)), `x match (@ >= 80 and @ < 85)`},
+	} {
+		if got := tc.f.String(); got != tc.want {
+			t.Errorf("String = %s, want %s", got, tc.want)
+			continue
+		}
+		again, err := ParseFilter(tc.want)
+		if err != nil {
+			t.Errorf("%s: %v", tc.want, err)
+			continue
+		}
+		if !reflect.DeepEqual(again.D(), tc.f.D()) {
+			t.Errorf("%s read back as %v, want %v", tc.want, again.D(), tc.f.D())
+		}
+	}
+
+	// filters the server rejects print as text ParseFilter rejects
+	for _, tc := range []struct {
+		f    Filter
+		want string
+	}{
+		{Or(), `or()`},
+		{Nor(), `nor()`},
+		{Not(Or()), `not or()`},
+		{Or(Eq("a", 1), And()), `a = 1 or and()`},
+	} {
+		if got := tc.f.String(); got != tc.want {
+			t.Errorf("String = %s, want %s", got, tc.want)
+		}
+		if _, err := ParseFilter(tc.want); err == nil {
+			t.Errorf("%s: expected a syntax error", tc.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, tc := range []struct {
+		input        string
+		line, column int
+	}{
+		{`age >=`, 1, 7},
+		{`age >= 18 and`, 1, 14},
+		{`age 18`, 1, 5},
+		{`(age > 1`, 1, 9},
+		{`age > 1)`, 1, 8},
+		{`and = 1`, 1, 1},
+		{`name = "joe`, 1, 8},
+		{"a = 1 and\n  b ~ /x/q", 2, 10},
+		{`a in 1`, 1, 6},
+		{`a size -1`, 1, 8},
+		{`a = ObjectId("xyz")`, 1, 14},
+		{`a = 1 # comment`, 1, 7},
+		{`café > 1 and é = ?`, 1, 18},
+		{`@ > 5`, 1, 1},
+		{`x match (@ > 1) and @ < 2`, 1, 21},
+		{`a. = 1`, 1, 3},
+		{`a..b = 1`, 1, 3},
+		{"`a.` = 1", 1, 4},
+		{`nor(a = 1,)`, 1, 11},
+		{`nor a = 1`, 1, 5},
+		{`x match (@ > 1 or @ < 0)`, 1, 16},
+		{`x match (@ > 1 and name = "a")`, 1, 20},
+		{`x match (name = "a" and @ > 1)`, 1, 25},
+		{`x match (not @ > 1)`, 1, 10},
+		{`x match (nor(@ > 1, @ < 0))`, 1, 10},
+		{"`a``.` = 1", 1, 6},
+	} {
+		_, err := ParseFilter(tc.input)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("%s: expected a SyntaxError, got %v", tc.input, err)
+			continue
+		}
+		if se.Line != tc.line || se.Column != tc.column {
+			t.Errorf("%s: error at %d:%d, want %d:%d (%v)", tc.input, se.Line, se.Column, tc.line, tc.column, err)
+		}
+	}
+}
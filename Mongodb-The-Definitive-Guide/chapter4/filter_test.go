@@ -0,0 +1,106 @@
+package chapter4
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFilterRendering(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		filter Filter
+		want   bson.D
+	}{
+		{"eq", Eq("username", "admin"), bson.D{{Key: "username", Value: "admin"}}},
+		{"eq operators document", Eq("doc", bson.D{{Key: "$gt", Value: 1}}), bson.D{{Key: "doc", Value: bson.D{{Key: "$eq", Value: bson.D{{Key: "$gt", Value: 1}}}}}}},
+		{"eq embedded document", Eq("name", bson.D{{Key: "first", Value: "Joe"}}), bson.D{{Key: "name", Value: bson.D{{Key: "first", Value: "Joe"}}}}},
+		{"ne", Ne("age", 20), bson.D{{Key: "age", Value: bson.D{{Key: "$ne", Value: 20}}}}},
+		{"in", In("age", 18, 19, 20), bson.D{{Key: "age", Value: bson.D{{Key: "$in", Value: bson.A{18, 19, 20}}}}}},
+		{"nin", Nin("age", 1), bson.D{{Key: "age", Value: bson.D{{Key: "$nin", Value: bson.A{1}}}}}},
+		{"not", Not(Gte("age", 23)), bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: 23}}}}}}},
+		{"not eq", Not(Eq("age", 23)), bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$eq", Value: 23}}}}}}},
+		{"not not", Not(Not(Eq("a", 1))), bson.D{{Key: "$nor", Value: bson.A{bson.D{{Key: "a", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$eq", Value: 1}}}}}}}}}},
+		{"not or", Not(Or(Eq("a", 1), Eq("b", 2))), bson.D{{Key: "$nor", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "a", Value: 1}}, bson.D{{Key: "b", Value: 2}}}}},
+		}}}},
+		{"exists", Exists("email", false), bson.D{{Key: "email", Value: bson.D{{Key: "$exists", Value: false}}}}},
+		{"type", Type("age", "int", "long"), bson.D{{Key: "age", Value: bson.D{{Key: "$type", Value: bson.A{"int", "long"}}}}}},
+		{"regex", Regex("name", "^adm", "i"), bson.D{{Key: "name", Value: bson.D{{Key: "$regex", Value: "^adm"}, {Key: "$options", Value: "i"}}}}},
+		{"all", All("fruit", "apple", "banana"), bson.D{{Key: "fruit", Value: bson.D{{Key: "$all", Value: bson.A{"apple", "banana"}}}}}},
+		{"size", Size("fruit", 3), bson.D{{Key: "fruit", Value: bson.D{{Key: "$size", Value: 3}}}}},
+		{"elem match documents", ElemMatch("comments", Eq("author", "Joe"), Gte("score", 5)), bson.D{{Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+			{Key: "author", Value: "Joe"}, {Key: "score", Value: bson.D{{Key: "$gte", Value: 5}}},
+		}}}}}},
+		{"elem match values", ElemMatch("x", Gt("", 10), Lt("", 20)), bson.D{{Key: "x", Value: bson.D{{Key: "$elemMatch", Value: bson.D{{Key: "$gt", Value: 10}, {Key: "$lt", Value: 20}}}}}}},
+		{"and merges", And(Gte("age", 18), Eq("city", "HN"), Lt("age", 30)), bson.D{
+			{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}, {Key: "$lt", Value: 30}}},
+			{Key: "city", Value: "HN"},
+		}},
+		{"and flattens", And(Or(Eq("a", 1), Eq("b", 1)), And(Eq("c", 1), Nor(Eq("d", 1)))), bson.D{
+			{Key: "$or", Value: bson.A{bson.D{{Key: "a", Value: 1}}, bson.D{{Key: "b", Value: 1}}}},
+			{Key: "c", Value: 1},
+			{Key: "$nor", Value: bson.A{bson.D{{Key: "d", Value: 1}}}},
+		}},
+		{"and clashing operators", And(Gt("age", 1), Gt("age", 2)), bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 1}}}},
+			bson.D{{Key: "age", Value: bson.D{{Key: "$gt", Value: 2}}}},
+		}}}},
+		{"and clashing ors", And(Or(Eq("a", 1)), Or(Eq("b", 1))), bson.D{{Key: "$and", Value: bson.A{
+			bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "a", Value: 1}}}}},
+			bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: "b", Value: 1}}}}},
+		}}}},
+		{"empty and", And(), bson.D{}},
+		{"sub", Sub("name", And(Eq("first", "Joe"), Eq("last", "Schmoe"))), bson.D{{Key: "name.first", Value: "Joe"}, {Key: "name.last", Value: "Schmoe"}}},
+	} {
+		if got := tc.filter.D(); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s:\ngot  %v\nwant %v", tc.name, got, tc.want)
+		}
+		// rendering twice gives the same document
+		if a, b := tc.filter.D(), tc.filter.D(); !reflect.DeepEqual(a, b) {
+			t.Errorf("%s: rendering is not deterministic", tc.name)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	if got := Path("comments", 0, "author"); got != "comments.0.author" {
+		t.Fatalf("Path = %q", got)
+	}
+	if got := Path("", "name", ""); got != "name" {
+		t.Fatalf("empty parts should be skipped, got %q", got)
+	}
+}
+
+func TestFilterAsQuery(t *testing.T) {
+	ctx := context.Background()
+	store := seedPeople(t)
+
+	// a Filter is passed to Find as it is
+	cur, err := store.Find(ctx, And(Gte("age", 21), Lt("age", 23), In("name", "a", "b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []person
+	if err := cur.All(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 {
+		t.Fatal("no documents matched")
+	}
+	for _, p := range got {
+		if age := p.Age.(int32); age < 21 || age >= 23 || p.Name == "c" {
+			t.Errorf("%+v should not match", p)
+		}
+	}
+
+	n, err := store.CountDocuments(ctx, Or(Exists("age", false), Eq("age", 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 {
+		t.Fatalf("count = %d, want 10", n)
+	}
+}
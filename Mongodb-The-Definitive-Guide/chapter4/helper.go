@@ -5,23 +5,19 @@ import (
 	"log"
 	"strings"
 
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+	"books-note/Mongodb-The-Definitive-Guide/iterator"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 func getCollection(ctx context.Context) *mongo.Collection {
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		log.Fatal("connect mongodb error:", err)
-	}
-	err = client.Ping(ctx, readpref.Primary())
+	collection, err := connection.Collection(ctx, "querying")
 	if err != nil {
-		log.Fatal("ping mongodb error:", err)
+		log.Fatal("mongodb collection error:", err)
 	}
 
-	collection := client.Database("learning").Collection("querying")
-
 	// drop before test
 	collection.Drop(ctx)
 
@@ -32,3 +28,16 @@ func getCollection(ctx context.Context) *mongo.Collection {
 func breakLine() {
 	log.Println(strings.Repeat("~", 40))
 }
+
+// printAll logs every document of cur, it stops when ctx is cancelled and always closes cur
+func printAll(ctx context.Context, cur *mongo.Cursor) {
+	it := iterator.New[bson.Raw](ctx, cur)
+	defer it.Close()
+
+	for it.Next() {
+		log.Println(it.Value())
+	}
+	if err := it.Err(); err != nil {
+		log.Println(err)
+	}
+}
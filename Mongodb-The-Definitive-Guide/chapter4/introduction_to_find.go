@@ -20,9 +20,7 @@ func Find(ctx context.Context) {
 		log.Fatal(err)
 	}
 
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	// Insert a document with user name: admin
 	filter = bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}
@@ -40,9 +38,7 @@ func Find(ctx context.Context) {
 	}
 	breakLine()
 	log.Println("find {username: admin}")
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	// Find username admin1
 	filter = bson.D{{Key: "username", Value: "admin1"}}
@@ -52,9 +48,7 @@ func Find(ctx context.Context) {
 	}
 	breakLine()
 	log.Println("find {username: admin1}")
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	// Find username admin and age 20
 	filter = bson.D{{Key: "username", Value: "admin"}, {Key: "age", Value: 20}}
@@ -64,9 +58,7 @@ func Find(ctx context.Context) {
 	}
 	breakLine()
 	log.Println("find {username: admin, age: 20}")
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // Projection ...
@@ -83,14 +75,21 @@ func Projection(ctx context.Context) {
 
 	// Find only name
 	filter := bson.D{}
-	opts := options.Find().SetProjection(bson.D{{Key: "name", Value: 1}, {Key: "age", Value: 1}, {Key: "_id", Value: 0}})
+	opts := options.Find().SetProjection(Include("name", "age").ExcludeID())
 	cur, err := collection.Find(ctx, filter, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
+	printAll(ctx, cur)
+
+	// excluding fields returns all the others, mixing both is rejected before reaching the server
+	breakLine()
+	cur, err = collection.Find(ctx, filter, options.Find().SetProjection(Exclude("email")))
+	if err != nil {
+		log.Fatal(err)
 	}
+	printAll(ctx, cur)
+	log.Println(Include("name").Exclude("email").Err())
 }
 
 // Limitations ...
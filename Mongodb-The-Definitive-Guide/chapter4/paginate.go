@@ -0,0 +1,268 @@
+package chapter4
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"books-note/Mongodb-The-Definitive-Guide/iterator"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Paginator pages through a query without skip: every page ends with a token holding the sort values and _id of its
+last document, and the next page asks for the documents sorting after them. With the sort {age: 1, name: -1} and a last
+document {age: 20, name: "b", _id: 7} the next page is
+	{$or: [{age: {$gt: 20}}, {age: 20, name: {$lt: "b"}}, {age: 20, name: "b", _id: {$gt: 7}}]}
+_id is always the last sort key so documents with equal sort values (ties) are neither repeated nor skipped. Each page
+costs the same however deep it is, as long as an index on the sort keys followed by _id exists.
+
+The sort fields should hold values of one type: a range query only compares values of the same type. Missing and null
+values are handled, they sort before every other value.
+
+Tokens are signed with HMAC-SHA256 over the filter, the sort and the values, so a client can't edit them or replay them
+on another query. Offset keeps skip/limit for the first pages of a listing, up to MaxSkip documents.
+*/
+
+const (
+	// DefaultPageSize is the page size of a Paginator when none is given
+	DefaultPageSize = 20
+	// DefaultMaxSkip is the largest offset accepted by Paginator.Offset when none is given
+	DefaultMaxSkip = 1000
+)
+
+var (
+	// ErrInvalidPageToken is returned for a page token that was modified or issued for another query
+	ErrInvalidPageToken = errors.New("chapter4: invalid page token")
+	// ErrSkipTooLarge is returned by Paginator.Offset for an offset over MaxSkip
+	ErrSkipTooLarge = errors.New("chapter4: skip too large, use page tokens")
+)
+
+// PageOptions configures a Paginator
+type PageOptions struct {
+	// Size is the number of documents per page, DefaultPageSize when <= 0
+	Size int64
+	// Secret signs the page tokens, it is required
+	Secret []byte
+	// MaxSkip is the largest offset accepted by Offset, DefaultMaxSkip when <= 0
+	MaxSkip int64
+}
+
+// Page is a page of results
+type Page[T any] struct {
+	Items []T
+	// Next is the token of the following page, empty on the last page
+	Next string
+}
+
+// Paginator pages through the documents matching a filter in a fixed order
+type Paginator[T any] struct {
+	finder  iterator.Finder
+	filter  bson.D
+	sort    bson.D
+	desc    []bool
+	size    int64
+	maxSkip int64
+	secret  []byte
+	query   []byte
+}
+
+// NewPaginator returns a paginator over the documents of finder matching filter, ordered by sort.
+// The sort directions are 1 or -1, _id is appended when sort does not end with it.
+func NewPaginator[T any](finder iterator.Finder, filter, sort bson.D, opts PageOptions) (*Paginator[T], error) {
+	if len(opts.Secret) == 0 {
+		return nil, errors.New("chapter4: a page token secret is required")
+	}
+	if filter == nil {
+		filter = bson.D{}
+	}
+	p := &Paginator[T]{finder: finder, filter: filter, size: opts.Size, maxSkip: opts.MaxSkip, secret: opts.Secret}
+	if p.size <= 0 {
+		p.size = DefaultPageSize
+	}
+	if p.maxSkip <= 0 {
+		p.maxSkip = DefaultMaxSkip
+	}
+	for _, e := range sort {
+		desc, err := sortDirection(e)
+		if err != nil {
+			return nil, err
+		}
+		p.sort = append(p.sort, bson.E{Key: e.Key, Value: e.Value})
+		p.desc = append(p.desc, desc)
+	}
+	if len(p.sort) == 0 || p.sort[len(p.sort)-1].Key != "_id" {
+		p.sort = append(p.sort, bson.E{Key: "_id", Value: 1})
+		p.desc = append(p.desc, false)
+	}
+
+	query, err := bson.Marshal(bson.D{{Key: "filter", Value: p.filter}, {Key: "sort", Value: p.sort}})
+	if err != nil {
+		return nil, err
+	}
+	p.query = query
+
+	return p, nil
+}
+
+func sortDirection(e bson.E) (bool, error) {
+	switch v := e.Value.(type) {
+	case int:
+		return v < 0, nil
+	case int32:
+		return v < 0, nil
+	case int64:
+		return v < 0, nil
+	case float64:
+		return v < 0, nil
+	}
+
+	return false, fmt.Errorf("chapter4: invalid sort direction for %s: %v", e.Key, e.Value)
+}
+
+// Page returns the page following token, the first page for an empty token
+func (p *Paginator[T]) Page(ctx context.Context, token string) (Page[T], error) {
+	filter := p.filter
+	if token != "" {
+		values, err := p.decodeToken(token)
+		if err != nil {
+			return Page[T]{}, err
+		}
+		after := p.after(values)
+		if len(p.filter) > 0 {
+			after = bson.D{{Key: "$and", Value: bson.A{p.filter, after}}}
+		}
+		filter = after
+	}
+
+	return p.fetch(ctx, filter, options.Find().SetSort(p.sort).SetLimit(p.size+1))
+}
+
+// Offset returns the page starting after skip documents, with skip/limit. The token of the returned page continues
+// with keyset pagination.
+func (p *Paginator[T]) Offset(ctx context.Context, skip int64) (Page[T], error) {
+	if skip > p.maxSkip {
+		return Page[T]{}, fmt.Errorf("%w: %d > %d", ErrSkipTooLarge, skip, p.maxSkip)
+	}
+	opts := options.Find().SetSort(p.sort).SetLimit(p.size + 1)
+	if skip > 0 {
+		opts.SetSkip(skip)
+	}
+
+	return p.fetch(ctx, p.filter, opts)
+}
+
+// fetch reads one document more than the page size to know whether a next page exists
+func (p *Paginator[T]) fetch(ctx context.Context, filter bson.D, opts *options.FindOptions) (Page[T], error) {
+	it, err := iterator.Find[bson.Raw](ctx, p.finder, filter, opts)
+	if err != nil {
+		return Page[T]{}, err
+	}
+	defer it.Close()
+
+	var page Page[T]
+	var last bson.Raw
+	for it.Next() {
+		if int64(len(page.Items)) == p.size {
+			if page.Next, err = p.encodeToken(last); err != nil {
+				return Page[T]{}, err
+			}
+			break
+		}
+		var v T
+		if err := bson.Unmarshal(it.Value(), &v); err != nil {
+			return Page[T]{}, err
+		}
+		page.Items = append(page.Items, v)
+		last = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		return Page[T]{}, err
+	}
+
+	return page, nil
+}
+
+// after returns the condition selecting the documents sorting after values
+func (p *Paginator[T]) after(values bson.A) bson.D {
+	var or bson.A
+	for i, key := range p.sort {
+		cond := bson.D{}
+		for j := 0; j < i; j++ {
+			cond = append(cond, bson.E{Key: p.sort[j].Key, Value: values[j]})
+		}
+		v := values[i]
+		switch {
+		case !p.desc[i] && v == nil:
+			// every value sorts after null
+			cond = append(cond, bson.E{Key: key.Key, Value: bson.D{{Key: "$ne", Value: nil}}})
+		case !p.desc[i]:
+			cond = append(cond, bson.E{Key: key.Key, Value: bson.D{{Key: "$gt", Value: v}}})
+		case v == nil:
+			// nothing sorts after null in descending order
+			continue
+		default:
+			cond = append(cond, bson.E{Key: "$or", Value: bson.A{
+				bson.D{{Key: key.Key, Value: bson.D{{Key: "$lt", Value: v}}}},
+				bson.D{{Key: key.Key, Value: nil}},
+			}})
+		}
+		or = append(or, cond)
+	}
+
+	return bson.D{{Key: "$or", Value: or}}
+}
+
+// encodeToken returns the signed sort values of doc
+func (p *Paginator[T]) encodeToken(doc bson.Raw) (string, error) {
+	values := make(bson.A, len(p.sort))
+	for i, key := range p.sort {
+		rv, err := doc.LookupErr(strings.Split(key.Key, ".")...)
+		if err != nil {
+			// a missing field sorts as null
+			continue
+		}
+		if err := rv.Unmarshal(&values[i]); err != nil {
+			return "", err
+		}
+	}
+	payload, err := bson.Marshal(bson.D{{Key: "v", Value: values}})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(append(payload, p.sign(payload)...)), nil
+}
+
+func (p *Paginator[T]) decodeToken(token string) (bson.A, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(data) <= sha256.Size {
+		return nil, ErrInvalidPageToken
+	}
+	payload, mac := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if !hmac.Equal(mac, p.sign(payload)) {
+		return nil, ErrInvalidPageToken
+	}
+	var decoded struct {
+		V bson.A `bson:"v"`
+	}
+	if err := bson.Unmarshal(payload, &decoded); err != nil || len(decoded.V) != len(p.sort) {
+		return nil, ErrInvalidPageToken
+	}
+
+	return decoded.V, nil
+}
+
+func (p *Paginator[T]) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(p.query)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
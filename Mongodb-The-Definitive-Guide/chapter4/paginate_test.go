@@ -0,0 +1,147 @@
+package chapter4
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type person struct {
+	ID   int    `bson:"_id"`
+	Age  any    `bson:"age,omitempty"`
+	Name string `bson:"name"`
+}
+
+// seedPeople stores 25 people, many of the same age and some without one
+func seedPeople(t *testing.T) *chapter3.MemoryStore {
+	store := chapter3.NewMemoryStore()
+	docs := make([]any, 25)
+	for i := range docs {
+		p := person{ID: i, Name: string(rune('a' + i%3))}
+		if i%7 != 0 {
+			p.Age = 20 + i%4
+		}
+		docs[i] = p
+	}
+	if _, err := store.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+
+	return store
+}
+
+// walk collects the ids of every page
+func walk(t *testing.T, p *Paginator[person]) []int {
+	var ids []int
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages > 25 {
+			t.Fatal("pagination does not end")
+		}
+		page, err := p.Page(context.Background(), token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range page.Items {
+			ids = append(ids, v.ID)
+		}
+		if page.Next == "" {
+			return ids
+		}
+		token = page.Next
+	}
+}
+
+func TestPaginator(t *testing.T) {
+	store := seedPeople(t)
+	for _, sort := range []bson.D{
+		{{Key: "age", Value: 1}},
+		{{Key: "age", Value: -1}},
+		{{Key: "age", Value: -1}, {Key: "name", Value: 1}},
+		{{Key: "name", Value: 1}, {Key: "age", Value: 1}, {Key: "_id", Value: -1}},
+	} {
+		// one page holding everything gives the expected order
+		single, err := NewPaginator[person](store, nil, sort, PageOptions{Size: 100, Secret: []byte("secret")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := walk(t, single)
+
+		p, err := NewPaginator[person](store, nil, sort, PageOptions{Size: 4, Secret: []byte("secret")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := walk(t, p)
+		if len(got) != 25 || len(want) != 25 {
+			t.Fatalf("sort %v: got %d documents, want 25", sort, len(got))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("sort %v: got %v, want %v", sort, got, want)
+			}
+		}
+	}
+}
+
+func TestPaginatorFilterAndOffset(t *testing.T) {
+	ctx := context.Background()
+	store := seedPeople(t)
+	filter := bson.D{{Key: "name", Value: "b"}}
+	p, err := NewPaginator[person](store, filter, bson.D{{Key: "age", Value: -1}}, PageOptions{Size: 3, Secret: []byte("secret"), MaxSkip: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := walk(t, p)
+	if len(ids) != 8 {
+		t.Fatalf("got %v, want the 8 people named b", ids)
+	}
+
+	// an offset page continues with its token
+	page, err := p.Offset(ctx, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := p.Page(ctx, page.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Items[0].ID != ids[3] || next.Items[0].ID != ids[6] || len(next.Items) != 2 || next.Next != "" {
+		t.Fatalf("offset page %v, next page %v, want them to follow %v", page.Items, next.Items, ids)
+	}
+	if _, err := p.Offset(ctx, 6); !errors.Is(err, ErrSkipTooLarge) {
+		t.Fatalf("expected ErrSkipTooLarge, got %v", err)
+	}
+}
+
+func TestPaginatorRejectsTokens(t *testing.T) {
+	ctx := context.Background()
+	store := seedPeople(t)
+	sort := bson.D{{Key: "age", Value: 1}}
+	p, _ := NewPaginator[person](store, nil, sort, PageOptions{Size: 5, Secret: []byte("secret")})
+	page, err := p.Page(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := []byte(page.Next)
+	tampered[len(tampered)/2] ^= 1
+	other, _ := NewPaginator[person](store, bson.D{{Key: "name", Value: "a"}}, sort, PageOptions{Size: 5, Secret: []byte("secret")})
+	resigned, _ := NewPaginator[person](store, nil, sort, PageOptions{Size: 5, Secret: []byte("other")})
+	for name, try := range map[string]func() error{
+		"tampered":     func() error { _, err := p.Page(ctx, string(tampered)); return err },
+		"garbage":      func() error { _, err := p.Page(ctx, "not a token"); return err },
+		"other query":  func() error { _, err := other.Page(ctx, page.Next); return err },
+		"other secret": func() error { _, err := resigned.Page(ctx, page.Next); return err },
+	} {
+		if err := try(); !errors.Is(err, ErrInvalidPageToken) {
+			t.Errorf("%s: expected ErrInvalidPageToken, got %v", name, err)
+		}
+	}
+	if _, err := NewPaginator[person](store, nil, bson.D{{Key: "age", Value: "up"}}, PageOptions{Secret: []byte("s")}); err == nil {
+		t.Error("expected an error for an invalid sort direction")
+	}
+}
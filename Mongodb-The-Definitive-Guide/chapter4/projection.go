@@ -0,0 +1,123 @@
+package chapter4
+
+import (
+	"fmt"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Fields builds a projection, the second argument of find:
+
+	Include("name", "age").ExcludeID()                      // {name: 1, age: 1, _id: 0}
+	Exclude("comments")                                     // {comments: 0}
+	Include("title").Slice("comments", -10)                 // {title: 1, comments: {$slice: -10}}
+	Include("title").ElemMatch("comments", Gte("score", 5)) // {title: 1, comments: {$elemMatch: {score: {$gte: 5}}}}
+	Include("title").Positional("comments")                 // {title: 1, "comments.$": 1}
+
+A projection the server would reject, like one mixing inclusion and exclusion, is rejected when it is built: the first
+error is kept and returned by Err, D and MarshalBSON, so passing an invalid Fields to Find fails before reaching the
+server. The rules and the results are those of chapter3.Project, Apply computes the projected document in memory.
+*/
+
+// Fields is a projection
+type Fields struct {
+	d   bson.D
+	err error
+}
+
+// Include returns a projection including paths
+func Include(paths ...string) *Fields { return new(Fields).Include(paths...) }
+
+// Exclude returns a projection excluding paths
+func Exclude(paths ...string) *Fields { return new(Fields).Exclude(paths...) }
+
+// Include adds paths to the included fields
+func (f *Fields) Include(paths ...string) *Fields {
+	for _, p := range paths {
+		f.add(p, 1)
+	}
+
+	return f
+}
+
+// Exclude adds paths to the excluded fields
+func (f *Fields) Exclude(paths ...string) *Fields {
+	for _, p := range paths {
+		f.add(p, 0)
+	}
+
+	return f
+}
+
+// ExcludeID leaves _id out, the only exclusion an inclusion projection may have
+func (f *Fields) ExcludeID() *Fields { return f.add("_id", 0) }
+
+// Slice returns the first n elements of the array at path, or the last -n when n is negative
+func (f *Fields) Slice(path string, n int) *Fields {
+	return f.add(path, bson.D{{Key: "$slice", Value: n}})
+}
+
+// SliceSkip returns n elements of the array at path after skipping skip of them, a negative skip counts from the end
+func (f *Fields) SliceSkip(path string, skip, n int) *Fields {
+	return f.add(path, bson.D{{Key: "$slice", Value: bson.A{skip, n}}})
+}
+
+// ElemMatch returns only the first element of the top level array at path matching every filter, or no field
+func (f *Fields) ElemMatch(path string, filters ...Filter) *Fields {
+	return f.add(path, bson.D{{Key: "$elemMatch", Value: And(filters...).D()}})
+}
+
+// Positional returns only the first element of the array at path matching the conditions of the query on it
+func (f *Fields) Positional(path string) *Fields { return f.add(path+".$", 1) }
+
+// add appends a field and checks the projection, the first error is kept
+func (f *Fields) add(key string, value any) *Fields {
+	if f.err != nil {
+		return f
+	}
+	f.d = append(f.d, bson.E{Key: key, Value: value})
+	if _, err := chapter3.Project(bson.D{}, f.d, nil); err != nil {
+		f.err = fmt.Errorf("chapter4: invalid projection: %w", err)
+	}
+
+	return f
+}
+
+// Err returns the first error of the projection
+func (f *Fields) Err() error { return f.err }
+
+// D renders the projection document
+func (f *Fields) D() (bson.D, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.d == nil {
+		return bson.D{}, nil
+	}
+
+	return f.d, nil
+}
+
+// MarshalBSON lets the driver use Fields as a projection
+func (f *Fields) MarshalBSON() ([]byte, error) {
+	d, err := f.D()
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.Marshal(d)
+}
+
+// Apply returns the fields of doc the projection selects, filter is the query doc was found with, used by positional
+// projections
+func (f *Fields) Apply(doc any, filter Filter) (bson.D, error) {
+	d, err := f.D()
+	if err != nil {
+		return nil, err
+	}
+
+	return chapter3.Project(doc, d, filter)
+}
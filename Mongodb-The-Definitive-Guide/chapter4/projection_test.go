@@ -0,0 +1,156 @@
+package chapter4
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func TestFieldsD(t *testing.T) {
+	for _, tc := range []struct {
+		fields *Fields
+		want   bson.D
+	}{
+		{new(Fields), bson.D{}},
+		{Include("name", "age").ExcludeID(), bson.D{{Key: "name", Value: 1}, {Key: "age", Value: 1}, {Key: "_id", Value: 0}}},
+		{Exclude("comments"), bson.D{{Key: "comments", Value: 0}}},
+		{Include("title").Slice("comments", -10), bson.D{{Key: "title", Value: 1}, {Key: "comments", Value: bson.D{{Key: "$slice", Value: -10}}}}},
+		{Exclude("title").SliceSkip("comments", 1, 2), bson.D{{Key: "title", Value: 0}, {Key: "comments", Value: bson.D{{Key: "$slice", Value: bson.A{1, 2}}}}}},
+		{Include("title").ElemMatch("comments", Gte("score", 5), Eq("author", "Joe")),
+			bson.D{{Key: "title", Value: 1}, {Key: "comments", Value: bson.D{{Key: "$elemMatch", Value: bson.D{
+				{Key: "score", Value: bson.D{{Key: "$gte", Value: 5}}}, {Key: "author", Value: "Joe"}}}}}}},
+		{Include("title").Positional("comments"), bson.D{{Key: "title", Value: 1}, {Key: "comments.$", Value: 1}}},
+	} {
+		got, err := tc.fields.D()
+		if err != nil {
+			t.Errorf("%v: %v", tc.want, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("got %v, want %v", got, tc.want)
+		}
+	}
+}
+
+func TestFieldsInvalid(t *testing.T) {
+	for name, f := range map[string]*Fields{
+		"inclusion and exclusion":  Include("name").Exclude("email"),
+		"exclusion and inclusion":  Exclude("email").Include("name"),
+		"elemMatch in exclusion":   Exclude("email").ElemMatch("comments", Gte("score", 5)),
+		"positional in exclusion":  Exclude("email").Positional("comments"),
+		"nested elemMatch":         new(Fields).ElemMatch("post.comments", Gte("score", 5)),
+		"two positional":           new(Fields).Positional("comments").Positional("tags"),
+		"path collision":           Include("comments", "comments.author"),
+		"slice and include":        Include("comments").Slice("comments", 2),
+		"slice limit not positive": new(Fields).SliceSkip("comments", 1, 0),
+	} {
+		if f.Err() == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if _, err := f.MarshalBSON(); err == nil {
+			t.Errorf("%s: MarshalBSON expected an error", name)
+		}
+	}
+
+	// the first error is kept, later calls don't change the projection
+	f := Include("name").Exclude("email").Include("age")
+	if _, err := f.D(); err == nil || len(f.d) != 2 {
+		t.Fatalf("D = %v, %v", f.d, err)
+	}
+}
+
+func TestFieldsApply(t *testing.T) {
+	post := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "content", Value: "content 1"},
+		{Key: "comments", Value: bson.A{
+			bson.D{{Key: "author", Value: "Joe"}, {Key: "score", Value: 3}},
+			bson.D{{Key: "author", Value: "Mary"}, {Key: "score", Value: 6}},
+			bson.D{{Key: "author", Value: "Bob"}, {Key: "score", Value: 9}},
+		}},
+	}
+	basket := bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"apple", "banana", "peach"}}}
+	comment := func(author string, score int) bson.D {
+		return bson.D{{Key: "author", Value: author}, {Key: "score", Value: score}}
+	}
+	for _, tc := range []struct {
+		example string
+		fields  *Fields
+		doc     bson.D
+		filter  Filter
+		want    bson.D
+	}{
+		{"Projection", Include("name", "age").ExcludeID(),
+			bson.D{{Key: "_id", Value: 3}, {Key: "name", Value: "admin"}, {Key: "age", Value: 20}, {Key: "email", Value: "admin@gmail.com"}}, nil,
+			bson.D{{Key: "name", Value: "admin"}, {Key: "age", Value: 20}}},
+		{"Projection", Exclude("email"),
+			bson.D{{Key: "_id", Value: 3}, {Key: "name", Value: "admin"}, {Key: "age", Value: 20}, {Key: "email", Value: "admin@gmail.com"}}, nil,
+			bson.D{{Key: "_id", Value: 3}, {Key: "name", Value: "admin"}, {Key: "age", Value: 20}}},
+		{"QueryingArraysSliceOperator", new(Fields).Slice("fruit", 2), basket, nil,
+			bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"apple", "banana"}}}},
+		{"QueryingArraysSliceOperator", new(Fields).Slice("fruit", -2), basket, nil,
+			bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"banana", "peach"}}}},
+		{"QueryingArraysSliceOperator", new(Fields).SliceSkip("fruit", 1, 2), basket, nil,
+			bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"banana", "peach"}}}},
+		{"QueryingArraysSliceOperator", new(Fields).SliceSkip("fruit", -1, 5), basket, nil,
+			bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"peach"}}}},
+		{"QueryingArraysEmbedded", Include("comments").ExcludeID(), post, nil, bson.D{post[2]}},
+		{"QueryingArraysEmbedded", Include("content").ElemMatch("comments", Gte("score", 6)).ExcludeID(), post, nil,
+			bson.D{post[1], {Key: "comments", Value: bson.A{comment("Mary", 6)}}}},
+		{"QueryingArraysEmbedded", Include("content").ElemMatch("comments", Gte("score", 10)).ExcludeID(), post, nil,
+			bson.D{post[1]}},
+		{"QueryingArraysEmbedded", Include("content").Positional("comments").ExcludeID(), post, Gte("comments.score", 6),
+			bson.D{post[1], {Key: "comments", Value: bson.A{comment("Mary", 6)}}}},
+		{"QueryingArraysEmbedded", Include("content").Positional("comments"), post, And(Eq("comments.author", "Bob"), Gt("comments.score", 5)),
+			bson.D{post[0], post[1], {Key: "comments", Value: bson.A{comment("Bob", 9)}}}},
+	} {
+		got, err := tc.fields.Apply(tc.doc, tc.filter)
+		if err != nil {
+			t.Errorf("%s %v: %v", tc.example, tc.fields.d, err)
+			continue
+		}
+		// ints are decoded as int32
+		want, err := chapter3.Project(tc.want, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s %v: got %v, want %v", tc.example, tc.fields.d, got, want)
+		}
+	}
+}
+
+func TestFieldsMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := chapter3.NewMemoryStore()
+	for _, doc := range []any{
+		bson.D{{Key: "_id", Value: 1}, {Key: "fruit", Value: bson.A{"apple", "banana", "peach"}}},
+		bson.D{{Key: "_id", Value: 2}, {Key: "fruit", Value: bson.A{"cherry", "kumquat"}}},
+	} {
+		if _, err := store.InsertOne(ctx, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cur, err := store.Find(ctx, Eq("fruit", "apple"), options.Find().SetProjection(new(Fields).SliceSkip("fruit", 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []bson.D
+	if err := cur.All(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []bson.D{{{Key: "_id", Value: int32(1)}, {Key: "fruit", Value: bson.A{"banana"}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if _, err := store.Find(ctx, bson.D{}, options.Find().SetProjection(Include("name").Exclude("fruit"))); err == nil {
+		t.Fatal("expected an error for an invalid projection")
+	}
+}
@@ -19,25 +19,21 @@ func QueryCondition(ctx context.Context) {
 		log.Fatal(err)
 	}
 
-	cur, err := collection.Find(ctx, bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}}}})
+	cur, err := collection.Find(ctx, Gte("age", 18))
 	if err != nil {
 		log.Fatal(err)
 	}
 	breakLine()
 	log.Println("find {age: {$gte: 18}}")
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
-	cur, err = collection.Find(ctx, bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 22}}}})
+	cur, err = collection.Find(ctx, Gte("age", 22))
 	if err != nil {
 		log.Fatal(err)
 	}
 	breakLine()
 	log.Println("find {age: {$gte: 22}}")
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // OrQuery ...
@@ -60,13 +56,11 @@ func OrQuery(ctx context.Context) {
 
 	breakLine()
 	log.Println("find {age: {$in: [18,19,20] }}")
-	cur, err := collection.Find(ctx, bson.D{{Key: "age", Value: bson.D{{Key: "$in", Value: bson.A{18, 19, 20}}}}})
+	cur, err := collection.Find(ctx, In("age", 18, 19, 20))
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // NotQuery ...
@@ -82,19 +76,50 @@ func NotQuery(ctx context.Context) {
 
 	// Find a document
 	var val1 any
-	result := collection.FindOne(ctx, bson.D{{Key: "age", Value: 23}})
+	result := collection.FindOne(ctx, Eq("age", 23))
 	result.Decode(&val1)
 	log.Println(val1)
 
 	// Find a document with $not operator
-	result = collection.FindOne(ctx, bson.D{{Key: "age", Value: bson.D{{Key: "$gte", Value: 23}}}})
+	result = collection.FindOne(ctx, Gte("age", 23))
 	var val2 any
 	result.Decode(&val2)
 	log.Println(val2)
 
 	// Find a document with $not operator
-	result = collection.FindOne(ctx, bson.D{{Key: "age", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gte", Value: 23}}}}}})
+	result = collection.FindOne(ctx, Not(Gte("age", 23)))
 	var val3 any
 	result.Decode(&val3)
 	log.Println(val3)
 }
+
+// TextQuery ...
+// ParseFilter compiles a filter typed as text into the same documents as above, String prints it back for the logs.
+func TextQuery(ctx context.Context) {
+	collection := getCollection(ctx)
+
+	_, err := collection.InsertMany(ctx, []any{
+		bson.D{{Key: "name", Value: "admin"}, {Key: "age", Value: 30}, {Key: "city", Value: "HN"}},
+		bson.D{{Key: "name", Value: "ngoctd"}, {Key: "age", Value: 23}, {Key: "city", Value: "HCM"}},
+		bson.D{{Key: "name", Value: "joe"}, {Key: "age", Value: 17}, {Key: "city", Value: "DN"}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filter, err := ParseFilter(`age >= 18 and (city in ["HN", "HCM"] or not name ~ /^adm/)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	breakLine()
+	log.Println("find", filter)
+	cur, err := collection.Find(ctx, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printAll(ctx, cur)
+
+	// errors tell where the text went wrong
+	_, err = ParseFilter(`age >= and city = "HN"`)
+	log.Println(err) // chapter4: syntax error at line 1, column 8: expected a value, found "and"
+}
@@ -3,16 +3,170 @@ package chapter4
 import (
 	"context"
 	"log"
+	"regexp"
+	"strings"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // Null ...
-func Null(ctx context.Context) {}
+// null matches itself and also "does not exist": {z: null} matches documents without a z field.
+// Querying for fields whose value is null needs $exists as well.
+func Null(ctx context.Context) {
+	collection := getCollection(ctx)
+
+	_, err := collection.InsertMany(ctx, []any{
+		bson.D{{Key: "y", Value: nil}},
+		bson.D{{Key: "y", Value: 1}},
+		bson.D{{Key: "y", Value: 2}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, filter := range []Filter{NullOrMissing("y"), NullOrMissing("z"), NullValue("z"), Missing("z")} {
+		breakLine()
+		log.Println("find", filter)
+		cur, err := collection.Find(ctx, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printAll(ctx, cur)
+	}
+}
+
+// NullOrMissing matches documents whose field at path is null or missing, {path: null}
+func NullOrMissing(path string) Filter {
+	return Eq(path, nil)
+}
+
+// NullValue matches documents whose field at path exists and is null, {path: {$eq: null, $exists: true}}
+func NullValue(path string) Filter {
+	return And(Eq(path, nil), Exists(path, true))
+}
+
+// Missing matches documents without a field at path, {path: {$exists: false}}
+func Missing(path string) Filter {
+	return Exists(path, false)
+}
 
 // RegularExpression ...
-func RegularExpression(ctx context.Context) {}
+// $regex matches strings against a PCRE regular expression, options like i (case insensitive) change how.
+// Only a case sensitive prefix expression, anchored with ^ and starting with literal characters, can use an index:
+// the literal prefix bounds the index scan. Any other expression reads every index key or every document.
+func RegularExpression(ctx context.Context) {
+	collection := getCollection(ctx)
+
+	_, err := collection.InsertMany(ctx, []any{
+		bson.D{{Key: "name", Value: "joe"}},
+		bson.D{{Key: "name", Value: "Joe"}},
+		bson.D{{Key: "name", Value: "joey"}},
+		bson.D{{Key: "name", Value: "billy joe"}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}}); err != nil {
+		log.Fatal(err)
+	}
+
+	for _, filter := range []Filter{Regex("name", "joe", "i"), Regex("name", "joey?", "i"), Prefix("name", "joe")} {
+		breakLine()
+		re := filter.D()[0].Value.(bson.D)
+		pattern, _ := re[0].Value.(string)
+		options := ""
+		if len(re) > 1 {
+			options, _ = re[1].Value.(string)
+		}
+		prefix, indexed := IndexablePrefix(pattern, options)
+		log.Printf("find %s, uses the index: %v %q", filter, indexed, prefix)
+		cur, err := collection.Find(ctx, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printAll(ctx, cur)
+	}
+}
+
+// Prefix matches documents whose string at path starts with prefix. The expression is anchored and case sensitive,
+// so an index on path can serve it.
+func Prefix(path, prefix string) Filter {
+	return Regex(path, "^"+regexp.QuoteMeta(prefix), "")
+}
+
+// IndexablePrefix returns the literal prefix an index scan is bounded with for a $regex, false when the whole index
+// must be read: the expression is not anchored with ^ or \A, is case insensitive (i), multiline (m) or extended (x),
+// has an alternative outside a group, like ^a|b whose b is not anchored, or starts with no literal character.
+func IndexablePrefix(pattern, options string) (string, bool) {
+	if strings.ContainsAny(options, "imx") || hasTopLevelAlternation(pattern) {
+		return "", false
+	}
+	switch {
+	case strings.HasPrefix(pattern, "^"):
+		pattern = pattern[1:]
+	case strings.HasPrefix(pattern, `\A`):
+		pattern = pattern[2:]
+	default:
+		return "", false
+	}
+
+	var prefix []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c == '\\' && i+1 < len(pattern) && !isAlphaNumeric(pattern[i+1]) {
+			// an escaped punctuation character is literal
+			i++
+			prefix = append(prefix, pattern[i])
+			continue
+		}
+		if strings.IndexByte(`.^$*+?()[]{}|\`, c) >= 0 {
+			// a quantifier makes the previous character optional
+			if strings.IndexByte("*?{", c) >= 0 && len(prefix) > 0 {
+				prefix = prefix[:len(prefix)-1]
+			}
+			break
+		}
+		prefix = append(prefix, c)
+	}
+
+	return string(prefix), len(prefix) > 0
+}
+
+// hasTopLevelAlternation reports whether pattern has a | that is not escaped, in a character class or in a group
+func hasTopLevelAlternation(pattern string) bool {
+	depth, inClass := 0, false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\':
+			i++
+		case inClass:
+			inClass = c != ']'
+		case c == '[':
+			inClass = true
+			// a ] right after [ or [^ is a literal
+			if i+1 < len(pattern) && pattern[i+1] == '^' {
+				i++
+			}
+			if i+1 < len(pattern) && pattern[i+1] == ']' {
+				i++
+			}
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == '|' && depth == 0:
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAlphaNumeric(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
 
 // QueryingArrays ...
 // Querying for elements of an array is designed to behave the way querying for scalars does.
@@ -46,9 +200,7 @@ func QueryingArraysAllOperation(ctx context.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	breakLine()
 	// We can also query by exact match using the entire array. However, exact match will not match a document
@@ -56,9 +208,7 @@ func QueryingArraysAllOperation(ctx context.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	breakLine()
 	// We can also query by exact match using the entire array. However, exact match will not match a document
@@ -66,9 +216,7 @@ func QueryingArraysAllOperation(ctx context.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // QueryingArraysSizeOperator ...
@@ -86,18 +234,14 @@ func QueryingArraysSizeOperator(ctx context.Context) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	breakLine()
 	cur, err = collection.Find(ctx, bson.M{"fruit": bson.M{"$size": 1}})
 	if err != nil {
 		log.Fatal(err)
 	}
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // QueryingArraysSliceOperator ...
@@ -115,21 +259,21 @@ func QueryingArraysSliceOperator(ctx context.Context) {
 	}
 
 	// we wanted the first 2 fruits
-	opts := options.FindOne().SetProjection(bson.M{"fruit": bson.M{"$slice": 2}})
+	opts := options.FindOne().SetProjection(new(Fields).Slice("fruit", 2))
 	rs := collection.FindOne(ctx, bson.D{{Key: "fruit", Value: "apple"}}, opts)
 	var val any
 	rs.Decode(&val)
 	log.Println(val)
 
 	// we wanted the last 2 fruits
-	opts = options.FindOne().SetProjection(bson.M{"fruit": bson.M{"$slice": -2}})
+	opts = options.FindOne().SetProjection(new(Fields).Slice("fruit", -2))
 	rs = collection.FindOne(ctx, bson.D{{Key: "fruit", Value: "apple"}}, opts)
 	var val1 any
 	rs.Decode(&val1)
 	log.Println(val1)
 
 	// we wanted the middle of the results by tanking an offset and the number of elements to return
-	opts = options.FindOne().SetProjection(bson.M{"fruit": bson.M{"$slice": []any{1, 2}}}) // skip 1 element and return 2 element
+	opts = options.FindOne().SetProjection(new(Fields).SliceSkip("fruit", 1, 2)) // skip 1 element and return 2 element
 	rs = collection.FindOne(ctx, bson.D{{Key: "fruit", Value: "apple"}}, opts)
 	var val2 any
 	rs.Decode(&val2)
@@ -137,7 +281,61 @@ func QueryingArraysSliceOperator(ctx context.Context) {
 }
 
 // ArrayAndRangeQuery ...
-func ArrayAndRangeQuery(ctx context.Context) {}
+// {x: {$gt: 10, $lt: 20}} on an array field matches when one element is greater than 10 and one, maybe another, is
+// lower than 20: [5, 25] matches. $elemMatch requires a single element in the range, but never matches a field that
+// is not an array. With an index on x, min and max bound the scan to the range and work on both.
+func ArrayAndRangeQuery(ctx context.Context) {
+	collection := getCollection(ctx)
+
+	_, err := collection.InsertMany(ctx, []any{
+		bson.D{{Key: "x", Value: 5}},
+		bson.D{{Key: "x", Value: 15}},
+		bson.D{{Key: "x", Value: 25}},
+		bson.D{{Key: "x", Value: bson.A{5, 25}}},
+		bson.D{{Key: "x", Value: bson.A{12, 30}}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, filter := range []Filter{InRange("x", 10, 20), ElemInRange("x", 10, 20), Or(ElemInRange("x", 10, 20), And(Not(Type("x", "array")), InRange("x", 10, 20)))} {
+		breakLine()
+		log.Println("find", filter)
+		cur, err := collection.Find(ctx, filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printAll(ctx, cur)
+	}
+
+	// min and max need an index on the field and a hint naming it, max is exclusive
+	if _, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "x", Value: 1}}}); err != nil {
+		log.Fatal(err)
+	}
+	opts := options.Find().
+		SetMin(bson.D{{Key: "x", Value: 10}}).
+		SetMax(bson.D{{Key: "x", Value: 20}}).
+		SetHint(bson.D{{Key: "x", Value: 1}})
+	breakLine()
+	log.Println("find", InRange("x", 10, 20), "min {x: 10} max {x: 20}")
+	cur, err := collection.Find(ctx, InRange("x", 10, 20), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printAll(ctx, cur)
+}
+
+// InRange matches documents whose field at path is greater than low and lower than high. On an array field the two
+// bounds may be met by different elements.
+func InRange(path string, low, high any) Filter {
+	return And(Gt(path, low), Lt(path, high))
+}
+
+// ElemInRange matches documents whose array at path has an element greater than low and lower than high. Fields that
+// are not arrays never match.
+func ElemInRange(path string, low, high any) Filter {
+	return ElemMatch(path, Gt("", low), Lt("", high))
+}
 
 // QueryingOnEmbedded ...
 func QueryingOnEmbedded(ctx context.Context) {
@@ -157,9 +355,7 @@ func QueryingOnEmbedded(ctx context.Context) {
 		log.Fatal(err)
 	}
 
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 
 	// Query by embedded key
 	// query documents can contain dots. Which mean "reach into an embedded document".
@@ -168,9 +364,7 @@ func QueryingOnEmbedded(ctx context.Context) {
 		log.Fatal(err)
 	}
 
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
-	}
+	printAll(ctx, cur)
 }
 
 // QueryingArraysEmbedded ...
@@ -185,13 +379,28 @@ func QueryingArraysEmbedded(ctx context.Context) {
 	}
 
 	// query comment store > 5
-	opts := options.Find().SetProjection(bson.M{"comments": 1, "_id": 0})
+	opts := options.Find().SetProjection(Include("comments").ExcludeID())
 	cur, err := collection.Find(ctx, bson.M{"comments": bson.M{"$elemMatch": bson.M{"score": bson.M{"$gte": 6}}}}, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for cur.Next(ctx) {
-		log.Println(cur.Current)
+	printAll(ctx, cur)
+
+	// only the comments matching, with $elemMatch in the projection or the positional operator
+	breakLine()
+	opts = options.Find().SetProjection(Include("content").ElemMatch("comments", Gte("score", 6)).ExcludeID())
+	cur, err = collection.Find(ctx, bson.D{}, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printAll(ctx, cur)
+
+	breakLine()
+	opts = options.Find().SetProjection(Include("content").Positional("comments").ExcludeID())
+	cur, err = collection.Find(ctx, Gte("comments.score", 6), opts)
+	if err != nil {
+		log.Fatal(err)
 	}
+	printAll(ctx, cur)
 }
@@ -0,0 +1,145 @@
+package chapter4
+
+import (
+	"reflect"
+	"testing"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// matching returns the indexes of the docs f matches
+func matching(t *testing.T, f Filter, docs []any) []int {
+	t.Helper()
+	var got []int
+	for i, doc := range docs {
+		ok, err := chapter3.Match(f, doc)
+		if err != nil {
+			t.Fatalf("%v: %v", f, err)
+		}
+		if ok {
+			got = append(got, i)
+		}
+	}
+
+	return got
+}
+
+func TestNullHelpers(t *testing.T) {
+	docs := []any{
+		bson.D{{Key: "y", Value: nil}},
+		bson.D{{Key: "y", Value: 1}},
+		bson.D{{Key: "y", Value: 2}},
+		bson.D{{Key: "z", Value: nil}},
+		bson.D{{Key: "z", Value: bson.A{1, nil}}},
+	}
+	tests := []struct {
+		filter Filter
+		doc    bson.D
+		want   []int
+	}{
+		{NullOrMissing("y"), bson.D{{Key: "y", Value: nil}}, []int{0, 3, 4}},
+		{NullOrMissing("z"), bson.D{{Key: "z", Value: nil}}, []int{0, 1, 2, 3, 4}},
+		{NullValue("z"), bson.D{{Key: "z", Value: bson.D{{Key: "$eq", Value: nil}, {Key: "$exists", Value: true}}}}, []int{3, 4}},
+		{Missing("z"), bson.D{{Key: "z", Value: bson.D{{Key: "$exists", Value: false}}}}, []int{0, 1, 2}},
+	}
+	for _, tc := range tests {
+		if d := tc.filter.D(); !reflect.DeepEqual(d, tc.doc) {
+			t.Errorf("%v: rendered %v, want %v", tc.filter, d, tc.doc)
+		}
+		if got := matching(t, tc.filter, docs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: matched %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestRegexHelpers(t *testing.T) {
+	docs := []any{
+		bson.D{{Key: "name", Value: "joe"}},
+		bson.D{{Key: "name", Value: "Joe"}},
+		bson.D{{Key: "name", Value: "joey"}},
+		bson.D{{Key: "name", Value: "billy joe"}},
+		bson.D{{Key: "name", Value: "jo.e"}},
+	}
+	tests := []struct {
+		filter Filter
+		want   []int
+	}{
+		{Regex("name", "joe", "i"), []int{0, 1, 2, 3}},
+		{Regex("name", "^joey?$", "i"), []int{0, 1, 2}},
+		{Prefix("name", "joe"), []int{0, 2}},
+		// the prefix is literal, . is not a wildcard
+		{Prefix("name", "jo.e"), []int{4}},
+	}
+	for _, tc := range tests {
+		if got := matching(t, tc.filter, docs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: matched %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
+
+func TestIndexablePrefix(t *testing.T) {
+	tests := []struct {
+		pattern, options string
+		prefix           string
+		ok               bool
+	}{
+		{"^joe", "", "joe", true},
+		{`\Ajoe`, "", "joe", true},
+		{"^joey?", "", "joe", true},
+		{"^jo.e", "", "jo", true},
+		{`^jo\.e`, "", "jo.e", true},
+		{`^a\d`, "", "a", true},
+		{"^(joe|bob)", "", "", false},
+		{"^a|b", "", "", false},
+		{"^ab(c|d)", "", "ab", true},
+		{`^ab\|c`, "", "ab|c", true},
+		{"^ab[|]c", "", "ab", true},
+		{"^ab[]|]c", "", "ab", true},
+		{"^ab(c)|d", "", "", false},
+		{"^joe", "i", "", false},
+		{"^joe", "m", "", false},
+		{"joe", "", "", false},
+		{"", "", "", false},
+	}
+	for _, tc := range tests {
+		prefix, ok := IndexablePrefix(tc.pattern, tc.options)
+		if prefix != tc.prefix || ok != tc.ok {
+			t.Errorf("IndexablePrefix(%q, %q) = %q, %v, want %q, %v", tc.pattern, tc.options, prefix, ok, tc.prefix, tc.ok)
+		}
+	}
+
+	// Prefix always gives an indexable expression of the whole prefix
+	for _, p := range []string{"joe", "a.b*c", "(x)"} {
+		re := Prefix("name", p).D()[0].Value.(bson.D)
+		if prefix, ok := IndexablePrefix(re[0].Value.(string), ""); !ok || prefix != p {
+			t.Errorf("Prefix(%q): indexable prefix %q, %v", p, prefix, ok)
+		}
+	}
+}
+
+func TestRangeHelpers(t *testing.T) {
+	docs := []any{
+		bson.D{{Key: "x", Value: 5}},
+		bson.D{{Key: "x", Value: 15}},
+		bson.D{{Key: "x", Value: 25}},
+		bson.D{{Key: "x", Value: bson.A{5, 25}}},
+		bson.D{{Key: "x", Value: bson.A{12, 30}}},
+	}
+	tests := []struct {
+		filter Filter
+		want   []int
+	}{
+		// [5, 25] matches: 25 > 10 and 5 < 20
+		{InRange("x", 10, 20), []int{1, 3, 4}},
+		// only an element in the range matches, and scalars never do
+		{ElemInRange("x", 10, 20), []int{4}},
+		{Or(ElemInRange("x", 10, 20), And(Not(Type("x", "array")), InRange("x", 10, 20))), []int{1, 4}},
+	}
+	for _, tc := range tests {
+		if got := matching(t, tc.filter, docs); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: matched %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
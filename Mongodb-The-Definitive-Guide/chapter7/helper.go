@@ -5,23 +5,17 @@ import (
 	"log"
 	"strings"
 
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
-	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 func getCollection(ctx context.Context) *mongo.Collection {
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
-	if err != nil {
-		log.Fatal("connect mongodb error:", err)
-	}
-	err = client.Ping(ctx, readpref.Primary())
+	collection, err := connection.Collection(ctx, "aggregate")
 	if err != nil {
-		log.Fatal("ping mongodb error:", err)
+		log.Fatal("mongodb collection error:", err)
 	}
 
-	collection := client.Database("learning").Collection("aggregate")
-
 	// drop before test
 	collection.Drop(ctx)
 
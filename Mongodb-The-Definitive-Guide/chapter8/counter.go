@@ -0,0 +1,101 @@
+package chapter8
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Counter is a document holding a count that MoveCount moves between documents
+type Counter struct {
+	ID    string `bson:"_id"`
+	Count int64  `bson:"count"`
+}
+
+// ErrInsufficientCount is returned when moving more than the source counter holds
+var ErrInsufficientCount = errors.New("chapter8: insufficient count")
+
+// ErrInvalidAmount is returned when moving zero or a negative amount, which would take from the destination
+var ErrInvalidAmount = errors.New("chapter8: amount must be positive")
+
+// MoveCount moves amount from the counter from to the counter to in a transaction of sess: either both counters
+// change or neither does. Reading the source and writing it back is safe in a transaction, a concurrent change of the
+// same document fails one of the transactions with a write conflict and WithTransaction runs it again.
+// amount must be positive, ErrInvalidAmount is returned before starting a transaction otherwise.
+func MoveCount(ctx context.Context, sess Session, counters *chapter3.Repository[Counter], from, to string, amount int64, opts TxOptions) error {
+	if amount <= 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidAmount, amount)
+	}
+
+	return WithTransaction(ctx, sess, func(ctx context.Context) error {
+		src, err := counters.Get(ctx, from)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", from, err)
+		}
+		if src.Count < amount {
+			return fmt.Errorf("%w: %s holds %d, %d requested", ErrInsufficientCount, from, src.Count, amount)
+		}
+		if err := counters.Update(ctx, from, bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: -amount}}}}); err != nil {
+			return fmt.Errorf("update %s: %w", from, err)
+		}
+		if err := counters.Update(ctx, to, bson.D{{Key: "$inc", Value: bson.D{{Key: "count", Value: amount}}}}); err != nil {
+			return fmt.Errorf("update %s: %w", to, err)
+		}
+
+		return nil
+	}, opts)
+}
+
+// MoveCountExample moves counts between two documents of a live replica set, then tries to move more than the
+// source holds: the second transaction is aborted and leaves both documents untouched
+func MoveCountExample(ctx context.Context) {
+	client, err := connection.Client(ctx)
+	if err != nil {
+		log.Fatal("mongodb client error:", err)
+	}
+	store, err := chapter3.NewMongoStore(ctx, "transactions", "counters")
+	if err != nil {
+		log.Fatal("mongodb collection error:", err)
+	}
+	store.Drop(ctx)
+	counters := chapter3.NewRepository[Counter](store)
+	for _, c := range []Counter{{ID: "a", Count: 10}, {ID: "b", Count: 0}} {
+		if _, err := counters.Insert(ctx, c); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	sess, err := client.StartSession()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sess.EndSession(ctx)
+
+	opts := TxOptions{
+		MaxCommitTime: 5 * time.Second,
+		Transaction: options.Transaction().
+			SetReadConcern(readconcern.Snapshot()).
+			SetWriteConcern(writeconcern.New(writeconcern.WMajority())),
+	}
+	if err := MoveCount(ctx, sess, counters, "a", "b", 4, opts); err != nil {
+		log.Fatal(err)
+	}
+	err = MoveCount(ctx, sess, counters, "a", "b", 100, opts)
+	log.Println("moving 100:", err)
+
+	list, err := counters.List(ctx, nil, chapter3.ListOptions{Sort: bson.D{{Key: "_id", Value: 1}}})
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(list) // [{a 6} {b 4}]
+}
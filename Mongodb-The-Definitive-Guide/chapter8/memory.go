@@ -0,0 +1,145 @@
+package chapter8
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Errors of MemorySession, named like the driver's
+var (
+	ErrTransactionInProgress = errors.New("transaction already in progress")
+	ErrNoTransactionStarted  = errors.New("no transaction started")
+)
+
+// MemorySession is a Session over chapter3.MemoryStore collections, to run transactions without a replica set.
+// StartTransaction takes a snapshot of the stores and an abort restores it, so writes made in an aborted
+// transaction disappear. Writes are visible to other readers before the commit, and writes made by others during
+// the transaction are rolled back with it: only one transaction should use the stores at a time.
+//
+// FailNext makes the next commits fail, which simulates write conflicts or lost commit replies.
+type MemorySession struct {
+	mu        sync.Mutex
+	stores    []*chapter3.MemoryStore
+	snapshots [][]bson.D
+	active    bool
+	failures  []error
+	options   *options.TransactionOptions
+
+	// Started, Committed and Aborted count the transactions
+	Started, Committed, Aborted int
+}
+
+// NewMemorySession returns a session whose transactions cover stores
+func NewMemorySession(stores ...*chapter3.MemoryStore) *MemorySession {
+	return &MemorySession{stores: stores}
+}
+
+// FailNext queues errors returned by the next commits, one per commit.
+// An error labelled TransientTransactionError aborts the transaction, UnknownTransactionCommitResult leaves it open
+// so the commit can be retried, any other error aborts it.
+func (s *MemorySession) FailNext(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, errs...)
+}
+
+// Options returns the options of the last transaction started
+func (s *MemorySession) Options() *options.TransactionOptions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.options
+}
+
+// StartTransaction snapshots the stores
+func (s *MemorySession) StartTransaction(opts ...*options.TransactionOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active {
+		return ErrTransactionInProgress
+	}
+	s.snapshots = make([][]bson.D, len(s.stores))
+	for i, store := range s.stores {
+		s.snapshots[i] = store.Snapshot()
+	}
+	s.options = options.MergeTransactionOptions(opts...)
+	s.active = true
+	s.Started++
+
+	return nil
+}
+
+// CommitTransaction keeps the writes, unless a failure is queued
+func (s *MemorySession) CommitTransaction(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return ErrNoTransactionStarted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(s.failures) > 0 {
+		err := s.failures[0]
+		s.failures = s.failures[1:]
+		if !HasErrorLabel(err, LabelUnknownTransactionCommit) {
+			s.rollback()
+		}
+		return err
+	}
+	s.active = false
+	s.snapshots = nil
+	s.Committed++
+
+	return nil
+}
+
+// AbortTransaction restores the snapshot
+func (s *MemorySession) AbortTransaction(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active {
+		return ErrNoTransactionStarted
+	}
+	s.rollback()
+
+	return nil
+}
+
+// EndSession aborts the transaction in progress
+func (s *MemorySession) EndSession(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active {
+		s.rollback()
+	}
+}
+
+// rollback restores the snapshot and ends the transaction. Callers must hold s.mu.
+func (s *MemorySession) rollback() {
+	for i, store := range s.stores {
+		store.Restore(s.snapshots[i])
+	}
+	s.active = false
+	s.snapshots = nil
+	s.Aborted++
+}
+
+// TransientError returns the error of a transaction aborted by a write conflict, which can be run again
+func TransientError(message string) error {
+	return mongo.CommandError{Code: 112, Name: "WriteConflict", Message: message, Labels: []string{LabelTransientTransaction}}
+}
+
+// UnknownCommitResultError returns the error of a commit whose reply was lost
+func UnknownCommitResultError(message string) error {
+	return mongo.CommandError{Message: message, Labels: []string{LabelUnknownTransactionCommit, "NetworkError"}}
+}
+
+var _ Session = (*MemorySession)(nil)
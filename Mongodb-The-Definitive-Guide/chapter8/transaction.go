@@ -0,0 +1,146 @@
+package chapter8
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+The callback API runs a function inside a transaction and takes care of the errors a transaction is expected to hit:
+
+  - TransientTransactionError: the whole transaction failed but may succeed when run again, after a write conflict, a
+    primary step down or a network error. Everything is retried, the function included, so it must not have side
+    effects outside the database.
+  - UnknownTransactionCommitResult: the commit may or may not have been applied, for example when the connection
+    dropped before the reply. Committing again is safe, the server answers with the outcome of the first commit.
+
+WithTransaction retries both until Timeout has passed since the first attempt, 120 seconds like the driver.
+MaxCommitTime bounds a single commit on the server, so a commit waiting for a slow majority gives up instead of
+holding the locks of the transaction.
+
+The session travels in the context passed to fn: collections and repositories called with that context run their
+operations inside the transaction, the driver picks the session up from the context.
+*/
+
+// Error labels the server attaches to transaction errors
+const (
+	LabelTransientTransaction     = "TransientTransactionError"
+	LabelUnknownTransactionCommit = "UnknownTransactionCommitResult"
+)
+
+// DefaultTransactionTimeout is how long WithTransaction keeps retrying by default
+const DefaultTransactionTimeout = 120 * time.Second
+
+const maxTimeMSExpiredCode = 50
+
+// Session is the part of mongo.Session used to run transactions, MemorySession fakes it
+type Session interface {
+	StartTransaction(opts ...*options.TransactionOptions) error
+	AbortTransaction(ctx context.Context) error
+	CommitTransaction(ctx context.Context) error
+	EndSession(ctx context.Context)
+}
+
+var _ Session = mongo.Session(nil)
+
+type sessionKey struct{}
+
+// ContextWithSession returns a context carrying sess. A mongo.Session is stored the way the driver looks for it, so
+// operations run with the context use the session.
+func ContextWithSession(ctx context.Context, sess Session) context.Context {
+	if ms, ok := sess.(mongo.Session); ok {
+		return mongo.NewSessionContext(ctx, ms)
+	}
+
+	return context.WithValue(ctx, sessionKey{}, sess)
+}
+
+// SessionFromContext returns the session carried by ctx, nil when there is none
+func SessionFromContext(ctx context.Context) Session {
+	if ms := mongo.SessionFromContext(ctx); ms != nil {
+		return ms
+	}
+	sess, _ := ctx.Value(sessionKey{}).(Session)
+
+	return sess
+}
+
+// TxOptions configures WithTransaction, zero values use the defaults
+type TxOptions struct {
+	// Timeout stops the retries once this long has passed since the first attempt, DefaultTransactionTimeout when <= 0
+	Timeout time.Duration
+	// MaxCommitTime is how long the server may spend on a commit, the server default when <= 0
+	MaxCommitTime time.Duration
+	// Transaction sets the read concern, write concern and read preference of the transaction
+	Transaction *options.TransactionOptions
+}
+
+func (o TxOptions) transactionOptions() *options.TransactionOptions {
+	opts := options.MergeTransactionOptions(o.Transaction)
+	if o.MaxCommitTime > 0 {
+		opts.SetMaxCommitTime(&o.MaxCommitTime)
+	}
+
+	return opts
+}
+
+// HasErrorLabel reports whether err is a server error carrying label
+func HasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
+
+// WithTransaction runs fn in a transaction of sess and commits it. fn receives a context carrying the session.
+// The transaction is aborted when fn fails, and the whole transaction is run again when the error is transient.
+// A commit with an unknown result is retried alone. It returns the error of the last attempt.
+func WithTransaction(ctx context.Context, sess Session, fn func(ctx context.Context) error, opts TxOptions) error {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTransactionTimeout
+	}
+	start := time.Now()
+	canRetry := func() bool {
+		return ctx.Err() == nil && time.Since(start) < timeout
+	}
+	txCtx := ContextWithSession(ctx, sess)
+	txOpts := opts.transactionOptions()
+
+	for {
+		if err := sess.StartTransaction(txOpts); err != nil {
+			return err
+		}
+		if err := fn(txCtx); err != nil {
+			// the server aborts transactions it failed itself, the abort error adds nothing
+			_ = sess.AbortTransaction(ctx)
+			if HasErrorLabel(err, LabelTransientTransaction) && canRetry() {
+				continue
+			}
+			return err
+		}
+
+		err := commit(ctx, sess, canRetry)
+		if err != nil && HasErrorLabel(err, LabelTransientTransaction) && canRetry() {
+			continue
+		}
+		return err
+	}
+}
+
+// commit commits the transaction of sess, again while the result is unknown
+func commit(ctx context.Context, sess Session, canRetry func() bool) error {
+	for {
+		err := sess.CommitTransaction(ctx)
+		if err == nil || !HasErrorLabel(err, LabelUnknownTransactionCommit) || !canRetry() {
+			return err
+		}
+		// the commit itself ran out of MaxCommitTime, another one would too
+		var se mongo.ServerError
+		if errors.As(err, &se) && se.HasErrorCode(maxTimeMSExpiredCode) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package chapter8
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func newCounters(t *testing.T, counts map[string]int64) (*chapter3.MemoryStore, *chapter3.Repository[Counter]) {
+	t.Helper()
+	store := chapter3.NewMemoryStore()
+	counters := chapter3.NewRepository[Counter](store)
+	for id, n := range counts {
+		if _, err := counters.Insert(context.Background(), Counter{ID: id, Count: n}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return store, counters
+}
+
+func counts(t *testing.T, counters *chapter3.Repository[Counter]) map[string]int64 {
+	t.Helper()
+	list, err := counters.List(context.Background(), nil, chapter3.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]int64{}
+	for _, c := range list {
+		m[c.ID] = c.Count
+	}
+
+	return m
+}
+
+func TestMoveCount(t *testing.T) {
+	ctx := context.Background()
+	store, counters := newCounters(t, map[string]int64{"a": 10, "b": 0})
+	sess := NewMemorySession(store)
+
+	if err := MoveCount(ctx, sess, counters, "a", "b", 4, TxOptions{MaxCommitTime: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	if got := counts(t, counters); got["a"] != 6 || got["b"] != 4 {
+		t.Fatalf("counts = %v", got)
+	}
+	if d := sess.Options().MaxCommitTime; d == nil || *d != time.Second {
+		t.Fatalf("max commit time = %v", d)
+	}
+
+	// the source was updated before the destination turned out to be missing, the abort undoes it
+	if err := MoveCount(ctx, sess, counters, "a", "missing", 1, TxOptions{}); !errors.Is(err, chapter3.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := MoveCount(ctx, sess, counters, "a", "b", 7, TxOptions{}); !errors.Is(err, ErrInsufficientCount) {
+		t.Fatalf("expected ErrInsufficientCount, got %v", err)
+	}
+	if got := counts(t, counters); got["a"] != 6 || got["b"] != 4 {
+		t.Fatalf("aborted transactions changed the counts: %v", got)
+	}
+	if sess.Committed != 1 || sess.Aborted != 2 {
+		t.Fatalf("%d committed, %d aborted", sess.Committed, sess.Aborted)
+	}
+
+	// a negative amount would take from the destination without checking it, no transaction is started
+	started := sess.Started
+	for _, amount := range []int64{0, -100} {
+		if err := MoveCount(ctx, sess, counters, "a", "b", amount, TxOptions{}); !errors.Is(err, ErrInvalidAmount) {
+			t.Fatalf("amount %d: expected ErrInvalidAmount, got %v", amount, err)
+		}
+	}
+	if sess.Started != started {
+		t.Fatalf("invalid amounts started %d transactions", sess.Started-started)
+	}
+	if got := counts(t, counters); got["a"] != 6 || got["b"] != 4 {
+		t.Fatalf("invalid amounts changed the counts: %v", got)
+	}
+}
+
+func TestWithTransactionRetries(t *testing.T) {
+	ctx := context.Background()
+	store, counters := newCounters(t, map[string]int64{"a": 10, "b": 0})
+	sess := NewMemorySession(store)
+
+	// write conflicts on commit run the whole transaction again, a lost commit reply only commits again
+	sess.FailNext(TransientError("write conflict"), UnknownCommitResultError("connection reset"), TransientError("write conflict"))
+	if err := MoveCount(ctx, sess, counters, "a", "b", 3, TxOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if sess.Started != 3 || sess.Aborted != 2 || sess.Committed != 1 {
+		t.Fatalf("%d started, %d aborted, %d committed", sess.Started, sess.Aborted, sess.Committed)
+	}
+	if got := counts(t, counters); got["a"] != 7 || got["b"] != 3 {
+		t.Fatalf("the transaction was applied more than once: %v", got)
+	}
+
+	// transient errors of the function are retried as well, other errors are not
+	calls := 0
+	err := WithTransaction(ctx, sess, func(ctx context.Context) error {
+		if SessionFromContext(ctx) != Session(sess) {
+			t.Fatal("the session is not in the context")
+		}
+		calls++
+		if calls < 3 {
+			return TransientError("write conflict")
+		}
+		return nil
+	}, TxOptions{})
+	if err != nil || calls != 3 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+	calls = 0
+	if err := WithTransaction(ctx, sess, func(ctx context.Context) error {
+		calls++
+		return mongo.CommandError{Code: 11000, Message: "duplicate key"}
+	}, TxOptions{}); !mongo.IsDuplicateKeyError(err) || calls != 1 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+}
+
+func TestWithTransactionGivesUp(t *testing.T) {
+	ctx := context.Background()
+	sess := NewMemorySession()
+
+	// past the timeout the last transient error is returned
+	calls := 0
+	err := WithTransaction(ctx, sess, func(ctx context.Context) error {
+		calls++
+		time.Sleep(5 * time.Millisecond)
+		return TransientError("write conflict")
+	}, TxOptions{Timeout: 20 * time.Millisecond})
+	if !HasErrorLabel(err, LabelTransientTransaction) || calls < 2 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+
+	// a commit running out of its max commit time is not retried
+	sess.FailNext(mongo.CommandError{Code: 50, Name: "MaxTimeMSExpired", Labels: []string{LabelUnknownTransactionCommit}})
+	err = WithTransaction(ctx, sess, func(ctx context.Context) error { return nil }, TxOptions{MaxCommitTime: time.Millisecond})
+	if !HasErrorLabel(err, LabelUnknownTransactionCommit) {
+		t.Fatalf("expected the commit error, got %v", err)
+	}
+	sess.AbortTransaction(ctx)
+
+	// a cancelled context stops the retries
+	cctx, cancel := context.WithCancel(ctx)
+	calls = 0
+	err = WithTransaction(cctx, sess, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return TransientError("write conflict")
+	}, TxOptions{})
+	if err == nil || calls != 1 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,227 @@
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Config describes how to reach MongoDB. Zero values keep the driver defaults
+// (or whatever the URI says), so a Config with only URI set behaves like options.Client().ApplyURI.
+type Config struct {
+	URI      string
+	Database string
+	AppName  string
+
+	ConnectTimeout         time.Duration
+	ServerSelectionTimeout time.Duration
+	MaxPoolSize            uint64
+	MinPoolSize            uint64
+
+	TLS         bool
+	TLSCAFile   string
+	TLSInsecure bool
+
+	Username      string
+	Password      string
+	AuthSource    string
+	AuthMechanism string
+
+	// Profile names the consistency profile used by default (see LookupProfile), empty keeps the driver defaults
+	Profile string
+}
+
+// DefaultConfig is the local server and database the book examples use
+func DefaultConfig() Config {
+	return Config{
+		URI:                    "mongodb://localhost:27017",
+		Database:               "learning",
+		ConnectTimeout:         10 * time.Second,
+		ServerSelectionTimeout: 5 * time.Second,
+	}
+}
+
+// Environment variables read by FromEnv
+const (
+	EnvURI                    = "MONGODB_URI"
+	EnvDatabase               = "MONGODB_DATABASE"
+	EnvAppName                = "MONGODB_APP_NAME"
+	EnvConnectTimeout         = "MONGODB_CONNECT_TIMEOUT"
+	EnvServerSelectionTimeout = "MONGODB_SERVER_SELECTION_TIMEOUT"
+	EnvMaxPoolSize            = "MONGODB_MAX_POOL_SIZE"
+	EnvMinPoolSize            = "MONGODB_MIN_POOL_SIZE"
+	EnvTLS                    = "MONGODB_TLS"
+	EnvTLSCAFile              = "MONGODB_TLS_CA_FILE"
+	EnvTLSInsecure            = "MONGODB_TLS_INSECURE"
+	EnvUsername               = "MONGODB_USERNAME"
+	EnvPassword               = "MONGODB_PASSWORD"
+	EnvAuthSource             = "MONGODB_AUTH_SOURCE"
+	EnvAuthMechanism          = "MONGODB_AUTH_MECHANISM"
+	EnvProfile                = "MONGODB_PROFILE"
+)
+
+// FromEnv returns DefaultConfig overridden by the MONGODB_* environment variables that are set.
+// The first malformed variable is reported as an error.
+func FromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	var firstErr error
+	fail := func(key string, err error) {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("connection: invalid %s: %w", key, err)
+		}
+	}
+	str := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	duration := func(key string, dst *time.Duration) {
+		if v, ok := os.LookupEnv(key); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				fail(key, err)
+			}
+			*dst = d
+		}
+	}
+	uint64Var := func(key string, dst *uint64) {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				fail(key, err)
+			}
+			*dst = n
+		}
+	}
+	boolVar := func(key string, dst *bool) {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				fail(key, err)
+			}
+			*dst = b
+		}
+	}
+
+	str(EnvURI, &cfg.URI)
+	str(EnvDatabase, &cfg.Database)
+	str(EnvAppName, &cfg.AppName)
+	duration(EnvConnectTimeout, &cfg.ConnectTimeout)
+	duration(EnvServerSelectionTimeout, &cfg.ServerSelectionTimeout)
+	uint64Var(EnvMaxPoolSize, &cfg.MaxPoolSize)
+	uint64Var(EnvMinPoolSize, &cfg.MinPoolSize)
+	boolVar(EnvTLS, &cfg.TLS)
+	str(EnvTLSCAFile, &cfg.TLSCAFile)
+	boolVar(EnvTLSInsecure, &cfg.TLSInsecure)
+	str(EnvUsername, &cfg.Username)
+	str(EnvPassword, &cfg.Password)
+	str(EnvAuthSource, &cfg.AuthSource)
+	str(EnvAuthMechanism, &cfg.AuthMechanism)
+	str(EnvProfile, &cfg.Profile)
+
+	return cfg, firstErr
+}
+
+// RegisterFlags binds the fields of c to command line flags. The current values of c are the flag defaults,
+// so calling it on the result of FromEnv gives flags > environment > defaults.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.URI, "mongodb-uri", c.URI, "MongoDB connection string")
+	fs.StringVar(&c.Database, "mongodb-database", c.Database, "default database")
+	fs.StringVar(&c.AppName, "mongodb-app-name", c.AppName, "application name reported to the server")
+	fs.DurationVar(&c.ConnectTimeout, "mongodb-connect-timeout", c.ConnectTimeout, "timeout for establishing a connection")
+	fs.DurationVar(&c.ServerSelectionTimeout, "mongodb-server-selection-timeout", c.ServerSelectionTimeout, "timeout for selecting a server")
+	fs.Uint64Var(&c.MaxPoolSize, "mongodb-max-pool-size", c.MaxPoolSize, "maximum number of connections per server, 0 keeps the driver default")
+	fs.Uint64Var(&c.MinPoolSize, "mongodb-min-pool-size", c.MinPoolSize, "minimum number of connections per server")
+	fs.BoolVar(&c.TLS, "mongodb-tls", c.TLS, "connect with TLS")
+	fs.StringVar(&c.TLSCAFile, "mongodb-tls-ca-file", c.TLSCAFile, "PEM file with the certificate authorities to trust")
+	fs.BoolVar(&c.TLSInsecure, "mongodb-tls-insecure", c.TLSInsecure, "skip verification of the server certificate")
+	fs.StringVar(&c.Username, "mongodb-username", c.Username, "user to authenticate as")
+	fs.StringVar(&c.Password, "mongodb-password", c.Password, "password of the user")
+	fs.StringVar(&c.AuthSource, "mongodb-auth-source", c.AuthSource, "database holding the user's credentials")
+	fs.StringVar(&c.AuthMechanism, "mongodb-auth-mechanism", c.AuthMechanism, "authentication mechanism, e.g. SCRAM-SHA-256")
+	fs.StringVar(&c.Profile, "mongodb-profile", c.Profile, "default consistency profile: fast, durable or analytics")
+}
+
+// ClientOptions converts the config into driver options. Explicit fields take precedence over the URI.
+func (c Config) ClientOptions() (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(c.URI)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("connection: invalid uri: %w", err)
+	}
+	if c.AppName != "" {
+		opts.SetAppName(c.AppName)
+	}
+	if c.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(c.ConnectTimeout)
+	}
+	if c.ServerSelectionTimeout > 0 {
+		opts.SetServerSelectionTimeout(c.ServerSelectionTimeout)
+	}
+	if c.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(c.MaxPoolSize)
+	}
+	if c.MinPoolSize > 0 {
+		opts.SetMinPoolSize(c.MinPoolSize)
+	}
+	if c.MaxPoolSize > 0 && c.MinPoolSize > c.MaxPoolSize {
+		return nil, fmt.Errorf("connection: min pool size %d is greater than max pool size %d", c.MinPoolSize, c.MaxPoolSize)
+	}
+
+	if c.TLS || c.TLSCAFile != "" || c.TLSInsecure {
+		tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSInsecure}
+		if c.TLSCAFile != "" {
+			pem, err := os.ReadFile(c.TLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("connection: read tls ca file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("connection: no certificates found in %s", c.TLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if c.Username != "" {
+		opts.SetAuth(options.Credential{
+			Username:      c.Username,
+			Password:      c.Password,
+			PasswordSet:   c.Password != "",
+			AuthSource:    c.AuthSource,
+			AuthMechanism: c.AuthMechanism,
+		})
+	}
+
+	if c.Profile != "" {
+		p, err := LookupProfile(c.Profile)
+		if err != nil {
+			return nil, err
+		}
+		p.apply(opts)
+	}
+
+	return opts, nil
+}
+
+// readPref is the read preference of the profile, the one health checks ping with
+func (c Config) readPref() *readpref.ReadPref {
+	if p, err := LookupProfile(c.Profile); err == nil && p.ReadPreference != nil {
+		return p.ReadPreference
+	}
+
+	return readpref.Primary()
+}
+
+// key identifies the clients a Registry can share, two configs with the same key get the same client
+func (c Config) key() string {
+	c.Database = ""
+	return fmt.Sprintf("%+v", c)
+}
@@ -0,0 +1,98 @@
+package connection
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv(EnvURI, "mongodb://db.internal:27018")
+	t.Setenv(EnvDatabase, "books")
+	t.Setenv(EnvConnectTimeout, "3s")
+	t.Setenv(EnvMaxPoolSize, "20")
+	t.Setenv(EnvTLS, "true")
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.URI != "mongodb://db.internal:27018" || cfg.Database != "books" {
+		t.Errorf("unexpected uri/database: %+v", cfg)
+	}
+	if cfg.ConnectTimeout != 3*time.Second || cfg.MaxPoolSize != 20 || !cfg.TLS {
+		t.Errorf("unexpected options: %+v", cfg)
+	}
+	if cfg.ServerSelectionTimeout != DefaultConfig().ServerSelectionTimeout {
+		t.Errorf("unset variables should keep the defaults: %+v", cfg)
+	}
+
+	t.Setenv(EnvMinPoolSize, "many")
+	if _, err := FromEnv(); err == nil {
+		t.Error("expected an error for a malformed pool size")
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-mongodb-app-name=books", "-mongodb-min-pool-size=2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.AppName != "books" || cfg.MinPoolSize != 2 {
+		t.Errorf("flags were not applied: %+v", cfg)
+	}
+	if cfg.URI != DefaultConfig().URI {
+		t.Errorf("flags that were not passed should keep their value: %+v", cfg)
+	}
+}
+
+func TestClientOptions(t *testing.T) {
+	cfg := Config{
+		URI:         "mongodb://localhost:27017/?appName=fromuri",
+		AppName:     "books",
+		MaxPoolSize: 10,
+		Username:    "reader",
+		Password:    "secret",
+		AuthSource:  "admin",
+		TLS:         true,
+	}
+	opts, err := cfg.ClientOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *opts.AppName != "books" || *opts.MaxPoolSize != 10 {
+		t.Errorf("explicit fields should override the uri: %v %v", *opts.AppName, *opts.MaxPoolSize)
+	}
+	if opts.Auth == nil || opts.Auth.Username != "reader" || opts.Auth.AuthSource != "admin" {
+		t.Errorf("unexpected credential: %+v", opts.Auth)
+	}
+	if opts.TLSConfig == nil {
+		t.Error("tls was not enabled")
+	}
+
+	invalid := []Config{
+		{URI: "localhost:27017"},
+		{URI: "mongodb://localhost", MinPoolSize: 5, MaxPoolSize: 1},
+		{URI: "mongodb://localhost", TLSCAFile: "testdata/missing.pem"},
+	}
+	for _, cfg := range invalid {
+		if _, err := cfg.ClientOptions(); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestConfigKeyIgnoresDatabase(t *testing.T) {
+	a, b := DefaultConfig(), DefaultConfig()
+	b.Database = "other"
+	if a.key() != b.key() {
+		t.Error("configs that only differ by database should share a client")
+	}
+	b.AppName = "other"
+	if a.key() == b.key() {
+		t.Error("configs with different client options should not share a client")
+	}
+}
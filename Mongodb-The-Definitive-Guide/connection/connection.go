@@ -0,0 +1,85 @@
+// Package connection builds and shares the MongoDB clients used by the book chapters.
+//
+// The configuration comes from DefaultConfig, the MONGODB_* environment variables and optionally
+// command line flags (see Config.RegisterFlags). Call Close on shutdown to disconnect every client.
+package connection
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	defaultRegistry = NewRegistry()
+
+	configMu  sync.Mutex
+	configSet bool
+	config    Config
+)
+
+// Configure replaces the configuration used by Client, Database and Collection, typically with the result of flag parsing
+func Configure(cfg Config) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config, configSet = cfg, true
+}
+
+// CurrentConfig returns the configured Config, or FromEnv when Configure was never called
+func CurrentConfig() (Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	if configSet {
+		return config, nil
+	}
+
+	return FromEnv()
+}
+
+// Client returns the process wide client for the current configuration
+func Client(ctx context.Context) (*mongo.Client, error) {
+	cfg, err := CurrentConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return defaultRegistry.Client(ctx, cfg)
+}
+
+// Database returns the configured database, or the named one when name is not empty
+func Database(ctx context.Context, name string) (*mongo.Database, error) {
+	cfg, err := CurrentConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := defaultRegistry.Client(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		name = cfg.Database
+	}
+
+	return client.Database(name), nil
+}
+
+// Collection returns a collection of the configured database
+func Collection(ctx context.Context, name string) (*mongo.Collection, error) {
+	db, err := Database(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return db.Collection(name), nil
+}
+
+// Health pings every client created through this package
+func Health(ctx context.Context) []Status {
+	return defaultRegistry.Health(ctx)
+}
+
+// Close disconnects every client created through this package, later calls to Client reconnect
+func Close(ctx context.Context) error {
+	return defaultRegistry.Close(ctx)
+}
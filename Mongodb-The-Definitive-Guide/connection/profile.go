@@ -0,0 +1,131 @@
+package connection
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Profile names accepted by LookupProfile and Config.Profile
+const (
+	ProfileFast      = "fast"
+	ProfileDurable   = "durable"
+	ProfileAnalytics = "analytics"
+)
+
+// AnalyticsMaxStaleness is how far behind the primary a secondary read by the analytics profile may be,
+// 90 seconds is the smallest value the server accepts
+const AnalyticsMaxStaleness = 90 * time.Second
+
+// Profile bundles the write concern, read concern and read preference of a consistency level.
+// A nil field keeps the setting of the client, database or collection it is applied to.
+type Profile struct {
+	Name           string
+	WriteConcern   *writeconcern.WriteConcern
+	ReadConcern    *readconcern.ReadConcern
+	ReadPreference *readpref.ReadPref
+}
+
+// Fast acknowledges writes once the primary applied them in memory and reads the primary's latest data, which a
+// failover can roll back
+func Fast() Profile {
+	return Profile{
+		Name:           ProfileFast,
+		WriteConcern:   writeconcern.New(writeconcern.W(1), writeconcern.J(false)),
+		ReadConcern:    readconcern.Local(),
+		ReadPreference: readpref.Primary(),
+	}
+}
+
+// Durable acknowledges writes once a majority journaled them, giving up after 5 seconds, and reads only majority
+// committed data: nothing it writes or reads is rolled back by a failover
+func Durable() Profile {
+	return Profile{
+		Name:           ProfileDurable,
+		WriteConcern:   writeconcern.New(writeconcern.WMajority(), writeconcern.J(true), writeconcern.WTimeout(5*time.Second)),
+		ReadConcern:    readconcern.Majority(),
+		ReadPreference: readpref.Primary(),
+	}
+}
+
+// Analytics sends reads to secondaries at most AnalyticsMaxStaleness behind, the primary when none is, so reporting
+// queries don't load the primary. Writes stay majority acknowledged.
+func Analytics() Profile {
+	return Profile{
+		Name:           ProfileAnalytics,
+		WriteConcern:   writeconcern.New(writeconcern.WMajority()),
+		ReadConcern:    readconcern.Local(),
+		ReadPreference: readpref.SecondaryPreferred(readpref.WithMaxStaleness(AnalyticsMaxStaleness)),
+	}
+}
+
+var profiles = map[string]func() Profile{
+	ProfileFast:      Fast,
+	ProfileDurable:   Durable,
+	ProfileAnalytics: Analytics,
+}
+
+// LookupProfile returns the profile called name
+func LookupProfile(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("connection: unknown profile %q, want one of %v", name, names)
+	}
+
+	return p(), nil
+}
+
+// CollectionOptions returns the options giving a collection the settings of p, see (*mongo.Collection).Clone
+func (p Profile) CollectionOptions() *options.CollectionOptions {
+	opts := options.Collection()
+	if p.WriteConcern != nil {
+		opts.SetWriteConcern(p.WriteConcern)
+	}
+	if p.ReadConcern != nil {
+		opts.SetReadConcern(p.ReadConcern)
+	}
+	if p.ReadPreference != nil {
+		opts.SetReadPreference(p.ReadPreference)
+	}
+
+	return opts
+}
+
+// DatabaseOptions returns the options giving a database the settings of p, see (*mongo.Client).Database
+func (p Profile) DatabaseOptions() *options.DatabaseOptions {
+	opts := options.Database()
+	if p.WriteConcern != nil {
+		opts.SetWriteConcern(p.WriteConcern)
+	}
+	if p.ReadConcern != nil {
+		opts.SetReadConcern(p.ReadConcern)
+	}
+	if p.ReadPreference != nil {
+		opts.SetReadPreference(p.ReadPreference)
+	}
+
+	return opts
+}
+
+// apply makes p the default of every operation of the client
+func (p Profile) apply(opts *options.ClientOptions) {
+	if p.WriteConcern != nil {
+		opts.SetWriteConcern(p.WriteConcern)
+	}
+	if p.ReadConcern != nil {
+		opts.SetReadConcern(p.ReadConcern)
+	}
+	if p.ReadPreference != nil {
+		opts.SetReadPreference(p.ReadPreference)
+	}
+}
@@ -0,0 +1,73 @@
+package connection
+
+import (
+	"flag"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+func TestLookupProfile(t *testing.T) {
+	for _, name := range []string{ProfileFast, ProfileDurable, ProfileAnalytics} {
+		p, err := LookupProfile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Name != name || p.WriteConcern == nil || p.ReadConcern == nil || p.ReadPreference == nil {
+			t.Errorf("incomplete profile %+v", p)
+		}
+	}
+	if _, err := LookupProfile("eventual"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+
+	durable := Durable()
+	if !durable.WriteConcern.GetJ() || durable.WriteConcern.GetW() != "majority" || durable.ReadConcern.GetLevel() != "majority" {
+		t.Errorf("durable should be majority and journaled: %+v", durable)
+	}
+	analytics := Analytics()
+	if analytics.ReadPreference.Mode() != readpref.SecondaryPreferredMode {
+		t.Errorf("analytics should read from secondaries, got %v", analytics.ReadPreference.Mode())
+	}
+	if staleness, ok := analytics.ReadPreference.MaxStaleness(); !ok || staleness != AnalyticsMaxStaleness {
+		t.Errorf("analytics max staleness = %v", staleness)
+	}
+	if analytics.WriteConcern.GetW() != "majority" {
+		t.Errorf("analytics writes should stay majority acknowledged, got %v", analytics.WriteConcern.GetW())
+	}
+}
+
+func TestConfigProfile(t *testing.T) {
+	t.Setenv(EnvProfile, ProfileAnalytics)
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Profile != ProfileAnalytics {
+		t.Fatalf("profile = %q", cfg.Profile)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-mongodb-profile=durable"}); err != nil {
+		t.Fatal(err)
+	}
+	opts, err := cfg.ClientOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.WriteConcern == nil || !opts.WriteConcern.GetJ() || opts.ReadPreference.Mode() != readpref.PrimaryMode {
+		t.Errorf("the durable profile was not applied: %+v %v", opts.WriteConcern, opts.ReadPreference)
+	}
+	if cfg.readPref().Mode() != readpref.PrimaryMode || (Config{}).readPref().Mode() != readpref.PrimaryMode {
+		t.Error("durable and unset profiles should ping the primary")
+	}
+	if (Config{Profile: ProfileAnalytics}).readPref().Mode() != readpref.SecondaryPreferredMode {
+		t.Error("the analytics profile should ping with its read preference")
+	}
+
+	cfg.Profile = "eventual"
+	if _, err := cfg.ClientOptions(); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
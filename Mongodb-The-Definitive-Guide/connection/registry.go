@@ -0,0 +1,185 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrClosed is returned by Registry.Client when the registry is closed while the client connects
+var ErrClosed = errors.New("connection: registry closed while connecting")
+
+// Registry caches one *mongo.Client per distinct Config, so every caller in the process shares
+// the same connection pool instead of dialing a new client per operation.
+type Registry struct {
+	mu      sync.Mutex
+	clients map[string]*entry
+	// connecting holds the connects in progress, so concurrent callers with the same Config wait for one connect
+	connecting map[string]*connectCall
+	// ctx bounds the connects in progress, no caller owns it: Close cancels it and replaces it
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+type entry struct {
+	cfg    Config
+	client *mongo.Client
+}
+
+// connectCall is a connect in progress, client and err are set before done is closed
+type connectCall struct {
+	done   chan struct{}
+	client *mongo.Client
+	err    error
+}
+
+// NewRegistry returns an empty Registry
+func NewRegistry() *Registry {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Registry{clients: map[string]*entry{}, connecting: map[string]*connectCall{}, ctx: ctx, cancel: cancel}
+}
+
+// Client returns the cached client for cfg, connecting and pinging on first use. The ping goes to the primary, or to
+// the servers the read preference of the configured profile selects.
+// A client that fails the ping is disconnected and not cached.
+// The connect runs in the background under a context of the registry, bounded by the server selection timeout of
+// cfg: concurrent callers with the same Config share it, each waiting until it ends or its own ctx is done, and the
+// registry is not locked meanwhile, so a slow or unreachable cluster only holds back the callers of its Config.
+func (r *Registry) Client(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	key := cfg.key()
+	r.mu.Lock()
+	if e, ok := r.clients[key]; ok {
+		r.mu.Unlock()
+		return e.client, nil
+	}
+	c, ok := r.connecting[key]
+	if !ok {
+		c = &connectCall{done: make(chan struct{})}
+		r.connecting[key] = c
+		go r.connect(r.ctx, key, cfg, c)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.client, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// connect runs c under ctx and caches its client, unless Close cancelled ctx meanwhile: the client is disconnected then
+func (r *Registry) connect(ctx context.Context, key string, cfg Config, c *connectCall) {
+	client, err := dial(ctx, cfg)
+
+	r.mu.Lock()
+	if r.connecting[key] == c {
+		delete(r.connecting, key)
+	}
+	closed := ctx.Err() != nil
+	if err == nil && !closed {
+		r.clients[key] = &entry{cfg: cfg, client: client}
+	}
+	r.mu.Unlock()
+
+	if closed {
+		if err == nil {
+			_ = client.Disconnect(context.Background())
+		}
+		client, err = nil, ErrClosed
+	}
+	c.client, c.err = client, err
+	close(c.done)
+}
+
+// dial returns a new client for cfg that answered a ping
+func dial(ctx context.Context, cfg Config) (*mongo.Client, error) {
+	opts, err := cfg.ClientOptions()
+	if err != nil {
+		return nil, err
+	}
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, fmt.Errorf("connect mongodb error: %w", err)
+	}
+	if err := client.Ping(ctx, cfg.readPref()); err != nil {
+		_ = client.Disconnect(context.Background())
+		return nil, fmt.Errorf("ping mongodb error: %w", err)
+	}
+
+	return client, nil
+}
+
+// Status is the result of pinging one cached client
+type Status struct {
+	Hosts   []string
+	AppName string
+	Latency time.Duration
+	Err     error
+}
+
+// Healthy reports whether every client answered the ping
+func Healthy(statuses []Status) bool {
+	for _, s := range statuses {
+		if s.Err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Health pings every cached client with the read preference of its profile, the primary by default
+func (r *Registry) Health(ctx context.Context) []Status {
+	r.mu.Lock()
+	entries := make([]*entry, 0, len(r.clients))
+	for _, e := range r.clients {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+
+	statuses := make([]Status, 0, len(entries))
+	for _, e := range entries {
+		s := Status{AppName: e.cfg.AppName}
+		if opts, err := e.cfg.ClientOptions(); err == nil {
+			s.Hosts = opts.Hosts
+		}
+		start := time.Now()
+		s.Err = e.client.Ping(ctx, e.cfg.readPref())
+		s.Latency = time.Since(start)
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return fmt.Sprint(statuses[i].Hosts) < fmt.Sprint(statuses[j].Hosts)
+	})
+
+	return statuses
+}
+
+// Close disconnects every cached client and empties the registry. The first disconnect error is returned.
+// Connects in progress are cancelled, their callers get ErrClosed and a client connecting anyway is disconnected instead
+// of cached. Later calls to Client connect again.
+func (r *Registry) Close(ctx context.Context) error {
+	r.mu.Lock()
+	clients := r.clients
+	r.clients = map[string]*entry{}
+	r.connecting = map[string]*connectCall{}
+	r.cancel()
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.mu.Unlock()
+
+	var firstErr error
+	for _, e := range clients {
+		if err := e.client.Disconnect(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -0,0 +1,108 @@
+package connection
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// unreachable is a Config whose connects fail after its server selection timeout
+func unreachable(timeout time.Duration) Config {
+	return Config{URI: "mongodb://127.0.0.1:1/?connect=direct", ServerSelectionTimeout: timeout}
+}
+
+// waitConnecting waits until the registry has n connects in progress
+func waitConnecting(t *testing.T, r *Registry, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		got := len(r.connecting)
+		r.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connects in progress, want %d", got, n)
+		}
+	}
+}
+
+// A connect to an unreachable cluster must not hold back the rest of the registry, nor fail the callers sharing it
+// when the first one gives up
+func TestRegistrySlowConnect(t *testing.T) {
+	cfg := unreachable(500 * time.Millisecond)
+	r := NewRegistry()
+	defer r.Close(context.Background())
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := r.Client(first, cfg)
+		firstErr <- err
+	}()
+	waitConnecting(t, r, 1)
+
+	start := time.Now()
+	if statuses := r.Health(context.Background()); len(statuses) != 0 {
+		t.Errorf("unexpected health: %+v", statuses)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Health blocked %v behind the connect", elapsed)
+	}
+
+	cancelFirst()
+	if err := <-firstErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("first caller: err = %v, want context.Canceled", err)
+	}
+	// the connect goes on for the other callers, which get its own result
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := r.Client(ctx, cfg)
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrClosed) {
+		t.Errorf("waiting caller: err = %v, want the ping error", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.clients) != 0 || len(r.connecting) != 0 {
+		t.Errorf("failed connect left %d clients, %d connects", len(r.clients), len(r.connecting))
+	}
+}
+
+// Close cancels the connects in progress, the registry connects again afterwards
+func TestRegistryCloseWhileConnecting(t *testing.T) {
+	cfg := unreachable(5 * time.Second)
+	r := NewRegistry()
+	defer r.Close(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Client(context.Background(), cfg)
+		done <- err
+	}()
+	waitConnecting(t, r, 1)
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("err = %v, want ErrClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not cancel the connect")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Client(ctx, cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("after Close: err = %v, want a new connect", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.clients) != 0 || len(r.connecting) != 1 {
+		t.Errorf("after Close: %d clients, %d connects, want 0 and 1", len(r.clients), len(r.connecting))
+	}
+}
@@ -0,0 +1,43 @@
+//go:build integration
+
+package connection
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Run with a local server: go test -tags integration ./...
+func TestRegistry(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRegistry()
+	first, err := r.Client(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Database = "other"
+	second, err := r.Client(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("expected the cached client")
+	}
+
+	if statuses := r.Health(ctx); len(statuses) != 1 || !Healthy(statuses) {
+		t.Errorf("unexpected health: %+v", statuses)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if statuses := r.Health(ctx); len(statuses) != 0 {
+		t.Errorf("expected no clients after Close: %+v", statuses)
+	}
+}
@@ -0,0 +1,171 @@
+// Package iterator streams query results decoded into typed values.
+//
+// An Iterator wraps a cursor: Next advances and decodes, Value returns the current value, Err reports why the iteration
+// stopped and Close releases the cursor. The cursor is closed as soon as the results are exhausted, decoding fails or
+// the context is cancelled, so forgetting Close after a full iteration does not leak a server cursor. Channel feeds the
+// values into a bounded channel instead: the cursor is only advanced when the consumer keeps up.
+package iterator
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// closeTimeout bounds the killCursors sent by Close, which can't use an already cancelled context
+const closeTimeout = 5 * time.Second
+
+// Cursor is the part of *mongo.Cursor an Iterator uses
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(v any) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// Finder is implemented by *mongo.Collection and the chapter stores
+type Finder interface {
+	Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error)
+}
+
+// Iterator decodes the documents of a cursor into T, one at a time
+type Iterator[T any] struct {
+	ctx    context.Context
+	cur    Cursor
+	value  T
+	err    error
+	closed bool
+}
+
+// New returns an iterator over cur, ctx bounds the whole iteration
+func New[T any](ctx context.Context, cur Cursor) *Iterator[T] {
+	return &Iterator[T]{ctx: ctx, cur: cur}
+}
+
+// Find runs a query on finder and returns an iterator over its results
+func Find[T any](ctx context.Context, finder Finder, filter any, opts ...*options.FindOptions) (*Iterator[T], error) {
+	cur, err := finder.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return New[T](ctx, cur), nil
+}
+
+// Next decodes the next document, it returns false once the results are exhausted or the iteration failed.
+// The cursor is closed when Next returns false.
+func (it *Iterator[T]) Next() bool {
+	if it.closed {
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.stop(err)
+		return false
+	}
+	if !it.cur.Next(it.ctx) {
+		err := it.cur.Err()
+		if err == nil {
+			// the driver reports a cancellation during getMore as the end of the results
+			err = it.ctx.Err()
+		}
+		it.stop(err)
+		return false
+	}
+	var v T
+	if err := it.cur.Decode(&v); err != nil {
+		it.stop(err)
+		return false
+	}
+	it.value = v
+
+	return true
+}
+
+// Value returns the value decoded by the last call to Next
+func (it *Iterator[T]) Value() T {
+	return it.value
+}
+
+// Err returns the error that stopped the iteration, nil when the results were exhausted or Close was called
+func (it *Iterator[T]) Err() error {
+	return it.err
+}
+
+// Close releases the cursor, it can be called any number of times
+func (it *Iterator[T]) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	var zero T
+	it.value = zero
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	return it.cur.Close(ctx)
+}
+
+func (it *Iterator[T]) stop(err error) {
+	if cerr := it.Close(); err == nil {
+		err = cerr
+	}
+	it.err = err
+}
+
+// All collects the remaining values and closes the iterator
+func (it *Iterator[T]) All() ([]T, error) {
+	defer it.Close()
+
+	var out []T
+	for it.Next() {
+		out = append(out, it.Value())
+	}
+
+	return out, it.Err()
+}
+
+// ForEach calls fn with every remaining value until fn returns an error, the iterator is closed on return
+func (it *Iterator[T]) ForEach(fn func(T) error) error {
+	defer it.Close()
+
+	for it.Next() {
+		if err := fn(it.Value()); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+// Channel sends the remaining values on a channel buffering at most size values, the cursor only advances when there
+// is room so a slow consumer holds back the producer. The channel is closed when the iteration ends, then the
+// returned function reports the error that stopped it. A consumer giving up early must cancel the context of the
+// iterator, the producer then stops and closes the cursor.
+func (it *Iterator[T]) Channel(size int) (<-chan T, func() error) {
+	ch := make(chan T, size)
+	done := make(chan struct{})
+	var err error
+	go func() {
+		defer close(done)
+		defer close(ch)
+		defer it.Close()
+
+		for it.Next() {
+			select {
+			case ch <- it.Value():
+			case <-it.ctx.Done():
+				err = it.ctx.Err()
+				return
+			}
+		}
+		err = it.Err()
+	}()
+
+	return ch, func() error {
+		<-done
+		return err
+	}
+}
@@ -0,0 +1,151 @@
+package iterator
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type item struct {
+	N int `bson:"n"`
+}
+
+// countingCursor wraps a cursor and counts the documents fetched and the calls to Close
+type countingCursor struct {
+	*mongo.Cursor
+	fetched int32
+	closed  int32
+}
+
+func (c *countingCursor) Next(ctx context.Context) bool {
+	if !c.Cursor.Next(ctx) {
+		return false
+	}
+	atomic.AddInt32(&c.fetched, 1)
+	return true
+}
+
+func (c *countingCursor) Close(ctx context.Context) error {
+	atomic.AddInt32(&c.closed, 1)
+	return c.Cursor.Close(ctx)
+}
+
+func newCursor(t *testing.T, n int) *countingCursor {
+	docs := make([]any, n)
+	for i := range docs {
+		docs[i] = bson.D{{Key: "n", Value: i}}
+	}
+	cur, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &countingCursor{Cursor: cur}
+}
+
+func TestIterator(t *testing.T) {
+	cur := newCursor(t, 3)
+	it := New[item](context.Background(), cur)
+	var got []int
+	for it.Next() {
+		got = append(got, it.Value().N)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0] != 0 || got[2] != 2 {
+		t.Fatalf("got %v", got)
+	}
+	if atomic.LoadInt32(&cur.closed) != 1 {
+		t.Fatal("the cursor must be closed once the results are exhausted")
+	}
+	if it.Next() || it.Close() != nil || atomic.LoadInt32(&cur.closed) != 1 {
+		t.Fatal("a finished iterator must stay closed")
+	}
+}
+
+func TestIteratorCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cur := newCursor(t, 10)
+	it := New[item](ctx, cur)
+	for it.Next() {
+		if it.Value().N == 2 {
+			cancel()
+		}
+	}
+	if !errors.Is(it.Err(), context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", it.Err())
+	}
+	if atomic.LoadInt32(&cur.fetched) != 3 || atomic.LoadInt32(&cur.closed) != 1 {
+		t.Fatalf("fetched %d, closed %d times", atomic.LoadInt32(&cur.fetched), atomic.LoadInt32(&cur.closed))
+	}
+}
+
+func TestIteratorDecodeError(t *testing.T) {
+	cur, err := mongo.NewCursorFromDocuments([]any{bson.D{{Key: "n", Value: "one"}}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := New[item](context.Background(), cur).All()
+	if err == nil || len(values) != 0 {
+		t.Fatalf("values = %v, err = %v", values, err)
+	}
+}
+
+func TestIteratorForEach(t *testing.T) {
+	cur := newCursor(t, 5)
+	errStop := errors.New("stop")
+	sum := 0
+	err := New[item](context.Background(), cur).ForEach(func(v item) error {
+		if v.N == 3 {
+			return errStop
+		}
+		sum += v.N
+		return nil
+	})
+	if !errors.Is(err, errStop) || sum != 3 || atomic.LoadInt32(&cur.closed) != 1 {
+		t.Fatalf("sum = %d, err = %v, closed %d times", sum, err, atomic.LoadInt32(&cur.closed))
+	}
+}
+
+func TestIteratorChannel(t *testing.T) {
+	cur := newCursor(t, 100)
+	values, wait := New[item](context.Background(), cur).Channel(2)
+
+	// without a consumer the producer stops once the buffer is full, plus the value it is trying to send
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&cur.fetched); n != 3 {
+		t.Fatalf("fetched %d documents ahead of the consumer, want 3", n)
+	}
+
+	want := 0
+	for v := range values {
+		if v.N != want {
+			t.Fatalf("got %d, want %d", v.N, want)
+		}
+		want++
+	}
+	if err := wait(); err != nil || want != 100 || atomic.LoadInt32(&cur.closed) != 1 {
+		t.Fatalf("received %d, err = %v, closed %d times", want, err, atomic.LoadInt32(&cur.closed))
+	}
+}
+
+func TestIteratorChannelCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cur := newCursor(t, 100)
+	values, wait := New[item](ctx, cur).Channel(0)
+	<-values
+	cancel()
+	if err := wait(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if atomic.LoadInt32(&cur.closed) != 1 || atomic.LoadInt32(&cur.fetched) > 3 {
+		t.Fatalf("fetched %d, closed %d times", atomic.LoadInt32(&cur.fetched), atomic.LoadInt32(&cur.closed))
+	}
+}
@@ -2,12 +2,16 @@ package modeling
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"time"
 
+	"books-note/Mongodb-The-Definitive-Guide/chapter3"
+	"books-note/Mongodb-The-Definitive-Guide/connection"
+
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 /*
@@ -17,53 +21,82 @@ we made use of  bson.A, bson.D and bson.M which represents arrays, documents and
 // Podcast ...
 type Podcast struct {
 	ID     primitive.ObjectID `bson:"_id,omitempty"`
-	Title  string             `bson:"title,omitempty"`
-	Author string             `bson:"author,omitempty"`
-	Tags   []string           `bson:"tags:omitempty"`
+	Title  string             `bson:"title,omitempty" schema:"required,minLength=1"`
+	Author string             `bson:"author,omitempty" schema:"required"`
+	Tags   []string           `bson:"tags,omitempty"`
 }
 
 // Episode ...
 type Episode struct {
 	ID          primitive.ObjectID `bson:"_id,omitempty"`
-	Poscast     primitive.ObjectID `bson:"podcast,omitempty"`
-	Title       string             `bson:"title,omitempty"`
-	Description string             `bson:"title,omitempty"`
-	Duration    int32              `bson:"duration,omitempty"`
+	Poscast     primitive.ObjectID `bson:"podcast,omitempty" schema:"required"`
+	Title       string             `bson:"title,omitempty" schema:"required,minLength=1"`
+	Description string             `bson:"description,omitempty"`
+	Duration    int32              `bson:"duration,omitempty" schema:"minimum=1"`
 }
 
 // Fn ...
 func Fn() {
-	ctx, _ := context.WithTimeout(context.Background(), time.Second*10)
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	database, err := connection.Database(ctx, "quickstart")
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Disconnect(ctx)
-
-	database := client.Database("quickstart")
-	postcastCollection := database.Collection("podcasts")
-	episodesCollection := database.Collection("episodes")
-	episodesCollection.Drop(ctx)
-	postcastCollection.Drop(ctx)
+	defer connection.Close(ctx)
 
-	// var episodes []Episode
-	// cur, err := episodesCollection.Find(ctx, bson.M{"duration": bson.D{{Key: "$gt", Value: 25}}})
-	// if err != nil {
-	// 	panic(err)
-	// }
-	// if err = cur.All(ctx, &episodes); err != nil {
-	// 	panic(err)
-	// }
-	// log.Println(episodes)
+	podcasts, err := validatedRepository[Podcast](ctx, database, "podcasts")
+	if err != nil {
+		log.Fatal(err)
+	}
+	episodes, err := validatedRepository[Episode](ctx, database, "episodes")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	podcast := Podcast{
 		Title:  "The Polyglot Developer",
 		Author: "Nic Raboy",
 		Tags:   []string{"development", "programming", "coding"},
 	}
-	insertResult, err := postcastCollection.InsertOne(ctx, podcast)
+	podcastID, err := podcasts.Insert(ctx, podcast)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println(podcastID)
+
+	for i, duration := range []int32{25, 32} {
+		episode := Episode{
+			Poscast:     podcastID.(primitive.ObjectID),
+			Title:       fmt.Sprintf("Episode #%d", i+1),
+			Description: "This is an episode of " + podcast.Title,
+			Duration:    duration,
+		}
+		if _, err := episodes.Insert(ctx, episode); err != nil {
+			log.Fatal(err)
+		}
+	}
+	long, err := episodes.List(ctx, bson.M{"duration": bson.D{{Key: "$gt", Value: 25}}}, chapter3.ListOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println(insertResult.InsertedID)
+	log.Println(long)
+}
+
+// validatedRepository recreates collection with the schema of T as its validator, the documents are also checked before
+// being sent and transient errors are retried
+func validatedRepository[T any](ctx context.Context, database *mongo.Database, collection string) (*chapter3.Repository[T], error) {
+	schema, err := chapter3.SchemaOf[T]()
+	if err != nil {
+		return nil, err
+	}
+	store := chapter3.MongoStore{Collection: database.Collection(collection)}
+	store.Drop(ctx)
+	if err := chapter3.ApplySchema(ctx, database, collection, schema, chapter3.ValidationOptions{Level: chapter3.LevelStrict, Action: chapter3.ActionError}); err != nil {
+		return nil, err
+	}
+
+	retrying := chapter3.RetryStore{DocumentStore: store}
+
+	return chapter3.NewRepository[T](chapter3.SchemaStore{DocumentStore: retrying, Schema: schema}), nil
 }